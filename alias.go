@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// writeAliases copies the archive rebuilt at path to every alias key, so
+// the cache can be restored under each of them. Aliases are refused like
+// path when under a protected path, before any of them is written.
+func (p *Plugin) writeAliases(path string) error {
+	var dsts []string
+
+	for _, alias := range p.AliasKeys {
+		dst := strings.TrimSuffix(alias, "/") + "/" + p.Filename
+
+		if dst == path {
+			continue
+		}
+
+		if err := p.checkProtected(dst); err != nil {
+			return err
+		}
+
+		dsts = append(dsts, dst)
+	}
+
+	for _, dst := range dsts {
+		log.Infof("Writing alias of %s at %s", path, dst)
+
+		if err := copyObject(p.Storage, path, dst); err != nil {
+			return fmt.Errorf("Failed to write alias %s %s", dst, err)
+		}
+	}
+
+	return nil
+}
+
+// copyObject copies src to dst on the server when the storage supports it,
+// or downloads src while uploading it to dst otherwise.
+func copyObject(s storage.Storage, src, dst string) error {
+	if cs, ok := s.(copyingStorage); ok {
+		if err := cs.Copy(src, dst); err != errNoCopy {
+			return err
+		}
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(s.Get(src, pw))
+	}()
+
+	err := s.Put(dst, pr)
+	pr.CloseWithError(err)
+
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWriteAliases(t *testing.T) {
+	s := newMemoryStorage()
+	s.objects["/bucket/repo/sum/archive.tar"] = []byte("archive")
+
+	// Storage which cannot copy on the server falls back to a transfer
+	p := &Plugin{
+		Storage:   &stampedStorage{metadataStorage: s},
+		Filename:  "archive.tar",
+		AliasKeys: []string{"/bucket/repo/latest/", "/bucket/repo/sum"},
+	}
+
+	if err := p.writeAliases("/bucket/repo/sum/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := s.objects["/bucket/repo/latest/archive.tar"]; string(b) != "archive" {
+		t.Errorf("Expected the alias to hold the archive, got %q", b)
+	}
+
+	if len(s.objects) != 2 {
+		t.Errorf("Expected only the alias written, got %d objects", len(s.objects))
+	}
+
+	p.AliasKeys = []string{"/bucket/repo/missing/"}
+
+	if err := p.writeAliases("/bucket/repo/gone/archive.tar"); err == nil {
+		t.Error("Expected an alias of a missing archive to fail")
+	}
+}
+
+func TestWriteAliasesProtected(t *testing.T) {
+	s := newMemoryStorage()
+	s.objects["/bucket/repo/feature/archive.tar"] = []byte("archive")
+
+	p := &Plugin{
+		Storage:           &stampedStorage{metadataStorage: s},
+		Filename:          "archive.tar",
+		AliasKeys:         []string{"/bucket/repo/latest/", "/bucket/repo/master/"},
+		ProtectedPaths:    []string{"/bucket/repo/master/"},
+		ProtectedBranches: []string{"master"},
+		Event:             "pull_request",
+		Branch:            "feature",
+	}
+
+	if err := p.writeAliases("/bucket/repo/feature/archive.tar"); err == nil {
+		t.Error("Expected an alias under a protected path to be refused")
+	}
+
+	if len(s.objects) != 1 {
+		t.Errorf("Expected no alias written, got %d objects", len(s.objects))
+	}
+
+	p.Event = "push"
+	p.Branch = "master"
+
+	if err := p.writeAliases("/bucket/repo/feature/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := s.objects["/bucket/repo/master/archive.tar"]; string(b) != "archive" {
+		t.Errorf("Expected pushes to master to write the protected alias, got %q", b)
+	}
+}
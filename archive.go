@@ -0,0 +1,568 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	cachearchive "github.com/drone-plugins/drone-s3-cache/pkg/archive"
+	"github.com/drone/drone-cache-lib/archive"
+)
+
+// tarArchive is an Archive using the .tar file format. Unlike the tar
+// archive in drone-cache-lib it unpacks over existing files, which allows
+// several archives to be layered on top of each other.
+type tarArchive struct {
+	// packSmallFiles packs small files into blocks with an index.
+	packSmallFiles bool
+
+	// onUnpack is called with the name of every file unpacked, or spooled
+	// to be unpacked later.
+	onUnpack func(name string)
+
+	// fileMask and dirMask clear mode bits of the files and directories
+	// unpacked, like a umask applied regardless of the process umask.
+	fileMask os.FileMode
+	dirMask  os.FileMode
+
+	// exactMtimes archives modification times with sub-second precision,
+	// where tar otherwise rounds them to seconds.
+	exactMtimes bool
+
+	// specialBits archives and restores the setuid, setgid and sticky bits
+	// and file capabilities, which are stripped otherwise.
+	specialBits bool
+
+	// external paths outside the workspace are archived under
+	// externalPrefix and restored at their absolute path.
+	external []string
+
+	// phases records the time spent packing and unpacking.
+	phases *phaseTracker
+
+	// files logs a sample of the files packed or unpacked.
+	files *fileLog
+
+	// priority paths are unpacked immediately while the other entries are
+	// deferred to a spool.
+	priority []string
+	deferred *spool
+
+	// workers write the files unpacked concurrently, while directories
+	// are created in archive order as they are read. Files up to
+	// bufferSize, or extractBufferSize when unset, are handed to them.
+	workers    int
+	bufferSize int64
+}
+
+// entryPacker is implemented by archives which can pack an explicit list of
+// paths rather than walking directories.
+type entryPacker interface {
+	archive.Archive
+
+	PackEntries(paths []string, w io.Writer) error
+}
+
+// tgzArchive is an Archive using the .tar.gz file format.
+type tgzArchive struct {
+	tar tarArchive
+
+	// level of the compression, or 0 for the default.
+	level int
+}
+
+// compressor configures the level and number of threads archives are
+// compressed with. Zero values use the defaults of the format.
+type compressor struct {
+	level   int
+	threads int
+}
+
+// zstd returns the command compressing with zstd, on every core unless
+// threads is set.
+func (c compressor) zstd() string {
+	cmd := fmt.Sprintf("zstd -q -T%d -c", c.threads)
+
+	if c.level > 0 {
+		cmd += fmt.Sprintf(" -%d", c.level)
+	}
+
+	return cmd
+}
+
+// lz4 returns the command compressing with lz4, which is single threaded.
+func (c compressor) lz4() string {
+	cmd := "lz4 -q -c"
+
+	if c.level > 0 {
+		cmd += fmt.Sprintf(" -%d", c.level)
+	}
+
+	return cmd
+}
+
+// archiveFromFilename determines the archive format to use based on the
+// name, with t configuring the underlying tar archive.
+func archiveFromFilename(name string, t tarArchive, c compressor) (archive.Archive, error) {
+	f, err := cachearchive.FromFilename(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return archiveFromFormat(f, t, c), nil
+}
+
+// archiveFromCompression returns the archive compressing with compression,
+// with t configuring the underlying tar archive.
+func archiveFromCompression(compression string, t tarArchive, c compressor) (archive.Archive, error) {
+	f, err := cachearchive.FromCompression(compression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return archiveFromFormat(f, t, c), nil
+}
+
+func archiveFromFormat(f cachearchive.Format, t tarArchive, c compressor) archive.Archive {
+	switch f {
+	case cachearchive.Gzip:
+		return &tgzArchive{tar: t, level: c.level}
+	case cachearchive.Zstd:
+		return &pipedArchive{tar: t, compress: c.zstd()}
+	case cachearchive.LZ4:
+		return &pipedArchive{tar: t, compress: c.lz4()}
+	}
+
+	return &t
+}
+
+func (a *tarArchive) Pack(srcs []string, w io.Writer) error {
+	return a.pack(srcs, w, cachearchive.Tar, 0)
+}
+
+// pack writes the archive of srcs to w compressed in format f at level.
+func (a *tarArchive) pack(srcs []string, w io.Writer, f cachearchive.Format, level int) error {
+	defer a.phases.begin("archive")()
+
+	tw, err := a.newWriter(w, f, level)
+
+	if err != nil {
+		return err
+	}
+
+	for _, s := range srcs {
+		// ensure the src actually exists before trying to tar it
+		if _, err := os.Stat(s); err != nil {
+			return err
+		}
+
+		err := filepath.Walk(s, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			return tw.add(path, fi)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// PackEntries writes an archive containing exactly the paths given, without
+// walking into directories.
+func (a *tarArchive) PackEntries(paths []string, w io.Writer) error {
+	return a.packEntries(paths, w, cachearchive.Tar, 0)
+}
+
+// packEntries writes the archive of paths to w compressed in format f at
+// level.
+func (a *tarArchive) packEntries(paths []string, w io.Writer, f cachearchive.Format, level int) error {
+	defer a.phases.begin("archive")()
+
+	tw, err := a.newWriter(w, f, level)
+
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+
+		if err != nil {
+			return err
+		}
+
+		if err = tw.add(path, fi); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// Unpack extracts the archive, decompressing it first when its magic bytes
+// show it is compressed. Caches written before the compression changed
+// restore regardless of the compression configured.
+func (a *tarArchive) Unpack(dst string, r io.Reader) error {
+	return decompressed(r, func(r io.Reader) error {
+		return a.unpack(dst, r)
+	})
+}
+
+// decompressed calls fn with the tar stream of r, decompressed first when
+// the magic bytes show it is compressed.
+func decompressed(r io.Reader, fn func(r io.Reader) error) error {
+	br := bufio.NewReader(r)
+
+	switch cachearchive.Sniff(br) {
+	case cachearchive.Zstd:
+		return decompress(zstdDecompressCmd, br, fn)
+	case cachearchive.LZ4:
+		return decompress(lz4DecompressCmd, br, fn)
+	}
+
+	tr, err := cachearchive.Decompress(br)
+
+	if err != nil {
+		return err
+	}
+
+	return fn(tr)
+}
+
+func (a *tarArchive) unpack(dst string, r io.Reader) error {
+	defer a.phases.begin("extract")()
+
+	tr, err := cachearchive.NewReader(r)
+
+	if err != nil {
+		return err
+	}
+
+	pool := a.newExtractPool()
+	dirs, err := a.unpackEntries(dst, tr, pool)
+
+	// The workers finish writing before any directory is changed
+	if werr := pool.wait(); err == nil {
+		err = werr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Directory modes and times are applied last, children before their
+	// parents, so unpacking their contents cannot prevent or change them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, err := a.target(dst, dirs[i].Name)
+
+		if err != nil {
+			return err
+		}
+
+		if err := applyMask(target, os.FileMode(dirs[i].Mode), a.dirMask); err != nil {
+			return err
+		}
+
+		if err := unpackSpecialBits(target, dirs[i], a.dirMask, a.specialBits); err != nil {
+			return err
+		}
+
+		if err := setModTime(target, dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unpackEntries creates the directories of the archive as they are read and
+// extracts the other entries, on the pool when there is one. It returns the
+// headers of the directories.
+func (a *tarArchive) unpackEntries(dst string, tr *cachearchive.Reader, pool *extractPool) ([]*tar.Header, error) {
+	var dirs []*tar.Header
+
+	for {
+		header, err := tr.Next()
+
+		switch {
+		// if no more files are found return
+		case err == io.EOF:
+			return dirs, nil
+
+		case errors.Is(err, cachearchive.ErrUnsafeName):
+			return nil, fmt.Errorf("Cache contains an entry outside the workspace %w", err)
+
+		// return any other error
+		case err != nil:
+			return nil, err
+
+		// if the header is nil, just skip it
+		case header == nil:
+			continue
+		}
+
+		if a.deferEntry(header) {
+			if err := a.deferred.add(dst, header, tr); err != nil {
+				return nil, err
+			}
+
+			a.spooled(dst, header)
+			continue
+		}
+
+		target, err := a.target(dst, header.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			log.Debugf("Directory found at %s", target)
+
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return nil, err
+			}
+
+			dirs = append(dirs, header)
+
+		case tar.TypeReg, tar.TypeRegA:
+			if index, ok := header.PAXRecords[packIndexKey]; ok {
+				if err := a.unpackBlock(dst, index, tr); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			fallthrough
+
+		case tar.TypeSymlink:
+			if err := a.extract(pool, target, header, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// extractEntry writes the file or link of header to target with the
+// contents read from r.
+func (a *tarArchive) extractEntry(target string, header *tar.Header, r io.Reader) error {
+	if header.Typeflag == tar.TypeSymlink {
+		log.Debugf("Creating link %s to %s", target, header.Linkname)
+
+		// Replace anything left behind by a previous layer
+		if err := removeIfExists(target); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+
+		a.unpacked(target)
+		return nil
+	}
+
+	log.Debugf("File found at %s", target)
+
+	if err := writeFile(target, header, r); err != nil {
+		return err
+	}
+
+	if err := applyMask(target, os.FileMode(header.Mode), a.fileMask); err != nil {
+		return err
+	}
+
+	if err := unpackSpecialBits(target, header, a.fileMask, a.specialBits); err != nil {
+		return err
+	}
+
+	if err := setModTime(target, header.ModTime); err != nil {
+		return err
+	}
+
+	a.unpacked(target)
+	return nil
+}
+
+// spooled reports a file deferred to the spool to the hook, which may no
+// longer be set by the time the spool is unpacked.
+func (a *tarArchive) spooled(dst string, header *tar.Header) {
+	if a.onUnpack == nil || header.Typeflag == tar.TypeDir {
+		return
+	}
+
+	if target, err := a.target(dst, header.Name); err == nil {
+		a.onUnpack(target)
+	}
+}
+
+func (a *tarArchive) unpacked(target string) {
+	a.files.record(target)
+	a.phases.addFile("extract")
+
+	if a.onUnpack != nil {
+		a.onUnpack(target)
+	}
+}
+
+func (a *tgzArchive) Pack(srcs []string, w io.Writer) error {
+	return a.tar.pack(srcs, w, cachearchive.Gzip, a.level)
+}
+
+func (a *tgzArchive) PackEntries(paths []string, w io.Writer) error {
+	return a.tar.packEntries(paths, w, cachearchive.Gzip, a.level)
+}
+
+// Unpack leaves the decompression to the tar archive, which detects the
+// format of r.
+func (a *tgzArchive) Unpack(dst string, r io.Reader) error {
+	return a.tar.Unpack(dst, r)
+}
+
+// setUnpackHook registers fn to be called with every file unpacked by a.
+func setUnpackHook(a archive.Archive, fn func(name string)) {
+	if t := tarOf(a); t != nil {
+		t.onUnpack = fn
+	}
+}
+
+// tarOf returns the tar archive underlying a.
+func tarOf(a archive.Archive) *tarArchive {
+	switch t := a.(type) {
+	case *tarArchive:
+		return t
+	case *tgzArchive:
+		return &t.tar
+	case *commandArchive:
+		return &t.tar
+	case *pipedArchive:
+		return &t.tar
+	}
+
+	return nil
+}
+
+// writeEntry writes the header and contents of path to the archive. Exact
+// entries keep the modification time with sub-second precision.
+func (w *tarWriter) writeEntry(path string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+		log.Debugf("Symbolic link found at %s to %s", path, link)
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+
+	header.Name = w.name(path)
+
+	// Only PAX records hold sub-second times. The access and change times
+	// are not restored so they are left out
+	if w.exact {
+		header.Format = tar.FormatPAX
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+	}
+
+	if err = packSpecialBits(header, path, fi, w.special); err != nil {
+		return err
+	}
+
+	if err = w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	log.Debugf("File found at %s", path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	_, err = io.Copy(w.tw, file)
+	return err
+}
+
+// writeFile creates or truncates the target file and copies the contents of
+// the current tar entry into it.
+func writeFile(target string, header *tar.Header, r io.Reader) error {
+	// A symlink left at the target would redirect the write
+	if fi, err := os.Lstat(target); err == nil && !fi.Mode().IsRegular() {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+
+	// Explicitly close otherwise too many files remain open
+	f.Close()
+
+	return err
+}
+
+// applyMask sets the permissions of target to mode without the mask bits.
+// Without a mask the permissions are left as created.
+func applyMask(target string, mode os.FileMode, mask os.FileMode) error {
+	if mask == 0 {
+		return nil
+	}
+
+	return os.Chmod(target, mode.Perm()&^mask)
+}
+
+// setModTime sets the access and modification times of target to mtime,
+// unless the archive did not record one.
+func setModTime(target string, mtime time.Time) error {
+	if mtime.IsZero() {
+		return nil
+	}
+
+	return os.Chtimes(target, mtime, mtime)
+}
+
+func removeIfExists(path string) error {
+	if _, err := os.Lstat(path); err != nil {
+		return nil
+	}
+
+	return os.RemoveAll(path)
+}
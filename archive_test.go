@@ -0,0 +1,502 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cachearchive "github.com/drone-plugins/drone-s3-cache/pkg/archive"
+	"github.com/drone/drone-cache-lib/archive"
+)
+
+func TestTarUnpackOverlaysExistingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Archives store paths relative to the workspace
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	src := "src"
+	os.MkdirAll(src, 0755)
+
+	file := filepath.Join(src, "file")
+	link := filepath.Join(src, "link")
+
+	a := &tarArchive{}
+
+	// First layer has a long file and a symlink
+	ioutil.WriteFile(file, []byte("base layer contents"), 0644)
+	os.Symlink("file", link)
+
+	var base bytes.Buffer
+	if err := a.Pack([]string{src}, &base); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second layer has a shorter file and the link replaced with a file
+	ioutil.WriteFile(file, []byte("delta"), 0644)
+	os.Remove(link)
+	ioutil.WriteFile(link, []byte("not a link"), 0644)
+
+	var delta bytes.Buffer
+	if err := a.Pack([]string{src}, &delta); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll(src)
+
+	if err := a.Unpack("", &base); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unpack("", &delta); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(file); string(b) != "delta" {
+		t.Errorf("Expected file to contain %q, got %q", "delta", b)
+	}
+
+	if fi, err := os.Lstat(link); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("Expected link to be replaced by a regular file")
+	}
+}
+
+func TestTarPackSmallFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("src/nested", 0755)
+	ioutil.WriteFile("src/small", []byte("small"), 0600)
+	ioutil.WriteFile("src/nested/small", []byte("nested"), 0644)
+	ioutil.WriteFile("src/large", bytes.Repeat([]byte("l"), smallFileSize), 0644)
+
+	a := &tarArchive{packSmallFiles: true}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"src"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("src")
+
+	if err := a.Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, size := range map[string]int{"src/small": 5, "src/nested/small": 6, "src/large": smallFileSize} {
+		if b, _ := ioutil.ReadFile(file); len(b) != size {
+			t.Errorf("Expected %s to have %d bytes, got %d", file, size, len(b))
+		}
+	}
+
+	if fi, err := os.Stat("src/small"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected src/small to keep its mode")
+	}
+
+	if _, err := os.Stat(".cache-pack"); err == nil {
+		t.Errorf("Expected blocks not to be extracted as files")
+	}
+}
+
+func TestTarUnpackWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	for i := 0; i < 200; i++ {
+		nested := filepath.Join("src", fmt.Sprint(i%10))
+		os.MkdirAll(nested, 0755)
+		ioutil.WriteFile(filepath.Join(nested, fmt.Sprint(i)), []byte(fmt.Sprint(i)), 0644)
+	}
+
+	ioutil.WriteFile("src/large", bytes.Repeat([]byte("l"), extractBufferSize+1), 0644)
+	os.Symlink("large", "src/link")
+
+	mtime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes("src/3", mtime, mtime)
+
+	a := &tarArchive{workers: 4}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"src"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("src")
+
+	if err := a.Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		file := filepath.Join("src", fmt.Sprint(i%10), fmt.Sprint(i))
+
+		if b, _ := ioutil.ReadFile(file); string(b) != fmt.Sprint(i) {
+			t.Errorf("Expected %s to contain %d, got %q", file, i, b)
+		}
+	}
+
+	if b, _ := ioutil.ReadFile("src/link"); len(b) != extractBufferSize+1 {
+		t.Errorf("Expected the link to the large file, got %d bytes", len(b))
+	}
+
+	// Directory times are only applied once the workers are done
+	if fi, err := os.Stat("src/3"); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected src/3 to keep its modification time")
+	}
+}
+
+func TestCommandArchiveRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("src", 0755)
+	ioutil.WriteFile("src/file", []byte("compressed"), 0644)
+
+	a := &commandArchive{compress: "gzip -c", decompress: "gzip -dc"}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"src"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("src")
+
+	if err := a.Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile("src/file"); string(b) != "compressed" {
+		t.Errorf("Expected file to contain %q, got %q", "compressed", b)
+	}
+
+	a.decompress = "false"
+	if err := a.Unpack("", bytes.NewReader(nil)); err == nil {
+		t.Error("Expected a failing decompressor to fail the unpack")
+	}
+}
+
+func TestTarUnpackPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("rest", 0755)
+	os.MkdirAll("first", 0755)
+	ioutil.WriteFile("rest/file", []byte("rest"), 0644)
+	ioutil.WriteFile("first/file", []byte("first"), 0644)
+
+	a := &tarArchive{}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"rest", "first"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("rest")
+	os.RemoveAll("first")
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.priority = []string{"./first"}
+	a.deferred = sp
+
+	if err := a.Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("first/file"); err != nil {
+		t.Errorf("Expected the priority path to be restored")
+	}
+	if _, err := os.Stat("rest"); err == nil {
+		t.Errorf("Expected the other paths to be deferred")
+	}
+
+	if err := finishPriorityRestore(a, sp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"rest/file", restorePriorityMarker, restoreCompleteMarker} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s to exist after the restore", name)
+		}
+	}
+}
+
+func TestTarUnpackModeMasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("src", 0755)
+	os.Chmod("src", 0777)
+	ioutil.WriteFile("src/key", []byte("key"), 0644)
+	os.Chmod("src/key", 0666)
+
+	a := &tarArchive{fileMask: 077, dirMask: 022}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"src"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("src")
+
+	if err := a.Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, _ := os.Stat("src/key"); fi == nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the file mode to be masked to 0600, got %v", fi.Mode())
+	}
+
+	if fi, _ := os.Stat("src"); fi == nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("Expected the directory mode to be masked to 0755, got %v", fi.Mode())
+	}
+}
+
+func TestTarUnpackModTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+
+	for _, a := range []*tarArchive{{}, {exactMtimes: true}, {packSmallFiles: true, exactMtimes: true}} {
+		os.MkdirAll("src/sub", 0755)
+		ioutil.WriteFile("src/sub/file", []byte("file"), 0644)
+
+		for _, name := range []string{"src/sub/file", "src/sub", "src"} {
+			os.Chtimes(name, mtime, mtime)
+		}
+
+		var buf bytes.Buffer
+		if err := a.Pack([]string{"src"}, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("src")
+
+		if err := a.Unpack("", &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		want := mtime.Truncate(time.Second)
+		if a.exactMtimes {
+			want = mtime
+		}
+
+		// Directories keep their times although their contents are
+		// extracted after them
+		for _, name := range []string{"src/sub/file", "src/sub", "src"} {
+			if fi, _ := os.Stat(name); fi == nil || !fi.ModTime().Equal(want) {
+				t.Errorf("Expected %s to be modified at %s, got %v", name, want, fi.ModTime())
+			}
+		}
+
+		os.RemoveAll("src")
+	}
+}
+
+func TestUnpackDetectsCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("src", 0755)
+	ioutil.WriteFile("src/file", []byte("migrated"), 0644)
+
+	formats := map[cachearchive.Format]archive.Archive{
+		cachearchive.Tar:  &tarArchive{},
+		cachearchive.Gzip: &tgzArchive{},
+	}
+
+	if _, err := exec.LookPath("zstd"); err == nil {
+		formats[cachearchive.Zstd] = &pipedArchive{compress: compressor{}.zstd()}
+	}
+
+	if _, err := exec.LookPath("lz4"); err == nil {
+		formats[cachearchive.LZ4] = &pipedArchive{compress: compressor{}.lz4()}
+	}
+
+	for format, packer := range formats {
+		var buf bytes.Buffer
+		if err := packer.Pack([]string{"src"}, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if sniffed := cachearchive.Sniff(bufio.NewReader(bytes.NewReader(buf.Bytes()))); sniffed != format {
+			t.Errorf("Expected %s archive to be detected, got %q", format, sniffed)
+		}
+
+		unpackers := []archive.Archive{&tarArchive{}, &tgzArchive{}}
+
+		// Uncompressed caches written before a decompressor was set bypass it
+		if format == cachearchive.Tar {
+			unpackers = append(unpackers, &commandArchive{decompress: "false"})
+		}
+
+		for _, unpacker := range unpackers {
+			os.RemoveAll("src")
+
+			if err := unpacker.Unpack("", bytes.NewReader(buf.Bytes())); err != nil {
+				t.Errorf("Expected %s archive to unpack with %T, got %s", format, unpacker, err)
+				continue
+			}
+
+			if b, _ := ioutil.ReadFile("src/file"); string(b) != "migrated" {
+				t.Errorf("Expected %s archive unpacked with %T to contain %q, got %q", format, unpacker, "migrated", b)
+			}
+		}
+	}
+}
+
+func TestTarSpecialBits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	for _, allow := range []bool{false, true} {
+		os.MkdirAll("src/shared", 0755)
+		ioutil.WriteFile("src/tool", []byte("setuid"), 0755)
+		os.Chmod("src/tool", 0755|os.ModeSetuid)
+		os.Chmod("src/shared", 0777|os.ModeSticky)
+
+		a := &tarArchive{specialBits: allow}
+
+		var buf bytes.Buffer
+		if err := a.Pack([]string{"src"}, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("src")
+
+		// Unpacking with the bits allowed shows whether they were archived
+		if err := (&tarArchive{specialBits: true}).Unpack("", &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		for path, mode := range map[string]os.FileMode{"src/tool": os.ModeSetuid, "src/shared": os.ModeSticky} {
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if kept := fi.Mode()&mode != 0; kept != allow {
+				t.Errorf("Expected %s to keep %s %t, got mode %s", path, mode, allow, fi.Mode())
+			}
+		}
+
+		os.RemoveAll("src")
+	}
+
+	// Caches built with the bits have them stripped unless allowed
+	os.MkdirAll("src", 0755)
+	ioutil.WriteFile("src/tool", []byte("setuid"), 0755)
+	os.Chmod("src/tool", 0755|os.ModeSetuid)
+
+	var buf bytes.Buffer
+	if err := (&tarArchive{specialBits: true}).Pack([]string{"src"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("src")
+
+	if err := (&tarArchive{}).Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, _ := os.Stat("src/tool"); fi.Mode()&os.ModeSetuid != 0 {
+		t.Errorf("Expected the setuid bit stripped on restore, got mode %s", fi.Mode())
+	}
+}
+
+func TestTarUnpackUnsafeName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../escaped", Mode: 0644, Size: 7, Typeflag: tar.TypeReg})
+	tw.Write([]byte("escaped"))
+	tw.Close()
+
+	err = (&tarArchive{}).Unpack(filepath.Join(dir, "dst"), &buf)
+
+	if !errors.Is(err, cachearchive.ErrUnsafeName) {
+		t.Errorf("Expected an entry outside the workspace to be refused, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err == nil {
+		t.Error("Expected nothing to be written outside the workspace")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+const (
+	// asyncStatusSuffix is appended to the key of an archive for the status
+	// of its background rebuild.
+	asyncStatusSuffix = ".upload-status.json"
+
+	// execStage is the type of pipelines running steps on the host.
+	execStage = "exec"
+
+	// asyncArchivePrefix names the archive packed for the helper, outside
+	// the scratch files of the run which are removed with the step.
+	asyncArchivePrefix = "drone-s3-cache-async-"
+
+	asyncRunning   = "running"
+	asyncSucceeded = "succeeded"
+	asyncFailed    = "failed"
+)
+
+// asyncStatus is the state of a background rebuild, written when it starts
+// and again by the helper once it is done.
+type asyncStatus struct {
+	State    string    `json:"state"`
+	Build    int       `json:"build"`
+	PID      int       `json:"pid,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// startAsyncRebuild packs the mounts into a file and starts a helper process
+// uploading it to key in the background, with the same arguments and
+// environment, and returns without waiting for it. The mounts are packed by
+// the step so later steps changing them cannot change the archive.
+func (p *Plugin) startAsyncRebuild(path, key string, mount []string, a archive.Archive) error {
+	f, err := ioutil.TempFile("", asyncArchivePrefix)
+
+	if err != nil {
+		return err
+	}
+
+	err = a.Pack(mount, f)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// The running status is written first so the helper always overwrites it
+	status := &asyncStatus{State: asyncRunning, Build: p.BuildNumber, Started: time.Now().UTC()}
+
+	if err = writeAsyncStatus(p.Storage, path, status); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	pid, err := startHelper("PLUGIN_ASYNC_REBUILD=false", "PLUGIN_ASYNC_HELPER=true", "PLUGIN_ASYNC_ARCHIVE="+f.Name(), "PLUGIN_ASYNC_KEY="+key)
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	log.Infof("Uploading cache at %s in the background as process %d. Its status is written to %s", key, pid, path+asyncStatusSuffix)
+
+	return nil
+}
+
+// uploadAsyncRebuild uploads the archive packed by the step in the helper,
+// followed by the aliases of the cache at path.
+func (p *Plugin) uploadAsyncRebuild(path string) error {
+	defer os.Remove(p.AsyncArchive)
+
+	f, err := os.Open(p.AsyncArchive)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if err = p.resolveDedupPointers(p.AsyncKey); err != nil {
+		return err
+	}
+
+	log.Infof("Uploading cache at %s", p.AsyncKey)
+
+	if err = p.Storage.Put(p.AsyncKey, &sizedReader{Reader: f, size: fi.Size()}); err != nil {
+		return err
+	}
+
+	if p.AsyncKey == path && p.JournalFile != "" {
+		p.removeJournalDelta(path)
+	}
+
+	if p.BranchMaxSize > 0 || p.BranchMaxAge > 0 {
+		if err = p.enforceBranchLimits(path, fi.Size()); err != nil {
+			return err
+		}
+	}
+
+	return p.writeAliases(path)
+}
+
+// startHelper starts the plugin again in a detached process, with the same
+// arguments and the environment along with env, and returns its pid without
+// waiting for it.
+func startHelper(env ...string) (int, error) {
+	self, err := os.Executable()
+
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.SysProcAttr = detachedProcess()
+
+	if err = cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	// The helper is not waited for, so it outlives the step
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	return pid, nil
+}
+
+// helpersOutliveStep reports whether a helper started in the background
+// keeps running once the step finishes. Only exec pipelines run steps as
+// processes of the host, while the Docker and Kubernetes runners stop every
+// process of the step along with its container.
+func (p *Plugin) helpersOutliveStep() bool {
+	return p.StageType == execStage
+}
+
+// finishAsyncRebuild records the outcome of the rebuild of key by the
+// helper.
+func (p *Plugin) finishAsyncRebuild(key string, started time.Time, err error) {
+	status := &asyncStatus{
+		State:    asyncSucceeded,
+		Build:    p.BuildNumber,
+		PID:      os.Getpid(),
+		Started:  started.UTC(),
+		Finished: time.Now().UTC(),
+	}
+
+	if err != nil {
+		status.State = asyncFailed
+		status.Error = err.Error()
+	}
+
+	if werr := writeAsyncStatus(p.Storage, key, status); werr != nil {
+		log.Warnf("Failed to write status of the background rebuild of %s %s", key, werr)
+	}
+}
+
+// checkAsyncRebuild logs the outcome of the last background rebuild of
+// key, so a failed or unfinished upload shows in a later step or build.
+func (p *Plugin) checkAsyncRebuild(key string) {
+	var buf bytes.Buffer
+
+	if err := p.Storage.Get(key+asyncStatusSuffix, &buf); err != nil {
+		return
+	}
+
+	status := &asyncStatus{}
+
+	if err := json.Unmarshal(buf.Bytes(), status); err != nil {
+		log.Warnf("Invalid status of the background rebuild of %s %s", key, err)
+		return
+	}
+
+	switch status.State {
+	case asyncRunning:
+		log.Warnf("Background rebuild of %s by build %d started at %s has not finished", key, status.Build, status.Started.Format(time.RFC3339))
+	case asyncFailed:
+		log.Warnf("Background rebuild of %s by build %d failed %s", key, status.Build, status.Error)
+	default:
+		log.Infof("Background rebuild of %s by build %d finished at %s", key, status.Build, status.Finished.Format(time.RFC3339))
+	}
+}
+
+func writeAsyncStatus(s storage.Storage, key string, status *asyncStatus) error {
+	b, _ := json.Marshal(status)
+	return s.Put(key+asyncStatusSuffix, bytes.NewReader(b))
+}
@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// detachedProcess starts the helper in its own session, so it is not
+// signalled along with the step.
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
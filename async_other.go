@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "syscall"
+
+func detachedProcess() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFinishAsyncRebuild(t *testing.T) {
+	s := newMemoryStorage()
+	p := &Plugin{Storage: s, BuildNumber: 7}
+
+	p.finishAsyncRebuild("/bucket/repo/archive.tar", time.Now(), errors.New("Upload failed"))
+
+	status := &asyncStatus{}
+
+	if err := json.Unmarshal(s.objects["/bucket/repo/archive.tar"+asyncStatusSuffix], status); err != nil {
+		t.Fatal(err)
+	}
+
+	if status.State != asyncFailed || status.Build != 7 || status.Error != "Upload failed" {
+		t.Errorf("Expected the failure of build 7, got %+v", status)
+	}
+
+	if status.Finished.Before(status.Started) {
+		t.Errorf("Expected the rebuild to finish after it started, got %+v", status)
+	}
+}
+
+func TestUploadAsyncRebuild(t *testing.T) {
+	f, err := ioutil.TempFile("", asyncArchivePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString("archive")
+	f.Close()
+
+	s := newMemoryStorage()
+	p := &Plugin{
+		Storage:      s,
+		Filename:     "archive.tar",
+		AliasKeys:    []string{"/bucket/repo/latest/"},
+		AsyncHelper:  true,
+		AsyncArchive: f.Name(),
+		AsyncKey:     "/bucket/repo/master/archive.tar",
+	}
+
+	if err := p.uploadAsyncRebuild(p.AsyncKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{p.AsyncKey, "/bucket/repo/latest/archive.tar"} {
+		if b := s.objects[key]; string(b) != "archive" {
+			t.Errorf("Expected the archive packed by the step at %s, got %q", key, b)
+		}
+	}
+
+	if _, err := os.Stat(f.Name()); err == nil {
+		t.Error("Expected the archive to be removed once uploaded")
+	}
+}
+
+func TestHelpersOutliveStep(t *testing.T) {
+	for stage, outlive := range map[string]bool{"exec": true, "docker": false, "kubernetes": false, "": false} {
+		if got := (&Plugin{StageType: stage}).helpersOutliveStep(); got != outlive {
+			t.Errorf("Expected helpers of %q pipelines to outlive the step %t, got %t", stage, outlive, got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// defaultBootstrapPolicy names the policy added by bootstrap.
+const defaultBootstrapPolicy = "drone-s3-cache"
+
+// bootstrappingStorage is implemented by backends which can create the
+// bucket of the caches and add a policy, reporting whether it was added.
+type bootstrappingStorage interface {
+	Bootstrap(bucket, name string, document []byte) (bool, error)
+}
+
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// cachePolicy returns a policy granting what the plugin needs on the
+// objects under prefix in bucket. Listing is granted on the whole bucket
+// as uploads check the bucket exists, which S3 authorizes as a listing.
+func cachePolicy(bucket, prefix string) []byte {
+	b, _ := json.MarshalIndent(&policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetBucketLocation", "s3:ListBucket", "s3:ListBucketMultipartUploads"},
+				Resource: []string{"arn:aws:s3:::" + bucket},
+			},
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"},
+				Resource: []string{"arn:aws:s3:::" + bucket + "/" + prefix + "*"},
+			},
+		},
+	}, "", "  ")
+
+	return b
+}
+
+// bootstrap creates the bucket of the flush path and a policy limited to
+// the caches under it, then prints how to create credentials using it.
+func (p *Plugin) bootstrap() error {
+	bs, ok := p.Storage.(bootstrappingStorage)
+
+	if !ok {
+		return errors.New("Storage does not support bootstrapping. Use a single S3 server")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(p.FlushPath, "/"), "/", 2)
+
+	if len(parts[0]) == 0 {
+		return fmt.Errorf("Invalid prefix %s", p.FlushPath)
+	}
+
+	bucket, prefix := parts[0], ""
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+
+	name := p.BootstrapPolicy
+	if len(name) == 0 {
+		name = defaultBootstrapPolicy
+	}
+
+	document := cachePolicy(bucket, prefix)
+	added, err := bs.Bootstrap(bucket, name, document)
+
+	if err != nil {
+		return err
+	}
+
+	if !added {
+		log.Infof("Attach this policy to the credentials of the plugin in the IAM of the provider")
+		fmt.Println(string(document))
+		return nil
+	}
+
+	fmt.Printf(`Policy %s grants access to the caches under /%s/%s. Create credentials
+using it with the MinIO client, then set access_key and secret_key to them:
+
+  mc admin user add <alias> <access key> <secret key>
+  mc admin policy attach <alias> %s --user <access key>
+`, name, bucket, prefix, name)
+
+	return nil
+}
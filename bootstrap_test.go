@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// bootstrapStorage records the policy added by bootstrap.
+type bootstrapStorage struct {
+	*memoryStorage
+
+	bucket   string
+	document []byte
+}
+
+func (s *bootstrapStorage) Bootstrap(bucket, name string, document []byte) (bool, error) {
+	s.bucket, s.document = bucket, document
+	return true, nil
+}
+
+func TestBootstrap(t *testing.T) {
+	s := &bootstrapStorage{memoryStorage: newMemoryStorage()}
+	p := &Plugin{Mode: BootstrapMode, FlushPath: "/bucket/drone/", Storage: s}
+
+	if err := p.exec(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.bucket != "bucket" {
+		t.Errorf("Expected the bucket to be created, got %q", s.bucket)
+	}
+
+	policy := &policyDocument{}
+	if err := json.Unmarshal(s.document, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(policy.Statement) != 2 || policy.Statement[1].Resource[0] != "arn:aws:s3:::bucket/drone/*" {
+		t.Errorf("Expected object access limited to the prefix, got %s", s.document)
+	}
+
+	p.FlushPath = "/"
+
+	if err := p.exec(context.Background()); err == nil {
+		t.Error("Expected a prefix without a bucket to fail")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+)
+
+// checkBranchSize refuses a cache of about size bytes larger than the size
+// limit of the branch on its own, before anything is uploaded.
+func (p *Plugin) checkBranchSize(size int64) error {
+	if p.BranchMaxSize > 0 && size > p.BranchMaxSize {
+		return fmt.Errorf("Cache is %s, more than branch_max_size %s", humanize.Bytes(uint64(size)), humanize.Bytes(uint64(p.BranchMaxSize)))
+	}
+
+	return nil
+}
+
+// enforceBranchLimits applies the size and age limits of the branch to the
+// caches under BranchPath once the cache at key, of about size bytes, is
+// uploaded. Expired caches are deleted, then the oldest until the cache at
+// key fits. Only archives named Filename count, each along with its
+// sidecars, which are deleted with it.
+func (p *Plugin) enforceBranchLimits(key string, size int64) error {
+	files, err := p.Storage.List(p.BranchPath)
+
+	if err != nil {
+		return err
+	}
+
+	archives, sidecars := branchArchives(files, p.Filename)
+
+	// The cache just uploaded is kept, at its size in the bucket
+	key = strings.TrimPrefix(key, "/")
+	var kept []storage.FileEntry
+
+	for _, archive := range archives {
+		if strings.TrimPrefix(archive.Path, "/") == key {
+			size = archive.Size
+		} else {
+			kept = append(kept, archive)
+		}
+	}
+
+	var expired []storage.FileEntry
+
+	if p.BranchMaxAge > 0 {
+		expired, kept = splitExpired(kept, genIsExpired(p.BranchMaxAge))
+	}
+
+	if p.BranchMaxSize > 0 {
+		rotated, _ := rotateOldest(kept, p.BranchMaxSize-size)
+		expired = append(expired, rotated...)
+	}
+
+	for _, file := range expired {
+		log.Infof("Deleting %s from %s to stay within the branch limits", file.Path, file.LastModified.Format(time.RFC3339))
+
+		if err := p.deleteBranchArchive(file.Path, sidecars[file.Path]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// branchArchives returns the archives named filename among files, each
+// sized along with its sidecars, and the sidecars of each archive. The
+// keys of sidecars extend the key of their archive. Other objects are
+// left out.
+func branchArchives(files []storage.FileEntry, filename string) ([]storage.FileEntry, map[string][]string) {
+	var archives []storage.FileEntry
+
+	for _, file := range files {
+		if isArchiveKey(file.Path, filename) {
+			archives = append(archives, file)
+		}
+	}
+
+	sidecars := make(map[string][]string)
+
+	for i, archive := range archives {
+		for _, file := range files {
+			if file.Path != archive.Path && strings.HasPrefix(file.Path, archive.Path) {
+				sidecars[archive.Path] = append(sidecars[archive.Path], file.Path)
+				archives[i].Size += file.Size
+			}
+		}
+	}
+
+	return archives, sidecars
+}
+
+// deleteBranchArchive deletes the archive at key and then its sidecars,
+// first copying it to the caches pointing at it.
+func (p *Plugin) deleteBranchArchive(key string, sidecars []string) error {
+	if err := p.resolveDedupPointers(key); err != nil {
+		return err
+	}
+
+	for _, name := range append([]string{key}, sidecars...) {
+		if err := p.Storage.Delete(name); err != nil {
+			return fmt.Errorf("Failed to delete %s %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// splitExpired splits the files into those dirty says are expired and the
+// rest.
+func splitExpired(files []storage.FileEntry, dirty func(storage.FileEntry) bool) (expired, kept []storage.FileEntry) {
+	for _, file := range files {
+		if dirty(file) {
+			expired = append(expired, file)
+		} else {
+			kept = append(kept, file)
+		}
+	}
+
+	return expired, kept
+}
+
+// rotateOldest splits the oldest files, whose removal brings the total size
+// of the files within budget, from the rest.
+func rotateOldest(files []storage.FileEntry, budget int64) (rotated, kept []storage.FileEntry) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].LastModified.Before(files[j].LastModified)
+	})
+
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+
+	for len(files) > 0 && total > budget {
+		total -= files[0].Size
+		rotated = append(rotated, files[0])
+		files = files[1:]
+	}
+
+	return rotated, files
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+func TestEnforceBranchLimits(t *testing.T) {
+	s := newMemoryStorage()
+	s.Put("/bucket/repo/feature/old/archive.tar", bytes.NewReader(make([]byte, 40)))
+	s.Put("/bucket/repo/feature/old/archive.tar.sig", bytes.NewReader(make([]byte, 5)))
+	s.Put("/bucket/repo/feature/archive.tar", bytes.NewReader(make([]byte, 50)))
+	s.Put("/bucket/repo/feature/notes.txt", bytes.NewReader(make([]byte, 30)))
+	s.Put("/bucket/repo/master/archive.tar", bytes.NewReader(make([]byte, 100)))
+
+	p := &Plugin{
+		Storage:       s,
+		Filename:      "archive.tar",
+		BranchPath:    "/bucket/repo/feature/",
+		BranchMaxSize: 100,
+	}
+
+	if err := p.checkBranchSize(200); err == nil {
+		t.Error("Expected a cache larger than the limit to be refused")
+	}
+
+	// The cache just uploaded is kept and other objects do not count
+	if err := p.enforceBranchLimits("/bucket/repo/feature/archive.tar", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.objects) != 5 {
+		t.Errorf("Expected nothing to be deleted, got %d objects", len(s.objects))
+	}
+
+	// Rotating the oldest feature cache makes room for the new one
+	s.Put("/bucket/repo/feature/new/archive.tar", bytes.NewReader(make([]byte, 50)))
+
+	if err := p.enforceBranchLimits("/bucket/repo/feature/new/archive.tar", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"/bucket/repo/feature/old/archive.tar", "/bucket/repo/feature/old/archive.tar.sig"} {
+		if _, ok := s.objects[key]; ok {
+			t.Errorf("Expected %s to be rotated with the oldest feature cache", key)
+		}
+	}
+
+	for _, key := range []string{
+		"/bucket/repo/feature/new/archive.tar",
+		"/bucket/repo/feature/archive.tar",
+		"/bucket/repo/feature/notes.txt",
+		"/bucket/repo/master/archive.tar",
+	} {
+		if _, ok := s.objects[key]; !ok {
+			t.Errorf("Expected %s to be kept", key)
+		}
+	}
+}
+
+func TestRotateOldest(t *testing.T) {
+	now := time.Now()
+
+	files := []storage.FileEntry{
+		{Path: "new", Size: 10, LastModified: now},
+		{Path: "old", Size: 10, LastModified: now.Add(-time.Hour)},
+		{Path: "mid", Size: 10, LastModified: now.Add(-time.Minute)},
+	}
+
+	rotated, kept := rotateOldest(files, 15)
+
+	if len(rotated) != 2 || rotated[0].Path != "old" || rotated[1].Path != "mid" {
+		t.Errorf("Expected the oldest files to be rotated, got %v", rotated)
+	}
+
+	if len(kept) != 1 || kept[0].Path != "new" {
+		t.Errorf("Expected the newest file to be kept, got %v", kept)
+	}
+}
+
+func TestSimulatePolicy(t *testing.T) {
+	now := time.Now()
+
+	files := []storage.FileEntry{
+		{Path: "bucket/repo/feature/expired.tar", Size: 10, LastModified: now.AddDate(0, 0, -30)},
+		{Path: "bucket/repo/feature/old.tar", Size: 40, LastModified: now.AddDate(0, 0, -5)},
+		{Path: "bucket/repo/feature/new.tar", Size: 50, LastModified: now},
+	}
+
+	sim := simulatePolicy(files, 14, 60)
+
+	if len(sim.Deleted) != 2 || sim.Deleted[0] != "/bucket/repo/feature/expired.tar" || sim.Deleted[1] != "/bucket/repo/feature/old.tar" {
+		t.Errorf("Expected the expired and then the oldest cache to be deleted, got %v", sim.Deleted)
+	}
+
+	if sim.Reclaimed != 50 || sim.Kept != 1 || sim.KeptSize != 50 {
+		t.Errorf("Expected 50 bytes reclaimed and 50 kept, got %+v", sim)
+	}
+
+	if files[0].Path != "bucket/repo/feature/expired.tar" {
+		t.Error("Expected the files of the report not to be reordered")
+	}
+}
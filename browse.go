@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	cachearchive "github.com/drone-plugins/drone-s3-cache/pkg/archive"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+)
+
+// errBrowseDone stops streaming an archive once every entry wanted was
+// seen.
+var errBrowseDone = errors.New("Browse done")
+
+// browse writes the files of the cache at key matching BrowseGlob without
+// unpacking anything. The manifest is read when one was published, or else
+// the headers of the archive are streamed.
+func (p *Plugin) browse(key string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	print := func(file manifestFile) {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", file.Mode, humanize.Bytes(uint64(file.Size)), file.Path)
+	}
+
+	if manifest, err := readManifest(p.Storage, key); err == nil {
+		for _, file := range manifest.Files {
+			if matchGlob(p.BrowseGlob, file.Path) {
+				print(file)
+			}
+		}
+
+		return w.Flush()
+	}
+
+	// A glob without wildcards names a single entry so the stream stops at it
+	literal := p.BrowseGlob != "" && !strings.ContainsAny(p.BrowseGlob, `*?[\`)
+
+	err := browseArchive(p.Storage, key, 0, func(h *tar.Header) error {
+		if h.Typeflag == tar.TypeDir || !matchGlob(p.BrowseGlob, h.Name) {
+			return nil
+		}
+
+		print(manifestFile{Path: h.Name, Mode: h.FileInfo().Mode().String(), Size: h.Size})
+
+		if literal {
+			return errBrowseDone
+		}
+
+		return nil
+	})
+
+	if err != nil && err != errBrowseDone {
+		if !exists(p.Storage, key) {
+			return fmt.Errorf("%w at %s", errCacheMiss, key)
+		}
+
+		return err
+	}
+
+	return w.Flush()
+}
+
+// readManifest downloads the manifest published for the archive at key,
+// failing when it was published for an earlier archive.
+func readManifest(s storage.Storage, key string) (*cacheManifest, error) {
+	var b bytes.Buffer
+
+	if err := s.Get(key+manifestSuffix, &b); err != nil {
+		return nil, err
+	}
+
+	manifest := &cacheManifest{}
+
+	if err := json.Unmarshal(b.Bytes(), manifest); err != nil {
+		return nil, fmt.Errorf("Failed to read manifest of %s %s", key, err)
+	}
+
+	if manifest.ETag != "" && manifest.ETag != archiveETag(s, key) {
+		return nil, fmt.Errorf("Manifest of %s was published for an earlier archive", key)
+	}
+
+	return manifest, nil
+}
+
+// browseArchive streams the archive at key calling fn with the header of
+// each entry, following pointers and shards, until fn returns an error.
+// The contents are skipped rather than written anywhere.
+func browseArchive(s storage.Storage, key string, depth int, fn func(h *tar.Header) error) error {
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	cw := make(chan error, 1)
+
+	go func() {
+		err := s.Get(key, writer)
+		writer.CloseWithError(err)
+		cw <- err
+	}()
+
+	br := bufio.NewReader(reader)
+
+	var err error
+	var parts []string
+
+	if target, _, isPointer := readPointer(br); isPointer {
+		parts = []string{target}
+		_, err = io.Copy(ioutil.Discard, br)
+	} else if m, isManifest, merr := cachearchive.ReadManifest(br); isManifest {
+		err = merr
+
+		if m != nil {
+			parts = m.Parts
+		}
+	} else {
+		err = decompressed(br, func(r io.Reader) error {
+			tr := tar.NewReader(r)
+
+			for {
+				h, err := tr.Next()
+
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+
+				if err = fn(h); err != nil {
+					return err
+				}
+			}
+		})
+	}
+
+	// Unblock the download when browsing stopped early
+	reader.Close()
+
+	if werr := <-cw; werr != nil && !(err != nil && errors.Is(werr, io.ErrClosedPipe)) {
+		return werr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(parts) > 0 && depth == maxPointerDepth {
+		return fmt.Errorf("Too many pointers followed from %s", key)
+	}
+
+	for _, part := range parts {
+		if err := browseArchive(s, part, depth+1, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchGlob reports whether the path of an entry, or its base name, matches
+// glob. An empty glob matches every entry.
+func matchGlob(glob, name string) bool {
+	if glob == "" {
+		return true
+	}
+
+	if ok, _ := path.Match(glob, name); ok {
+		return true
+	}
+
+	ok, _ := path.Match(glob, path.Base(name))
+	return ok
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestBrowseArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "browse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	for i := 0; i < 6; i++ {
+		file := filepath.Join("src", fmt.Sprintf("dir%d", i%2), fmt.Sprintf("file%d", i))
+		os.MkdirAll(filepath.Dir(file), 0755)
+		ioutil.WriteFile(file, []byte(file), 0644)
+	}
+
+	s := newMemoryStorage()
+
+	if err := rebuildSharded([]string{"src"}, "/bucket/archive.tgz", 3, s, &tgzArchive{}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("src")
+
+	var names []string
+
+	err = browseArchive(s, "/bucket/archive.tgz", 0, func(h *tar.Header) error {
+		if h.Typeflag != tar.TypeDir {
+			names = append(names, h.Name)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(names)
+
+	if len(names) != 6 || names[0] != "src/dir0/file0" {
+		t.Errorf("Expected the 6 files across the parts, got %v", names)
+	}
+
+	if _, err := os.Stat("src"); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be unpacked, got %v", err)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		glob  string
+		name  string
+		match bool
+	}{
+		{"", "src/dir0/file0", true},
+		{"src/*/file0", "src/dir0/file0", true},
+		{"file*", "src/dir0/file0", true},
+		{"*.jar", "src/dir0/file0", false},
+		{"src/*", "src/dir0/file0", false},
+	}
+
+	for _, test := range tests {
+		if got := matchGlob(test.glob, test.name); got != test.match {
+			t.Errorf("Expected %q matching %s to be %t, got %t", test.glob, test.name, test.match, got)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	cachearchive "github.com/drone-plugins/drone-s3-cache/pkg/archive"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// restoreCache streams the archive at src from storage and unpacks it into
+// the working directory, following any pointers left by deduplication. The
+// key of the archive unpacked is returned.
+func restoreCache(src string, s storage.Storage, a archive.Archive) (string, error) {
+	for depth := 0; ; depth++ {
+		target, err := restoreArchive(src, s, a)
+
+		// The archive may be in another format than its name or the
+		// decompressor expects, e.g. after it was renamed or migrated
+		var uerr *unpackError
+		if errors.As(err, &uerr) {
+			if d := detectingArchive(a); d != nil {
+				log.Warnf("Failed to unpack %s %s. Retrying with the format detected", src, uerr.err)
+				target, err = restoreArchive(src, s, d)
+			}
+		}
+
+		if err != nil || target == "" {
+			return src, err
+		}
+
+		if depth == maxPointerDepth {
+			return src, fmt.Errorf("Too many pointers followed from %s", src)
+		}
+
+		log.Infof("Following pointer at %s to %s", src, target)
+		src = target
+	}
+}
+
+// restoreArchive unpacks the archive at src. When src is a pointer nothing
+// is unpacked and the pointer target is returned instead.
+func restoreArchive(src string, s storage.Storage, a archive.Archive) (string, error) {
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	cw := make(chan error, 1)
+
+	go func() {
+		err := s.Get(src, writer)
+		writer.CloseWithError(err)
+		cw <- err
+	}()
+
+	br := bufio.NewReader(reader)
+
+	var err error
+	var target string
+	var manifest *cachearchive.Manifest
+
+	if _, perr := br.Peek(1); perr == io.EOF {
+		// Zero-byte objects, e.g. left by an interrupted upload, hold
+		// nothing to unpack
+		err = fmt.Errorf("Cache at %s is empty. Treating it as a miss", src)
+	} else if pointer, sum, isPointer := readPointer(br); isPointer {
+		target = pointer
+
+		if _, err = io.Copy(ioutil.Discard, br); err == nil {
+			err = checkPointer(s, target, sum)
+		}
+	} else if m, isManifest, merr := cachearchive.ReadManifest(br); isManifest {
+		manifest, err = m, merr
+	} else if err = a.Unpack("", br); err != nil {
+		err = &unpackError{err: err}
+	}
+
+	// Unblock the download if unpacking stopped early
+	reader.Close()
+
+	// The download fails writing to the closed pipe when the unpack failed
+	if werr := <-cw; werr != nil && !(err != nil && errors.Is(werr, io.ErrClosedPipe)) {
+		return "", werr
+	}
+
+	if err == nil && manifest != nil {
+		err = restoreShards(manifest, s, a)
+	}
+
+	return target, err
+}
+
+// unpackError is a failure to unpack an archive which was downloaded.
+type unpackError struct {
+	err error
+}
+
+func (e *unpackError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unpackError) Unwrap() error {
+	return e.err
+}
+
+// detectingArchive returns the archive unpacking a with the format detected
+// from the archive rather than configured, or nil when a already does.
+func detectingArchive(a archive.Archive) archive.Archive {
+	switch t := a.(type) {
+	case *commandArchive:
+		return &t.tar
+	case *rootedArchive:
+		if d := detectingArchive(t.Archive); d != nil {
+			return &rootedArchive{Archive: d, root: t.root}
+		}
+	}
+
+	return nil
+}
+
+// exists reports whether there is an object at key, without downloading it
+// when the storage supports metadata.
+func exists(s storage.Storage, key string) bool {
+	if ms, ok := s.(metadataStorage); ok {
+		_, _, err := ms.Stat(key)
+		return err == nil
+	}
+
+	files, err := s.List(key)
+
+	if err != nil {
+		return false
+	}
+
+	for _, file := range files {
+		if "/"+file.Path == key || file.Path == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rebuildCache packs the srcs into an archive and streams it to dst.
+func rebuildCache(srcs []string, dst string, s storage.Storage, a archive.Archive) error {
+	log.Infof("Rebuilding cache at %s to %s", srcs, dst)
+
+	return uploadArchive(dst, s, func(w io.Writer) error {
+		return a.Pack(srcs, w)
+	})
+}
+
+// uploadArchive streams the archive written by pack to dst.
+func uploadArchive(dst string, s storage.Storage, pack func(w io.Writer) error) error {
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	cw := make(chan error, 1)
+
+	go func() {
+		err := pack(writer)
+		writer.CloseWithError(err)
+		cw <- err
+	}()
+
+	err := s.Put(dst, reader)
+
+	// Unblock the archiver if the upload stopped early
+	reader.Close()
+
+	if werr := <-cw; werr != nil {
+		return werr
+	}
+
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRestoreCacheDetectsFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	// Larger than the pipe buffers so the download outlives the failed unpack
+	contents := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	os.MkdirAll("src", 0755)
+	ioutil.WriteFile("src/file", contents, 0644)
+
+	// A gzip archive left at the key of a cache compressed by a command
+	var buf bytes.Buffer
+	if err := (&tgzArchive{}).Pack([]string{"src"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newMemoryStorage()
+	s.Put("/bucket/archive.tar.bz2", &buf)
+	os.RemoveAll("src")
+
+	a := &commandArchive{compress: "bzip2 -c", decompress: "bzip2 -dc"}
+
+	if _, err := restoreCache("/bucket/archive.tar.bz2", s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile("src/file"); !bytes.Equal(b, contents) {
+		t.Errorf("Expected file to be restored, got %d bytes", len(b))
+	}
+}
+
+func TestRestoreCacheEmpty(t *testing.T) {
+	s := newMemoryStorage()
+	s.objects["/bucket/archive.tar"] = []byte{}
+
+	_, err := restoreCache("/bucket/archive.tar", s, &tarArchive{})
+
+	if err == nil || !strings.Contains(err.Error(), "is empty") {
+		t.Errorf("Expected the empty cache to be a miss, got %v", err)
+	}
+}
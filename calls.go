@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// errCallLimit is returned by storage calls past the limit of a run.
+var errCallLimit = errors.New("Storage call limit reached")
+
+// callKinds are the kinds of storage calls counted, in the order logged.
+var callKinds = []string{"list", "head", "get", "put", "delete"}
+
+// callCounter counts the storage calls of a run by kind, failing the calls
+// past max when it is set.
+type callCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+	total  int
+	max    int
+}
+
+func newCallCounter(max int) *callCounter {
+	return &callCounter{counts: make(map[string]int), max: max}
+}
+
+// count records a call of kind, failing it when the limit was reached.
+func (c *callCounter) count(kind string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.max > 0 && c.total >= c.max {
+		return fmt.Errorf("%w. Refusing %s after %d calls", errCallLimit, kind, c.total)
+	}
+
+	c.counts[kind]++
+	c.total++
+
+	return nil
+}
+
+// String formats the counts, e.g. list=3 head=12 get=1 put=2 delete=0.
+func (c *callCounter) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	parts := make([]string, len(callKinds))
+
+	for i, kind := range callKinds {
+		parts[i] = fmt.Sprintf("%s=%d", kind, c.counts[kind])
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// countedStorage counts the calls made to the storage.
+type countedStorage struct {
+	metadataStorage
+
+	calls *callCounter
+}
+
+func (s *countedStorage) Get(p string, dst io.Writer) error {
+	if err := s.calls.count("get"); err != nil {
+		return err
+	}
+
+	return s.metadataStorage.Get(p, dst)
+}
+
+func (s *countedStorage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+func (s *countedStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	if err := s.calls.count("put"); err != nil {
+		return err
+	}
+
+	return s.metadataStorage.PutWithMetadata(p, src, metadata)
+}
+
+func (s *countedStorage) List(p string) ([]storage.FileEntry, error) {
+	if err := s.calls.count("list"); err != nil {
+		return nil, err
+	}
+
+	return s.metadataStorage.List(p)
+}
+
+func (s *countedStorage) Delete(p string) error {
+	if err := s.calls.count("delete"); err != nil {
+		return err
+	}
+
+	return s.metadataStorage.Delete(p)
+}
+
+func (s *countedStorage) Stat(p string) (storage.FileEntry, map[string]string, error) {
+	if err := s.calls.count("head"); err != nil {
+		return storage.FileEntry{}, nil, err
+	}
+
+	return s.metadataStorage.Stat(p)
+}
+
+func (s *countedStorage) ETag(p string) (string, error) {
+	if ts, ok := s.metadataStorage.(taggedStorage); ok {
+		if err := s.calls.count("head"); err != nil {
+			return "", err
+		}
+
+		return ts.ETag(p)
+	}
+
+	return "", errors.New("Storage does not support entity tags")
+}
+
+func (s *countedStorage) Copy(src, dst string) error {
+	if cs, ok := s.metadataStorage.(copyingStorage); ok {
+		if err := s.calls.count("put"); err != nil {
+			return err
+		}
+
+		return cs.Copy(src, dst)
+	}
+
+	return errNoCopy
+}
+
+func (s *countedStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	if cs, ok := s.metadataStorage.(conditionalStorage); ok {
+		if err := s.calls.count("put"); err != nil {
+			return false, err
+		}
+
+		return cs.PutIfMatch(p, src, etag, metadata)
+	}
+
+	return false, errors.New("Storage does not support conditional writes")
+}
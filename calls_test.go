@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCountedStorage(t *testing.T) {
+	calls := newCallCounter(3)
+	s := &countedStorage{metadataStorage: newMemoryStorage(), calls: calls}
+
+	s.Put("/bucket/key", bytes.NewReader([]byte("cache")))
+	s.List("/bucket/")
+	s.Stat("/bucket/key")
+
+	if err := s.Delete("/bucket/key"); !errors.Is(err, errCallLimit) {
+		t.Errorf("Expected the call past the limit to fail, got %v", err)
+	}
+
+	if got := calls.String(); got != "list=1 head=1 get=0 put=1 delete=0" {
+		t.Errorf("Expected the calls made to be counted, got %s", got)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// stopGrace is how long a run which timed out is given to stop its calls
+// in flight.
+var stopGrace = 30 * time.Second
+
+// cancelledStorage stops the storage calls of a run once ctx is done,
+// failing new calls and the reads and writes of transfers in flight, so
+// nothing is left writing to the workspace or the bucket after a timeout.
+type cancelledStorage struct {
+	metadataStorage
+
+	ctx context.Context
+}
+
+// stopped returns the error of a call of kind on p once ctx is done.
+func (s *cancelledStorage) stopped(kind, p string) error {
+	if s.ctx.Err() == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w. Stopping %s of %s", errTimeout, kind, p)
+}
+
+func (s *cancelledStorage) Get(p string, dst io.Writer) error {
+	if err := s.stopped("get", p); err != nil {
+		return err
+	}
+
+	return s.metadataStorage.Get(p, &cancelledWriter{w: dst, s: s, p: p})
+}
+
+func (s *cancelledStorage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+func (s *cancelledStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	if err := s.stopped("put", p); err != nil {
+		return err
+	}
+
+	return s.metadataStorage.PutWithMetadata(p, s.reader(p, src), metadata)
+}
+
+func (s *cancelledStorage) List(p string) ([]storage.FileEntry, error) {
+	if err := s.stopped("list", p); err != nil {
+		return nil, err
+	}
+
+	return s.metadataStorage.List(p)
+}
+
+func (s *cancelledStorage) Delete(p string) error {
+	if err := s.stopped("delete", p); err != nil {
+		return err
+	}
+
+	return s.metadataStorage.Delete(p)
+}
+
+func (s *cancelledStorage) Stat(p string) (storage.FileEntry, map[string]string, error) {
+	if err := s.stopped("head", p); err != nil {
+		return storage.FileEntry{}, nil, err
+	}
+
+	return s.metadataStorage.Stat(p)
+}
+
+func (s *cancelledStorage) ETag(p string) (string, error) {
+	if ts, ok := s.metadataStorage.(taggedStorage); ok {
+		if err := s.stopped("head", p); err != nil {
+			return "", err
+		}
+
+		return ts.ETag(p)
+	}
+
+	return "", errors.New("Storage does not support entity tags")
+}
+
+func (s *cancelledStorage) Copy(src, dst string) error {
+	if cs, ok := s.metadataStorage.(copyingStorage); ok {
+		if err := s.stopped("copy", src); err != nil {
+			return err
+		}
+
+		return cs.Copy(src, dst)
+	}
+
+	return errNoCopy
+}
+
+func (s *cancelledStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	if cs, ok := s.metadataStorage.(conditionalStorage); ok {
+		if err := s.stopped("put", p); err != nil {
+			return false, err
+		}
+
+		return cs.PutIfMatch(p, s.reader(p, src), etag, metadata)
+	}
+
+	return false, errors.New("Storage does not support conditional writes")
+}
+
+// reader returns src failing once ctx is done, keeping its size.
+func (s *cancelledStorage) reader(p string, src io.Reader) io.Reader {
+	return &sizedReader{Reader: &cancelledReader{r: src, s: s, p: p}, size: readerSize(src)}
+}
+
+type cancelledReader struct {
+	r io.Reader
+	s *cancelledStorage
+	p string
+}
+
+func (r *cancelledReader) Read(b []byte) (int, error) {
+	if err := r.s.stopped("upload", r.p); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(b)
+}
+
+type cancelledWriter struct {
+	w io.Writer
+	s *cancelledStorage
+	p string
+}
+
+func (w *cancelledWriter) Write(b []byte) (int, error) {
+	if err := w.s.stopped("download", w.p); err != nil {
+		return 0, err
+	}
+
+	return w.w.Write(b)
+}
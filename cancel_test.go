@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// cancellingReader cancels the run after the first read.
+type cancellingReader struct {
+	r      io.Reader
+	cancel func()
+}
+
+func (r *cancellingReader) Read(b []byte) (int, error) {
+	defer r.cancel()
+	return r.r.Read(b[:1])
+}
+
+func TestCancelledStorage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := newMemoryStorage()
+	s := &cancelledStorage{metadataStorage: ms, ctx: ctx}
+
+	if err := s.Put("/bucket/archive.tar", strings.NewReader("cache")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Put("/bucket/partial.tar", &cancellingReader{r: strings.NewReader("cache"), cancel: cancel})
+
+	if !errors.Is(err, errTimeout) {
+		t.Errorf("Expected the upload in flight to stop, got %v", err)
+	}
+
+	var got bytes.Buffer
+
+	if err := s.Get("/bucket/archive.tar", &got); !errors.Is(err, errTimeout) || got.Len() != 0 {
+		t.Errorf("Expected calls after cancelling to fail, got %q %v", got.String(), err)
+	}
+
+	if _, err := s.List("/bucket/"); !errors.Is(err, errTimeout) {
+		t.Errorf("Expected listing after cancelling to fail, got %v", err)
+	}
+}
+
+// stuckStorage never answers, like a backend whose connection hangs.
+type stuckStorage struct {
+	*memoryStorage
+
+	release chan struct{}
+}
+
+func (s *stuckStorage) Get(p string, dst io.Writer) error {
+	<-s.release
+	return errors.New("released")
+}
+
+func (s *stuckStorage) List(p string) ([]storage.FileEntry, error) {
+	<-s.release
+	return nil, errors.New("released")
+}
+
+func (s *stuckStorage) Stat(p string) (storage.FileEntry, map[string]string, error) {
+	<-s.release
+	return storage.FileEntry{}, nil, errors.New("released")
+}
+
+func TestTimeoutStuckStorage(t *testing.T) {
+	defer func(grace time.Duration) { stopGrace = grace }(stopGrace)
+	stopGrace = 10 * time.Millisecond
+
+	s := &stuckStorage{memoryStorage: newMemoryStorage(), release: make(chan struct{})}
+	defer close(s.release)
+
+	p := &Plugin{
+		Mode:       RestoreMode,
+		Storage:    s,
+		Path:       "/bucket/repo/master/",
+		Filename:   "archive.tar",
+		Mount:      []string{"src"},
+		Timeout:    10 * time.Millisecond,
+		FailOnMiss: true,
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- p.execWithTimeout()
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errTimeout) {
+			t.Errorf("Expected the restore to time out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the restore to return without waiting for the stuck storage")
+	}
+}
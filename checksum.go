@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// checksumAlgorithms are the hashes checksum keys can be computed with.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"xxhash": func() hash.Hash { return newXXHash64() },
+}
+
+// checksumFiles hashes the contents of the files matching the patterns,
+// concatenated in the order of the patterns with the matches of each
+// pattern sorted. A single file hashes the same as sha256sum or xxhsum.
+func checksumFiles(patterns []string, algorithm string) (string, error) {
+	newHash, ok := checksumAlgorithms[algorithm]
+
+	if !ok {
+		return "", fmt.Errorf("Unknown checksum algorithm %s. Needs to be sha256, sha1 or xxhash", algorithm)
+	}
+
+	h := newHash()
+	found := false
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+
+		if err != nil {
+			return "", err
+		}
+
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			if err = hashFile(h, match); err != nil {
+				return "", err
+			}
+
+			found = true
+		}
+	}
+
+	if !found {
+		return "", fmt.Errorf("No files match the checksum files %s", patterns)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func hashFile(h hash.Hash, path string) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	return err
+}
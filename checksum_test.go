@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.lock"), []byte("ab"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.lock"), []byte("c"), 0644)
+
+	tests := []struct {
+		algorithm string
+		patterns  []string
+		expected  string
+	}{
+		// Matches are hashed concatenated, the same as the sum of "abc"
+		{"sha256", []string{"*.lock"}, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha1", []string{"a.lock", "b.lock"}, "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"xxhash", []string{"*.lock"}, "44bc2cf5ad770999"},
+	}
+
+	for _, test := range tests {
+		patterns := make([]string, len(test.patterns))
+		for i, p := range test.patterns {
+			patterns[i] = filepath.Join(dir, p)
+		}
+
+		sum, err := checksumFiles(patterns, test.algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sum != test.expected {
+			t.Errorf("Expected %s checksum %s, got %s", test.algorithm, test.expected, sum)
+		}
+	}
+
+	if _, err := checksumFiles([]string{filepath.Join(dir, "missing")}, "sha256"); err == nil {
+		t.Error("Expected an error when no files match")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	cachearchive "github.com/drone-plugins/drone-s3-cache/pkg/archive"
+)
+
+// The commands .tar.zst and .tar.lz4 archives are decompressed with. The
+// compression commands are built by compressor.
+const (
+	zstdDecompressCmd = "zstd -q -d -c"
+	lz4DecompressCmd  = "lz4 -q -d -c"
+)
+
+// commandArchive is an Archive piping the tar stream through external
+// compressor and decompressor commands, such as pigz or zstd.
+type commandArchive struct {
+	tar        tarArchive
+	compress   string
+	decompress string
+}
+
+func (a *commandArchive) Pack(srcs []string, w io.Writer) error {
+	return pipe(a.compress, w, func(w io.Writer) error {
+		return a.tar.Pack(srcs, w)
+	})
+}
+
+func (a *commandArchive) PackEntries(paths []string, w io.Writer) error {
+	return pipe(a.compress, w, func(w io.Writer) error {
+		return a.tar.PackEntries(paths, w)
+	})
+}
+
+// Unpack decompresses r with the decompressor, unless it is an archive the
+// tar archive unpacks on its own, such as a cache written before the
+// compressor was set.
+func (a *commandArchive) Unpack(dst string, r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	if cachearchive.Sniff(br) == cachearchive.Tar {
+		return a.tar.Unpack(dst, br)
+	}
+
+	return decompress(a.decompress, br, func(r io.Reader) error {
+		return a.tar.Unpack(dst, r)
+	})
+}
+
+// pipedArchive is an Archive compressed with a built in command, such as
+// zstd for the .tar.zst file format.
+type pipedArchive struct {
+	tar      tarArchive
+	compress string
+}
+
+func (a *pipedArchive) Pack(srcs []string, w io.Writer) error {
+	return pipe(a.compress, w, func(w io.Writer) error {
+		return a.tar.Pack(srcs, w)
+	})
+}
+
+func (a *pipedArchive) PackEntries(paths []string, w io.Writer) error {
+	return pipe(a.compress, w, func(w io.Writer) error {
+		return a.tar.PackEntries(paths, w)
+	})
+}
+
+// Unpack leaves the decompression to the tar archive, which detects the
+// format of r.
+func (a *pipedArchive) Unpack(dst string, r io.Reader) error {
+	return a.tar.Unpack(dst, r)
+}
+
+// decompress runs the command name with r as its input and unpacks its
+// output.
+func decompress(name string, r io.Reader, unpack func(r io.Reader) error) error {
+	cmd, stderr := command(name)
+	cmd.Stdin = r
+
+	out, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start %s %s", name, err)
+	}
+
+	err = unpack(out)
+
+	// Drain any trailing output so the command can exit
+	io.Copy(ioutil.Discard, out)
+
+	if werr := cmd.Wait(); werr != nil {
+		return commandError(name, werr, stderr)
+	}
+
+	return err
+}
+
+// pipe runs the command with the output of write as its input and w as its
+// output.
+func pipe(name string, w io.Writer, write func(w io.Writer) error) error {
+	cmd, stderr := command(name)
+	cmd.Stdout = w
+
+	in, err := cmd.StdinPipe()
+
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start %s %s", name, err)
+	}
+
+	err = write(in)
+	in.Close()
+
+	if werr := cmd.Wait(); werr != nil {
+		return commandError(name, werr, stderr)
+	}
+
+	return err
+}
+
+// command runs name through the shell so it can carry arguments.
+func command(name string) (*exec.Cmd, *bytes.Buffer) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("sh", "-c", name)
+	cmd.Stderr = &stderr
+
+	return cmd, &stderr
+}
+
+func commandError(name string, err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%s failed: %s", name, msg)
+	}
+
+	return fmt.Errorf("%s failed: %s", name, err)
+}
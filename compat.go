@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+)
+
+const (
+	// CompatDroneCache restores the caches of meltwater/drone-cache, an
+	// archive per mount at <path><mount>.
+	CompatDroneCache = "drone-cache"
+
+	// CompatVolumeCache restores the caches of drone-volume-cache, a copy
+	// of each mount in a directory of the volume.
+	CompatVolumeCache = "drone-volume-cache"
+)
+
+// restoreCompat restores the mounts from the caches another plugin left,
+// unpacking archives with a and copying directories under root.
+func (p *Plugin) restoreCompat(a archive.Archive, root string) error {
+	restored := 0
+
+	for _, mount := range p.Mount {
+		var err error
+
+		switch p.Compat {
+		case CompatDroneCache:
+			key := p.Path + strings.TrimPrefix(filepath.ToSlash(mount), "/")
+
+			log.Infof("Restoring %s cache of %s at %s", p.Compat, mount, key)
+			_, err = restoreCache(key, p.Storage, a)
+		case CompatVolumeCache:
+			src := filepath.Join(p.CompatPath, mount)
+
+			log.Infof("Restoring %s cache of %s from %s", p.Compat, mount, src)
+			err = copyTree(src, filepath.Join(root, mount))
+		default:
+			return fmt.Errorf("Invalid compat %s. Needs to be %s or %s", p.Compat, CompatDroneCache, CompatVolumeCache)
+		}
+
+		if err != nil {
+			log.Warnf("The %s cache of %s could not be restored %s", p.Compat, mount, err)
+			continue
+		}
+
+		restored++
+	}
+
+	if restored == 0 {
+		return fmt.Errorf("No %s cache found", p.Compat)
+	}
+
+	return nil
+}
+
+// copyTree copies the files, directories and links under src to dst,
+// keeping their modes and modification times.
+func copyTree(src, dst string) error {
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+
+			if err != nil {
+				return err
+			}
+
+			if err := removeIfExists(target); err != nil {
+				return err
+			}
+
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			if err := copyFile(path, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// validCompat checks the compat settings.
+func validCompat(compat, path string) error {
+	switch compat {
+	case "", CompatDroneCache:
+		return nil
+	case CompatVolumeCache:
+		if len(path) == 0 {
+			return errors.New("compat drone-volume-cache needs compat_path, the directory of the repo in the cache volume")
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Invalid compat %s. Needs to be %s or %s", compat, CompatDroneCache, CompatVolumeCache)
+}
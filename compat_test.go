@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreCompat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("src/dir", 0755)
+	ioutil.WriteFile("src/dir/file", []byte("drone-cache"), 0644)
+
+	s := newMemoryStorage()
+	a := &tarArchive{}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"src"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Put("/bucket/key/src", &buf)
+
+	os.MkdirAll("volume/owner/repo/1/vendor", 0755)
+	ioutil.WriteFile("volume/owner/repo/1/vendor/file", []byte("drone-volume-cache"), 0644)
+	os.Symlink("file", "volume/owner/repo/1/vendor/link")
+
+	os.RemoveAll("src")
+
+	tests := []struct {
+		compat, mount, file, contents string
+	}{
+		{CompatDroneCache, "src", "src/dir/file", "drone-cache"},
+		{CompatVolumeCache, "vendor", "vendor/link", "drone-volume-cache"},
+	}
+
+	for _, test := range tests {
+		p := &Plugin{
+			Storage:    s,
+			Path:       "/bucket/key/",
+			Mount:      []string{test.mount},
+			Compat:     test.compat,
+			CompatPath: filepath.Join(dir, "volume/owner/repo/1"),
+		}
+
+		if err := p.restoreCompat(a, ""); err != nil {
+			t.Fatalf("Failed to restore the %s cache %s", test.compat, err)
+		}
+
+		if b, _ := ioutil.ReadFile(test.file); string(b) != test.contents {
+			t.Errorf("Expected %s restored from the %s cache, got %q", test.file, test.compat, b)
+		}
+	}
+
+	p := &Plugin{Storage: s, Path: "/bucket/other/", Mount: []string{"src"}, Compat: CompatDroneCache}
+
+	if err := p.restoreCompat(a, ""); err == nil {
+		t.Error("Expected a miss without any drone-cache cache")
+	}
+}
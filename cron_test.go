@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2017, time.March, 10, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2017, time.March, 10, 14, 31, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2017, time.March, 11, 3, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2017, time.March, 10, 14, 40, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * 1-5", time.Date(2017, time.March, 13, 2, 30, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		c, err := parseCron(test.spec)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", test.spec, err)
+		}
+
+		if next := c.Next(from); !next.Equal(test.next) {
+			t.Errorf("Expected %q to run at %s, got %s", test.spec, test.next, next)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("Expected %q to be invalid", spec)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+const (
+	// cryptMagic starts every object encrypted with a passphrase.
+	cryptMagic = "DSCENC1\n"
+
+	// cryptChunkSize is the size of the plaintext of each chunk sealed,
+	// so objects are encrypted and decrypted as they stream.
+	cryptChunkSize = 64 * 1024
+
+	cryptSaltSize   = 16
+	cryptPrefixSize = 7
+	cryptIterations = 100000
+)
+
+// errNotEncrypted is returned for objects which were not encrypted with a
+// passphrase, like caches written before encryption was enabled.
+var errNotEncrypted = errors.New("Object is not encrypted with a passphrase")
+
+// encryptedStorage encrypts objects on the client with AES-256-GCM under a
+// key derived from a passphrase, so the storage only ever holds ciphertext.
+//
+// Objects are the magic, a random salt and nonce prefix, and the plaintext
+// sealed in chunks. The nonce of each chunk is the prefix, the index of the
+// chunk and whether it is the last, so chunks cannot be reordered and a
+// truncated object fails to decrypt.
+type encryptedStorage struct {
+	metadataStorage
+
+	passphrase string
+}
+
+func (s *encryptedStorage) Get(p string, dst io.Writer) error {
+	w := &decryptWriter{w: dst, passphrase: s.passphrase}
+
+	if err := s.metadataStorage.Get(p, w); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Failed to decrypt %s %w", p, err)
+	}
+
+	return nil
+}
+
+func (s *encryptedStorage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+func (s *encryptedStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	r, err := newEncryptReader(src, s.passphrase)
+
+	if err != nil {
+		return err
+	}
+
+	return s.metadataStorage.PutWithMetadata(p, r, metadata)
+}
+
+func (s *encryptedStorage) ETag(p string) (string, error) {
+	if ts, ok := s.metadataStorage.(taggedStorage); ok {
+		return ts.ETag(p)
+	}
+
+	return "", errors.New("Storage does not support entity tags")
+}
+
+func (s *encryptedStorage) Copy(src, dst string) error {
+	if cs, ok := s.metadataStorage.(copyingStorage); ok {
+		return cs.Copy(src, dst)
+	}
+
+	return errNoCopy
+}
+
+func (s *encryptedStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	cs, ok := s.metadataStorage.(conditionalStorage)
+
+	if !ok {
+		return false, errors.New("Storage does not support conditional writes")
+	}
+
+	r, err := newEncryptReader(src, s.passphrase)
+
+	if err != nil {
+		return false, err
+	}
+
+	return cs.PutIfMatch(p, r, etag, metadata)
+}
+
+// newCryptAEAD returns the cipher of the key derived from passphrase and
+// salt.
+func newCryptAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256([]byte(passphrase), salt, cryptIterations, 32))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// cryptNonce returns the nonce of the chunk at index.
+func cryptNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, cryptPrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptPrefixSize:], index)
+
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// encryptReader reads the object encrypting the plaintext of src.
+type encryptReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+
+	plain []byte
+	next  []byte
+	out   bytes.Buffer
+	done  bool
+}
+
+func newEncryptReader(src io.Reader, passphrase string) (*encryptReader, error) {
+	header := make([]byte, cryptSaltSize+cryptPrefixSize)
+
+	if _, err := rand.Read(header); err != nil {
+		return nil, err
+	}
+
+	aead, err := newCryptAEAD(passphrase, header[:cryptSaltSize])
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := &encryptReader{
+		src:    src,
+		aead:   aead,
+		prefix: header[cryptSaltSize:],
+		plain:  make([]byte, cryptChunkSize),
+		next:   make([]byte, 0, 1),
+	}
+
+	r.out.WriteString(cryptMagic)
+	r.out.Write(header)
+
+	return r, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.out.Read(p)
+}
+
+// seal encrypts the next chunk, reading a byte ahead to tell whether it is
+// the last one.
+func (r *encryptReader) seal() error {
+	chunk := r.plain[:0]
+
+	if len(r.next) == 1 {
+		chunk = append(chunk, r.next[0])
+	}
+
+	n, err := io.ReadFull(r.src, r.plain[len(chunk):])
+	chunk = r.plain[:len(chunk)+n]
+
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+
+	if err != nil && !last {
+		return err
+	}
+
+	if !last {
+		if _, err = io.ReadFull(r.src, r.next[:1]); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if last {
+		r.next = r.next[:0]
+	} else {
+		r.next = r.next[:1]
+	}
+
+	r.out.Write(r.aead.Seal(nil, cryptNonce(r.prefix, r.index, last), chunk, nil))
+	r.index++
+	r.done = last
+
+	return nil
+}
+
+// decryptWriter decrypts the object written to it into w. Close opens the
+// last chunk, failing for objects which were truncated.
+type decryptWriter struct {
+	w          io.Writer
+	passphrase string
+
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+
+	if d.aead == nil {
+		if len(d.buf) < len(cryptMagic)+cryptSaltSize+cryptPrefixSize {
+			return len(p), nil
+		}
+
+		if err := d.init(); err != nil {
+			return 0, err
+		}
+	}
+
+	sealed := cryptChunkSize + d.aead.Overhead()
+
+	// A chunk is only known not to be the last once more data follows it
+	for len(d.buf) > sealed {
+		if err := d.open(d.buf[:sealed], false); err != nil {
+			return 0, err
+		}
+
+		d.buf = d.buf[sealed:]
+	}
+
+	return len(p), nil
+}
+
+func (d *decryptWriter) Close() error {
+	if d.aead == nil {
+		return errNotEncrypted
+	}
+
+	return d.open(d.buf, true)
+}
+
+func (d *decryptWriter) init() error {
+	if string(d.buf[:len(cryptMagic)]) != cryptMagic {
+		return errNotEncrypted
+	}
+
+	header := d.buf[len(cryptMagic) : len(cryptMagic)+cryptSaltSize+cryptPrefixSize]
+	aead, err := newCryptAEAD(d.passphrase, header[:cryptSaltSize])
+
+	if err != nil {
+		return err
+	}
+
+	d.aead = aead
+	d.prefix = append([]byte(nil), header[cryptSaltSize:]...)
+	d.buf = d.buf[len(cryptMagic)+len(header):]
+
+	return nil
+}
+
+func (d *decryptWriter) open(chunk []byte, last bool) error {
+	plain, err := d.aead.Open(nil, cryptNonce(d.prefix, d.index, last), chunk, nil)
+
+	if err != nil {
+		return errors.New("Wrong passphrase or corrupted object")
+	}
+
+	d.index++
+
+	_, err = d.w.Write(plain)
+	return err
+}
+
+// pbkdf2SHA256 derives a key of size bytes from password and salt with
+// PBKDF2 and HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, size+prf.Size())
+
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:size]
+}
+
+// encryptStorage wraps s to encrypt its objects with passphrase.
+func encryptStorage(s storage.Storage, passphrase string) (storage.Storage, error) {
+	ms, ok := s.(metadataStorage)
+
+	if !ok {
+		return nil, errors.New("Storage does not support client side encryption")
+	}
+
+	return &encryptedStorage{metadataStorage: ms, passphrase: passphrase}, nil
+}
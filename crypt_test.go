@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	for _, size := range []int{0, 10, cryptChunkSize, 3*cryptChunkSize + 7} {
+		backend := newMemoryStorage()
+		s := &encryptedStorage{metadataStorage: backend, passphrase: "secret"}
+
+		plain := bytes.Repeat([]byte{'x'}, size)
+
+		if err := s.Put("/bucket/key", bytes.NewReader(plain)); err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(backend.objects["/bucket/key"], []byte("xxxxxxxx")) {
+			t.Errorf("Expected the %d bytes to be stored encrypted", size)
+		}
+
+		var buf bytes.Buffer
+
+		if err := s.Get("/bucket/key", &buf); err != nil || !bytes.Equal(buf.Bytes(), plain) {
+			t.Errorf("Expected the %d bytes decrypted, got %d %v", size, buf.Len(), err)
+		}
+
+		wrong := &encryptedStorage{metadataStorage: backend, passphrase: "wrong"}
+
+		if err := wrong.Get("/bucket/key", &buf); err == nil {
+			t.Errorf("Expected the %d bytes not to decrypt with another passphrase", size)
+		}
+
+		// Dropping the last chunk leaves a valid chunk which is not marked
+		// as the last
+		if size > cryptChunkSize {
+			sealed := backend.objects["/bucket/key"]
+			backend.objects["/bucket/key"] = sealed[:len(cryptMagic)+cryptSaltSize+cryptPrefixSize+cryptChunkSize+16]
+
+			if err := s.Get("/bucket/key", &buf); err == nil {
+				t.Errorf("Expected the truncated %d bytes not to decrypt", size)
+			}
+		}
+	}
+}
+
+func TestEncryptedStorageNotEncrypted(t *testing.T) {
+	backend := newMemoryStorage()
+	backend.objects["/bucket/key"] = []byte("plain archive written before encryption was enabled")
+
+	s := &encryptedStorage{metadataStorage: backend, passphrase: "secret"}
+
+	var buf bytes.Buffer
+
+	if err := s.Get("/bucket/key", &buf); !errors.Is(err, errNotEncrypted) {
+		t.Errorf("Expected the object not to be encrypted, got %v", err)
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914 section 11
+	key := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+
+	if got := hex.EncodeToString(key); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+const (
+	// flushLockRenewal is how often the leader renews the lock while it
+	// flushes, extending it to flushLockLease from then.
+	flushLockRenewal = time.Minute
+	flushLockLease   = 3 * flushLockRenewal
+)
+
+// flushLock is stored in the lock object to elect a single flush daemon.
+type flushLock struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// flushDaemon applies the retention policy across the flush prefixes on
+// every tick of the schedule until the process is signalled to stop.
+func (p *Plugin) flushDaemon() error {
+	var schedule *cronSchedule
+
+	if p.FlushSchedule != "" {
+		var err error
+		if schedule, err = parseCron(p.FlushSchedule); err != nil {
+			return err
+		}
+	}
+
+	holder := lockHolder()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// Interval daemons flush on startup, scheduled ones wait for the schedule
+	next := time.Now()
+	if schedule != nil {
+		next = schedule.Next(next)
+	}
+
+	for {
+		if next.IsZero() {
+			return fmt.Errorf("Schedule %s never runs", p.FlushSchedule)
+		}
+
+		log.Infof("Next flush at %s", next.Format(time.RFC3339))
+
+		select {
+		case <-time.After(time.Until(next)):
+		case sig := <-stop:
+			log.Infof("Received %s. Stopping flush daemon", sig)
+			return nil
+		}
+
+		if schedule != nil {
+			next = schedule.Next(time.Now())
+		} else {
+			next = time.Now().Add(p.FlushInterval)
+		}
+
+		// Hold the lock until shortly after the next run renews it
+		if p.acquireFlushLock(holder, next.Add(time.Minute)) {
+			p.flushLeased(holder)
+		} else {
+			log.Info("Another flush daemon holds the lock. Skipping run")
+		}
+	}
+}
+
+// flushLeased flushes the prefixes while renewing the lock, so a flush
+// running past the next run is not started by another daemon. The flush
+// stops when the lock cannot be renewed.
+func (p *Plugin) flushLeased(holder string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	renewed := make(chan struct{})
+
+	go func() {
+		defer close(renewed)
+
+		ticker := time.NewTicker(flushLockRenewal)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if !p.acquireFlushLock(holder, time.Now().Add(flushLockLease)) {
+				log.Warn("Failed to renew the flush lock. Stopping flush")
+				cancel()
+				return
+			}
+		}
+	}()
+
+	p.flushPrefixes(ctx)
+	cancel()
+	<-renewed
+}
+
+func (p *Plugin) flushPrefixes(ctx context.Context) {
+	s := p.Storage
+
+	if ms, ok := s.(metadataStorage); ok {
+		s = &cancelledStorage{metadataStorage: ms, ctx: ctx}
+	}
+
+	expired := genIsExpired(p.FlushAge)
+	lock := strings.TrimPrefix(p.FlushLock, "/")
+
+	dirty, err := p.ownedDirty(func(file storage.FileEntry) bool {
+		// Never flush the lock electing the daemon
+		return file.Path != lock && expired(file)
+	})
+
+	if err != nil {
+		log.Warnf("Skipping flush %s", err)
+		return
+	}
+
+	for _, prefix := range p.FlushPrefixes {
+		log.Infof("Flushing cache items older then %d days at %s", p.FlushAge, prefix)
+
+		if err := flush(s, prefix, dirty, p.FlushDryRun, p.FlushCheckpoint); err != nil {
+			log.Warnf("Failed to flush %s %s", prefix, err)
+		}
+	}
+}
+
+// acquireFlushLock takes or renews the lock until expires, never shortening
+// a lock holder already has, and reports whether holder is the leader. The
+// lock is written with a conditional write when the storage supports them,
+// so only one daemon wins a race. Otherwise it is read back after writing,
+// and the last writer wins.
+func (p *Plugin) acquireFlushLock(holder string, expires time.Time) bool {
+	cs, conditional := p.Storage.(conditionalStorage)
+
+	// The tag is read first so a change before the lock is read fails the
+	// write. It is empty when there is no lock yet
+	var etag string
+	if conditional {
+		etag, _ = cs.ETag(p.FlushLock)
+	}
+
+	current, err := readFlushLock(p.Storage, p.FlushLock)
+
+	if err == nil && current.Holder != holder && time.Now().Before(current.Expires) {
+		return false
+	}
+
+	if err == nil && current.Holder == holder && current.Expires.After(expires) {
+		expires = current.Expires
+	}
+
+	b, _ := json.Marshal(&flushLock{
+		Holder:  holder,
+		Expires: expires,
+	})
+
+	if conditional {
+		written, err := cs.PutIfMatch(p.FlushLock, bytes.NewReader(b), etag, nil)
+
+		if err == nil {
+			return written
+		}
+
+		log.Debugf("Failed to write flush lock %s conditionally %s. Reading it back instead", p.FlushLock, err)
+	}
+
+	if err = p.Storage.Put(p.FlushLock, bytes.NewReader(b)); err != nil {
+		log.Warnf("Failed to write flush lock %s %s", p.FlushLock, err)
+		return false
+	}
+
+	// Give a competing daemon the chance to overwrite the lock
+	time.Sleep(time.Second)
+
+	current, err = readFlushLock(p.Storage, p.FlushLock)
+
+	return err == nil && current.Holder == holder
+}
+
+func readFlushLock(s storage.Storage, path string) (*flushLock, error) {
+	var buf bytes.Buffer
+
+	if err := s.Get(path, &buf); err != nil {
+		return nil, err
+	}
+
+	lock := &flushLock{}
+	if err := json.Unmarshal(buf.Bytes(), lock); err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+func lockHolder() string {
+	hostname, _ := os.Hostname()
+
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
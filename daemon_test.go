@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquireFlushLock(t *testing.T) {
+	s := &versionedStorage{memoryStorage: newMemoryStorage(), versions: make(map[string]int)}
+	p := &Plugin{Storage: s, FlushLock: "/bucket/flush-daemon.lock"}
+	expires := time.Now().Add(time.Hour)
+
+	if !p.acquireFlushLock("first", expires) {
+		t.Fatal("Expected the first daemon to take the lock")
+	}
+
+	if p.acquireFlushLock("second", time.Now().Add(2*time.Hour)) {
+		t.Error("Expected the lock held by another daemon to be refused")
+	}
+
+	if !p.acquireFlushLock("first", time.Now().Add(time.Minute)) {
+		t.Error("Expected the holder to renew the lock")
+	}
+
+	if lock, _ := readFlushLock(s, p.FlushLock); !lock.Expires.Equal(expires) {
+		t.Errorf("Expected renewing not to shorten the lock, got %s", lock.Expires)
+	}
+
+	// A daemon writing in between fails the conditional write
+	s.conflicts = 1
+
+	if p.acquireFlushLock("first", expires) {
+		t.Error("Expected a conflicting write to lose the lock")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+const (
+	// pointerMagic starts the body of a pointer object, which is uploaded
+	// in place of an archive identical to one already in storage.
+	pointerMagic = "drone-s3-cache-pointer\n"
+
+	// maxPointerDepth limits how many pointers are followed on restore.
+	maxPointerDepth = 5
+
+	// hashMetadataKey is the metadata key holding the sha256 of an archive.
+	hashMetadataKey = "sha256"
+
+	// pointerMetadataKey is the metadata key holding the target of a
+	// pointer object.
+	pointerMetadataKey = "pointer"
+
+	// pointerRefsSuffix is appended to the key of an archive for the prefix
+	// of its referrers, an empty object for every pointer to it named by
+	// the key of the pointer.
+	pointerRefsSuffix = ".pointers/"
+)
+
+// rebuildDeduplicated packs the srcs to a temporary file and uploads it to
+// dst. When the archive at base has the same content hash a pointer to base
+// is uploaded instead of the archive, along with a referrer next to base so
+// the pointer is resolved before base is replaced or flushed.
+func rebuildDeduplicated(srcs []string, dst string, base string, tempDir string, s metadataStorage, a archive.Archive) error {
+	log.Infof("Rebuilding cache at %s to %s", srcs, dst)
+
+	tmp, err := ioutil.TempFile(tempDir, "archive")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+
+	if err = a.Pack(srcs, io.MultiWriter(tmp, h)); err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	metadata := map[string]string{hashMetadataKey: sum}
+
+	if base != "" && base != dst {
+		_, baseMetadata, err := s.Stat(base)
+
+		// Pointers are only written to archives, so resolving them never
+		// needs to follow another pointer
+		if target := baseMetadata[pointerMetadataKey]; err == nil && target != "" {
+			base = target
+			_, baseMetadata, err = s.Stat(base)
+		}
+
+		if err != nil {
+			log.Infof("Could not retrieve %s for deduplication %s", base, err)
+		} else if baseMetadata[hashMetadataKey] == sum && base != dst {
+			log.Infof("Cache is identical to %s, uploading pointer", base)
+
+			return writePointer(s, base, dst, sum)
+		}
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return s.PutWithMetadata(dst, tmp, metadata)
+}
+
+// writePointer uploads a pointer to base at dst, after the referrer of dst
+// next to base.
+func writePointer(s metadataStorage, base, dst, sum string) error {
+	if err := s.Put(pointerRef(base, dst), strings.NewReader("")); err != nil {
+		return err
+	}
+
+	body := pointerMagic + base + "\n" + sum + "\n"
+	metadata := map[string]string{hashMetadataKey: sum, pointerMetadataKey: base}
+
+	return s.PutWithMetadata(dst, strings.NewReader(body), metadata)
+}
+
+// pointerRef returns the key of the referrer of the pointer at dst to base.
+func pointerRef(base, dst string) string {
+	return base + pointerRefsSuffix + strings.TrimPrefix(dst, "/")
+}
+
+// isPointerRef reports whether key is the referrer of a pointer.
+func isPointerRef(key string) bool {
+	return strings.Contains(key, pointerRefsSuffix)
+}
+
+// resolvePointers replaces every pointer to base with a copy of the archive
+// at base, so they stand on their own before base is replaced or deleted.
+// Referrers of pointers since rebuilt or flushed are removed.
+func resolvePointers(s metadataStorage, base string) error {
+	refs, err := s.List(base + pointerRefsSuffix)
+
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.TrimPrefix(base+pointerRefsSuffix, "/")
+
+	for _, ref := range refs {
+		dst := "/" + strings.TrimPrefix(strings.TrimPrefix(ref.Path, "/"), prefix)
+
+		if _, metadata, serr := s.Stat(dst); serr == nil && metadata[pointerMetadataKey] == base {
+			log.Infof("Replacing pointer at %s with a copy of %s", dst, base)
+
+			if err = copyObject(s, base, dst); err != nil {
+				return fmt.Errorf("Failed to resolve pointer at %s %s", dst, err)
+			}
+		}
+
+		if err = s.Delete(pointerRef(base, dst)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveDedupPointers resolves the pointers to key before it is replaced, when
+// deduplicating.
+func (p *Plugin) resolveDedupPointers(key string) error {
+	if ms, ok := p.Storage.(metadataStorage); ok && p.Dedup {
+		return resolvePointers(ms, key)
+	}
+
+	return nil
+}
+
+// readPointer returns the target and content hash when r starts with a
+// pointer object.
+func readPointer(r *bufio.Reader) (string, string, bool) {
+	magic, err := r.Peek(len(pointerMagic))
+
+	if err != nil || string(magic) != pointerMagic {
+		return "", "", false
+	}
+
+	r.Discard(len(pointerMagic))
+	target, _ := r.ReadString('\n')
+	sum, _ := r.ReadString('\n')
+
+	return strings.TrimSpace(target), strings.TrimSpace(sum), true
+}
+
+// checkPointer fails when the archive at target no longer has the content
+// hash sum the pointer was written for.
+func checkPointer(s storage.Storage, target, sum string) error {
+	ms, ok := s.(metadataStorage)
+
+	if !ok || sum == "" {
+		return nil
+	}
+
+	_, metadata, err := ms.Stat(target)
+
+	if err != nil {
+		return err
+	}
+
+	if metadata[hashMetadataKey] != sum {
+		return fmt.Errorf("Cache at %s was replaced since it was pointed to", target)
+	}
+
+	return nil
+}
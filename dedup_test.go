@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+func TestRebuildDeduplicated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Archives store paths relative to the workspace
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.Mkdir("src", 0755)
+	ioutil.WriteFile("src/file", []byte("contents"), 0644)
+
+	s := &labelledStorage{memoryStorage: newMemoryStorage(), metadata: make(map[string]map[string]string)}
+	base := "/bucket/repo/master/archive.tar"
+	dst := "/bucket/repo/feature/archive.tar"
+
+	if err := rebuildDeduplicated([]string{"src"}, base, "", dir, s, &tarArchive{}); err != nil {
+		t.Fatal(err)
+	}
+
+	archived := s.objects[base]
+
+	if err := rebuildDeduplicated([]string{"src"}, dst, base, dir, s, &tarArchive{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, _, isPointer := readPointer(bufio.NewReader(bytes.NewReader(s.objects[dst]))); !isPointer || target != base {
+		t.Fatalf("Expected a pointer to %s, got %q", base, s.objects[dst])
+	}
+
+	if _, ok := s.objects[pointerRef(base, dst)]; !ok {
+		t.Error("Expected the referrer of the pointer next to the archive")
+	}
+
+	if restored, err := restoreCache(dst, s, &tarArchive{}); err != nil || restored != base {
+		t.Errorf("Expected the pointer to be followed to %s, got %s %v", base, restored, err)
+	}
+
+	// Pointers are resolved before the archive pointed to is replaced
+	if err := resolvePointers(s, base); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile("src/file", []byte("rebuilt"), 0644)
+
+	if err := rebuildDeduplicated([]string{"src"}, base, "", dir, s, &tarArchive{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(s.objects[dst], archived) {
+		t.Error("Expected the pointer to be replaced with a copy of the archive")
+	}
+
+	if _, ok := s.objects[pointerRef(base, dst)]; ok {
+		t.Error("Expected the referrer to be removed once resolved")
+	}
+}
+
+func TestStalePointer(t *testing.T) {
+	s := &labelledStorage{memoryStorage: newMemoryStorage(), metadata: make(map[string]map[string]string)}
+	base := "/bucket/repo/master/archive.tar"
+
+	s.PutWithMetadata(base, strings.NewReader("archive"), map[string]string{hashMetadataKey: "new"})
+	s.Put("/bucket/repo/feature/archive.tar", strings.NewReader(pointerMagic+base+"\nold\n"))
+
+	if _, err := restoreCache("/bucket/repo/feature/archive.tar", s, &tarArchive{}); err == nil {
+		t.Error("Expected a pointer to a replaced archive to be a miss")
+	}
+}
+
+func TestFlushResolvesPointers(t *testing.T) {
+	s := &labelledStorage{memoryStorage: newMemoryStorage(), metadata: make(map[string]map[string]string)}
+	base := "/bucket/repo/master/archive.tar"
+	dst := "/bucket/repo/feature/archive.tar"
+
+	s.PutWithMetadata(base, strings.NewReader("archive"), map[string]string{hashMetadataKey: "sum"})
+
+	if err := writePointer(s, base, dst, "sum"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the archive pointed to is expired
+	dirty := func(file storage.FileEntry) bool {
+		return file.Path == base || isPointerRef(file.Path)
+	}
+
+	if err := flush(s, "/bucket/repo/", dirty, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.objects[base]; ok {
+		t.Error("Expected the archive to be flushed")
+	}
+
+	if b := s.objects[dst]; string(b) != "archive" {
+		t.Errorf("Expected the pointer to be resolved before the flush, got %q", b)
+	}
+
+	if len(s.objects) != 1 {
+		t.Errorf("Expected only the resolved copy to remain, got %d objects", len(s.objects))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// cacheEnv returns the variables describing the cache at key, written to the
+// env file for later steps.
+func (p *Plugin) cacheEnv(key, fallbackKey string) map[string]string {
+	return map[string]string{
+		"CACHE_KEY":          key,
+		"CACHE_PATH":         p.Path,
+		"CACHE_BUCKET":       strings.SplitN(strings.TrimPrefix(p.Path, "/"), "/", 2)[0],
+		"CACHE_FALLBACK_KEY": fallbackKey,
+	}
+}
+
+// writeRebuildEnv writes the env file after a rebuild, when configured.
+func (p *Plugin) writeRebuildEnv(key, fallbackKey string, rebuilt bool) {
+	if p.EnvFile == "" {
+		return
+	}
+
+	env := p.cacheEnv(key, fallbackKey)
+	env["CACHE_REBUILT"] = strconv.FormatBool(rebuilt)
+
+	p.writeEnvFile(env)
+}
+
+// writeRestoreEnv writes the env file after a restore, when configured. A
+// hit is the restore of the cache at key rather than along the fallback
+// chain.
+func (p *Plugin) writeRestoreEnv(key, fallbackKey, restoredKey string, restored bool) {
+	if p.EnvFile == "" {
+		return
+	}
+
+	env := p.cacheEnv(key, fallbackKey)
+	env["CACHE_HIT"] = strconv.FormatBool(restored && restoredKey == key)
+	env["CACHE_RESTORED"] = strconv.FormatBool(restored)
+
+	if restored {
+		env["CACHE_RESTORED_KEY"] = restoredKey
+	}
+
+	p.writeEnvFile(env)
+}
+
+// writeEnvFile writes the variables to the env file as KEY=value lines,
+// which can be sourced by the shell of later steps or read as a dotenv file.
+func (p *Plugin) writeEnvFile(vars map[string]string) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%s\n", name, envQuote(vars[name]))
+	}
+
+	if err := ioutil.WriteFile(p.EnvFile, []byte(b.String()), 0644); err != nil {
+		log.Warnf("Failed to write env file %s %s", p.EnvFile, err)
+	}
+}
+
+// envQuote single quotes values the shell would otherwise interpret.
+func envQuote(value string) string {
+	safe := strings.IndexFunc(value, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("/._-:+=@,", r))
+	}) == -1
+
+	if safe {
+		return value
+	}
+
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
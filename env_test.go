@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvQuote(t *testing.T) {
+	tests := []struct {
+		value, quoted string
+	}{
+		{"/bucket/repo/master/archive.tar", "/bucket/repo/master/archive.tar"},
+		{"true", "true"},
+		{"", ""},
+		{"with space", "'with space'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+	}
+
+	for _, test := range tests {
+		if quoted := envQuote(test.value); quoted != test.quoted {
+			t.Errorf("Expected %q to be quoted as %s, got %s", test.value, test.quoted, quoted)
+		}
+	}
+}
+
+func TestWriteRestoreEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &Plugin{
+		Path:    "/bucket/repo/feature/",
+		EnvFile: filepath.Join(dir, ".cache.env"),
+	}
+
+	p.writeRestoreEnv("/bucket/repo/feature/archive.tar", "/bucket/repo/master/archive.tar", "/bucket/repo/master/archive.tar", true)
+
+	b, err := ioutil.ReadFile(p.EnvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `CACHE_BUCKET=bucket
+CACHE_FALLBACK_KEY=/bucket/repo/master/archive.tar
+CACHE_HIT=false
+CACHE_KEY=/bucket/repo/feature/archive.tar
+CACHE_PATH=/bucket/repo/feature/
+CACHE_RESTORED=true
+CACHE_RESTORED_KEY=/bucket/repo/master/archive.tar
+`
+
+	if string(b) != expected {
+		t.Errorf("Expected env file\n%s\ngot\n%s", expected, b)
+	}
+}
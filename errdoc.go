@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+)
+
+// errTimeout is returned when an operation exceeds the timeout.
+var errTimeout = errors.New("Timed out")
+
+// retryableCodes are the S3 error codes of failures which may succeed when
+// tried again.
+var retryableCodes = map[string]bool{
+	"InternalError":      true,
+	"RequestTimeout":     true,
+	"ServiceUnavailable": true,
+	"SlowDown":           true,
+}
+
+// errorDocument describes a failed operation for tooling, written to the
+// error file as JSON.
+type errorDocument struct {
+	Mode      string `json:"mode"`
+	Phase     string `json:"phase,omitempty"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Key       string `json:"key,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+// errorCode classifies err, returning a code and whether the operation may
+// succeed when tried again.
+func errorCode(err error) (string, bool) {
+	switch {
+	case errors.Is(err, errCacheMiss):
+		return "cache_miss", false
+	case errors.Is(err, errTimeout):
+		return "timeout", true
+	case errors.Is(err, errCallLimit):
+		return "call_limit", false
+	case isConnectionError(err):
+		return "unreachable", true
+	}
+
+	if code := s3.ErrorCode(err); code != "" {
+		return code, retryableCodes[code]
+	}
+
+	return "error", false
+}
+
+// isStorageError reports whether err is a failure to reach the storage or
+// an error response from it, rather than a failure of the plugin itself.
+func isStorageError(err error) bool {
+	switch code, _ := errorCode(err); code {
+	case "cache_miss", "call_limit", "error":
+		return false
+	}
+
+	return true
+}
+
+// isNotFound reports whether err is the storage reporting that the object
+// does not exist, rather than a failure to check it.
+func isNotFound(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || s3.ErrorCode(err) == "NoSuchKey"
+}
+
+// writeErrorDocument writes the document describing err to the error file.
+// Failing to write it only logs a warning so the original error is kept.
+func (p *Plugin) writeErrorDocument(err error) {
+	code, retryable := errorCode(err)
+
+	doc := &errorDocument{
+		Mode:      p.Mode,
+		Phase:     p.phases.last(),
+		Code:      code,
+		Message:   err.Error(),
+		Endpoint:  p.Endpoint,
+		Retryable: retryable,
+	}
+
+	if p.Mode == RebuildMode || p.Mode == RestoreMode || p.Mode == ManifestMode || p.Mode == CheckMode {
+		doc.Key = p.Path + p.Filename
+	}
+
+	b, _ := json.MarshalIndent(doc, "", "  ")
+
+	if werr := ioutil.WriteFile(p.ErrorFile, append(b, '\n'), 0644); werr != nil {
+		log.Warnf("Failed to write error file %s %s", p.ErrorFile, werr)
+	}
+}
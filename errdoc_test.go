@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/minio/minio-go"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err       error
+		code      string
+		retryable bool
+	}{
+		{fmt.Errorf("%w at /bucket/key", errCacheMiss), "cache_miss", false},
+		{fmt.Errorf("%w after 1m", errTimeout), "timeout", true},
+		{fmt.Errorf("%w. Refusing list after 10 calls", errCallLimit), "call_limit", false},
+		{minio.ErrorResponse{Code: "AccessDenied"}, "AccessDenied", false},
+		{fmt.Errorf("wrapped %w", minio.ErrorResponse{Code: "SlowDown"}), "SlowDown", true},
+		{errors.New("Unknown file format"), "error", false},
+	}
+
+	for _, test := range tests {
+		code, retryable := errorCode(test.err)
+
+		if code != test.code || retryable != test.retryable {
+			t.Errorf("Expected %q to be %s %v, got %s %v", test.err, test.code, test.retryable, code, retryable)
+		}
+	}
+}
+
+func TestIsStorageError(t *testing.T) {
+	tests := []struct {
+		err     error
+		storage bool
+	}{
+		{fmt.Errorf("%w at /bucket/key", errCacheMiss), false},
+		{fmt.Errorf("%w after 1m", errTimeout), true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{minio.ErrorResponse{Code: "InternalError"}, true},
+		{fmt.Errorf("%w. Refusing list after 10 calls", errCallLimit), false},
+		{errors.New("No mounts specified"), false},
+	}
+
+	for _, test := range tests {
+		if got := isStorageError(test.err); got != test.storage {
+			t.Errorf("Expected %q to be a storage error %t, got %t", test.err, test.storage, got)
+		}
+	}
+}
+
+func TestUnreachableRestore(t *testing.T) {
+	unreachable := fmt.Errorf("No endpoint reachable within 5s %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")})
+
+	tests := []struct {
+		failOnMiss  bool
+		failOnError bool
+		miss        bool
+		fails       bool
+	}{
+		{failOnMiss: true, miss: true, fails: true},
+		{failOnError: true},
+		{},
+	}
+
+	for _, test := range tests {
+		p := &Plugin{Mode: RestoreMode, Unreachable: unreachable, FailOnMiss: test.failOnMiss, FailOnError: test.failOnError}
+		err := p.Exec()
+
+		if (err != nil) != test.fails || errors.Is(err, errCacheMiss) != test.miss {
+			t.Errorf("Expected required %t and fail_on_error %t to fail %t as a miss %t, got %v", test.failOnMiss, test.failOnError, test.fails, test.miss, err)
+		}
+	}
+}
+
+func TestWriteErrorDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errdoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &Plugin{
+		Mode:      RestoreMode,
+		Path:      "/bucket/repo/master/",
+		Filename:  "archive.tar",
+		Endpoint:  "s3.example.com",
+		ErrorFile: filepath.Join(dir, "error.json"),
+		phases:    newPhaseTracker(),
+	}
+
+	p.phases.begin("download")()
+	p.writeErrorDocument(fmt.Errorf("%w at /bucket/repo/master/archive.tar", errCacheMiss))
+
+	b, err := ioutil.ReadFile(p.ErrorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc errorDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := errorDocument{
+		Mode:     RestoreMode,
+		Phase:    "download",
+		Code:     "cache_miss",
+		Message:  "Cache not found at /bucket/repo/master/archive.tar",
+		Key:      "/bucket/repo/master/archive.tar",
+		Endpoint: "s3.example.com",
+	}
+
+	if doc != expected {
+		t.Errorf("Expected %+v, got %+v", expected, doc)
+	}
+}
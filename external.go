@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	cachearchive "github.com/drone-plugins/drone-s3-cache/pkg/archive"
+)
+
+// externalPrefix marks the archive entries of external mounts, which are
+// restored at their absolute path rather than in the workspace.
+const externalPrefix = ".cache-external/"
+
+// resolveMounts checks every mount is within the workspace or one of the
+// external paths. Mounts within the workspace are returned relative to it
+// and external mounts as absolute paths.
+func resolveMounts(mounts []string, workspace string, external []string) ([]string, error) {
+	resolved := make([]string, 0, len(mounts))
+
+	for _, mount := range mounts {
+		abs := mount
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(workspace, mount)
+		}
+
+		abs = filepath.Clean(abs)
+		rel, err := filepath.Rel(workspace, abs)
+
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			resolved = append(resolved, rel)
+			continue
+		}
+
+		if !isExternal(abs, external) {
+			return nil, fmt.Errorf("Mount %s is outside the workspace %s. Add it to external_mounts to cache it", mount, workspace)
+		}
+
+		resolved = append(resolved, abs)
+	}
+
+	return resolved, nil
+}
+
+// dangerousMounts are system directories never worth caching, which a typo
+// in the mounts could otherwise archive whole.
+var dangerousMounts = map[string]bool{
+	"/":     true,
+	"/bin":  true,
+	"/boot": true,
+	"/dev":  true,
+	"/etc":  true,
+	"/home": true,
+	"/lib":  true,
+	"/proc": true,
+	"/root": true,
+	"/sbin": true,
+	"/sys":  true,
+	"/usr":  true,
+	"/var":  true,
+}
+
+// checkDangerousMounts refuses resolved mounts which are the workspace root
+// or a system directory.
+func checkDangerousMounts(mounts []string) error {
+	for _, mount := range mounts {
+		if mount == "." {
+			return errors.New("Mount is the workspace root. Mount the directories to cache instead, or set allow_dangerous_mounts")
+		}
+
+		if dangerousMounts[mount] {
+			return fmt.Errorf("Mount %s is a system directory. Mount the directories to cache instead, or set allow_dangerous_mounts", mount)
+		}
+	}
+
+	return nil
+}
+
+// isExternal reports whether the absolute path is within an external path.
+func isExternal(path string, external []string) bool {
+	for _, dir := range external {
+		if withinPath(path, dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// entryName returns the name of the archive entry of path. Paths are
+// relative to the workspace, except those of external mounts.
+func (a *tarArchive) entryName(path string) string {
+	name := strings.TrimPrefix(filepath.ToSlash(path), "/")
+
+	if filepath.IsAbs(path) && isExternal(path, a.external) {
+		return externalPrefix + name
+	}
+
+	return name
+}
+
+// target returns where the entry name is unpacked within dst, or at its
+// absolute path for external mounts. Entries escaping dst, or external
+// entries outside the external paths, are refused.
+func (a *tarArchive) target(dst, name string) (string, error) {
+	if strings.HasPrefix(name, externalPrefix) {
+		path := filepath.Clean("/" + strings.TrimPrefix(name, externalPrefix))
+
+		if !isExternal(path, a.external) {
+			return "", fmt.Errorf("Cache contains %s outside the workspace. Add it to external_mounts to restore it", path)
+		}
+
+		return path, nil
+	}
+
+	clean, err := cachearchive.CleanName(filepath.ToSlash(name))
+
+	if err != nil {
+		return "", fmt.Errorf("Cache contains %s outside the workspace", name)
+	}
+
+	return filepath.Join(dst, filepath.FromSlash(clean)), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveMounts(t *testing.T) {
+	external := []string{"/root/.cache", "/go/pkg/"}
+
+	tests := []struct {
+		mount, resolved string
+		valid           bool
+	}{
+		{"node_modules", "node_modules", true},
+		{"/drone/src/vendor", "vendor", true},
+		{"/root/.cache/pip", "/root/.cache/pip", true},
+		{"/go/pkg", "/go/pkg", true},
+		{"../other", "", false},
+		{"/root/.cache-other", "", false},
+		{"/etc", "", false},
+	}
+
+	for _, test := range tests {
+		resolved, err := resolveMounts([]string{test.mount}, "/drone/src", external)
+
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Expected %s to be refused, got %v", test.mount, resolved)
+			}
+			continue
+		}
+
+		if err != nil || resolved[0] != test.resolved {
+			t.Errorf("Expected %s to resolve to %s, got %v %v", test.mount, test.resolved, resolved, err)
+		}
+	}
+}
+
+func TestCheckDangerousMounts(t *testing.T) {
+	external := []string{"/"}
+
+	tests := []struct {
+		mount     string
+		dangerous bool
+	}{
+		{"node_modules", false},
+		{".", true},
+		{"/drone/src", true},
+		{"/", true},
+		{"/usr", true},
+		{"/usr/local/lib", false},
+	}
+
+	for _, test := range tests {
+		resolved, err := resolveMounts([]string{test.mount}, "/drone/src", external)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkDangerousMounts(resolved); (err != nil) != test.dangerous {
+			t.Errorf("Expected %s to be dangerous %t, got %v", test.mount, test.dangerous, err)
+		}
+	}
+}
+
+func TestTarExternalMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+
+	workspace := filepath.Join(dir, "workspace")
+	external := filepath.Join(dir, "external")
+
+	os.MkdirAll(workspace, 0755)
+	os.MkdirAll(external, 0755)
+	os.Chdir(workspace)
+
+	ioutil.WriteFile(filepath.Join(external, "file"), []byte("external"), 0644)
+	ioutil.WriteFile("file", []byte("workspace"), 0644)
+
+	a := &tarArchive{external: []string{external}}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{external, "file"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	archived := buf.Bytes()
+
+	os.RemoveAll(external)
+	os.Remove("file")
+
+	if err := a.Unpack("", bytes.NewReader(archived)); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(filepath.Join(external, "file")); string(b) != "external" {
+		t.Errorf("Expected the external file at its absolute path, got %q", b)
+	}
+	if b, _ := ioutil.ReadFile("file"); string(b) != "workspace" {
+		t.Errorf("Expected the workspace file, got %q", b)
+	}
+
+	// Without the path allowed the cache cannot be restored
+	if err := (&tarArchive{}).Unpack("", bytes.NewReader(archived)); err == nil {
+		t.Error("Expected the external path to be refused")
+	}
+}
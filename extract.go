@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// extractBufferSize is the largest file handed to the extraction
+	// workers, which hold its contents in memory. Larger files are written
+	// by the reader as they are read.
+	extractBufferSize = 256 * 1024
+
+	// extractQueueSize is the number of entries queued for each worker
+	// before the reader blocks.
+	extractQueueSize = 8
+)
+
+// extractJob is a file or link read from the archive for a worker to write.
+type extractJob struct {
+	target   string
+	header   *tar.Header
+	contents []byte
+}
+
+// extractPool writes the files and links of an archive on several workers
+// while the reader creates directories in archive order. Entries for the
+// same target always go to the same worker, so they are written in
+// archive order too. A nil pool writes everything on the reader.
+type extractPool struct {
+	a      *tarArchive
+	queues []chan extractJob
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// newExtractPool starts the workers of a, or returns nil when a extracts
+// on a single thread.
+func (a *tarArchive) newExtractPool() *extractPool {
+	if a.workers <= 1 {
+		return nil
+	}
+
+	p := &extractPool{a: a, queues: make([]chan extractJob, a.workers)}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan extractJob, extractQueueSize)
+		p.wg.Add(1)
+
+		go p.work(p.queues[i])
+	}
+
+	return p
+}
+
+func (p *extractPool) work(queue chan extractJob) {
+	defer p.wg.Done()
+
+	for job := range queue {
+		// Keep draining after a failure so the reader never blocks
+		if p.failed() != nil {
+			continue
+		}
+
+		if err := p.a.extractEntry(job.target, job.header, bytes.NewReader(job.contents)); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *extractPool) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.err
+}
+
+// extract writes the file or link of header to target, handing it to a
+// worker of the pool when its contents fit in extractBufferSize. It returns
+// the first error of the workers so the reader stops.
+func (a *tarArchive) extract(p *extractPool, target string, header *tar.Header, r io.Reader) error {
+	limit := a.bufferSize
+
+	if limit == 0 {
+		limit = extractBufferSize
+	}
+
+	if p == nil || header.Size > limit {
+		return a.extractEntry(target, header, r)
+	}
+
+	if err := p.failed(); err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(target))
+
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- extractJob{target: target, header: header, contents: contents}
+
+	return nil
+}
+
+// wait stops the workers once they have written every entry queued,
+// returning the first error of the workers.
+func (p *extractPool) wait() error {
+	if p == nil {
+		return nil
+	}
+
+	for _, queue := range p.queues {
+		close(queue)
+	}
+
+	p.wg.Wait()
+
+	return p.err
+}
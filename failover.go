@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// failoverStorage sends requests to the first of several endpoints serving
+// the same buckets, failing over to the next on connection errors. Requests
+// which already transferred data are not retried as the streams cannot be
+// rewound.
+type failoverStorage struct {
+	mu       sync.Mutex
+	current  int
+	names    []string
+	backends []metadataStorage
+}
+
+func newFailoverStorage(names []string, backends []storage.Storage) (*failoverStorage, error) {
+	s := &failoverStorage{names: names}
+
+	for i, b := range backends {
+		ms, ok := b.(metadataStorage)
+
+		if !ok {
+			return nil, fmt.Errorf("Storage at %s does not support failover", names[i])
+		}
+
+		s.backends = append(s.backends, ms)
+	}
+
+	return s, nil
+}
+
+// do runs fn against each endpoint in turn, starting with the current one,
+// until it succeeds or fails other than by a connection error.
+func (s *failoverStorage) do(fn func(b metadataStorage) (transferred bool, err error)) error {
+	s.mu.Lock()
+	start := s.current
+	s.mu.Unlock()
+
+	var err error
+
+	for i := 0; i < len(s.backends); i++ {
+		n := (start + i) % len(s.backends)
+
+		var transferred bool
+		if transferred, err = fn(s.backends[n]); err == nil || transferred || !isConnectionError(err) {
+			return err
+		}
+
+		next := (n + 1) % len(s.backends)
+		log.Warnf("Endpoint %s is unreachable %s. Failing over to %s", s.names[n], err, s.names[next])
+
+		s.mu.Lock()
+		s.current = next
+		s.mu.Unlock()
+	}
+
+	return err
+}
+
+func (s *failoverStorage) Get(p string, dst io.Writer) error {
+	return s.do(func(b metadataStorage) (bool, error) {
+		cw := &countingWriter{w: dst}
+		err := b.Get(p, cw)
+		return cw.n > 0, err
+	})
+}
+
+func (s *failoverStorage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+func (s *failoverStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	return s.do(func(b metadataStorage) (bool, error) {
+		cr := &countingReader{r: src}
+		err := b.PutWithMetadata(p, cr, metadata)
+		return cr.n > 0, err
+	})
+}
+
+func (s *failoverStorage) List(p string) (entries []storage.FileEntry, err error) {
+	err = s.do(func(b metadataStorage) (bool, error) {
+		entries, err = b.List(p)
+		return false, err
+	})
+
+	return entries, err
+}
+
+func (s *failoverStorage) Delete(p string) error {
+	return s.do(func(b metadataStorage) (bool, error) {
+		return false, b.Delete(p)
+	})
+}
+
+func (s *failoverStorage) Stat(p string) (entry storage.FileEntry, metadata map[string]string, err error) {
+	err = s.do(func(b metadataStorage) (bool, error) {
+		entry, metadata, err = b.Stat(p)
+		return false, err
+	})
+
+	return entry, metadata, err
+}
+
+func (s *failoverStorage) ETag(p string) (etag string, err error) {
+	err = s.do(func(b metadataStorage) (bool, error) {
+		ts, ok := b.(taggedStorage)
+
+		if !ok {
+			return false, errors.New("Storage does not support entity tags")
+		}
+
+		etag, err = ts.ETag(p)
+		return false, err
+	})
+
+	return etag, err
+}
+
+func (s *failoverStorage) Copy(src, dst string) error {
+	return s.do(func(b metadataStorage) (bool, error) {
+		cs, ok := b.(copyingStorage)
+
+		if !ok {
+			return false, errNoCopy
+		}
+
+		return false, cs.Copy(src, dst)
+	})
+}
+
+func (s *failoverStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (written bool, err error) {
+	err = s.do(func(b metadataStorage) (bool, error) {
+		cs, ok := b.(conditionalStorage)
+
+		if !ok {
+			return false, errors.New("Storage does not support conditional writes")
+		}
+
+		cr := &countingReader{r: src}
+		written, err = cs.PutIfMatch(p, cr, etag, metadata)
+		return cr.n > 0, err
+	})
+
+	return written, err
+}
+
+// isConnectionError reports whether err is a failure to reach the endpoint
+// rather than an error response.
+func isConnectionError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Size() int64 {
+	return readerSize(c.r)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// unreachableStorage fails every request with a connection error.
+type unreachableStorage struct {
+	*memoryStorage
+
+	calls int
+}
+
+func (s *unreachableStorage) err() error {
+	s.calls++
+	return &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+}
+
+func (s *unreachableStorage) Get(p string, dst io.Writer) error {
+	return s.err()
+}
+
+func (s *unreachableStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	return s.err()
+}
+
+func (s *unreachableStorage) Stat(p string) (storage.FileEntry, map[string]string, error) {
+	return storage.FileEntry{}, nil, s.err()
+}
+
+func TestFailoverToSecondary(t *testing.T) {
+	primary := &unreachableStorage{memoryStorage: newMemoryStorage()}
+	secondary := newMemoryStorage()
+
+	s, err := newFailoverStorage([]string{"primary", "secondary"}, []storage.Storage{primary, secondary})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PutWithMetadata("/bucket/archive.tar", strings.NewReader("cached"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Get("/bucket/archive.tar", &buf); err != nil || buf.String() != "cached" {
+		t.Fatalf("Expected the secondary to serve the cache, got %q %v", buf.String(), err)
+	}
+
+	// Requests stay on the secondary once failed over
+	if primary.calls != 1 {
+		t.Errorf("Expected the primary to be tried once, got %d calls", primary.calls)
+	}
+
+	// Error responses are returned rather than failed over
+	if _, _, err := s.Stat("/bucket/missing.tar"); !isNotFound(err) {
+		t.Errorf("Expected the secondary to report the missing object, got %v", err)
+	}
+
+	if primary.calls != 1 {
+		t.Errorf("Expected an error response not to fail over, got %d calls", primary.calls)
+	}
+}
+
+func TestFailoverAllUnreachable(t *testing.T) {
+	primary := &unreachableStorage{memoryStorage: newMemoryStorage()}
+	secondary := &unreachableStorage{memoryStorage: newMemoryStorage()}
+
+	s, err := newFailoverStorage([]string{"primary", "secondary"}, []storage.Storage{primary, secondary})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Get("/bucket/archive.tar", &buf); !isConnectionError(err) {
+		t.Errorf("Expected the connection error of the last endpoint, got %v", err)
+	}
+
+	if primary.calls != 1 || secondary.calls != 1 {
+		t.Errorf("Expected each endpoint to be tried once, got %d and %d calls", primary.calls, secondary.calls)
+	}
+}
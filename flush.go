@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+	"github.com/drone/drone-cache-lib/cache"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// flushProgressInterval is the number of objects scanned between
+	// progress reports, and checkpoints when enabled.
+	flushProgressInterval = 1000
+
+	// flushCheckpointName is the object under the flushed path recording
+	// the progress of an unfinished flush.
+	flushCheckpointName = ".flush-checkpoint"
+)
+
+// flushStats counts the objects seen by a flush. On a dry run Reclaimed is
+// the size of the objects which would have been deleted. Protected objects
+// are under a legal hold or retention and could not be deleted.
+type flushStats struct {
+	Scanned   int
+	Matched   int
+	Deleted   int
+	Protected int
+	Reclaimed int64
+}
+
+func (f *flushStats) log(msg string) {
+	log.Infof("%s: scanned %d, matched %d, deleted %d, protected %d, reclaimed %s",
+		msg, f.Scanned, f.Matched, f.Deleted, f.Protected, humanize.Bytes(uint64(f.Reclaimed)))
+}
+
+// flushCheckpoint is the progress of a flush. Objects are handled in key
+// order so a resumed flush skips every key up to After, which acts as the
+// continuation token.
+type flushCheckpoint struct {
+	After   string     `json:"after"`
+	Stats   flushStats `json:"stats"`
+	Updated time.Time  `json:"updated"`
+}
+
+// flushCheckpointPath returns the checkpoint object of the flush of src.
+func flushCheckpointPath(src string) string {
+	return strings.TrimSuffix(src, "/") + "/" + flushCheckpointName
+}
+
+// flush deletes the objects under src for which dirty returns true, logging
+// progress as it goes. Objects under a legal hold or retention are skipped
+// and listed in the summary. A dry run logs the objects without deleting
+// them.
+// With checkpoint the progress is saved as it goes, so an interrupted
+// flush resumes where it left off on the next run.
+func flush(s storage.Storage, src string, dirty cache.DirtyFunc, dryRun, checkpoint bool) error {
+	log.Infof("Cleaning files from %s", src)
+
+	files, err := s.List(src)
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	stats := &flushStats{}
+	summary := "Flush summary"
+
+	if dryRun {
+		summary = "Flush dry run summary"
+		checkpoint = false
+	}
+
+	var after string
+	checkpointPath := flushCheckpointPath(src)
+
+	if checkpoint {
+		if cp, err := readFlushCheckpoint(s, checkpointPath); err == nil {
+			log.Infof("Resuming flush from %s after %s", cp.Updated.Format(time.RFC3339), cp.After)
+			after = cp.After
+			*stats = cp.Stats
+		}
+	}
+
+	save := func(last string) {
+		if !checkpoint || last == "" {
+			return
+		}
+
+		if err := writeFlushCheckpoint(s, checkpointPath, last, stats); err != nil {
+			log.Warnf("Failed to write flush checkpoint %s %s", checkpointPath, err)
+		}
+	}
+
+	// Archives pointed to are resolved before they are deleted, with their
+	// referrers removed along with them
+	referred := make(map[string]bool)
+
+	for _, file := range files {
+		if i := strings.Index(file.Path, pointerRefsSuffix); i >= 0 {
+			referred[strings.TrimPrefix(file.Path[:i], "/")] = true
+		}
+	}
+
+	ms, resolves := s.(metadataStorage)
+
+	var last string
+	var protected []string
+
+	for _, file := range files {
+		name := strings.TrimPrefix(file.Path, "/")
+
+		if name == strings.TrimPrefix(checkpointPath, "/") || name <= after || isPointerRef(name) {
+			continue
+		}
+
+		stats.Scanned++
+
+		if dirty(file) {
+			stats.Matched++
+
+			if !dryRun && resolves && referred[name] {
+				if err = resolvePointers(ms, "/"+name); err != nil {
+					stats.log("Flush failed")
+					save(last)
+					return err
+				}
+			}
+
+			if dryRun {
+				log.Infof("Would delete %s", file.Path)
+				stats.Reclaimed += file.Size
+			} else if err = s.Delete(file.Path); s3.IsObjectLocked(err) {
+				log.Warnf("Skipping %s protected by object lock %s", file.Path, err)
+				stats.Protected++
+				protected = append(protected, file.Path)
+			} else if err != nil {
+				stats.log("Flush failed")
+				save(last)
+				return err
+			} else {
+				stats.Deleted++
+				stats.Reclaimed += file.Size
+			}
+		}
+
+		last = name
+
+		if stats.Scanned%flushProgressInterval == 0 {
+			stats.log("Flush progress")
+			save(last)
+		}
+	}
+
+	stats.log(summary)
+
+	if len(protected) > 0 {
+		log.Warnf("Kept %d objects under a legal hold or retention: %s", len(protected), strings.Join(protected, ", "))
+	}
+
+	if checkpoint {
+		if err = s.Delete(checkpointPath); err != nil {
+			log.Debugf("Failed to remove flush checkpoint %s %s", checkpointPath, err)
+		}
+	}
+
+	return nil
+}
+
+// ownedDirty narrows dirty to objects bearing the producer marker, unless
+// FlushForce is set. The marker is only checked for objects dirty matches,
+// as each check costs a request.
+func (p *Plugin) ownedDirty(dirty cache.DirtyFunc) (cache.DirtyFunc, error) {
+	if p.FlushForce {
+		return dirty, nil
+	}
+
+	ms, ok := p.Storage.(metadataStorage)
+
+	if !ok {
+		return nil, errors.New("Storage does not support metadata so objects uploaded by the plugin cannot be told apart. Set flush_force to flush every expired object")
+	}
+
+	return func(file storage.FileEntry) bool {
+		if !dirty(file) {
+			return false
+		}
+
+		_, metadata, err := ms.Stat(file.Path)
+
+		if err != nil {
+			log.Warnf("Failed to check %s was uploaded by the plugin. Keeping it %s", file.Path, err)
+			return false
+		}
+
+		if metadata[producerMetadataKey] != producerName {
+			log.Debugf("Keeping %s not uploaded by the plugin", file.Path)
+			return false
+		}
+
+		return true
+	}, nil
+}
+
+func readFlushCheckpoint(s storage.Storage, path string) (*flushCheckpoint, error) {
+	var buf bytes.Buffer
+
+	if err := s.Get(path, &buf); err != nil {
+		return nil, err
+	}
+
+	cp := &flushCheckpoint{}
+	if err := json.Unmarshal(buf.Bytes(), cp); err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+func writeFlushCheckpoint(s storage.Storage, path, after string, stats *flushStats) error {
+	b, _ := json.Marshal(&flushCheckpoint{
+		After:   after,
+		Stats:   *stats,
+		Updated: time.Now(),
+	})
+
+	return s.Put(path, bytes.NewReader(b))
+}
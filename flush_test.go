@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/minio/minio-go"
+)
+
+// failingDeleteStorage fails deleting the object at fail, with err when set.
+type failingDeleteStorage struct {
+	*memoryStorage
+
+	fail string
+	err  error
+}
+
+func (s *failingDeleteStorage) Delete(p string) error {
+	if p == s.fail && s.err != nil {
+		return s.err
+	} else if p == s.fail {
+		return errors.New("delete failed")
+	}
+
+	return s.memoryStorage.Delete(p)
+}
+
+func TestFlushCheckpoint(t *testing.T) {
+	s := &failingDeleteStorage{memoryStorage: newMemoryStorage()}
+	total := flushProgressInterval + 500
+
+	for i := 0; i < total; i++ {
+		s.Put(fmt.Sprintf("bucket/cache/%05d", i), strings.NewReader("x"))
+	}
+
+	all := func(storage.FileEntry) bool { return true }
+
+	// Fail past the first checkpoint, which is kept for the next run
+	s.fail = fmt.Sprintf("bucket/cache/%05d", flushProgressInterval+100)
+
+	if err := flush(s, "bucket/cache", all, false, true); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	cp, err := readFlushCheckpoint(s, flushCheckpointPath("bucket/cache"))
+
+	if err != nil {
+		t.Fatalf("Expected a checkpoint, got %s", err)
+	}
+
+	if cp.After != fmt.Sprintf("bucket/cache/%05d", flushProgressInterval+99) {
+		t.Errorf("Expected the checkpoint after the last deleted object, got %s", cp.After)
+	}
+
+	if cp.Stats.Deleted != flushProgressInterval+100 {
+		t.Errorf("Expected %d deleted in the checkpoint, got %d", flushProgressInterval+100, cp.Stats.Deleted)
+	}
+
+	// Resuming deletes the rest and removes the checkpoint
+	s.fail = ""
+
+	if err := flush(s, "bucket/cache", all, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining, _ := s.List("bucket/cache"); len(remaining) != 0 {
+		t.Errorf("Expected every object flushed, %d remain", len(remaining))
+	}
+}
+
+func TestFlushWithoutCheckpoint(t *testing.T) {
+	s := &failingDeleteStorage{memoryStorage: newMemoryStorage(), fail: "bucket/cache/b"}
+
+	for _, name := range []string{"a", "b", "c"} {
+		s.Put("bucket/cache/"+name, strings.NewReader("x"))
+	}
+
+	all := func(storage.FileEntry) bool { return true }
+
+	if err := flush(s, "bucket/cache", all, false, false); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	if _, err := readFlushCheckpoint(s, flushCheckpointPath("bucket/cache")); err == nil {
+		t.Error("Expected no checkpoint")
+	}
+}
+
+func TestFlushSkipsProtected(t *testing.T) {
+	s := &failingDeleteStorage{
+		memoryStorage: newMemoryStorage(),
+		fail:          "bucket/cache/b",
+		err:           minio.ErrorResponse{Code: "AccessDenied", Message: "Access Denied because object protected by object lock."},
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		s.Put("bucket/cache/"+name, strings.NewReader("x"))
+	}
+
+	all := func(storage.FileEntry) bool { return true }
+
+	if err := flush(s, "bucket/cache", all, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining, _ := s.List("bucket/cache")
+
+	if len(remaining) != 1 || remaining[0].Path != "bucket/cache/b" {
+		t.Errorf("Expected only the protected object to remain, got %v", remaining)
+	}
+}
+
+// labelledStorage keeps the metadata of objects in memory.
+type labelledStorage struct {
+	*memoryStorage
+
+	metadata map[string]map[string]string
+}
+
+func (s *labelledStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	s.metadata[p] = metadata
+	return s.Put(p, src)
+}
+
+func (s *labelledStorage) Stat(p string) (storage.FileEntry, map[string]string, error) {
+	entry, _, err := s.memoryStorage.Stat(p)
+	return entry, s.metadata[p], err
+}
+
+// Copy copies an object with its metadata, like copies on the server.
+func (s *labelledStorage) Copy(src, dst string) error {
+	var buf bytes.Buffer
+
+	if err := s.Get(src, &buf); err != nil {
+		return err
+	}
+
+	return s.PutWithMetadata(dst, &buf, s.metadata[src])
+}
+
+func TestFlushOwned(t *testing.T) {
+	all := func(storage.FileEntry) bool { return true }
+
+	for _, force := range []bool{false, true} {
+		s := &labelledStorage{memoryStorage: newMemoryStorage(), metadata: make(map[string]map[string]string)}
+		p := &Plugin{FlushForce: force}
+		p.Storage = &stampedStorage{metadataStorage: s, metadata: p.producerMetadata()}
+
+		p.Storage.Put("bucket/cache/owned", strings.NewReader("x"))
+		s.Put("bucket/cache/foreign", strings.NewReader("x"))
+
+		dirty, err := p.ownedDirty(all)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := flush(p.Storage, "bucket/cache", dirty, false, false); err != nil {
+			t.Fatal(err)
+		}
+
+		remaining, _ := s.List("bucket/cache")
+
+		if force && len(remaining) != 0 {
+			t.Errorf("Expected every object flushed when forced, %d remain", len(remaining))
+		}
+
+		if !force && (len(remaining) != 1 || remaining[0].Path != "bucket/cache/foreign") {
+			t.Errorf("Expected only the foreign object kept, got %v", remaining)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// restoreHintSuffix is appended to the key of an archive for the hint
+	// recorded by its last restore.
+	restoreHintSuffix = ".restore-hint.json"
+
+	// restoreHintFilesPerWorker is the number of files worth an extraction
+	// worker, so small caches do not start a worker per core.
+	restoreHintFilesPerWorker = 256
+
+	// minHintBufferSize and maxHintBufferSize bound the largest file the
+	// extraction workers buffer when sized from a hint.
+	minHintBufferSize = 64 * 1024
+	maxHintBufferSize = 4 * 1024 * 1024
+)
+
+// restoreHint describes the last restore of an archive, to tune the next
+// one before anything is downloaded.
+type restoreHint struct {
+	Size     int64         `json:"size"`
+	Files    int           `json:"files"`
+	Duration time.Duration `json:"duration"`
+	Updated  time.Time     `json:"updated"`
+}
+
+// applyRestoreHint tunes the extraction of t from the hint recorded for
+// key, when there is one, and logs the time the restore should take.
+func applyRestoreHint(s storage.Storage, key string, t *tarArchive) {
+	hint, err := readRestoreHint(s, key)
+
+	if err != nil {
+		log.Debugf("No restore hint for %s %s", key, err)
+		return
+	}
+
+	log.Infof("Restoring %s is expected to take %s, like the previous restore of %s in %d files",
+		key, hint.Duration.Round(time.Second), humanize.Bytes(uint64(hint.Size)), hint.Files)
+
+	if t == nil || hint.Files == 0 {
+		return
+	}
+
+	if workers := (hint.Files + restoreHintFilesPerWorker - 1) / restoreHintFilesPerWorker; workers < t.workers {
+		t.workers = workers
+	}
+
+	// Buffering files up to twice the average size hands most of them to
+	// the workers
+	t.bufferSize = 2 * hint.Size / int64(hint.Files)
+
+	if t.bufferSize < minHintBufferSize {
+		t.bufferSize = minHintBufferSize
+	} else if t.bufferSize > maxHintBufferSize {
+		t.bufferSize = maxHintBufferSize
+	}
+
+	log.Debugf("Extracting %s on %d workers buffering files up to %s", key, t.workers, humanize.Bytes(uint64(t.bufferSize)))
+}
+
+// recordRestoreHint writes the hint of the restore of key, which took
+// elapsed, from the bytes downloaded and files extracted.
+func (p *Plugin) recordRestoreHint(key string, elapsed time.Duration) {
+	size, _ := p.phases.counts("download")
+	_, files := p.phases.counts("extract")
+
+	b, _ := json.Marshal(&restoreHint{
+		Size:     size,
+		Files:    files,
+		Duration: elapsed,
+		Updated:  time.Now().UTC(),
+	})
+
+	if err := p.Storage.Put(key+restoreHintSuffix, bytes.NewReader(b)); err != nil {
+		log.Warnf("Failed to write restore hint of %s %s", key, err)
+	}
+}
+
+func readRestoreHint(s storage.Storage, key string) (*restoreHint, error) {
+	var buf bytes.Buffer
+
+	if err := s.Get(key+restoreHintSuffix, &buf); err != nil {
+		return nil, err
+	}
+
+	hint := &restoreHint{}
+	if err := json.Unmarshal(buf.Bytes(), hint); err != nil {
+		return nil, err
+	}
+
+	return hint, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestApplyRestoreHint(t *testing.T) {
+	tests := []struct {
+		hint       restoreHint
+		workers    int
+		bufferSize int64
+	}{
+		{restoreHint{Size: 300 * 1024, Files: 300}, 2, minHintBufferSize},
+		{restoreHint{Size: 10000 * 1024 * 1024, Files: 10000}, 8, 2 * 1024 * 1024},
+		{restoreHint{Size: 100 * 1024 * 1024, Files: 10}, 1, maxHintBufferSize},
+	}
+
+	for _, test := range tests {
+		s := newMemoryStorage()
+		test.hint.Duration = time.Minute
+
+		b, _ := json.Marshal(&test.hint)
+		s.Put("/bucket/cache/archive.tar"+restoreHintSuffix, bytes.NewReader(b))
+
+		a := &tarArchive{workers: 8}
+		applyRestoreHint(s, "/bucket/cache/archive.tar", a)
+
+		if a.workers != test.workers || a.bufferSize != test.bufferSize {
+			t.Errorf("Expected %d workers buffering %d for %+v, got %d buffering %d", test.workers, test.bufferSize, test.hint, a.workers, a.bufferSize)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+const (
+	// hitStatsName is the object under the cache path counting the restores
+	// of the caches in it.
+	hitStatsName = ".hit-stats.json"
+
+	// hitStatsAttempts is the number of times the counters are updated
+	// when concurrent restores change them in between.
+	hitStatsAttempts = 5
+)
+
+// hitStats counts the restores of the caches under a path. Hits restored
+// the cache of the build, fallback hits a cache along the fallback chain.
+type hitStats struct {
+	Hits         int       `json:"hits"`
+	FallbackHits int       `json:"fallback_hits"`
+	Misses       int       `json:"misses"`
+	Updated      time.Time `json:"updated"`
+}
+
+func (h *hitStats) add(o *hitStats) {
+	h.Hits += o.Hits
+	h.FallbackHits += o.FallbackHits
+	h.Misses += o.Misses
+}
+
+func (h *hitStats) restores() int {
+	return h.Hits + h.FallbackHits + h.Misses
+}
+
+// ratio is the share of restores which restored any cache.
+func (h *hitStats) ratio() float64 {
+	if h.restores() == 0 {
+		return 0
+	}
+
+	return float64(h.Hits+h.FallbackHits) / float64(h.restores())
+}
+
+// recordHit counts the restore of key, restored when a cache was restored,
+// in the stats under the cache path. The stats are updated with
+// conditional writes when the storage supports them, so concurrent builds
+// do not lose counts.
+func (p *Plugin) recordHit(key, restored string) {
+	statsPath := p.Path + hitStatsName
+	cs, conditional := p.Storage.(conditionalStorage)
+
+	for attempt := 1; attempt <= hitStatsAttempts; attempt++ {
+		// The tag is read first so a change before the stats are read fails
+		// the write rather than being overwritten. It is empty when the stats
+		// do not exist yet
+		var etag string
+		if conditional {
+			etag, _ = cs.ETag(statsPath)
+		}
+
+		stats, err := readHitStats(p.Storage, statsPath)
+
+		if err != nil {
+			stats = &hitStats{}
+		}
+
+		switch {
+		case restored == "":
+			stats.Misses++
+		case restored == key:
+			stats.Hits++
+		default:
+			stats.FallbackHits++
+		}
+
+		stats.Updated = time.Now().UTC()
+		b, _ := json.Marshal(stats)
+
+		if !conditional {
+			if err = p.Storage.Put(statsPath, bytes.NewReader(b)); err != nil {
+				log.Warnf("Failed to write %s %s", statsPath, err)
+			}
+
+			return
+		}
+
+		written, err := cs.PutIfMatch(statsPath, bytes.NewReader(b), etag, nil)
+
+		if err != nil {
+			log.Warnf("Failed to write %s %s", statsPath, err)
+			return
+		}
+
+		if written {
+			log.Debugf("Hit ratio at %s is %.1f%% over %d restores", p.Path, 100*stats.ratio(), stats.restores())
+			return
+		}
+
+		log.Debugf("%s changed while updating it. Retrying", statsPath)
+	}
+
+	log.Warnf("Failed to update %s after %d attempts", statsPath, hitStatsAttempts)
+}
+
+func readHitStats(s storage.Storage, path string) (*hitStats, error) {
+	var buf bytes.Buffer
+
+	if err := s.Get(path, &buf); err != nil {
+		return nil, err
+	}
+
+	stats := &hitStats{}
+	if err := json.Unmarshal(buf.Bytes(), stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// versionedStorage is a memoryStorage with conditional writes, whose
+// entity tags are the number of writes. conflicts writes are made to fail
+// as if another build wrote in between.
+type versionedStorage struct {
+	*memoryStorage
+
+	versions  map[string]int
+	conflicts int
+}
+
+func (s *versionedStorage) ETag(p string) (string, error) {
+	if _, ok := s.objects[p]; !ok {
+		return "", fmt.Errorf("%s does not exist", p)
+	}
+
+	return fmt.Sprint(s.versions[p]), nil
+}
+
+func (s *versionedStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	current, _ := s.ETag(p)
+
+	if s.conflicts > 0 || current != etag {
+		s.conflicts--
+		return false, nil
+	}
+
+	s.versions[p]++
+
+	return true, s.Put(p, src)
+}
+
+func TestRecordHit(t *testing.T) {
+	s := &versionedStorage{memoryStorage: newMemoryStorage(), versions: make(map[string]int), conflicts: 2}
+	p := &Plugin{Path: "/bucket/owner/repo/master/", Storage: s}
+	key := p.Path + "archive.tar"
+
+	p.recordHit(key, key)
+	p.recordHit(key, key)
+	p.recordHit(key, "/bucket/owner/repo/main/archive.tar")
+	p.recordHit(key, "")
+
+	stats, err := readHitStats(s, p.Path+hitStatsName)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Hits != 2 || stats.FallbackHits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected 2 hits, 1 fallback hit and 1 miss, got %+v", stats)
+	}
+
+	if stats.ratio() != 0.75 {
+		t.Errorf("Expected a hit ratio of 0.75, got %f", stats.ratio())
+	}
+
+	if s.versions[p.Path+hitStatsName] != 4 {
+		t.Errorf("Expected 4 writes, got %d", s.versions[p.Path+hitStatsName])
+	}
+}
+
+func TestRecordHitGivesUp(t *testing.T) {
+	s := &versionedStorage{memoryStorage: newMemoryStorage(), versions: make(map[string]int), conflicts: hitStatsAttempts}
+	p := &Plugin{Path: "/bucket/owner/repo/master/", Storage: s}
+
+	p.recordHit(p.Path+"archive.tar", p.Path+"archive.tar")
+
+	if _, err := readHitStats(s, p.Path+hitStatsName); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected no stats written while every write conflicts, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// errCacheMiss is returned when no cache exists, for the exit status of
+// the subcommands.
+var errCacheMiss = errors.New("Cache not found")
+
+// list writes the caches under the flush path, the repo by default, with
+// their size and age.
+func (p *Plugin) list() error {
+	files, err := p.Storage.List(p.FlushPath)
+
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	found := false
+
+	for _, file := range files {
+		if !isArchiveKey(file.Path, p.Filename) {
+			continue
+		}
+
+		found = true
+		fmt.Fprintf(w, "/%s\t%s\t%s\n", file.Path, humanize.Bytes(uint64(file.Size)), file.LastModified.Format(time.RFC3339))
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("%w under %s", errCacheMiss, p.FlushPath)
+	}
+
+	return nil
+}
+
+// check fails with errCacheMiss unless a cache exists at path. Failing to
+// reach the storage is an error rather than a miss.
+func (p *Plugin) check(path string) error {
+	if ms, ok := p.Storage.(metadataStorage); ok {
+		if _, _, err := ms.Stat(path); isConnectionError(err) {
+			return err
+		}
+	}
+
+	if !exists(p.Storage, path) {
+		return fmt.Errorf("%w at %s", errCacheMiss, path)
+	}
+
+	fmt.Println(path)
+	return nil
+}
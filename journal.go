@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+)
+
+const (
+	// journalOverflow is written to the journal when changes may have been
+	// missed, which forces the next rebuild to archive the mounts in full.
+	journalOverflow = "!overflow"
+
+	// journalDeltaSuffix is appended to the key of a cache for the archive
+	// of the files changed since it was rebuilt in full, which is restored
+	// over it.
+	journalDeltaSuffix = ".delta"
+)
+
+// journal appends the paths of changed files to a journal file shared by
+// the watcher and restore.
+type journal struct {
+	mu   sync.Mutex
+	file *os.File
+	seen map[string]bool
+}
+
+func openJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{
+		file: file,
+		seen: make(map[string]bool),
+	}, nil
+}
+
+// Record adds path to the journal unless it is already there.
+func (j *journal) Record(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.seen[path] {
+		return
+	}
+
+	j.seen[path] = true
+	fmt.Fprintln(j.file, path)
+}
+
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+// readJournal returns the changed paths recorded in the journal which still
+// exist. When the journal is incomplete ok is false and the mounts need to
+// be archived in full.
+func readJournal(path string) (paths []string, ok bool, err error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == journalOverflow {
+			return nil, false, nil
+		}
+
+		if line == "" || seen[line] {
+			continue
+		}
+
+		seen[line] = true
+
+		// Only regular files and symlinks are archived from the journal so
+		// changed directories are not archived recursively
+		if fi, err := os.Lstat(line); err == nil && !fi.IsDir() {
+			paths = append(paths, line)
+		}
+	}
+
+	return paths, true, scanner.Err()
+}
+
+// watchJournal records changes to the mounts in the journal file until the
+// process is signalled to stop.
+func (p *Plugin) watchJournal() error {
+	j, err := openJournal(p.JournalFile)
+
+	if err != nil {
+		return err
+	}
+
+	defer j.Close()
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s. Stopping change journal", sig)
+		close(stop)
+	}()
+
+	return watchJournal(p.Mount, j, stop)
+}
+
+// journaledMount returns the paths to archive on rebuild of the cache at
+// path. With a complete journal of a build which restored that cache only
+// the changed files are archived, as the delta of the cache, otherwise the
+// mounts are.
+func (p *Plugin) journaledMount(path string) (mount []string, delta, skip bool) {
+	if p.JournalFile == "" {
+		return p.Mount, false, false
+	}
+
+	paths, ok, err := readJournal(p.JournalFile)
+
+	if err != nil {
+		log.Warnf("Could not read journal %s %s. Archiving all mounts", p.JournalFile, err)
+		return p.Mount, false, false
+	}
+
+	if !ok {
+		log.Warn("Journal is incomplete. Archiving all mounts")
+		return p.Mount, false, false
+	}
+
+	// A delta only applies to the cache it was journaled over
+	if record, err := readRestoreRecord(); err != nil || record.Key != path {
+		log.Infof("The cache at %s was not restored. Archiving all mounts", path)
+		return p.Mount, false, false
+	}
+
+	log.Infof("Archiving %d files recorded in the journal", len(paths))
+
+	return paths, true, len(paths) == 0
+}
+
+// restoreJournalDelta restores the delta of the cache at key over it,
+// journaling its files so the next delta keeps them. The files of the
+// cache itself are not journaled, as they are in the cache already.
+func (p *Plugin) restoreJournalDelta(key, staging string, at, ua archive.Archive) error {
+	delta := key + journalDeltaSuffix
+
+	if !exists(p.Storage, delta) {
+		return nil
+	}
+
+	j, err := openJournal(p.JournalFile)
+
+	if err != nil {
+		return err
+	}
+
+	defer j.Close()
+
+	if staging != "" {
+		setUnpackHook(at, func(name string) {
+			j.Record(unstaged(staging, name))
+		})
+	} else {
+		setUnpackHook(at, j.Record)
+	}
+
+	defer setUnpackHook(at, nil)
+
+	log.Infof("Restoring changes at %s", delta)
+
+	_, err = restoreCache(delta, p.Storage, ua)
+	return err
+}
+
+// removeJournalDelta removes the delta of the cache at key after it was
+// rebuilt in full, so it is not restored over the newer cache.
+func (p *Plugin) removeJournalDelta(key string) {
+	delta := key + journalDeltaSuffix
+
+	if !exists(p.Storage, delta) {
+		return
+	}
+
+	if err := p.Storage.Delete(delta); err != nil {
+		log.Warnf("Failed to remove %s %s", delta, err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const journalEvents = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+// watchJournal records every file changed under the mounts to the journal
+// until stop is closed.
+func watchJournal(mounts []string, j *journal, stop <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+
+	if err != nil {
+		return err
+	}
+
+	watches := make(map[int]string)
+
+	addWatches := func(root string) error {
+		return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return nil
+			}
+
+			wd, err := syscall.InotifyAddWatch(fd, path, journalEvents)
+
+			if err != nil {
+				return err
+			}
+
+			watches[wd] = path
+			return nil
+		})
+	}
+
+	for _, mount := range mounts {
+		if err := os.MkdirAll(mount, 0755); err != nil {
+			return err
+		}
+
+		if err := addWatches(mount); err != nil {
+			syscall.Close(fd)
+			return err
+		}
+	}
+
+	log.Infof("Watching %d directories for changes", len(watches))
+
+	go func() {
+		<-stop
+		syscall.Close(fd)
+	}()
+
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := syscall.Read(fd, buf)
+
+		if err != nil || n <= 0 {
+			// Closing the descriptor on stop ends the read loop
+			select {
+			case <-stop:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Warn("Change journal overflowed. Next rebuild archives all mounts")
+				j.Record(journalOverflow)
+				continue
+			}
+
+			dir, ok := watches[int(event.Wd)]
+			if !ok {
+				continue
+			}
+
+			path := filepath.Join(dir, cString(nameBytes))
+
+			// New directories need watching, and their contents at creation
+			// time recording, since events for them were missed
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+						if err == nil && !fi.IsDir() {
+							j.Record(p)
+						}
+						return nil
+					})
+
+					if err := addWatches(path); err != nil {
+						log.Warnf("Failed to watch %s %s", path, err)
+						j.Record(journalOverflow)
+					}
+				}
+
+				continue
+			}
+
+			j.Record(path)
+		}
+	}
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+
+	return string(b)
+}
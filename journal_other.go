@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func watchJournal(mounts []string, j *journal, stop <-chan struct{}) error {
+	return errors.New("Change journals are only supported on linux")
+}
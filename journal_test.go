@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestJournaledMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The journal and restore record are in the workspace
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.Mkdir("src", 0755)
+	ioutil.WriteFile("src/changed", []byte("changed"), 0644)
+	ioutil.WriteFile(".cache-journal", []byte("src/changed\n"), 0644)
+
+	p := &Plugin{Mount: []string{"src"}, JournalFile: ".cache-journal"}
+	key := "/bucket/repo/master/archive.tar"
+
+	if mount, delta, _ := p.journaledMount(key); delta || strings.Join(mount, ",") != "src" {
+		t.Errorf("Expected the mounts to be archived in full without a restore, got %v %t", mount, delta)
+	}
+
+	writeRestoreRecord(newMemoryStorage(), "/bucket/repo/main/archive.tar")
+
+	if _, delta, _ := p.journaledMount(key); delta {
+		t.Error("Expected the mounts to be archived in full after restoring another cache")
+	}
+
+	writeRestoreRecord(newMemoryStorage(), key)
+
+	if mount, delta, _ := p.journaledMount(key); !delta || strings.Join(mount, ",") != "src/changed" {
+		t.Errorf("Expected a delta of the journaled files after restoring the cache, got %v %t", mount, delta)
+	}
+}
+
+func TestRestoreJournalDeltaWithPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	s := newMemoryStorage()
+	key := "/bucket/repo/master/archive.tar"
+
+	for _, object := range []struct {
+		key      string
+		contents string
+	}{{key, "cached"}, {key + journalDeltaSuffix, "changed"}} {
+		os.MkdirAll("rest", 0755)
+		os.MkdirAll("first", 0755)
+		ioutil.WriteFile("rest/file", []byte(object.contents), 0644)
+		ioutil.WriteFile("first/file", []byte(object.contents), 0644)
+
+		if err := rebuildCache([]string{"rest", "first"}, object.key, s, &tarArchive{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	os.RemoveAll("rest")
+	os.RemoveAll("first")
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &tarArchive{priority: []string{"first"}, deferred: sp}
+	p := &Plugin{Storage: s, JournalFile: ".cache-journal"}
+
+	if _, err := restoreCache(key, s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.restoreJournalDelta(key, "", a, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := finishPriorityRestore(a, sp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"rest/file", "first/file"} {
+		if b, _ := ioutil.ReadFile(name); string(b) != "changed" {
+			t.Errorf("Expected the delta to be restored over %s, got %q", name, b)
+		}
+	}
+
+	if _, err := os.Stat(restoreCompleteMarker); err != nil {
+		t.Error("Expected the complete marker once the delta is restored")
+	}
+
+	if b, _ := ioutil.ReadFile(".cache-journal"); !strings.Contains(string(b), "rest/file") {
+		t.Errorf("Expected the spooled files of the delta to be journaled, got %q", b)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// The default paths, as templates of keyData.
+const (
+	defaultPathTemplate         = "/{{ .Repo.Owner }}/{{ .Repo.Name }}/{{ .Branch }}/"
+	defaultFallbackPathTemplate = "/{{ .Repo.Owner }}/{{ .Repo.Name }}/{{ .DefaultBranch }}/"
+	defaultFlushPathTemplate    = "/{{ .Repo.Owner }}/{{ .Repo.Name }}/"
+)
+
+// keyData is available to the templates of the path, fallback_path,
+// flush_path and filename.
+type keyData struct {
+	Repo struct {
+		Owner string
+		Name  string
+	}
+
+	Commit struct {
+		Sha    string
+		Branch string
+	}
+
+	Build struct {
+		Number int
+		Event  string
+	}
+
+	// Branch is the branch of the build, or DefaultBranch without one.
+	Branch        string
+	DefaultBranch string
+
+	OS     string
+	Arch   string
+	Runner string
+
+	// Env holds the environment variables of the plugin.
+	Env map[string]string
+}
+
+// keyFuncs are the functions available to key templates.
+var keyFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.ReplaceAll,
+	"trunc": func(n int, s string) string {
+		if len(s) > n {
+			return s[:n]
+		}
+
+		return s
+	},
+}
+
+// environ returns the environment variables as a map.
+func environ() map[string]string {
+	env := make(map[string]string)
+
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	return env
+}
+
+// render executes text as a template of the data and then expands the
+// placeholders, such as {branch}, in the result. The placeholders are
+// expanded last so values of the build, like a branch named with template
+// actions, are never executed. Settings without template actions are only
+// expanded.
+func (d *keyData) render(name, text string, vars *strings.Replacer) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return vars.Replace(text), nil
+	}
+
+	t, err := template.New(name).Funcs(keyFuncs).Option("missingkey=error").Parse(text)
+
+	if err != nil {
+		return "", fmt.Errorf("Invalid %s template %s", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, d); err != nil {
+		return "", fmt.Errorf("Failed to render %s %s", name, err)
+	}
+
+	return vars.Replace(buf.String()), nil
+}
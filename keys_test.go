@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyRender(t *testing.T) {
+	keys := &keyData{
+		Branch:        "feature/x",
+		DefaultBranch: "main",
+		Arch:          "arm64",
+		Env:           map[string]string{"GO_VERSION": "1.21"},
+	}
+
+	keys.Repo.Owner = "Owner"
+	keys.Repo.Name = "repo"
+	keys.Commit.Sha = "0123456789abcdef"
+	keys.Build.Number = 42
+
+	vars := strings.NewReplacer("{branch}", keys.Branch)
+
+	tests := []struct {
+		text     string
+		expected string
+		valid    bool
+	}{
+		{defaultPathTemplate, "/Owner/repo/feature/x/", true},
+		{defaultFallbackPathTemplate, "/Owner/repo/main/", true},
+		{"/bucket/{branch}/", "/bucket/feature/x/", true},
+		{"/bucket/{{ .Repo.Owner | lower }}/{{ .Arch }}/", "/bucket/owner/arm64/", true},
+		{"/bucket/go{{ .Env.GO_VERSION }}/{{ trunc 7 .Commit.Sha }}/", "/bucket/go1.21/0123456/", true},
+		{"archive-{{ .Build.Number }}.tgz", "archive-42.tgz", true},
+		{"/bucket/{{ .Env.MISSING }}/", "", false},
+		{"/bucket/{{ .Missing }}/", "", false},
+		{"/bucket/{{ .Repo.Owner /", "", false},
+	}
+
+	for _, test := range tests {
+		rendered, err := keys.render("path", test.text, vars)
+
+		if (err == nil) != test.valid {
+			t.Errorf("Expected %q to be valid %t, got %v", test.text, test.valid, err)
+			continue
+		}
+
+		if rendered != test.expected {
+			t.Errorf("Expected %q to render %q, got %q", test.text, test.expected, rendered)
+		}
+	}
+}
+
+func TestKeyRenderBranchTemplate(t *testing.T) {
+	keys := &keyData{
+		Branch: "{{ .Env.PLUGIN_SECRET_KEY }}",
+		Env:    map[string]string{"PLUGIN_SECRET_KEY": "secret"},
+	}
+
+	vars := strings.NewReplacer("{branch}", keys.Branch)
+
+	for _, text := range []string{"/bucket/{branch}/", "/bucket/{{ .Env | len }}/{branch}/"} {
+		rendered, err := keys.render("path", text, vars)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(rendered, "secret") || !strings.Contains(rendered, keys.Branch) {
+			t.Errorf("Expected the branch of %q to be kept as it is, got %q", text, rendered)
+		}
+	}
+}
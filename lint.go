@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// unsafeKeyChars need encoding in URLs or are handled inconsistently by S3
+// compatible providers, so keys holding them miss in some clients.
+const unsafeKeyChars = " #?%+&\\\"'<>{}|^`[]"
+
+// lint writes the keys the settings resolve to in this build and fails when
+// they hold common mistakes, which otherwise show only as cache misses.
+func (p *Plugin) lint() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(w, "path\t%s\n", p.Path)
+	fmt.Fprintf(w, "fallback_path\t%s\n", p.FallbackPath)
+
+	for _, fallback := range p.FallbackPaths {
+		fmt.Fprintf(w, "fallback_paths\t%s\n", fallback)
+	}
+
+	fmt.Fprintf(w, "flush_path\t%s\n", p.FlushPath)
+	fmt.Fprintf(w, "filename\t%s\n", p.Filename)
+	fmt.Fprintf(w, "cache\t%s\n", p.Path+p.Filename)
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	problems := p.lintKeys()
+
+	for _, problem := range problems {
+		fmt.Printf("problem: %s\n", problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Found %d problems in the keys", len(problems))
+	}
+
+	return nil
+}
+
+// lintKeys returns the problems of the keys.
+func (p *Plugin) lintKeys() []string {
+	var problems []string
+
+	prefixes := [][2]string{{"path", p.Path}, {"fallback_path", p.FallbackPath}, {"flush_path", p.FlushPath}}
+
+	for i, fallback := range p.FallbackPaths {
+		prefixes = append(prefixes, [2]string{fmt.Sprintf("fallback_paths[%d]", i), fallback})
+	}
+
+	for _, setting := range prefixes {
+		name, prefix := setting[0], setting[1]
+
+		if len(prefix) == 0 {
+			continue
+		}
+
+		if strings.Contains(strings.TrimPrefix(prefix, "/"), "//") {
+			problems = append(problems, fmt.Sprintf("%s %s has an empty segment, e.g. from a template rendering to nothing", name, prefix))
+		}
+
+		if !strings.HasSuffix(prefix, "/") {
+			problems = append(problems, fmt.Sprintf("%s %s does not end with /, so the filename is appended to its last segment", name, prefix))
+		}
+
+		if len(strings.Split(strings.Trim(prefix, "/"), "/")) < 2 && name != "flush_path" {
+			problems = append(problems, fmt.Sprintf("%s %s has no key below the bucket", name, prefix))
+		}
+
+		if i := strings.IndexAny(prefix, unsafeKeyChars); i >= 0 {
+			problem := fmt.Sprintf("%s %s holds %q, which needs encoding in URLs", name, prefix, prefix[i])
+
+			if strings.ContainsAny(p.Branch, unsafeKeyChars) && strings.Contains(prefix, p.Branch) {
+				problem += fmt.Sprintf(", from the branch %s. Use a sanitized branch in the template", p.Branch)
+			}
+
+			problems = append(problems, problem)
+		}
+	}
+
+	if len(p.Filename) == 0 || strings.Contains(p.Filename, "/") {
+		problems = append(problems, fmt.Sprintf("filename %q needs to be a name without /", p.Filename))
+	}
+
+	if len(p.FlushPath) > 0 {
+		if !strings.HasPrefix(p.Path, p.FlushPath) {
+			problems = append(problems, fmt.Sprintf("path %s is not under flush_path %s, so flushing never removes the cache", p.Path, p.FlushPath))
+		}
+
+		if len(p.Repo) > 0 && !strings.Contains(p.FlushPath, "/"+p.Repo+"/") {
+			problems = append(problems, fmt.Sprintf("flush_path %s does not hold the repo %s, so flushing also removes the caches of other repos", p.FlushPath, p.Repo))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintKeys(t *testing.T) {
+	tests := []struct {
+		plugin   Plugin
+		problems []string
+	}{
+		{
+			Plugin{Repo: "acme/web", Path: "/acme/web/master/", FallbackPath: "/acme/web/master/", FlushPath: "/acme/web/", Filename: "archive.tar"},
+			nil,
+		},
+		{
+			Plugin{Repo: "acme/web", Branch: "feature x", Path: "/acme/web/feature x/", FlushPath: "/acme/web/", Filename: "archive.tar"},
+			[]string{"from the branch feature x"},
+		},
+		{
+			Plugin{Repo: "acme/web", Path: "/acme/web//", FlushPath: "/acme/web/", Filename: "archive.tar"},
+			[]string{"empty segment"},
+		},
+		{
+			Plugin{Repo: "acme/web", Path: "/acme/web/master", FlushPath: "/acme/", Filename: "archive.tar"},
+			[]string{"does not end with /", "other repos"},
+		},
+		{
+			Plugin{Repo: "acme/web", Path: "/cache/acme/web/master/", FlushPath: "/acme/web/", Filename: "archive.tar"},
+			[]string{"never removes the cache"},
+		},
+	}
+
+	for _, test := range tests {
+		problems := test.plugin.lintKeys()
+
+		if len(problems) != len(test.problems) {
+			t.Errorf("Expected %d problems with %s, got %v", len(test.problems), test.plugin.Path, problems)
+			continue
+		}
+
+		for i, problem := range problems {
+			if !strings.Contains(problem, test.problems[i]) {
+				t.Errorf("Expected a problem about %s, got %s", test.problems[i], problem)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errLocked is returned by tryLockFile when another process holds the
+// lock.
+var errLocked = errors.New("File is locked")
+
+// lockFile takes an exclusive flock on path, creating it when missing, and
+// returns the function releasing it.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// tryLockFile takes an exclusive flock on path like lockFile, returning
+// errLocked rather than waiting when it is held.
+func tryLockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+var errLocked = errors.New("File is locked")
+
+func lockFile(path string) (func(), error) {
+	return nil, errors.New("Local cache locking is only supported on linux")
+}
+
+func tryLockFile(path string) (func(), error) {
+	return nil, errors.New("Transfer slots are only supported on linux")
+}
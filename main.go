@@ -3,13 +3,21 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone-plugins/drone-s3-cache/storage/process"
 	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli"
 )
 
@@ -24,11 +32,46 @@ func main() {
 	app.Flags = []cli.Flag{
 		// Cache information
 
+		cli.StringFlag{
+			Name:   "local_cache",
+			Usage:  "local directory shared by builds on the host caching objects",
+			EnvVar: "PLUGIN_LOCAL_CACHE",
+		},
+		cli.StringFlag{
+			Name:   "compat",
+			Usage:  "restore the caches of drone-cache or drone-volume-cache on a miss",
+			EnvVar: "PLUGIN_COMPAT",
+		},
+		cli.StringFlag{
+			Name:   "compat_path",
+			Usage:  "directory of the repo in the drone-volume-cache volume",
+			EnvVar: "PLUGIN_COMPAT_PATH",
+		},
 		cli.StringFlag{
 			Name:   "filename",
 			Usage:  "Filename for the cache",
 			EnvVar: "PLUGIN_FILENAME",
 		},
+		cli.StringFlag{
+			Name:   "compression",
+			Usage:  "compression of the cache: none, gzip, zstd or lz4",
+			EnvVar: "PLUGIN_COMPRESSION",
+		},
+		cli.IntFlag{
+			Name:   "compression_level",
+			Usage:  "compression level, defaults to the default of the compression",
+			EnvVar: "PLUGIN_COMPRESSION_LEVEL",
+		},
+		cli.IntFlag{
+			Name:   "compression_threads",
+			Usage:  "threads compressing with zstd, defaults to the number of CPUs",
+			EnvVar: "PLUGIN_COMPRESSION_THREADS",
+		},
+		cli.IntFlag{
+			Name:   "extract_workers",
+			Usage:  "files written at once on restore, defaults to the number of CPUs",
+			EnvVar: "PLUGIN_EXTRACT_WORKERS",
+		},
 		cli.StringFlag{
 			Name:   "path",
 			Usage:  "path",
@@ -39,37 +82,430 @@ func main() {
 			Usage:  "fallback_path",
 			EnvVar: "PLUGIN_FALLBACK_PATH",
 		},
+		cli.StringSliceFlag{
+			Name:   "fallback_paths",
+			Usage:  "paths restored in order on a miss, replacing fallback_path",
+			EnvVar: "PLUGIN_FALLBACK_PATHS",
+		},
+		cli.IntFlag{
+			Name:   "fallback_parallelism",
+			Usage:  "number of fallback keys probed at once, 1 to try them in turn",
+			Value:  4,
+			EnvVar: "PLUGIN_FALLBACK_PARALLELISM",
+		},
+		cli.BoolFlag{
+			Name:   "legacy_fallback",
+			Usage:  "restore the legacy archive.tar cache on a miss",
+			EnvVar: "PLUGIN_LEGACY_FALLBACK",
+		},
+		cli.StringFlag{
+			Name:   "previous_prefix",
+			Usage:  "prefix searched for the newest previous cache on a miss",
+			EnvVar: "PLUGIN_PREVIOUS_PREFIX",
+		},
+		cli.StringSliceFlag{
+			Name:   "alias_keys",
+			Usage:  "paths the rebuilt archive is also copied to, e.g. a latest key of the branch",
+			EnvVar: "PLUGIN_ALIAS_KEYS",
+		},
+		cli.BoolFlag{
+			Name:   "restore_newest",
+			Usage:  "restore the newest archive under path when the exact key is missing",
+			EnvVar: "PLUGIN_RESTORE_NEWEST",
+		},
+		cli.StringSliceFlag{
+			Name:   "restore_keys",
+			Usage:  "keys tried in order on a miss, exactly and then as a prefix, in place of fallback_path",
+			EnvVar: "PLUGIN_RESTORE_KEYS",
+		},
+		cli.StringFlag{
+			Name:   "key_scheme",
+			Usage:  "scheme of the cache keys, actions to look them up like actions/cache",
+			EnvVar: "PLUGIN_KEY_SCHEME",
+		},
+		cli.StringFlag{
+			Name:   "key",
+			Usage:  "key of the cache within the path of the branch with the actions key scheme",
+			EnvVar: "PLUGIN_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:   "checksum_files",
+			Usage:  "files or globs whose checksum is appended to the path",
+			EnvVar: "PLUGIN_CHECKSUM_FILES",
+		},
+		cli.StringFlag{
+			Name:   "checksum_algorithm",
+			Usage:  "checksum algorithm of checksum_files, sha256, sha1 or xxhash",
+			EnvVar: "PLUGIN_CHECKSUM_ALGORITHM",
+			Value:  "sha256",
+		},
+		cli.StringSliceFlag{
+			Name:   "merge_paths",
+			Usage:  "paths restored in order before path, later archives overlaying earlier ones",
+			EnvVar: "PLUGIN_MERGE_PATHS",
+		},
 		cli.StringSliceFlag{
 			Name:   "mount",
 			Usage:  "cache directories",
 			EnvVar: "PLUGIN_MOUNT",
 		},
+		cli.StringSliceFlag{
+			Name:   "external_mounts",
+			Usage:  "paths outside the workspace allowed as mounts, e.g. /root/.cache",
+			EnvVar: "PLUGIN_EXTERNAL_MOUNTS",
+		},
+		cli.BoolFlag{
+			Name:   "allow_dangerous_mounts",
+			Usage:  "allow mounting the workspace root or system directories",
+			EnvVar: "PLUGIN_ALLOW_DANGEROUS_MOUNTS",
+		},
+		cli.BoolFlag{
+			Name:   "skip_existing",
+			Usage:  "skip the rebuild when the cache already exists",
+			EnvVar: "PLUGIN_SKIP_EXISTING",
+		},
+		cli.IntFlag{
+			Name:   "max_files",
+			Usage:  "fail the rebuild when the mounts hold more files",
+			EnvVar: "PLUGIN_MAX_FILES",
+		},
+		cli.StringFlag{
+			Name:   "max_size",
+			Usage:  "fail the rebuild when the mounts are larger, e.g. 2GB",
+			EnvVar: "PLUGIN_MAX_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "transfer_strategy",
+			Usage:  "auto to pick the upload strategy from the size of the mounts",
+			EnvVar: "PLUGIN_TRANSFER_STRATEGY",
+		},
+		cli.StringFlag{
+			Name:   "transfer_single_max",
+			Usage:  "largest archive uploaded in a single request by the auto strategy",
+			Value:  "32MB",
+			EnvVar: "PLUGIN_TRANSFER_SINGLE_MAX",
+		},
+		cli.StringFlag{
+			Name:   "transfer_shard_min",
+			Usage:  "smallest archive split into shards by the auto strategy, 0 to never shard",
+			Value:  "4GB",
+			EnvVar: "PLUGIN_TRANSFER_SHARD_MIN",
+		},
+		cli.StringFlag{
+			Name:   "branch_max_size",
+			Usage:  "size of the caches of the branch, deleting the oldest to make room on rebuild, e.g. 5GB",
+			EnvVar: "PLUGIN_BRANCH_MAX_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "branch_max_age",
+			Usage:  "delete caches of the branch older then # days on rebuild",
+			EnvVar: "PLUGIN_BRANCH_MAX_AGE",
+		},
+		cli.StringSliceFlag{
+			Name:   "mount_routes",
+			Usage:  "mount=path pairs archiving mounts separately under other paths",
+			EnvVar: "PLUGIN_MOUNT_ROUTES",
+		},
+		cli.StringSliceFlag{
+			Name:   "mount_priority",
+			Usage:  "mounts archived and restored first",
+			EnvVar: "PLUGIN_MOUNT_PRIORITY",
+		},
+		cli.StringSliceFlag{
+			Name:   "volumes",
+			Usage:  "named docker volumes to cache",
+			EnvVar: "PLUGIN_VOLUMES",
+		},
+		cli.StringFlag{
+			Name:   "volumes_root",
+			Usage:  "directory holding the docker volumes",
+			EnvVar: "PLUGIN_VOLUMES_ROOT",
+			Value:  "/var/lib/docker/volumes",
+		},
+		cli.StringFlag{
+			Name:   "mode",
+			Usage:  "auto to restore in the first step and rebuild in later ones",
+			EnvVar: "PLUGIN_MODE",
+		},
 		cli.BoolFlag{
 			Name:   "rebuild",
 			Usage:  "rebuild the cache directories",
 			EnvVar: "PLUGIN_REBUILD",
 		},
+		cli.BoolFlag{
+			Name:   "dedup",
+			Usage:  "upload a pointer instead of an archive identical to the fallback cache",
+			EnvVar: "PLUGIN_DEDUP",
+		},
+		cli.IntFlag{
+			Name:   "shards",
+			Usage:  "number of archive parts built and uploaded concurrently",
+			EnvVar: "PLUGIN_SHARDS",
+			Value:  1,
+		},
+		cli.BoolFlag{
+			Name:   "pack_small_files",
+			Usage:  "pack small files into indexed blocks to speed up extraction",
+			EnvVar: "PLUGIN_PACK_SMALL_FILES",
+		},
+		cli.StringFlag{
+			Name:   "compressor_cmd",
+			Usage:  "command compressing the tar stream from stdin to stdout",
+			EnvVar: "PLUGIN_COMPRESSOR_CMD",
+		},
+		cli.StringFlag{
+			Name:   "decompressor_cmd",
+			Usage:  "command decompressing the archive from stdin to a tar stream on stdout",
+			EnvVar: "PLUGIN_DECOMPRESSOR_CMD",
+		},
+		cli.StringSliceFlag{
+			Name:   "metadata",
+			Usage:  "key=value metadata attached to uploaded objects",
+			EnvVar: "PLUGIN_METADATA",
+		},
 		cli.BoolFlag{
 			Name:   "restore",
 			Usage:  "restore the cache directories",
 			EnvVar: "PLUGIN_RESTORE",
 		},
+		cli.BoolFlag{
+			Name:   "exact_mtimes",
+			Usage:  "archive modification times with sub-second precision",
+			EnvVar: "PLUGIN_EXACT_MTIMES",
+		},
+		cli.BoolFlag{
+			Name:   "allow_special_bits",
+			Usage:  "archive and restore setuid, setgid and sticky bits and file capabilities",
+			EnvVar: "PLUGIN_ALLOW_SPECIAL_BITS",
+		},
+		cli.BoolFlag{
+			Name:   "verify_uploads",
+			Usage:  "verify the ETag of uploads, retrying corrupted uploads",
+			EnvVar: "PLUGIN_VERIFY_UPLOADS",
+		},
+		cli.StringFlag{
+			Name:   "download_base_url",
+			Usage:  "base url of a cdn or caching proxy restores download through",
+			EnvVar: "PLUGIN_DOWNLOAD_BASE_URL",
+		},
+		cli.StringFlag{
+			Name:   "download_key_pair_id",
+			Usage:  "cloudfront key pair id signing the urls of downloads",
+			EnvVar: "PLUGIN_DOWNLOAD_KEY_PAIR_ID",
+		},
+		cli.StringFlag{
+			Name:   "download_private_key",
+			Usage:  "cloudfront private key signing the urls of downloads",
+			EnvVar: "PLUGIN_DOWNLOAD_PRIVATE_KEY",
+		},
+		cli.StringFlag{
+			Name:   "encryption",
+			Usage:  "server side encryption of uploads (aes256, aws:kms)",
+			EnvVar: "PLUGIN_ENCRYPTION",
+		},
+		cli.StringFlag{
+			Name:   "encryption_passphrase",
+			Usage:  "passphrase encrypting the caches on the client with aes-256-gcm",
+			EnvVar: "PLUGIN_ENCRYPTION_PASSPHRASE",
+		},
+		cli.StringSliceFlag{
+			Name:   "encryption_recipients",
+			Usage:  "age or armored pgp public keys encrypting the caches on the client",
+			EnvVar: "PLUGIN_ENCRYPTION_RECIPIENTS",
+		},
+		cli.StringFlag{
+			Name:   "encryption_identity",
+			Usage:  "age or armored pgp private key decrypting the caches",
+			EnvVar: "PLUGIN_ENCRYPTION_IDENTITY",
+		},
+		cli.StringFlag{
+			Name:   "signing_key",
+			Usage:  "hmac key or pem encoded ed25519 private key signing the caches",
+			EnvVar: "PLUGIN_SIGNING_KEY",
+		},
+		cli.StringFlag{
+			Name:   "verify_key",
+			Usage:  "pem encoded ed25519 public key verifying the caches on restore",
+			EnvVar: "PLUGIN_VERIFY_KEY",
+		},
+		cli.StringFlag{
+			Name:   "kms_key_id",
+			Usage:  "kms key encrypting uploads with aws:kms encryption",
+			EnvVar: "PLUGIN_KMS_KEY_ID",
+		},
+		cli.BoolFlag{
+			Name:   "staged_restore",
+			Usage:  "restore into a staging directory moved into the mounts on success",
+			EnvVar: "PLUGIN_STAGED_RESTORE",
+		},
+		cli.StringFlag{
+			Name:   "overlay_dir",
+			Usage:  "directory restored into, with the commands mounting it as overlays of the mounts",
+			EnvVar: "PLUGIN_OVERLAY_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "overlay_mount",
+			Usage:  "mount the overlays of overlay_dir, needing a privileged step",
+			EnvVar: "PLUGIN_OVERLAY_MOUNT",
+		},
+		cli.StringSliceFlag{
+			Name:   "restore_priority",
+			Usage:  "paths restored before the rest of the cache",
+			EnvVar: "PLUGIN_RESTORE_PRIORITY",
+		},
 		cli.BoolFlag{
 			Name:   "flush",
 			Usage:  "flush the cache",
 			EnvVar: "PLUGIN_FLUSH",
 		},
+		cli.BoolFlag{
+			Name:   "flush_daemon",
+			Usage:  "run continuously flushing the flush_prefixes",
+			EnvVar: "PLUGIN_FLUSH_DAEMON",
+		},
+		cli.StringSliceFlag{
+			Name:   "flush_prefixes",
+			Usage:  "paths flushed by the flush daemon",
+			EnvVar: "PLUGIN_FLUSH_PREFIXES",
+		},
+		cli.DurationFlag{
+			Name:   "flush_interval",
+			Usage:  "time between flush daemon runs",
+			EnvVar: "PLUGIN_FLUSH_INTERVAL",
+			Value:  time.Hour,
+		},
+		cli.StringFlag{
+			Name:   "flush_schedule",
+			Usage:  "cron spec for flush daemon runs, overrides flush_interval",
+			EnvVar: "PLUGIN_FLUSH_SCHEDULE",
+		},
+		cli.StringFlag{
+			Name:   "flush_lock",
+			Usage:  "lock object electing a single flush daemon",
+			EnvVar: "PLUGIN_FLUSH_LOCK",
+		},
+		cli.BoolFlag{
+			Name:   "journal",
+			Usage:  "run continuously recording changes to the mounts",
+			EnvVar: "PLUGIN_JOURNAL",
+		},
+		cli.StringFlag{
+			Name:   "journal_file",
+			Usage:  "change journal used for incremental rebuilds",
+			EnvVar: "PLUGIN_JOURNAL_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "report",
+			Usage:  "report cache usage per repo and branch",
+			EnvVar: "PLUGIN_REPORT",
+		},
+		cli.BoolFlag{
+			Name:   "manifest",
+			Usage:  "publish the file list and hashes of the mounts next to the cache",
+			EnvVar: "PLUGIN_MANIFEST",
+		},
+		cli.StringFlag{
+			Name:   "report_path",
+			Usage:  "path to report on",
+			EnvVar: "PLUGIN_REPORT_PATH",
+		},
+		cli.StringFlag{
+			Name:   "report_format",
+			Usage:  "report format, csv or json",
+			EnvVar: "PLUGIN_REPORT_FORMAT",
+			Value:  "csv",
+		},
+		cli.StringFlag{
+			Name:   "report_file",
+			Usage:  "file to write the report to instead of stdout",
+			EnvVar: "PLUGIN_REPORT_FILE",
+		},
+		cli.IntFlag{
+			Name:   "simulate_flush_age",
+			Usage:  "age in days of the objects the report simulates deleting per path",
+			EnvVar: "PLUGIN_SIMULATE_FLUSH_AGE",
+		},
+		cli.StringFlag{
+			Name:   "simulate_max_size",
+			Usage:  "size of the objects per path the report simulates keeping, e.g. 5GB",
+			EnvVar: "PLUGIN_SIMULATE_MAX_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "track_access",
+			Usage:  "write an access marker for every restored cache",
+			EnvVar: "PLUGIN_TRACK_ACCESS",
+		},
+		cli.BoolFlag{
+			Name:   "track_hits",
+			Usage:  "count the hits and misses of restores for the hit ratio of report",
+			EnvVar: "PLUGIN_TRACK_HITS",
+		},
+		cli.BoolFlag{
+			Name:   "restore_hints",
+			Usage:  "record each restore next to the cache to tune and estimate the next restore",
+			EnvVar: "PLUGIN_RESTORE_HINTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "protected_paths",
+			Usage:  "cache paths only rebuilt by pushes to protected branches",
+			EnvVar: "PLUGIN_PROTECTED_PATHS",
+		},
+		cli.StringSliceFlag{
+			Name:   "protected_branches",
+			Usage:  "branches allowed to rebuild protected paths, defaults to the default branch",
+			EnvVar: "PLUGIN_PROTECTED_BRANCHES",
+		},
 		cli.StringFlag{
 			Name:   "flush_age",
 			Usage:  "flush cache files older then # days",
 			EnvVar: "PLUGIN_FLUSH_AGE",
 			Value:  "30",
 		},
+		cli.BoolFlag{
+			Name:   "flush_dry_run",
+			Usage:  "report what flush would delete without deleting",
+			EnvVar: "PLUGIN_FLUSH_DRY_RUN",
+		},
+		cli.BoolFlag{
+			Name:   "flush_checkpoint",
+			Usage:  "save flush progress so an interrupted flush resumes on the next run",
+			EnvVar: "PLUGIN_FLUSH_CHECKPOINT",
+		},
+		cli.BoolFlag{
+			Name:   "flush_force",
+			Usage:  "flush expired objects not uploaded by the plugin",
+			EnvVar: "PLUGIN_FLUSH_FORCE",
+		},
+		cli.StringFlag{
+			Name:   "file_mode_mask",
+			Usage:  "octal permission bits cleared from restored files, e.g. 022",
+			EnvVar: "PLUGIN_FILE_MODE_MASK",
+		},
+		cli.StringFlag{
+			Name:   "dir_mode_mask",
+			Usage:  "octal permission bits cleared from restored directories, e.g. 022",
+			EnvVar: "PLUGIN_DIR_MODE_MASK",
+		},
+		cli.IntFlag{
+			Name:   "verbose_files",
+			Usage:  "log every nth file archived or extracted",
+			EnvVar: "PLUGIN_VERBOSE_FILES",
+		},
 		cli.BoolFlag{
 			Name:   "debug",
 			Usage:  "debug plugin output",
 			EnvVar: "PLUGIN_DEBUG",
 		},
+		cli.BoolFlag{
+			Name:   "phase_markers",
+			Usage:  "log the start and end of each phase with its duration",
+			EnvVar: "PLUGIN_PHASE_MARKERS",
+		},
+		cli.StringFlag{
+			Name:   "log_timestamps",
+			Usage:  "timestamp log lines, rfc3339",
+			EnvVar: "PLUGIN_LOG_TIMESTAMPS",
+		},
 
 		// Build information (for setting defaults)
 
@@ -83,20 +519,206 @@ func main() {
 			Usage:  "repository name",
 			EnvVar: "DRONE_REPO_NAME",
 		},
+		cli.IntFlag{
+			Name:   "build.number",
+			Usage:  "build number",
+			EnvVar: "DRONE_BUILD_NUMBER",
+		},
+		cli.StringFlag{
+			Name:   "workspace",
+			Usage:  "build workspace, defaults to the working directory",
+			EnvVar: "DRONE_WORKSPACE",
+		},
+		cli.StringFlag{
+			Name:   "stage.os",
+			Usage:  "pipeline stage operating system",
+			EnvVar: "DRONE_STAGE_OS",
+		},
+		cli.StringFlag{
+			Name:   "stage.type",
+			Usage:  "pipeline stage type",
+			EnvVar: "DRONE_STAGE_TYPE",
+		},
+		cli.StringFlag{
+			Name:   "stage.arch",
+			Usage:  "pipeline stage architecture",
+			EnvVar: "DRONE_STAGE_ARCH",
+		},
+		cli.StringFlag{
+			Name:   "runner.label",
+			Usage:  "label of the runner pool",
+			EnvVar: "PLUGIN_RUNNER_LABEL,DRONE_RUNNER_LABEL",
+		},
+		cli.StringFlag{
+			Name:   "step.name",
+			Usage:  "pipeline step name",
+			EnvVar: "DRONE_STEP_NAME",
+		},
+		cli.Int64Flag{
+			Name:   "build.created",
+			Usage:  "build created",
+			EnvVar: "DRONE_BUILD_CREATED",
+		},
+		cli.StringFlag{
+			Name:   "build.status",
+			Usage:  "build status",
+			EnvVar: "DRONE_BUILD_STATUS",
+		},
+		cli.StringFlag{
+			Name:   "build.event",
+			Usage:  "build event",
+			EnvVar: "DRONE_BUILD_EVENT",
+		},
+		cli.StringFlag{
+			Name:   "commit.sha",
+			Usage:  "git commit sha",
+			EnvVar: "DRONE_COMMIT_SHA",
+		},
 		cli.StringFlag{
 			Name:   "commit.branch",
-			Value:  "master",
 			Usage:  "git commit branch",
 			EnvVar: "DRONE_COMMIT_BRANCH",
 		},
+		cli.StringFlag{
+			Name:   "target.branch",
+			Usage:  "target branch of the pull request",
+			EnvVar: "DRONE_TARGET_BRANCH",
+		},
+		cli.BoolFlag{
+			Name:   "pull_request_rebuild",
+			Usage:  "rebuild the cache of the target branch on pull requests",
+			EnvVar: "PLUGIN_PULL_REQUEST_REBUILD",
+		},
+		cli.BoolTFlag{
+			Name:   "fail_on_error",
+			Usage:  "fail the restore or rebuild when the storage cannot be reached or returns an error",
+			EnvVar: "PLUGIN_FAIL_ON_ERROR",
+		},
+		cli.BoolFlag{
+			Name:   "required",
+			Usage:  "fail the restore when no cache could be restored",
+			EnvVar: "PLUGIN_REQUIRED",
+		},
+		cli.BoolFlag{
+			Name:   "rebuild_on_failure",
+			Usage:  "rebuild the cache even when the build failed",
+			EnvVar: "PLUGIN_REBUILD_ON_FAILURE",
+		},
+		cli.BoolFlag{
+			Name:   "skip_empty",
+			Usage:  "skip rebuilds of mounts without any files",
+			EnvVar: "PLUGIN_SKIP_EMPTY",
+		},
+		cli.IntFlag{
+			Name:   "max_transfers",
+			Usage:  "maximum number of steps of the build transferring caches at once, 0 for no limit",
+			EnvVar: "PLUGIN_MAX_TRANSFERS",
+		},
+		cli.StringFlag{
+			Name:   "transfer_locks",
+			Usage:  "directory on a shared volume holding the locks limiting transfers",
+			EnvVar: "PLUGIN_TRANSFER_LOCKS",
+		},
+		cli.IntFlag{
+			Name:   "max_calls",
+			Usage:  "maximum number of storage calls of a run, 0 for no limit",
+			EnvVar: "PLUGIN_MAX_CALLS",
+		},
+		cli.BoolFlag{
+			Name:   "async_rebuild",
+			Usage:  "rebuild the cache in a background process and finish the step without waiting for the upload",
+			EnvVar: "PLUGIN_ASYNC_REBUILD",
+		},
+		cli.StringFlag{
+			Name:   "restore_spool",
+			Usage:  "set in the background process of restore_priority to the spool it extracts",
+			EnvVar: "PLUGIN_RESTORE_SPOOL",
+			Hidden: true,
+		},
+		cli.BoolFlag{
+			Name:   "async_helper",
+			Usage:  "set in the background process of async_rebuild",
+			EnvVar: "PLUGIN_ASYNC_HELPER",
+			Hidden: true,
+		},
+		cli.StringFlag{
+			Name:   "async_archive",
+			Usage:  "set in the background process of async_rebuild to the archive it uploads",
+			EnvVar: "PLUGIN_ASYNC_ARCHIVE",
+			Hidden: true,
+		},
+		cli.StringFlag{
+			Name:   "async_key",
+			Usage:  "set in the background process of async_rebuild to the key it uploads to",
+			EnvVar: "PLUGIN_ASYNC_KEY",
+			Hidden: true,
+		},
+		cli.BoolFlag{
+			Name:   "key_runner",
+			Usage:  "key the cache and fallback by the os, arch and label of the runner",
+			EnvVar: "PLUGIN_KEY_RUNNER",
+		},
+		cli.StringFlag{
+			Name:   "default_branch",
+			Value:  "master",
+			Usage:  "default branch of the repository",
+			EnvVar: "PLUGIN_DEFAULT_BRANCH,DRONE_REPO_BRANCH",
+		},
 
 		// S3 information
 
 		cli.StringFlag{
 			Name:   "server",
-			Usage:  "s3 server",
+			Usage:  "s3 server, or comma separated servers to fail over between",
 			EnvVar: "PLUGIN_SERVER,CACHE_S3_SERVER",
 		},
+		cli.StringFlag{
+			Name:   "env_file",
+			Usage:  "file receiving the cache keys and results as environment variables",
+			EnvVar: "PLUGIN_ENV_FILE",
+		},
+		cli.StringFlag{
+			Name:   "error_file",
+			Usage:  "file receiving a json description of failures",
+			EnvVar: "PLUGIN_ERROR_FILE",
+		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			Usage:  "timeout of the whole operation, 0 for none",
+			EnvVar: "PLUGIN_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "storage_cmd",
+			Usage:  "command implementing the storage backend instead of s3",
+			EnvVar: "PLUGIN_STORAGE_CMD",
+		},
+		cli.StringFlag{
+			Name:   "endpoint_ip",
+			Usage:  "ip address connected to for the host of the server instead of resolving it",
+			EnvVar: "PLUGIN_ENDPOINT_IP",
+		},
+		cli.StringSliceFlag{
+			Name:   "hosts",
+			Usage:  "host=ip pairs connected to instead of resolving the hosts",
+			EnvVar: "PLUGIN_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "dns_server",
+			Usage:  "dns server resolving the hosts of the servers",
+			EnvVar: "PLUGIN_DNS_SERVER",
+		},
+		cli.DurationFlag{
+			Name:   "probe_timeout",
+			Usage:  "timeout of the reachability probe of the server, 0 disables it",
+			EnvVar: "PLUGIN_PROBE_TIMEOUT",
+			Value:  5 * time.Second,
+		},
+		cli.StringFlag{
+			Name:   "provider",
+			Usage:  "s3 provider (" + strings.Join(s3.Providers(), ", ") + ")",
+			EnvVar: "PLUGIN_PROVIDER",
+			Value:  "aws",
+		},
 		cli.StringFlag{
 			Name:   "access-key",
 			Usage:  "s3 access key",
@@ -107,164 +729,1349 @@ func main() {
 			Usage:  "s3 secret key",
 			EnvVar: "PLUGIN_SECRET_KEY,CACHE_S3_SECRET_KEY",
 		},
-	}
-
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
-	}
-}
-
-func run(c *cli.Context) error {
-	// Set the logging level
-	if c.Bool("debug") {
-		log.SetLevel(log.DebugLevel)
-	}
-
-	// Determine the mode for the plugin
-	rebuild := c.Bool("rebuild")
-	restore := c.Bool("restore")
-	flush := c.Bool("flush")
-
-	if isMultipleModes(rebuild, restore, flush) {
-		return errors.New("Must use a single mode: rebuild, restore or flush")
-	} else if !rebuild && !restore && !flush {
-		return errors.New("No action specified")
-	}
-
-	var mode string
-	var mount []string
-
-	if rebuild {
-		// Look for the mount points to rebuild
-		mount = c.StringSlice("mount")
-
-		if len(mount) == 0 {
-			return errors.New("No mounts specified")
+		cli.StringFlag{
+			Name:   "ca_cert",
+			Usage:  "pem encoded ca certificates trusted for the server",
+			EnvVar: "PLUGIN_CA_CERT",
+		},
+		cli.StringFlag{
+			Name:   "ca_cert_path",
+			Usage:  "file of pem encoded ca certificates trusted for the server",
+			EnvVar: "PLUGIN_CA_CERT_PATH",
+		},
+		cli.StringFlag{
+			Name:   "tls_client_cert",
+			Usage:  "pem encoded client certificate, or its file, presented to the server for mutual tls",
+			EnvVar: "PLUGIN_TLS_CLIENT_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls_client_key",
+			Usage:  "pem encoded key of tls_client_cert, or its file",
+			EnvVar: "PLUGIN_TLS_CLIENT_KEY",
+		},
+		cli.BoolFlag{
+			Name:   "skip_verify",
+			Usage:  "do not verify the tls certificate of the server, for lab environments only",
+			EnvVar: "PLUGIN_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "region",
+			Usage:  "region of the bucket, found from the bucket when unset",
+			EnvVar: "PLUGIN_REGION",
+		},
+		cli.StringFlag{
+			Name:   "session-token",
+			Usage:  "s3 session token of temporary credentials",
+			EnvVar: "PLUGIN_SESSION_TOKEN,CACHE_S3_SESSION_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "read_access_key",
+			Usage:  "access key of restore, check, browse, list and report in place of access-key",
+			EnvVar: "PLUGIN_READ_ACCESS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "read_secret_key",
+			Usage:  "secret key of restore, check, browse, list and report in place of secret-key",
+			EnvVar: "PLUGIN_READ_SECRET_KEY",
+		},
+		cli.StringFlag{
+			Name:   "write_access_key",
+			Usage:  "access key of rebuild, flush and the other modes writing the cache in place of access-key",
+			EnvVar: "PLUGIN_WRITE_ACCESS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "write_secret_key",
+			Usage:  "secret key of rebuild, flush and the other modes writing the cache in place of secret-key",
+			EnvVar: "PLUGIN_WRITE_SECRET_KEY",
+		},
+		cli.StringFlag{
+			Name:   "aws_profile",
+			Usage:  "profile of the shared credentials file used without keys",
+			EnvVar: "PLUGIN_AWS_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "credentials_file",
+			Usage:  "shared credentials file used without keys",
+			EnvVar: "PLUGIN_CREDENTIALS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "role_arn",
+			Usage:  "role assumed through STS for bucket access",
+			EnvVar: "PLUGIN_ROLE_ARN",
+		},
+		cli.StringFlag{
+			Name:   "role_session_name",
+			Usage:  "session name of the role assumed",
+			Value:  s3.DefaultRoleSessionName,
+			EnvVar: "PLUGIN_ROLE_SESSION_NAME",
+		},
+		cli.StringFlag{
+			Name:   "external_id",
+			Usage:  "external id required by the trust policy of the role",
+			EnvVar: "PLUGIN_EXTERNAL_ID",
+		},
+	}
+
+	app.Commands = commands()
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+const (
+	// AutoMode restores or rebuilds depending on the progress of the build.
+	AutoMode = "auto"
+
+	// autoModeMarker is written to the workspace when mode auto restores.
+	autoModeMarker = ".cache-auto-restored"
+)
+
+// Exit statuses of the subcommands
+const (
+	exitError = 1
+	exitMiss  = 2
+)
+
+// commands returns the subcommands. Each mode is also a subcommand, taking
+// the global flags before the subcommand and its own flags after it.
+func commands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:   "rebuild",
+			Usage:  "rebuild the cache directories",
+			Action: subcommand(RebuildMode, nil),
+		},
+		{
+			Name:  "restore",
+			Usage: "restore the cache directories",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "required",
+					Usage: "exit with status 2 when no cache could be restored, like the global required",
+				},
+			},
+			Action: subcommand(RestoreMode, func(c *cli.Context, p *Plugin) {
+				p.FailOnMiss = p.FailOnMiss || c.Bool("required")
+			}),
+		},
+		{
+			Name:  "flush",
+			Usage: "flush the cache",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "age",
+					Usage: "flush cache files older than # days instead of flush_age",
+				},
+			},
+			Action: subcommand(FlushMode, func(c *cli.Context, p *Plugin) {
+				if c.IsSet("age") {
+					p.FlushAge = c.Int("age")
+				}
+			}),
+		},
+		{
+			Name:   "flush-daemon",
+			Usage:  "run continuously flushing the flush prefixes",
+			Action: subcommand(FlushDaemonMode, nil),
+		},
+		{
+			Name:   "journal",
+			Usage:  "run continuously recording changes to the mounts",
+			Action: subcommand(JournalMode, nil),
+		},
+		{
+			Name:   "report",
+			Usage:  "report cache usage per repo and branch",
+			Action: subcommand(ReportMode, nil),
+		},
+		{
+			Name:   "manifest",
+			Usage:  "publish the file list and hashes of the mounts next to the cache",
+			Action: subcommand(ManifestMode, nil),
+		},
+		{
+			Name:  "list",
+			Usage: "list the caches of the repo",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "prefix",
+					Usage:  "prefix to list instead of the repo",
+					EnvVar: "PLUGIN_LIST_PREFIX",
+				},
+			},
+			Action: subcommand(ListMode, func(c *cli.Context, p *Plugin) {
+				if prefix := c.String("prefix"); len(prefix) > 0 {
+					p.FlushPath = prefix
+				}
+			}),
+		},
+		{
+			Name:   "check",
+			Usage:  "exit with status 0 when the cache exists and 2 when it does not",
+			Action: subcommand(CheckMode, nil),
+		},
+		{
+			Name:  "browse",
+			Usage: "list the files in the cache without downloading it when it has a manifest",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "glob",
+					Usage:  "only list the files whose path or name matches the glob",
+					EnvVar: "PLUGIN_BROWSE_GLOB",
+				},
+			},
+			Action: subcommand(BrowseMode, func(c *cli.Context, p *Plugin) {
+				p.BrowseGlob = c.String("glob")
+			}),
+		},
+		{
+			Name:   "lint",
+			Usage:  "print the keys the settings resolve to in this build and check them for common mistakes",
+			Action: subcommand(LintMode, nil),
+		},
+		{
+			Name:  "bootstrap",
+			Usage: "create the bucket and a policy limited to the caches, with admin credentials",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "prefix",
+					Usage:  "prefix of the caches instead of the repo, e.g. /bucket/",
+					EnvVar: "PLUGIN_BOOTSTRAP_PREFIX",
+				},
+				cli.StringFlag{
+					Name:   "policy",
+					Usage:  "name of the policy",
+					Value:  defaultBootstrapPolicy,
+					EnvVar: "PLUGIN_BOOTSTRAP_POLICY",
+				},
+			},
+			Action: subcommand(BootstrapMode, func(c *cli.Context, p *Plugin) {
+				if prefix := c.String("prefix"); len(prefix) > 0 {
+					p.FlushPath = prefix
+				}
+
+				p.BootstrapPolicy = c.String("policy")
+			}),
+		},
+	}
+}
+
+// subcommand returns the action of the subcommand running mode, with configure
+// applying the flags of the subcommand.
+func subcommand(mode string, configure func(c *cli.Context, p *Plugin)) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		err := executeMode(c.Parent(), mode, func(p *Plugin) {
+			if configure != nil {
+				configure(c, p)
+			}
+		})
+
+		if errors.Is(err, errCacheMiss) {
+			return cli.NewExitError(err.Error(), exitMiss)
+		} else if err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+
+		return nil
+	}
+}
+
+// executeMode runs mode with the global flags of c, replaced in tests.
+var executeMode = execute
+
+func run(c *cli.Context) error {
+	// Determine the mode for the plugin
+	rebuild := c.Bool("rebuild")
+	restore := c.Bool("restore")
+	flush := c.Bool("flush")
+	flushDaemon := c.Bool("flush_daemon")
+	journal := c.Bool("journal")
+	report := c.Bool("report")
+	manifest := c.Bool("manifest")
+
+	if name := c.String("mode"); len(name) > 0 {
+		if name != AutoMode {
+			return fmt.Errorf("Invalid mode %s. Needs to be %s", name, AutoMode)
 		}
 
+		if rebuild || restore || flush || flushDaemon || journal || report || manifest {
+			return errors.New("Must not combine mode auto with another mode")
+		}
+
+		_, err := os.Stat(autoModeMarker)
+		mode, skip := pickAutoMode(err == nil, c.String("build.status"))
+
+		if skip {
+			log.Info("Build failed. Skipping rebuild")
+			return nil
+		}
+
+		log.Infof("Picked %s mode", mode)
+
+		// Later steps of the build rebuild
+		if mode == RestoreMode {
+			if err := ioutil.WriteFile(autoModeMarker, nil, 0644); err != nil {
+				log.Warnf("Failed to write %s %s", autoModeMarker, err)
+			}
+		}
+
+		return execute(c, mode, nil)
+	}
+
+	if isMultipleModes(rebuild, restore, flush, flushDaemon, journal, report, manifest) {
+		return errors.New("Must use a single mode: rebuild, restore, flush, flush_daemon, journal, report or manifest")
+	} else if !rebuild && !restore && !flush && !flushDaemon && !journal && !report && !manifest {
+		return errors.New("No action specified")
+	}
+
+	var mode string
+
+	if rebuild {
 		mode = RebuildMode
+	} else if journal {
+		mode = JournalMode
+	} else if manifest {
+		mode = ManifestMode
 	} else if flush {
 		mode = FlushMode
+	} else if flushDaemon {
+		mode = FlushDaemonMode
+	} else if report {
+		mode = ReportMode
 	} else {
 		mode = RestoreMode
 	}
 
+	return execute(c, mode, nil)
+}
+
+// execute runs the plugin in mode configured by the global flags, with
+// configure applying any further options.
+func execute(c *cli.Context, mode string, configure func(p *Plugin)) error {
+	// Set the logging level
+	if c.Bool("debug") {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	switch c.String("log_timestamps") {
+	case "":
+	case "rfc3339":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true, TimestampFormat: time.RFC3339})
+	default:
+		return fmt.Errorf("Invalid log_timestamps %s. Needs to be rfc3339", c.String("log_timestamps"))
+	}
+
+	var mount []string
+
+	if mode == RebuildMode || mode == JournalMode || mode == ManifestMode {
+		// Look for the mount points to rebuild, watch or list
+		mount = c.StringSlice("mount")
+
+		if len(mount) == 0 {
+			return errors.New("No mounts specified")
+		}
+	} else if mode == RestoreMode {
+		// Staged restores move the mounts into place
+		mount = c.StringSlice("mount")
+	}
+
+	workspace := c.String("workspace")
+
+	if len(workspace) == 0 {
+		workspace, _ = os.Getwd()
+	}
+
+	mount, err := resolveMounts(mount, workspace, c.StringSlice("external_mounts"))
+
+	if err != nil {
+		return err
+	}
+
+	if !c.Bool("allow_dangerous_mounts") {
+		if err := checkDangerousMounts(mount); err != nil {
+			return err
+		}
+	}
+
+	// External mounts only exist in the plugin when shared with the build
+	for _, m := range mount {
+		if !filepath.IsAbs(m) || mode != RebuildMode {
+			continue
+		}
+
+		if _, err := os.Stat(m); err != nil {
+			return fmt.Errorf("External mount %s not found. Mount it as a volume at the same path in the build and plugin steps", m)
+		}
+	}
+
+	if mode == FlushDaemonMode && len(c.StringSlice("flush_prefixes")) == 0 {
+		return errors.New("No flush_prefixes specified")
+	}
+
+	defaultBranch := c.String("default_branch")
+	branch := cacheBranch(c.String("build.event"), c.String("commit.branch"), c.String("target.branch"), defaultBranch)
+
+	// Pull requests restore the cache of their target branch without
+	// writing to it
+	readOnly := c.String("build.event") == "pull_request" && !c.Bool("pull_request_rebuild")
+
+	runner := runnerKey(c.String("stage.os"), c.String("stage.arch"), c.String("runner.label"))
+
+	vars := strings.NewReplacer(
+		"{owner}", c.String("repo.owner"),
+		"{repo}", c.String("repo.name"),
+		"{branch}", branch,
+		"{default_branch}", defaultBranch,
+		"{runner}", runner,
+	)
+
+	keys := &keyData{
+		Branch:        branch,
+		DefaultBranch: defaultBranch,
+		OS:            c.String("stage.os"),
+		Arch:          c.String("stage.arch"),
+		Runner:        runner,
+		Env:           environ(),
+	}
+
+	keys.Repo.Owner = c.String("repo.owner")
+	keys.Repo.Name = c.String("repo.name")
+	keys.Commit.Sha = c.String("commit.sha")
+	keys.Commit.Branch = c.String("commit.branch")
+	keys.Build.Number = c.Int("build.number")
+	keys.Build.Event = c.String("build.event")
+
 	// Get the path to place the cache files
-	path := c.GlobalString("path")
+	pathTemplate := c.GlobalString("path")
 
 	// Defaults to <owner>/<repo>/<branch>/
-	if len(path) == 0 {
+	if len(pathTemplate) == 0 {
 		log.Info("No path specified. Creating default")
 
-		path = fmt.Sprintf(
-			"/%s/%s/%s/",
-			c.String("repo.owner"),
-			c.String("repo.name"),
-			c.String("commit.branch"),
-		)
+		pathTemplate = defaultPathTemplate
+	}
+
+	path, err := keys.render("path", pathTemplate, vars)
+
+	if err != nil {
+		return err
+	}
+
+	// Branch limits apply to every cache of the branch whatever its checksum
+	// or runner
+	branchPath := path
+
+	// Keep the caches of heterogeneous runner pools apart
+	if c.Bool("key_runner") {
+		path += runner + "/"
+	}
+
+	// The actions key scheme looks the key up within the path of the branch
+	scope := path
+	keyScheme := c.String("key_scheme")
+
+	var key string
+
+	switch keyScheme {
+	case "":
+	case KeySchemeActions:
+		if key, err = keys.render("key", c.String("key"), vars); err != nil {
+			return err
+		}
+
+		if key = strings.Trim(key, "/"); len(key) == 0 {
+			return errors.New("key_scheme actions needs a key")
+		}
+	default:
+		return fmt.Errorf("Invalid key_scheme %s. Needs to be %s", keyScheme, KeySchemeActions)
+	}
+
+	// Key the cache by the checksum of files such as lockfiles
+	if files := c.StringSlice("checksum_files"); len(files) > 0 && (mode == RebuildMode || mode == RestoreMode || mode == ManifestMode || mode == CheckMode || mode == BrowseMode || mode == LintMode) {
+		sum, err := checksumFiles(files, c.String("checksum_algorithm"))
+
+		if err != nil {
+			return err
+		}
+
+		if keyScheme == KeySchemeActions {
+			key += "-" + sum
+		} else {
+			path += sum + "/"
+		}
+	}
+
+	if keyScheme == KeySchemeActions {
+		path = scope + key + "/"
 	}
 
 	// Get the fallback path to retrieve the cache files
-	fallbackPath := c.GlobalString("fallback_path")
+	fallbackTemplate := c.GlobalString("fallback_path")
 
-	// Defaults to <owner>/<repo>/master/
-	if len(fallbackPath) == 0 {
+	// Defaults to <owner>/<repo>/<default branch>/
+	if len(fallbackTemplate) == 0 {
 		log.Info("No fallback_path specified. Creating default")
 
-		fallbackPath = fmt.Sprintf(
-			"/%s/%s/master/",
-			c.String("repo.owner"),
-			c.String("repo.name"),
-		)
+		fallbackTemplate = defaultFallbackPathTemplate
+	}
+
+	fallbackPath, err := keys.render("fallback_path", fallbackTemplate, vars)
+
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("key_runner") {
+		fallbackPath += runner + "/"
+	}
+
+	// Get the chain of fallback paths, which replaces fallback_path
+	var fallbackPaths []string
+
+	for _, template := range c.StringSlice("fallback_paths") {
+		rendered, err := keys.render("fallback_paths", template, vars)
+
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("key_runner") {
+			rendered += runner + "/"
+		}
+
+		fallbackPaths = append(fallbackPaths, rendered)
+	}
+
+	if len(fallbackPaths) > 0 {
+		fallbackPath = fallbackPaths[0]
+	}
+
+	// Get the restore keys tried in place of the fallback path
+	var restoreKeys []string
+
+	for _, key := range c.StringSlice("restore_keys") {
+		rendered, err := keys.render("restore_keys", key, vars)
+
+		if err != nil {
+			return err
+		}
+
+		restoreKeys = append(restoreKeys, rendered)
+	}
+
+	// Look the key up in the scope of the branch and then of the default
+	// branch
+	var scopes []string
+
+	if keyScheme == KeySchemeActions {
+		scopes = []string{scope, fallbackPath}
+	}
+
+	// Get the alias keys the rebuilt cache is copied to
+	var aliasKeys []string
+
+	for _, key := range c.StringSlice("alias_keys") {
+		rendered, err := keys.render("alias_keys", key, vars)
+
+		if err != nil {
+			return err
+		}
+
+		aliasKeys = append(aliasKeys, rendered)
 	}
 
 	// Get the flush path to flush the cache files from
-	flushPath := c.GlobalString("flush_path")
+	flushTemplate := c.GlobalString("flush_path")
 
-	// Defaults to <owner>/<repo>/master/
-	if len(flushPath) == 0 {
+	// Defaults to <owner>/<repo>/
+	if len(flushTemplate) == 0 {
 		log.Info("No flush_path specified. Creating default")
 
-		flushPath = fmt.Sprintf(
-			"/%s/%s/",
-			c.String("repo.owner"),
-			c.String("repo.name"),
-		)
+		flushTemplate = defaultFlushPathTemplate
 	}
 
-	// Get the filename
-	filename := c.GlobalString("filename")
+	flushPath, err := keys.render("flush_path", flushTemplate, vars)
 
-	if len(filename) == 0 {
-		log.Info("No filename specified. Creating default")
+	if err != nil {
+		return err
+	}
+
+	// Get the lock electing a single flush daemon
+	flushLock := c.String("flush_lock")
+
+	// Defaults to <bucket>/flush-daemon.lock of the first prefix
+	if len(flushLock) == 0 && mode == FlushDaemonMode {
+		bucket := strings.SplitN(strings.TrimPrefix(c.StringSlice("flush_prefixes")[0], "/"), "/", 2)[0]
+		flushLock = fmt.Sprintf("/%s/flush-daemon.lock", bucket)
+	}
+
+	// Get the path to report on
+	reportPath := c.String("report_path")
+
+	// Defaults to <owner>/
+	if len(reportPath) == 0 {
+		reportPath = fmt.Sprintf("/%s/", c.String("repo.owner"))
+	}
+
+	// Only the default branch rebuilds protected paths unless configured
+	protectedBranches := c.StringSlice("protected_branches")
 
-		filename = "archive.tar"
+	if len(protectedBranches) == 0 {
+		protectedBranches = []string{defaultBranch}
 	}
 
-	s, err := s3Storage(c)
+	// Get the metadata attached to uploads
+	metadata, err := parseMetadata(c.StringSlice("metadata"))
 
 	if err != nil {
 		return err
 	}
 
+	// Get the permission bits cleared on extraction
+	fileModeMask, err := parseModeMask(c.String("file_mode_mask"))
+
+	if err != nil {
+		return err
+	}
+
+	dirModeMask, err := parseModeMask(c.String("dir_mode_mask"))
+
+	if err != nil {
+		return err
+	}
+
+	// Get the paths mounts are routed to
+	routes, err := parseMountRoutes(c.StringSlice("mount_routes"))
+
+	if err != nil {
+		return err
+	}
+
+	// Get the start of the build, before which previous caches were built
+	buildCreated := time.Now()
+
+	if created := c.Int64("build.created"); created > 0 {
+		buildCreated = time.Unix(created, 0)
+	}
+
+	// Get the change journal, which the journal mode always writes
+	journalFile := c.String("journal_file")
+
+	// The journal is shared by the journal, restore and rebuild steps so
+	// unlike scratch files it is not namespaced by step
+	if len(journalFile) == 0 && mode == JournalMode {
+		journalFile = ".cache-journal"
+	}
+
+	// Scratch files are namespaced by build and step
+	tempDir, err := ioutil.TempDir("", fmt.Sprintf("drone-s3-cache-%d-%s-", c.Int("build.number"), sanitizeName(c.String("step.name"))))
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tempDir)
+
+	// External compression replaces the format of the filename in both
+	// directions
+	if (c.String("compressor_cmd") == "") != (c.String("decompressor_cmd") == "") {
+		return errors.New("compressor_cmd and decompressor_cmd must be set together")
+	}
+
+	// Priority paths are available before the restore completes, which
+	// staging prevents
+	if c.Bool("staged_restore") && len(c.StringSlice("restore_priority")) > 0 {
+		return errors.New("restore_priority cannot be used with staged_restore")
+	}
+
+	if c.String("overlay_dir") != "" && len(c.StringSlice("restore_priority")) > 0 {
+		return errors.New("restore_priority cannot be used with overlay_dir")
+	}
+
+	// Get the filename
+	filename, err := keys.render("filename", c.GlobalString("filename"), vars)
+
+	if err != nil {
+		return err
+	}
+
+	filename, err = compressionFilename(filename, c.String("compression"))
+
+	if err != nil {
+		return err
+	}
+
+	if err = checkCompressionLevel(c.String("compression"), filename, c.Int("compression_level")); err != nil {
+		return err
+	}
+
+	compressionThreads := c.Int("compression_threads")
+
+	if compressionThreads < 0 {
+		return fmt.Errorf("Invalid compression_threads %d", compressionThreads)
+	} else if compressionThreads == 0 {
+		compressionThreads = runtime.NumCPU()
+	}
+
+	if err := validCompat(c.String("compat"), c.String("compat_path")); err != nil {
+		return err
+	}
+
+	extractWorkers := c.Int("extract_workers")
+
+	if extractWorkers < 0 {
+		return fmt.Errorf("Invalid extract_workers %d", extractWorkers)
+	} else if extractWorkers == 0 {
+		extractWorkers = runtime.NumCPU()
+	}
+
+	var (
+		s           storage.Storage
+		unreachable error
+	)
+
+	// Linting resolves the keys without the storage, which may not be
+	// reachable from where the settings are checked
+	if cmd := c.String("storage_cmd"); len(cmd) > 0 && mode != LintMode {
+		s = process.New(cmd)
+	} else if mode != LintMode {
+		resolver, err := parseResolver(c.String("server"), c.String("endpoint_ip"), c.StringSlice("hosts"), c.String("dns_server"))
+
+		if err != nil {
+			return err
+		}
+
+		// Fail fast when the endpoint is down rather than hanging on the TCP
+		// timeout. A restore leaves it to the plugin, which skips it like a
+		// miss and only fails it when required
+		if timeout := c.Duration("probe_timeout"); timeout > 0 && mode != JournalMode {
+			if unreachable = probeServers(c.String("server"), timeout, resolver); unreachable != nil && mode != RestoreMode {
+				return unreachable
+			}
+		}
+
+		if unreachable == nil {
+			if s, err = s3Storage(c, mode, tempDir, resolver); err != nil {
+				return err
+			}
+		}
+	}
+
 	flushAge, err := strconv.Atoi(c.String("flush_age"))
 
 	if err != nil {
 		return err
 	}
 
+	// Get the size limit of the mounts
+	var maxSize uint64
+
+	if size := c.String("max_size"); len(size) > 0 {
+		if maxSize, err = humanize.ParseBytes(size); err != nil {
+			return fmt.Errorf("Invalid max_size %s", size)
+		}
+	}
+
+	var branchMaxSize uint64
+
+	if size := c.String("branch_max_size"); len(size) > 0 {
+		if branchMaxSize, err = humanize.ParseBytes(size); err != nil {
+			return fmt.Errorf("Invalid branch_max_size %s", size)
+		}
+	}
+
+	var simulateSize uint64
+
+	if size := c.String("simulate_max_size"); len(size) > 0 {
+		if simulateSize, err = humanize.ParseBytes(size); err != nil {
+			return fmt.Errorf("Invalid simulate_max_size %s", size)
+		}
+	}
+
+	skipExisting := c.Bool("skip_existing") || keyScheme == KeySchemeActions
+
+	// Only keys derived from checksums hold the same contents once written
+	if skipExisting && len(c.StringSlice("checksum_files")) == 0 && keyScheme != KeySchemeActions {
+		log.Warn("skip_existing only applies to keys including the checksum of checksum_files. Rebuilding existing caches")
+		skipExisting = false
+	}
+
+	// Get the thresholds of the transfer strategies
+	transferStrategy := c.String("transfer_strategy")
+
+	if len(transferStrategy) > 0 && transferStrategy != TransferAuto {
+		return fmt.Errorf("Invalid transfer_strategy %s. Needs to be %s", transferStrategy, TransferAuto)
+	}
+
+	transferSingleMax, err := humanize.ParseBytes(c.String("transfer_single_max"))
+
+	if err != nil {
+		return fmt.Errorf("Invalid transfer_single_max %s", c.String("transfer_single_max"))
+	}
+
+	transferShardMin, err := humanize.ParseBytes(c.String("transfer_shard_min"))
+
+	if err != nil {
+		return fmt.Errorf("Invalid transfer_shard_min %s", c.String("transfer_shard_min"))
+	}
+
 	p := &Plugin{
-		Filename:     filename,
-		Path:         path,
-		FallbackPath: fallbackPath,
-		FlushPath:    flushPath,
-		Mode:         mode,
-		FlushAge:     flushAge,
-		Mount:        mount,
-		Storage:      s,
+		Filename:            filename,
+		Path:                path,
+		FallbackPath:        fallbackPath,
+		FallbackPaths:       fallbackPaths,
+		FlushPath:           flushPath,
+		Mode:                mode,
+		Repo:                c.String("repo.owner") + "/" + c.String("repo.name"),
+		FlushAge:            flushAge,
+		FlushDryRun:         c.Bool("flush_dry_run"),
+		FlushCheckpoint:     c.Bool("flush_checkpoint"),
+		FlushForce:          c.Bool("flush_force"),
+		Mount:               mount,
+		ExternalMounts:      c.StringSlice("external_mounts"),
+		FlushPrefixes:       c.StringSlice("flush_prefixes"),
+		FlushInterval:       c.Duration("flush_interval"),
+		FlushSchedule:       c.String("flush_schedule"),
+		FlushLock:           flushLock,
+		JournalFile:         journalFile,
+		ReportPath:          reportPath,
+		ReportFormat:        c.String("report_format"),
+		ReportFile:          c.String("report_file"),
+		SimulateAge:         c.Int("simulate_flush_age"),
+		SimulateSize:        int64(simulateSize),
+		TrackAccess:         c.Bool("track_access"),
+		TrackHits:           c.Bool("track_hits"),
+		RestoreHints:        c.Bool("restore_hints"),
+		ReadOnlyKeys:        usesReadKeys(c, mode) && len(c.String("storage_cmd")) == 0,
+		PhaseMarkers:        c.Bool("phase_markers"),
+		Metadata:            metadata,
+		PreviousPrefix:      c.String("previous_prefix"),
+		AliasKeys:           aliasKeys,
+		RestoreNewest:       c.Bool("restore_newest"),
+		RestoreKeys:         restoreKeys,
+		KeyScheme:           keyScheme,
+		Key:                 key,
+		Scopes:              scopes,
+		LegacyFallback:      c.Bool("legacy_fallback"),
+		BuildCreated:        buildCreated,
+		BuildNumber:         c.Int("build.number"),
+		MaxTransfers:        c.Int("max_transfers"),
+		TransferLocks:       c.String("transfer_locks"),
+		Commit:              c.String("commit.sha"),
+		LocalCache:          c.String("local_cache"),
+		Compat:              c.String("compat"),
+		CompatPath:          c.String("compat_path"),
+		FallbackParallelism: c.Int("fallback_parallelism"),
+		Timeout:             c.Duration("timeout"),
+		ErrorFile:           c.String("error_file"),
+		EnvFile:             c.String("env_file"),
+		Endpoint:            c.String("server"),
+		ProtectedPaths:      c.StringSlice("protected_paths"),
+		ProtectedBranches:   protectedBranches,
+		Event:               c.String("build.event"),
+		ReadOnly:            readOnly,
+		FailOnError:         c.BoolT("fail_on_error"),
+		FailOnMiss:          c.Bool("required"),
+		SkipEmpty:           c.Bool("skip_empty"),
+		MaxCalls:            c.Int("max_calls"),
+		AsyncRebuild:        c.Bool("async_rebuild"),
+		AsyncHelper:         c.Bool("async_helper"),
+		AsyncArchive:        c.String("async_archive"),
+		AsyncKey:            c.String("async_key"),
+		BuildFailed:         c.String("build.status") == "failure" && !c.Bool("rebuild_on_failure"),
+		Branch:              branch,
+		TempDir:             tempDir,
+		Dedup:               c.Bool("dedup"),
+		Shards:              c.Int("shards"),
+		PackSmallFiles:      c.Bool("pack_small_files"),
+		VerboseFiles:        c.Int("verbose_files"),
+		FileModeMask:        fileModeMask,
+		DirModeMask:         dirModeMask,
+		CompressorCmd:       c.String("compressor_cmd"),
+		Compression:         c.String("compression"),
+		CompressionLevel:    c.Int("compression_level"),
+		CompressionThreads:  compressionThreads,
+		ExtractWorkers:      extractWorkers,
+		DecompressorCmd:     c.String("decompressor_cmd"),
+		MergePaths:          c.StringSlice("merge_paths"),
+		RestorePriority:     c.StringSlice("restore_priority"),
+		RestoreSpool:        c.String("restore_spool"),
+		StageType:           c.String("stage.type"),
+		StagedRestore:       c.Bool("staged_restore"),
+		ExactMtimes:         c.Bool("exact_mtimes"),
+		AllowSpecialBits:    c.Bool("allow_special_bits"),
+		MountPriority:       c.StringSlice("mount_priority"),
+		MountRoutes:         routes,
+		MaxFiles:            c.Int("max_files"),
+		SkipExisting:        skipExisting,
+		MaxSize:             int64(maxSize),
+		BranchPath:          branchPath,
+		BranchMaxSize:       int64(branchMaxSize),
+		TransferStrategy:    transferStrategy,
+		TransferSingleMax:   int64(transferSingleMax),
+		TransferShardMin:    int64(transferShardMin),
+		BranchMaxAge:        c.Int("branch_max_age"),
+		Volumes:             c.StringSlice("volumes"),
+		VolumesRoot:         c.String("volumes_root"),
+		OverlayDir:          c.String("overlay_dir"),
+		OverlayMount:        c.Bool("overlay_mount"),
+		Passphrase:          c.String("encryption_passphrase"),
+		Recipients:          c.StringSlice("encryption_recipients"),
+		Identity:            c.String("encryption_identity"),
+		SigningKey:          c.String("signing_key"),
+		VerifyKey:           c.String("verify_key"),
+		Storage:             s,
+		Unreachable:         unreachable,
+	}
+
+	if configure != nil {
+		configure(p)
 	}
 
 	return p.Exec()
 }
 
-func s3Storage(c *cli.Context) (storage.Storage, error) {
-	// Get the endpoint
-	server := c.String("server")
+func s3Storage(c *cli.Context, mode, tempDir string, resolver *s3.Resolver) (storage.Storage, error) {
+	// Get the access credentials, or use the standard AWS credential chain
+	// when none are given
+	access := c.String("access-key")
+	secret := c.String("secret-key")
+
+	if (len(access) == 0) != (len(secret) == 0) {
+		return nil, fmt.Errorf("Both access-key and secret-key need to be provided")
+	}
+
+	token := c.String("session-token")
+
+	// Least privilege setups give the modes which only read the cache other
+	// keys than those writing it
+	prefix := "write"
+
+	if usesReadKeys(c, mode) {
+		prefix = "read"
+	}
+
+	if modeAccess, modeSecret := c.String(prefix+"_access_key"), c.String(prefix+"_secret_key"); len(modeAccess) > 0 || len(modeSecret) > 0 {
+		if len(modeAccess) == 0 || len(modeSecret) == 0 {
+			return nil, fmt.Errorf("Both %s_access_key and %s_secret_key need to be provided", prefix, prefix)
+		}
+
+		log.Infof("Using the %s keys for mode %s", prefix, mode)
+
+		access, secret, token = modeAccess, modeSecret, ""
+	}
+
+	if len(token) > 0 && len(access) == 0 {
+		return nil, fmt.Errorf("A session-token needs the access-key and secret-key it was issued with")
+	}
+
+	caCert := c.String("ca_cert")
+
+	if file := c.String("ca_cert_path"); len(file) > 0 {
+		b, err := ioutil.ReadFile(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read ca_cert_path %s", err)
+		}
+
+		caCert += "\n" + string(b)
+	}
+
+	clientCert, err := pemOrFile("tls_client_cert", c.String("tls_client_cert"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey, err := pemOrFile("tls_client_key", c.String("tls_client_key"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the endpoints, failing over between them when several are given
+	servers := strings.Split(c.String("server"), ",")
+	backends := make([]storage.Storage, len(servers))
+
+	for i, server := range servers {
+		servers[i] = strings.TrimSpace(server)
+
+		endpoint, useSSL, err := s3Endpoint(servers[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		backends[i], err = s3.New(&s3.Options{
+			Provider: c.String("provider"),
+			TempDir:  tempDir,
+			Endpoint: endpoint,
+			Access:   access,
+			Secret:   secret,
+			Token:    token,
+			UseSSL:   useSSL,
+			Region:   c.String("region"),
+			Resolver: resolver,
+			CACert:   caCert,
+
+			SkipVerify: c.Bool("skip_verify"),
+			ClientCert: clientCert,
+			ClientKey:  clientKey,
+
+			Profile:         c.String("aws_profile"),
+			CredentialsFile: c.String("credentials_file"),
+
+			RoleARN:         c.String("role_arn"),
+			RoleSessionName: c.String("role_session_name"),
+			ExternalID:      c.String("external_id"),
+
+			DownloadBaseURL:    c.String("download_base_url"),
+			DownloadKeyPairID:  c.String("download_key_pair_id"),
+			DownloadPrivateKey: c.String("download_private_key"),
+
+			Encryption:    c.String("encryption"),
+			KMSKeyID:      c.String("kms_key_id"),
+			VerifyUploads: c.Bool("verify_uploads"),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+
+	return newFailoverStorage(servers, backends)
+}
+
+// pemOrFile returns the PEM encoded value of the setting name, reading it
+// from the file value names when it is not PEM encoded itself.
+func pemOrFile(name, value string) (string, error) {
+	if len(value) == 0 || strings.Contains(value, "-----BEGIN ") {
+		return value, nil
+	}
+
+	b, err := ioutil.ReadFile(value)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %s %s", name, err)
+	}
+
+	return string(b), nil
+}
+
+// s3Endpoint parses the server into the host, with any port, and whether
+// to use TLS. Servers without a scheme use HTTPS.
+func s3Endpoint(server string) (string, bool, error) {
+	if len(server) == 0 {
+		return "s3.amazonaws.com", true, nil
+	}
 
-	var endpoint string
-	var useSSL bool
+	raw := server
 
-	if len(server) > 0 {
-		useSSL = strings.HasPrefix(server, "https://")
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+
+	if err != nil {
+		return "", false, fmt.Errorf("Invalid server %s. %s", server, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false, fmt.Errorf("Invalid server %s. The scheme needs to be http or https", server)
+	}
 
-		if !useSSL {
-			if !strings.HasPrefix(server, "http://") {
-				return nil, fmt.Errorf("Invalid server %s. Needs to be a HTTP URI", server)
+	if u.User != nil {
+		return "", false, fmt.Errorf("Invalid server %s. Credentials need to be given as access_key and secret_key", server)
+	}
+
+	if len(u.Hostname()) == 0 {
+		return "", false, fmt.Errorf("Invalid server %s. Missing the host", server)
+	}
+
+	if port := u.Port(); len(port) > 0 {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", false, fmt.Errorf("Invalid server %s. The port needs to be between 1 and 65535", server)
+		}
+	}
+
+	if strings.Trim(u.Path, "/") != "" || len(u.RawQuery) > 0 || len(u.Fragment) > 0 {
+		return "", false, fmt.Errorf("Invalid server %s. The bucket belongs in the path parameter rather than the server", server)
+	}
+
+	// IPv6 addresses are only told apart from a port by the brackets, which
+	// the client keeps along with an explicit port
+	if len(u.Port()) == 0 && strings.Contains(u.Hostname(), ":") {
+		if u.Scheme == "https" {
+			return net.JoinHostPort(u.Hostname(), "443"), true, nil
+		}
+
+		return net.JoinHostPort(u.Hostname(), "80"), false, nil
+	}
+
+	return u.Host, u.Scheme == "https", nil
+}
+
+func parseMetadata(pairs []string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+
+		if i < 1 {
+			return nil, fmt.Errorf("Invalid metadata %s. Needs to be key=value", pair)
+		}
+
+		// S3 metadata keys are case insensitive
+		metadata[strings.ToLower(pair[:i])] = pair[i+1:]
+	}
+
+	return metadata, nil
+}
+
+// compressionExtensions are the filename extensions of each compression.
+// The first is used for the default filename.
+var compressionExtensions = map[string][]string{
+	"none": {".tar"},
+	"gzip": {".tgz", ".tar.gz"},
+	"zstd": {".tar.zst", ".tzst"},
+	"lz4":  {".tar.lz4"},
+}
+
+// compressionFilename returns the filename of the cache, defaulting to an
+// archive with the extension of the compression. A filename of another
+// format is kept so a cache can change compression under the same key.
+func compressionFilename(filename, compression string) (string, error) {
+	if len(compression) == 0 {
+		if len(filename) == 0 {
+			log.Info("No filename specified. Creating default")
+			filename = "archive.tar"
+		}
+
+		return filename, nil
+	}
+
+	extensions, ok := compressionExtensions[compression]
+
+	if !ok {
+		return "", fmt.Errorf("Invalid compression %s. Needs to be none, gzip, zstd or lz4", compression)
+	}
+
+	if len(filename) == 0 {
+		log.Info("No filename specified. Creating default")
+		return "archive" + extensions[0], nil
+	}
+
+	for _, ext := range extensions {
+		if strings.HasSuffix(filename, ext) {
+			return filename, nil
+		}
+	}
+
+	log.Warnf("Filename %s does not end in %s. Archiving with %s compression regardless", filename, extensions[0], compression)
+
+	return filename, nil
+}
+
+// compressionLevels are the highest levels of each compression, starting
+// from 1.
+var compressionLevels = map[string]int{
+	"gzip": 9,
+	"zstd": 19,
+	"lz4":  12,
+}
+
+// checkCompressionLevel checks the level is within the range of the
+// compression, or of the format of the filename when none is given.
+func checkCompressionLevel(compression, filename string, level int) error {
+	if level == 0 {
+		return nil
+	}
+
+	if len(compression) == 0 {
+		for name, extensions := range compressionExtensions {
+			for _, ext := range extensions {
+				if strings.HasSuffix(filename, ext) {
+					compression = name
+				}
 			}
+		}
+	}
 
-			endpoint = server[7:]
-		} else {
-			endpoint = server[8:]
+	max, ok := compressionLevels[compression]
+
+	if !ok {
+		return fmt.Errorf("compression_level cannot be set for %s", filename)
+	}
+
+	if level < 1 || level > max {
+		return fmt.Errorf("Invalid compression_level %d. Needs to be between 1 and %d for %s", level, max, compression)
+	}
+
+	return nil
+}
+
+// parseResolver returns the resolver of the endpoint host names, or nil to
+// use the system resolver. The endpoint IP is the address of the host of
+// the single server, while hosts are host=ip pairs.
+func parseResolver(servers, endpointIP string, hosts []string, dnsServer string) (*s3.Resolver, error) {
+	if len(endpointIP) == 0 && len(hosts) == 0 && len(dnsServer) == 0 {
+		return nil, nil
+	}
+
+	r := &s3.Resolver{
+		Hosts:     make(map[string]string),
+		DNSServer: dnsServer,
+	}
+
+	for _, pair := range hosts {
+		i := strings.Index(pair, "=")
+
+		if i < 1 || net.ParseIP(pair[i+1:]) == nil {
+			return nil, fmt.Errorf("Invalid host %s. Needs to be host=ip", pair)
 		}
-	} else {
-		endpoint = "s3.amazonaws.com"
-		useSSL = true
+
+		r.Hosts[pair[:i]] = pair[i+1:]
 	}
 
-	// Get the access credentials
-	access := c.String("access-key")
-	secret := c.String("secret-key")
+	if len(endpointIP) > 0 {
+		if strings.Contains(servers, ",") {
+			return nil, errors.New("endpoint_ip cannot be used with several servers. Use hosts instead")
+		}
+
+		if net.ParseIP(endpointIP) == nil {
+			return nil, fmt.Errorf("Invalid endpoint_ip %s", endpointIP)
+		}
+
+		endpoint, _, err := s3Endpoint(strings.TrimSpace(servers))
+
+		if err != nil {
+			return nil, err
+		}
+
+		host := endpoint
+		if h, _, err := net.SplitHostPort(endpoint); err == nil {
+			host = h
+		}
+
+		r.Hosts[host] = endpointIP
+	}
+
+	return r, nil
+}
+
+func parseMountRoutes(pairs []string) ([]mountRoute, error) {
+	var routes []mountRoute
+
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+
+		if i < 1 || i == len(pair)-1 {
+			return nil, fmt.Errorf("Invalid mount route %s. Needs to be mount=path", pair)
+		}
+
+		path := pair[i+1:]
+
+		if !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+
+		routes = append(routes, mountRoute{Mount: pair[:i], Path: path})
+	}
+
+	return routes, nil
+}
+
+func parseModeMask(mask string) (os.FileMode, error) {
+	if len(mask) == 0 {
+		return 0, nil
+	}
+
+	m, err := strconv.ParseUint(mask, 8, 32)
 
-	if len(access) == 0 || len(secret) == 0 {
-		return nil, fmt.Errorf("No access credentials provided")
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("Invalid mode mask %s. Needs to be octal permission bits like 022", mask)
 	}
 
-	return s3.New(&s3.Options{
-		Endpoint: endpoint,
-		Access:   access,
-		Secret:   secret,
-		UseSSL:   useSSL,
-	})
+	return os.FileMode(m), nil
+}
+
+// pickAutoMode returns the mode picked by mode auto: restore the first time
+// the plugin runs in the workspace, recorded by autoModeMarker, and rebuild
+// afterwards, skipping the rebuild of a failed build.
+func pickAutoMode(restored bool, status string) (mode string, skip bool) {
+	if !restored {
+		return RestoreMode, false
+	}
+
+	return RebuildMode, status == "failure"
+}
+
+// cacheBranch returns the branch keying the cache. Pull requests use the
+// cache of their target branch, and builds without a branch, such as tags,
+// the default branch.
+func cacheBranch(event, commitBranch, targetBranch, defaultBranch string) string {
+	if event == "pull_request" && len(targetBranch) > 0 {
+		return targetBranch
+	}
+
+	if len(commitBranch) == 0 {
+		return defaultBranch
+	}
+
+	return commitBranch
+}
+
+// runnerKey identifies the runner pool by its operating system and
+// architecture, defaulting to those of the plugin, and label when set.
+func runnerKey(goos, goarch, label string) string {
+	if len(goos) == 0 {
+		goos = runtime.GOOS
+	}
+
+	if len(goarch) == 0 {
+		goarch = runtime.GOARCH
+	}
+
+	key := goos + "-" + goarch
+
+	if len(label) > 0 {
+		key += "-" + label
+	}
+
+	return sanitizeName(key)
+}
+
+// usesReadKeys reports whether mode runs with the read-only keys.
+func usesReadKeys(c *cli.Context, mode string) bool {
+	return isReadMode(mode) && (len(c.String("read_access_key")) > 0 || len(c.String("read_secret_key")) > 0)
+}
+
+// isReadMode reports whether mode only reads the caches, other than the
+// markers and records restores leave next to them.
+func isReadMode(mode string) bool {
+	switch mode {
+	case RestoreMode, CheckMode, BrowseMode, ListMode, ReportMode:
+		return true
+	}
+
+	return false
+}
+
+// sanitizeName makes name safe to use in a file name.
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, name)
 }
 
 func isMultipleModes(bools ...bool) bool {
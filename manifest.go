@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// manifestSuffix is appended to the key of an archive for its manifest.
+const manifestSuffix = ".manifest.json"
+
+// manifestFile is a file listed in a manifest. Directories are not listed
+// and symlinks are listed with their target instead of a hash.
+type manifestFile struct {
+	Path   string `json:"path"`
+	Mode   string `json:"mode"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// cacheManifest lists the files of a cache, for inspecting a cache without
+// downloading the archive.
+type cacheManifest struct {
+	// ETag is the entity tag of the archive the manifest was published
+	// for, so it is not read once the archive is rebuilt. Empty where the
+	// storage has no entity tags.
+	ETag string `json:"etag,omitempty"`
+
+	Files []manifestFile `json:"files"`
+}
+
+// buildManifest walks the paths listing every file with its hash.
+func buildManifest(paths []string) (*cacheManifest, error) {
+	manifest := &cacheManifest{Files: []manifestFile{}}
+
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+
+			file := manifestFile{
+				Path: filepath.ToSlash(path),
+				Mode: fi.Mode().String(),
+				Size: fi.Size(),
+			}
+
+			if fi.Mode()&os.ModeSymlink != 0 {
+				file.Link, err = os.Readlink(path)
+			} else if fi.Mode().IsRegular() {
+				file.SHA256, err = sha256File(path)
+			}
+
+			manifest.Files = append(manifest.Files, file)
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// publishManifest uploads the manifest of the mounts next to the archive at
+// key, tied to the archive by its entity tag.
+func (p *Plugin) publishManifest(key string) error {
+	if !exists(p.Storage, key) {
+		return fmt.Errorf("%w at %s. Publish the manifest once the cache is rebuilt", errCacheMiss, key)
+	}
+
+	manifest, err := buildManifest(p.Mount)
+
+	if err != nil {
+		return err
+	}
+
+	manifest.ETag = archiveETag(p.Storage, key)
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Publishing manifest of %d files at %s", len(manifest.Files), key+manifestSuffix)
+
+	return p.Storage.Put(key+manifestSuffix, bytes.NewReader(b))
+}
+
+// archiveETag returns the entity tag of the archive at key, or an empty
+// string where the storage has none.
+func archiveETag(s storage.Storage, key string) string {
+	if ts, ok := s.(taggedStorage); ok {
+		if etag, err := ts.ETag(key); err == nil {
+			return etag
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBuildManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("src/dir", 0755)
+	ioutil.WriteFile("src/dir/file", []byte("cached"), 0644)
+	os.Symlink("dir/file", "src/link")
+
+	manifest, err := buildManifest([]string{"src"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Files) != 2 {
+		t.Fatalf("Expected the file and link without directories, got %+v", manifest.Files)
+	}
+
+	file, link := manifest.Files[0], manifest.Files[1]
+
+	if file.Path != "src/dir/file" || file.Size != 6 || file.SHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte("cached"))) {
+		t.Errorf("Expected the file with its size and hash, got %+v", file)
+	}
+
+	if link.Path != "src/link" || link.Link != "dir/file" || link.SHA256 != "" {
+		t.Errorf("Expected the link with its target, got %+v", link)
+	}
+}
+
+func TestPublishManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.Mkdir("src", 0755)
+	ioutil.WriteFile("src/file", []byte("cached"), 0644)
+
+	s := &versionedStorage{memoryStorage: newMemoryStorage(), versions: make(map[string]int)}
+	p := &Plugin{Storage: s, Mount: []string{"src"}}
+	key := "/bucket/repo/master/archive.tar"
+
+	if err := p.publishManifest(key); !errors.Is(err, errCacheMiss) {
+		t.Errorf("Expected no manifest without a cache, got %v", err)
+	}
+
+	s.Put(key, bytes.NewReader([]byte("archive")))
+
+	if err := p.publishManifest(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest, err := readManifest(s, key); err != nil || len(manifest.Files) != 1 {
+		t.Errorf("Expected the manifest of the cache, got %+v %v", manifest, err)
+	}
+
+	// Rebuilding the cache leaves the manifest behind
+	s.versions[key]++
+
+	if _, err := readManifest(s, key); err == nil {
+		t.Error("Expected the manifest of an earlier archive not to be read")
+	}
+}
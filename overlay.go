@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// overlayScript names the script in the overlay directory mounting the
+// restored cache over the mounts.
+const overlayScript = "mount.sh"
+
+// newOverlayLower empties the directory under dir the cache is unpacked
+// into, the lower layer of the overlays.
+func newOverlayLower(dir string) (string, error) {
+	lower, err := filepath.Abs(filepath.Join(dir, "lower"))
+
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.RemoveAll(lower); err != nil {
+		return "", err
+	}
+
+	return lower, os.MkdirAll(lower, 0755)
+}
+
+// overlayMounts writes the commands mounting an overlay of each mount
+// restored into lower over the mount, with the current contents of the
+// mount beneath the cache and changes going to an upper directory of the
+// overlay directory, so read-only build roots can be backed by the cache.
+// With OverlayMount the overlays are mounted as well.
+func (p *Plugin) overlayMounts(lower string) error {
+	dir := filepath.Dir(lower)
+	names := make([]string, 0, len(p.Mount))
+
+	for _, mount := range p.Mount {
+		names = append(names, filepath.Clean(strings.TrimPrefix(mount, "/")))
+	}
+
+	// Parents are mounted before the mounts nested in them
+	sort.Strings(names)
+
+	var script bytes.Buffer
+	script.WriteString("#!/bin/sh\nset -e\n")
+
+	for _, name := range names {
+		layer := filepath.Join(lower, name)
+
+		if _, err := os.Lstat(layer); err != nil {
+			log.Debugf("Mount %s not in the cache. Not overlaying it", name)
+			continue
+		}
+
+		target, err := filepath.Abs(name)
+
+		if err != nil {
+			return err
+		}
+
+		upper := filepath.Join(dir, "upper", name)
+		work := filepath.Join(dir, "work", name)
+
+		for _, d := range []string{upper, work} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return err
+			}
+		}
+
+		// The mount itself is the lowest layer, so files of a read-only
+		// build root stay visible beneath the cache
+		lowers := layer
+
+		if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+			lowers += ":" + target
+		}
+
+		options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowers, upper, work)
+
+		fmt.Fprintf(&script, "mkdir -p %s\nmount -t overlay overlay -o %s %s\n", shellQuote(target), shellQuote(options), shellQuote(target))
+
+		if !p.OverlayMount {
+			continue
+		}
+
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+
+		if err := mountOverlay(options, target); err != nil {
+			return fmt.Errorf("Failed to mount the overlay of %s %s", name, err)
+		}
+
+		log.Infof("Mounted the cache of %s as an overlay", name)
+	}
+
+	file := filepath.Join(dir, overlayScript)
+
+	if err := ioutil.WriteFile(file, script.Bytes(), 0755); err != nil {
+		return err
+	}
+
+	if !p.OverlayMount {
+		log.Infof("Cache restored into %s. Mount it over the mounts with %s", lower, file)
+	}
+
+	return nil
+}
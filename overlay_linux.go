@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// mountOverlay mounts an overlay with options at target, which needs the
+// step to be privileged.
+func mountOverlay(options, target string) error {
+	return syscall.Mount("overlay", target, "overlay", 0, options)
+}
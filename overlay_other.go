@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func mountOverlay(options, target string) error {
+	return errors.New("Overlay mounts are only supported on linux")
+}
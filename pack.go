@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	cachearchive "github.com/drone-plugins/drone-s3-cache/pkg/archive"
+)
+
+const (
+	// smallFileSize is the size below which files are packed into blocks.
+	smallFileSize = 16 * 1024
+
+	// packBlockSize is the size at which a block of small files is written.
+	packBlockSize = 4 * 1024 * 1024
+
+	// packIndexKey is the PAX record holding the index of a block.
+	packIndexKey = "DRONECACHE.pack"
+)
+
+// packedFile is the index entry of a file within a block.
+type packedFile struct {
+	Name string `json:"name"`
+	Mode int64  `json:"mode"`
+	Size int64  `json:"size"`
+
+	// ModTime is in nanoseconds since the epoch, missing from blocks
+	// packed before it was recorded.
+	ModTime int64 `json:"mtime,omitempty"`
+}
+
+// tarWriter writes entries to a tar stream, packing small files into blocks
+// when enabled. A block is a single entry holding the contents of many
+// files, with an index to restore them, which avoids the per entry work of
+// extracting them individually.
+type tarWriter struct {
+	tw    *cachearchive.Writer
+	pack  bool
+	exact bool
+
+	// special keeps the special mode bits and capabilities of the files,
+	// which are stripped otherwise.
+	special bool
+
+	name   func(path string) string
+	log    *fileLog
+	phases *phaseTracker
+
+	block  bytes.Buffer
+	index  []packedFile
+	blocks int
+
+	files int
+	small int
+}
+
+func (a *tarArchive) newWriter(w io.Writer, f cachearchive.Format, level int) (*tarWriter, error) {
+	tw, err := cachearchive.NewWriter(w, f, level)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tarWriter{
+		tw:      tw,
+		pack:    a.packSmallFiles,
+		exact:   a.exactMtimes,
+		special: a.specialBits,
+		name:    a.entryName,
+		log:     a.files,
+		phases:  a.phases,
+	}, nil
+}
+
+func (w *tarWriter) add(path string, fi os.FileInfo) error {
+	isSmall := fi.Mode().IsRegular() && fi.Size() < smallFileSize
+
+	if fi.Mode().IsRegular() {
+		w.files++
+		if isSmall {
+			w.small++
+		}
+	}
+
+	if fi.Mode().IsRegular() || fi.Mode()&os.ModeSymlink != 0 {
+		w.log.record(path)
+		w.phases.addFile("archive")
+	}
+
+	// Blocks only keep the permissions so special files are written alone,
+	// which keeps or strips their special bits with a warning
+	if !w.pack || !isSmall || hasSpecialBits(path, fi) {
+		return w.writeEntry(path, fi)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(&w.block, file)
+	file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	mtime := fi.ModTime()
+	if !w.exact {
+		mtime = mtime.Truncate(time.Second)
+	}
+
+	w.index = append(w.index, packedFile{
+		Name:    w.name(path),
+		Mode:    int64(fi.Mode().Perm()),
+		Size:    n,
+		ModTime: mtime.UnixNano(),
+	})
+
+	if w.block.Len() >= packBlockSize {
+		return w.flush()
+	}
+
+	return nil
+}
+
+// flush writes the pending block of small files.
+func (w *tarWriter) flush() error {
+	if len(w.index) == 0 {
+		return nil
+	}
+
+	index, err := json.Marshal(w.index)
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       fmt.Sprintf(".cache-pack/%d", w.blocks),
+		Mode:       0644,
+		Size:       int64(w.block.Len()),
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{packIndexKey: string(index)},
+	}
+
+	if err = w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if _, err = w.block.WriteTo(w.tw); err != nil {
+		return err
+	}
+
+	log.Debugf("Packed %d small files into block %d", len(w.index), w.blocks)
+
+	w.blocks++
+	w.index = w.index[:0]
+	w.block.Reset()
+
+	return nil
+}
+
+func (w *tarWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	if w.blocks > 0 {
+		log.Infof("Packed %d of %d files into %d blocks", w.small, w.files, w.blocks)
+	} else if !w.pack && w.files > 1000 && w.small*10 >= w.files*9 {
+		log.Infof("%d of %d files are smaller than %d bytes. Consider enabling pack_small_files", w.small, w.files, smallFileSize)
+	}
+
+	return w.tw.Close()
+}
+
+// unpackBlock restores the small files packed in a block using its index.
+func (a *tarArchive) unpackBlock(dst string, index string, r io.Reader) error {
+	var files []packedFile
+
+	if err := json.Unmarshal([]byte(index), &files); err != nil {
+		return fmt.Errorf("Invalid block index %s", err)
+	}
+
+	block := make([]byte, 0, packBlockSize+smallFileSize)
+	buf := bytes.NewBuffer(block)
+
+	if _, err := io.Copy(buf, r); err != nil {
+		return err
+	}
+
+	dirs := make(map[string]bool)
+
+	for _, file := range files {
+		target, err := a.target(dst, file.Name)
+
+		if err != nil {
+			return err
+		}
+		contents := buf.Next(int(file.Size))
+
+		if int64(len(contents)) != file.Size {
+			return fmt.Errorf("Block is missing contents of %s", target)
+		}
+
+		if dir := filepath.Dir(target); !dirs[dir] {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			dirs[dir] = true
+		}
+
+		if err := writeBlockFile(target, os.FileMode(file.Mode), contents); err != nil {
+			return err
+		}
+
+		if err := applyMask(target, os.FileMode(file.Mode), a.fileMask); err != nil {
+			return err
+		}
+
+		if file.ModTime != 0 {
+			if err := setModTime(target, time.Unix(0, file.ModTime)); err != nil {
+				return err
+			}
+		}
+
+		a.unpacked(target)
+	}
+
+	return nil
+}
+
+func writeBlockFile(target string, mode os.FileMode, contents []byte) error {
+	// Without checking the target first a symlink must not be followed
+	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY | syscall.O_NOFOLLOW
+
+	f, err := os.OpenFile(target, flags, mode)
+
+	if err != nil {
+		// Replace anything left behind by a previous layer, such as a
+		// symlink or directory, and try again
+		if rerr := removeIfExists(target); rerr != nil {
+			return err
+		}
+
+		if f, err = os.OpenFile(target, flags, mode); err != nil {
+			return err
+		}
+	}
+
+	_, err = f.Write(contents)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
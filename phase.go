@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+)
+
+// phaseOrder is the order phases are reported in.
+var phaseOrder = []string{"list", "head", "download", "extract", "archive", "upload"}
+
+// phaseStat is the time spent in a phase and how far it got.
+type phaseStat struct {
+	elapsed time.Duration
+	started time.Time
+	active  int
+	bytes   int64
+	files   int
+}
+
+// phaseTracker records the time spent in each phase of an operation, to
+// attribute a timeout. Phases overlap as archives are streamed, so the
+// time of a phase counts while any call in it is running.
+type phaseTracker struct {
+	mu     sync.Mutex
+	phases map[string]*phaseStat
+	latest string
+
+	// markers logs when each phase starts and ends.
+	markers bool
+}
+
+func newPhaseTracker() *phaseTracker {
+	return &phaseTracker{phases: make(map[string]*phaseStat)}
+}
+
+func (t *phaseTracker) stat(name string) *phaseStat {
+	s, ok := t.phases[name]
+
+	if !ok {
+		s = &phaseStat{}
+		t.phases[name] = s
+	}
+
+	return s
+}
+
+// begin enters the phase, returning the function leaving it.
+func (t *phaseTracker) begin(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.stat(name)
+	t.latest = name
+
+	if s.active == 0 {
+		s.started = time.Now()
+
+		if t.markers {
+			log.Infof("phase=%s event=start", name)
+		}
+	}
+
+	s.active++
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		s.active--
+
+		if s.active == 0 {
+			elapsed := time.Since(s.started)
+			s.elapsed += elapsed
+
+			if t.markers {
+				log.Infof("phase=%s event=end duration=%s", name, formatSeconds(elapsed))
+			}
+		}
+	}
+}
+
+// last returns the phase entered most recently, where an operation which
+// failed stopped.
+func (t *phaseTracker) last() string {
+	if t == nil {
+		return ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.latest
+}
+
+func (t *phaseTracker) addBytes(name string, n int64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.stat(name).bytes += n
+	t.mu.Unlock()
+}
+
+func (t *phaseTracker) addFile(name string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.stat(name).files++
+	t.mu.Unlock()
+}
+
+// counts returns the bytes and files the phase got through.
+func (t *phaseTracker) counts(name string) (int64, int) {
+	if t == nil {
+		return 0, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.stat(name)
+	return s.bytes, s.files
+}
+
+// durations lists the time spent in each phase entered, e.g.
+// "archive=12.3s upload=45.1s".
+func (t *phaseTracker) durations() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var parts []string
+
+	for _, name := range phaseOrder {
+		if s, ok := t.phases[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", name, formatSeconds(s.elapsed)))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// formatSeconds formats d in seconds to a tenth, e.g. "12.3s".
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
+
+// String summarises the phases entered, marking those still running.
+func (t *phaseTracker) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var parts []string
+
+	for _, name := range phaseOrder {
+		s, ok := t.phases[name]
+
+		if !ok {
+			continue
+		}
+
+		elapsed := s.elapsed
+		if s.active > 0 {
+			elapsed += time.Since(s.started)
+		}
+
+		part := fmt.Sprintf("%s %s", name, elapsed.Round(time.Millisecond))
+
+		if s.files > 0 {
+			part += fmt.Sprintf(", %d files", s.files)
+		}
+
+		if s.bytes > 0 {
+			part += ", " + humanize.Bytes(uint64(s.bytes))
+		}
+
+		if s.active > 0 {
+			part += " (running)"
+		}
+
+		parts = append(parts, part)
+	}
+
+	if len(parts) == 0 {
+		return "no phase started"
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// trackedStorage records the time and bytes of storage calls by phase.
+type trackedStorage struct {
+	metadataStorage
+
+	phases *phaseTracker
+}
+
+func (s *trackedStorage) Get(p string, dst io.Writer) error {
+	defer s.phases.begin("download")()
+
+	return s.metadataStorage.Get(p, &phaseWriter{w: dst, t: s.phases, phase: "download"})
+}
+
+func (s *trackedStorage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+func (s *trackedStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	defer s.phases.begin("upload")()
+
+	return s.metadataStorage.PutWithMetadata(p, &phaseReader{r: src, t: s.phases, phase: "upload"}, metadata)
+}
+
+func (s *trackedStorage) List(p string) ([]storage.FileEntry, error) {
+	defer s.phases.begin("list")()
+
+	return s.metadataStorage.List(p)
+}
+
+func (s *trackedStorage) Stat(p string) (storage.FileEntry, map[string]string, error) {
+	defer s.phases.begin("head")()
+
+	return s.metadataStorage.Stat(p)
+}
+
+func (s *trackedStorage) ETag(p string) (string, error) {
+	defer s.phases.begin("head")()
+
+	if ts, ok := s.metadataStorage.(taggedStorage); ok {
+		return ts.ETag(p)
+	}
+
+	return "", errors.New("Storage does not support entity tags")
+}
+
+func (s *trackedStorage) Copy(src, dst string) error {
+	defer s.phases.begin("upload")()
+
+	if cs, ok := s.metadataStorage.(copyingStorage); ok {
+		return cs.Copy(src, dst)
+	}
+
+	return errNoCopy
+}
+
+func (s *trackedStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	defer s.phases.begin("upload")()
+
+	if cs, ok := s.metadataStorage.(conditionalStorage); ok {
+		return cs.PutIfMatch(p, src, etag, metadata)
+	}
+
+	return false, errors.New("Storage does not support conditional writes")
+}
+
+type phaseWriter struct {
+	w     io.Writer
+	t     *phaseTracker
+	phase string
+}
+
+func (w *phaseWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.t.addBytes(w.phase, int64(n))
+	return n, err
+}
+
+type phaseReader struct {
+	r     io.Reader
+	t     *phaseTracker
+	phase string
+}
+
+func (r *phaseReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.addBytes(r.phase, int64(n))
+	return n, err
+}
+
+func (r *phaseReader) Size() int64 {
+	return readerSize(r.r)
+}
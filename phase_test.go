@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseTracker(t *testing.T) {
+	tracker := newPhaseTracker()
+
+	if got := tracker.String(); got != "no phase started" {
+		t.Errorf("Expected no phase started, got %q", got)
+	}
+
+	tracker.begin("download")()
+	tracker.addBytes("download", 2048)
+
+	end := tracker.begin("extract")
+	tracker.addFile("extract")
+	tracker.addFile("extract")
+
+	got := tracker.String()
+
+	for _, want := range []string{"download ", ", 2.0 kB", "extract ", ", 2 files (running)"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in %q", want, got)
+		}
+	}
+
+	if strings.Index(got, "download") > strings.Index(got, "extract") {
+		t.Errorf("Expected phases in order, got %q", got)
+	}
+
+	end()
+
+	if got = tracker.String(); strings.Contains(got, "running") {
+		t.Errorf("Expected no running phase, got %q", got)
+	}
+
+	// A nil tracker ignores everything
+	var none *phaseTracker
+	none.begin("archive")()
+	none.addFile("archive")
+}
+
+func TestPhaseDurations(t *testing.T) {
+	tracker := newPhaseTracker()
+	tracker.markers = true
+
+	tracker.begin("upload")()
+	tracker.begin("archive")()
+
+	got := tracker.durations()
+
+	if got != "archive=0.0s upload=0.0s" {
+		t.Errorf("Expected archive=0.0s upload=0.0s, got %q", got)
+	}
+
+	if got := formatSeconds(12345 * time.Millisecond); got != "12.3s" {
+		t.Errorf("Expected 12.3s, got %s", got)
+	}
+}
@@ -0,0 +1,241 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFromFilename(t *testing.T) {
+	tests := map[string]Format{
+		"archive.tar":     Tar,
+		"archive.tgz":     Gzip,
+		"archive.tar.gz":  Gzip,
+		"archive.tzst":    Zstd,
+		"archive.tar.zst": Zstd,
+		"archive.tar.lz4": LZ4,
+	}
+
+	for name, format := range tests {
+		if f, err := FromFilename(name); err != nil || f != format {
+			t.Errorf("Expected %s to be %s, got %s %v", name, format, f, err)
+		}
+	}
+
+	if _, err := FromFilename("archive.zip"); err == nil {
+		t.Error("Expected an unknown file format to fail")
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name  string
+		clean string
+		safe  bool
+	}{
+		{"src/file", "src/file", true},
+		{"/src/file", "src/file", true},
+		{"src/../file", "file", true},
+		{"/../file", "file", true},
+		{"../file", "", false},
+		{"src/../../file", "", false},
+	}
+
+	for _, test := range tests {
+		clean, err := CleanName(test.name)
+
+		if test.safe && (err != nil || clean != test.clean) {
+			t.Errorf("Expected %s to clean to %s, got %s %v", test.name, test.clean, clean, err)
+		}
+
+		if !test.safe && !errors.Is(err, ErrUnsafeName) {
+			t.Errorf("Expected %s to be unsafe, got %s", test.name, clean)
+		}
+	}
+}
+
+// writeArchive writes an archive of files, by name, in format f.
+func writeArchive(t testing.TB, f Format, files map[string]string) []byte {
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contents := range files {
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+
+		io.WriteString(w, contents)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// readArchive reads the files of an archive by name.
+func readArchive(r io.Reader) (map[string]string, error) {
+	ar, err := NewReader(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string)
+
+	for {
+		header, err := ar.Next()
+
+		if err == io.EOF {
+			return files, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadAll(ar)
+
+		if err != nil {
+			return nil, err
+		}
+
+		files[header.Name] = string(b)
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("src/file", "contents", true)
+	f.Add("/abs/file", "", false)
+	f.Add("dir/../file", strings.Repeat("x", 1024), true)
+
+	f.Fuzz(func(t *testing.T, name, contents string, gzip bool) {
+		clean, err := CleanName(name)
+
+		if err != nil || clean == "." || strings.ContainsAny(name, "\x00") {
+			t.Skip()
+		}
+
+		format := Tar
+		if gzip {
+			format = Gzip
+		}
+
+		b := writeArchive(t, format, map[string]string{name: contents})
+
+		if sniffed := Sniff(bufio.NewReader(bytes.NewReader(b))); sniffed != format {
+			t.Fatalf("Expected %s to be detected, got %q", format, sniffed)
+		}
+
+		files, err := readArchive(bytes.NewReader(b))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if files[clean] != contents {
+			t.Errorf("Expected %q to read back as %q, got %v", name, clean, files)
+		}
+	})
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add(writeArchive(f, Tar, map[string]string{"src/file": "contents"}))
+	f.Add(writeArchive(f, Gzip, map[string]string{"../escape": "contents"}))
+	f.Add([]byte{0x1f, 0x8b, 0x08})
+	f.Add([]byte(ManifestMagic))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		ar, err := NewReader(bytes.NewReader(b))
+
+		if err != nil {
+			return
+		}
+
+		for {
+			header, err := ar.Next()
+
+			if err != nil {
+				return
+			}
+
+			if header.Name == ".." || strings.HasPrefix(header.Name, "../") || strings.HasPrefix(header.Name, "/") {
+				t.Fatalf("Expected only names inside the root, got %s", header.Name)
+			}
+
+			if _, err := io.Copy(ioutil.Discard, ar); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzSniff(f *testing.F) {
+	f.Add(writeArchive(f, Tar, map[string]string{"file": "contents"}))
+	f.Add(gzipMagic)
+	f.Add(zstdMagic)
+	f.Add(lz4Magic)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bufio.NewReader(bytes.NewReader(b))
+		Sniff(r)
+
+		rest, _ := ioutil.ReadAll(r)
+
+		if !bytes.Equal(rest, b) {
+			t.Fatal("Expected sniffing not to consume the archive")
+		}
+	})
+}
+
+func FuzzReadManifest(f *testing.F) {
+	var buf bytes.Buffer
+	WriteManifest(&buf, &Manifest{Parts: []string{"/bucket/archive.tar.part-0", "/bucket/archive.tar.part-1"}})
+
+	f.Add(buf.Bytes())
+	f.Add([]byte(ManifestMagic + "{"))
+	f.Add([]byte("not a manifest"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bufio.NewReader(bytes.NewReader(b))
+		m, isManifest, err := ReadManifest(r)
+
+		if isManifest != bytes.HasPrefix(b, []byte(ManifestMagic)) {
+			t.Fatalf("Expected the magic to tell manifests apart, got %t", isManifest)
+		}
+
+		if !isManifest {
+			if rest, _ := ioutil.ReadAll(r); !bytes.Equal(rest, b) {
+				t.Fatal("Expected nothing to be consumed from other objects")
+			}
+
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		var out bytes.Buffer
+
+		if err := WriteManifest(&out, m); err != nil {
+			t.Fatal(err)
+		}
+
+		again, _, err := ReadManifest(bufio.NewReader(&out))
+
+		if err != nil || len(again.Parts) != len(m.Parts) {
+			t.Fatalf("Expected the manifest to round trip, got %v %v", again, err)
+		}
+	})
+}
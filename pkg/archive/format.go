@@ -0,0 +1,84 @@
+// Package archive reads and writes the tar streams caches are stored as,
+// detecting their compression from the magic bytes, along with the
+// manifests uploaded in place of archives split into parts.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Format is the compression of an archive.
+type Format string
+
+// Formats of the archives detected on read.
+const (
+	Tar  Format = "tar"
+	Gzip Format = "gzip"
+	Zstd Format = "zstd"
+	LZ4  Format = "lz4"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+
+	// tarMagic is at tarMagicOffset in the header of ustar, pax and GNU
+	// archives.
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+)
+
+// Sniff detects the format of the archive from its magic bytes without
+// consuming them. It returns an empty format when they are not recognised.
+func Sniff(r *bufio.Reader) Format {
+	if b, _ := r.Peek(len(zstdMagic)); bytes.Equal(b, zstdMagic) {
+		return Zstd
+	}
+
+	if b, _ := r.Peek(len(lz4Magic)); bytes.Equal(b, lz4Magic) {
+		return LZ4
+	}
+
+	if b, _ := r.Peek(len(gzipMagic)); bytes.Equal(b, gzipMagic) {
+		return Gzip
+	}
+
+	if b, _ := r.Peek(tarMagicOffset + len(tarMagic)); len(b) == tarMagicOffset+len(tarMagic) && bytes.Equal(b[tarMagicOffset:], tarMagic) {
+		return Tar
+	}
+
+	return ""
+}
+
+// FromFilename returns the format of an archive named name.
+func FromFilename(name string) (Format, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return Tar, nil
+	case strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".tar.gz"):
+		return Gzip, nil
+	case strings.HasSuffix(name, ".tzst") || strings.HasSuffix(name, ".tar.zst"):
+		return Zstd, nil
+	case strings.HasSuffix(name, ".tar.lz4"):
+		return LZ4, nil
+	}
+
+	return "", fmt.Errorf("Unknown file format for archive %s", name)
+}
+
+// FromCompression returns the format of the compression setting, where
+// none is an uncompressed tar.
+func FromCompression(compression string) (Format, error) {
+	switch compression {
+	case "none":
+		return Tar, nil
+	case "gzip", "zstd", "lz4":
+		return Format(compression), nil
+	}
+
+	return "", fmt.Errorf("Invalid compression %s. Needs to be none, gzip, zstd or lz4", compression)
+}
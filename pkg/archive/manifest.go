@@ -0,0 +1,52 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ManifestMagic starts the body of a manifest, which is uploaded in place
+// of an archive split into several parts.
+const ManifestMagic = "drone-s3-cache-manifest\n"
+
+// Manifest lists the parts making up an archive.
+type Manifest struct {
+	Parts []string `json:"parts"`
+}
+
+// ReadManifest returns the manifest when r starts with one, reporting
+// whether it does. Nothing is consumed otherwise.
+func ReadManifest(r *bufio.Reader) (*Manifest, bool, error) {
+	magic, err := r.Peek(len(ManifestMagic))
+
+	if err != nil || string(magic) != ManifestMagic {
+		return nil, false, nil
+	}
+
+	r.Discard(len(ManifestMagic))
+
+	manifest := &Manifest{}
+	if err = json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, true, fmt.Errorf("Invalid shard manifest %s", err)
+	}
+
+	return manifest, true, nil
+}
+
+// WriteManifest writes m to w.
+func WriteManifest(w io.Writer, m *Manifest) error {
+	b, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(w, ManifestMagic); err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,137 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ErrUnsupported is returned for formats compressed with external
+// commands, which callers decompress themselves.
+var ErrUnsupported = errors.New("Format is not supported natively")
+
+// ErrUnsafeName is returned for entries named outside the directory the
+// archive is unpacked into.
+var ErrUnsafeName = errors.New("Entry is outside the archive root")
+
+// Decompress returns the tar stream of r, decompressed when the magic bytes
+// show it is gzip compressed.
+func Decompress(r *bufio.Reader) (io.Reader, error) {
+	switch f := Sniff(r); f {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd, LZ4:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, f)
+	}
+
+	return r, nil
+}
+
+// Compress returns the writer compressing to w in format f, at level or
+// the default level for 0. Closing it flushes the compressor but leaves w
+// open.
+func Compress(w io.Writer, f Format, level int) (io.WriteCloser, error) {
+	switch f {
+	case Tar:
+		return nopCloser{w}, nil
+	case Gzip:
+		if level == 0 {
+			return gzip.NewWriter(w), nil
+		}
+
+		return gzip.NewWriterLevel(w, level)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupported, f)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// CleanName returns the slash separated path of an entry relative to the
+// archive root. Leading slashes are dropped, and names escaping the root
+// fail with ErrUnsafeName.
+func CleanName(name string) (string, error) {
+	clean := path.Clean(name)
+
+	if clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(clean, "\x00") {
+		return "", fmt.Errorf("%w: %q", ErrUnsafeName, name)
+	}
+
+	return strings.TrimPrefix(clean, "/"), nil
+}
+
+// Reader streams the entries of an archive, decompressing it as detected.
+type Reader struct {
+	tr *tar.Reader
+}
+
+// NewReader returns the reader of the archive r.
+func NewReader(r io.Reader) (*Reader, error) {
+	tr, err := Decompress(bufio.NewReader(r))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{tr: tar.NewReader(tr)}, nil
+}
+
+// Next advances to the next entry, returning io.EOF at the end. The name
+// of the header is cleaned with CleanName.
+func (r *Reader) Next() (*tar.Header, error) {
+	header, err := r.tr.Next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Name, err = CleanName(header.Name); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// Read reads the contents of the current entry.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.tr.Read(p)
+}
+
+// Writer streams the entries of an archive compressed in a format.
+type Writer struct {
+	*tar.Writer
+
+	compressor io.WriteCloser
+}
+
+// NewWriter returns the writer of an archive to w in format f, at level or
+// the default level for 0.
+func NewWriter(w io.Writer, f Format, level int) (*Writer, error) {
+	c, err := Compress(w, f, level)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{Writer: tar.NewWriter(c), compressor: c}, nil
+}
+
+// Close finishes the archive and flushes the compressor.
+func (w *Writer) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+
+	return w.compressor.Close()
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
 	"github.com/drone/drone-cache-lib/cache"
 	"github.com/drone/drone-cache-lib/storage"
-	"github.com/drone/drone-cache-lib/archive/util"
 )
 
 type Plugin struct {
@@ -14,68 +18,865 @@ type Plugin struct {
 	Path         string
 	FallbackPath string
 	FlushPath    string
-	Mode         string
-	FlushAge     int
-	Mount        []string
 
-	Storage storage.Storage
+	// FallbackPaths are restored in order on a miss, or FallbackPath
+	// alone without them.
+	FallbackPaths []string
+
+	Mode        string
+	FlushAge    int
+	FlushDryRun bool
+	Mount       []string
+
+	// FlushCheckpoint saves the progress of flushes so an interrupted flush
+	// resumes where it left off.
+	FlushCheckpoint bool
+
+	// FlushForce flushes every expired object, rather than only those
+	// marked as uploaded by the plugin.
+	FlushForce bool
+
+	// ExternalMounts are paths outside the workspace which can be mounts,
+	// archived and restored at their absolute path.
+	ExternalMounts []string
+	Dedup          bool
+	Shards         int
+
+	// PackSmallFiles packs small files into indexed blocks on rebuild.
+	PackSmallFiles bool
+
+	// FileModeMask and DirModeMask clear permission bits of the files and
+	// directories restored.
+	FileModeMask os.FileMode
+	DirModeMask  os.FileMode
+
+	// ExactMtimes archives modification times with sub-second precision.
+	ExactMtimes bool
+
+	// AllowSpecialBits archives and restores the setuid, setgid and sticky
+	// bits and file capabilities, which are stripped otherwise.
+	AllowSpecialBits bool
+
+	// VerboseFiles logs every Nth file archived or extracted.
+	VerboseFiles int
+
+	// CompressorCmd and DecompressorCmd pipe the tar stream through
+	// external commands instead of the format of the filename.
+	CompressorCmd   string
+	DecompressorCmd string
+
+	// Compression of rebuilt archives, none, gzip, zstd or lz4, instead of the
+	// format of the filename. Restores detect the format of the archive.
+	Compression string
+
+	// CompressionLevel and CompressionThreads tune the compression, with
+	// zero using the defaults of the format.
+	CompressionLevel   int
+	CompressionThreads int
+
+	// ExtractWorkers is the number of files written at once on restore.
+	ExtractWorkers int
+
+	// Flush daemon settings. The daemon flushes every FlushInterval, or on
+	// the FlushSchedule cron spec when set, while holding FlushLock.
+	FlushPrefixes []string
+	FlushInterval time.Duration
+	FlushSchedule string
+	FlushLock     string
+
+	// JournalFile records the files changed during the build. Rebuild
+	// archives only the journaled files when it is set.
+	JournalFile string
+
+	// Report settings. The report summarises the caches under ReportPath,
+	// written as csv or json to ReportFile or stdout.
+	ReportPath   string
+	ReportFormat string
+	ReportFile   string
+
+	// SimulateAge, in days, and SimulateSize are a retention policy the
+	// report simulates per path, listing what it would delete.
+	SimulateAge  int
+	SimulateSize int64
+
+	// TrackAccess writes an access marker for every restored archive.
+	TrackAccess bool
+
+	// TrackHits counts the hits and misses of restores under Path.
+	TrackHits bool
+
+	// RestoreHints records the size, files and duration of each restore
+	// next to the archive, to tune and estimate the next restore of it.
+	RestoreHints bool
+
+	// ReadOnlyKeys is set when the storage uses the read-only keys, which
+	// may not write the markers, counters and hints above.
+	ReadOnlyKeys bool
+
+	// PhaseMarkers logs the start and end of each phase, and the duration
+	// of every phase once done.
+	PhaseMarkers bool
+
+	// Metadata is attached to every uploaded object.
+	Metadata map[string]string
+
+	// FailOnMiss fails a restore when no cache could be restored.
+	FailOnMiss bool
+
+	// FailOnError fails restores and rebuilds when the storage cannot be
+	// reached or returns an error. Otherwise only a warning is logged.
+	FailOnError bool
+
+	// LegacyFallback restores the cache under legacyFilename on a miss,
+	// while caches are rebuilt under a new filename.
+	LegacyFallback bool
+
+	// PreviousPrefix is listed on a miss to restore the newest archive
+	// older than BuildCreated, for keys including build numbers.
+	PreviousPrefix string
+	BuildCreated   time.Time
+
+	// TransferStrategy set to TransferAuto picks how archives are uploaded
+	// from the size of the mounts. Archives up to TransferSingleMax are
+	// uploaded in a single request and from TransferShardMin in shards.
+	TransferStrategy  string
+	TransferSingleMax int64
+	TransferShardMin  int64
+
+	// ReadOnly skips rebuilds, so pull requests cannot write to the cache
+	// of their target branch.
+	ReadOnly bool
+
+	// SkipEmpty skips rebuilds of mounts without any files, rather than
+	// uploading an empty cache.
+	SkipEmpty bool
+
+	// AsyncRebuild uploads the archive in a helper process started in the
+	// background on exec pipelines, so the step finishes without waiting for
+	// the upload. AsyncHelper is set in the helper, which uploads
+	// AsyncArchive to AsyncKey and writes the status of the rebuild once
+	// done.
+	AsyncRebuild bool
+	AsyncHelper  bool
+	AsyncArchive string
+	AsyncKey     string
+
+	// StageType is the type of the pipeline, where helpers started in the
+	// background only outlive the step on exec pipelines.
+	StageType string
+
+	// BuildFailed skips rebuilds, so a half-built workspace cannot replace
+	// a good cache.
+	BuildFailed bool
+
+	// BrowseGlob filters the files browse lists by path or base name.
+	BrowseGlob string
+
+	// BootstrapPolicy names the policy bootstrap adds for the caches under
+	// FlushPath.
+	BootstrapPolicy string
+
+	// AliasKeys are paths the archive is copied to after a rebuild, so it
+	// can be restored under each of them.
+	AliasKeys []string
+
+	// RestoreNewest restores the newest archive under Path when the exact
+	// key is missing, before the rest of the fallback chain.
+	RestoreNewest bool
+
+	// KeyScheme set to KeySchemeActions stores the cache at Key within the
+	// first of the Scopes and looks it up like actions/cache, with
+	// RestoreKeys as prefixes within each scope.
+	KeyScheme string
+	Key       string
+	Scopes    []string
+
+	// RestoreKeys are tried in order on a miss in place of FallbackPaths,
+	// each as an exact key and then as a prefix of the newest archive.
+	RestoreKeys []string
+
+	// MergePaths are restored in order before Path, with each archive
+	// extracted over the previous ones.
+	MergePaths []string
+
+	// SkipExisting skips a rebuild when the cache already exists.
+	SkipExisting bool
+
+	// MaxFiles and MaxSize fail a rebuild of mounts exceeding them, when
+	// set.
+	MaxFiles int
+	MaxSize  int64
+
+	// BranchMaxSize and BranchMaxAge, in days, limit the objects under
+	// BranchPath, the path of the branch before any checksum. Rebuilds
+	// delete the objects exceeding them.
+	BranchPath    string
+	BranchMaxSize int64
+	BranchMaxAge  int
+
+	// MountRoutes archive mounts separately under other paths.
+	MountRoutes []mountRoute
+
+	// MountPriority orders the mounts archived, and so restored, first.
+	MountPriority []string
+
+	// RestorePriority paths are restored before the rest of the archive,
+	// which is extracted in the background on exec pipelines. RestoreSpool
+	// is set in the helper extracting it, to the spool of the rest.
+	RestorePriority []string
+	RestoreSpool    string
+
+	// StagedRestore unpacks into a staging directory in the workspace,
+	// moving the mounts into place only once the cache is restored.
+	StagedRestore bool
+
+	// OverlayDir is unpacked into instead of the mounts, writing the
+	// commands mounting overlays of it over the mounts, which OverlayMount
+	// runs.
+	OverlayDir   string
+	OverlayMount bool
+
+	// Volumes are named Docker volumes archived next to the cache, read
+	// from VolumesRoot which needs to be mounted from the host.
+	Volumes     []string
+	VolumesRoot string
+
+	// Passphrase encrypts the objects on the client before they are
+	// uploaded, and decrypts them on restore.
+	Passphrase string
+
+	// Recipients are the age or armored PGP public keys objects are
+	// encrypted to, and Identity the private key decrypting them.
+	Recipients []string
+	Identity   string
+
+	// SigningKey signs the archives uploaded, and VerifyKey is the public
+	// key verifying them on restore when SigningKey is not an HMAC key.
+	SigningKey string
+	VerifyKey  string
+
+	// Repo is the <owner>/<name> of the repo, checked by linting.
+	Repo string
+
+	// ProtectedPaths are key prefixes only rebuilt by pushes to the
+	// ProtectedBranches, checked against the Event and Branch of the build.
+	ProtectedPaths    []string
+	ProtectedBranches []string
+	Event             string
+	Branch            string
+
+	// MaxTransfers limits the restores and rebuilds of the build running
+	// at once, across steps sharing the TransferLocks directory.
+	MaxTransfers  int
+	TransferLocks string
+
+	// BuildNumber and Commit are attached to rebuilt archives and recorded
+	// on restore.
+	BuildNumber int
+	Commit      string
+
+	// Timeout limits the time of an operation, reporting the time spent in
+	// each phase when exceeded.
+	Timeout time.Duration
+	phases  *phaseTracker
+
+	// MaxCalls fails the storage calls of a run past it, guarding against
+	// runaway listings and deletes on backends priced by request. The calls
+	// are counted and logged either way.
+	MaxCalls int
+	calls    *callCounter
+
+	// FallbackParallelism is the number of keys of the fallback chain
+	// probed at once before restoring. 1 tries them one after the other.
+	FallbackParallelism int
+
+	// EnvFile receives the keys of the cache and whether it was restored or
+	// rebuilt, for later steps.
+	EnvFile string
+
+	// ErrorFile receives a JSON document describing the failure when the
+	// operation fails, reporting Endpoint as the server.
+	ErrorFile string
+	Endpoint  string
+
+	// Compat restores the caches of another plugin on a miss, from
+	// CompatPath for drone-volume-cache.
+	Compat     string
+	CompatPath string
+
+	// LocalCache is a directory shared by the builds on a host holding
+	// copies of the objects transferred.
+	LocalCache string
+
+	// TempDir holds scratch files of this run, namespaced by build and step
+	// so concurrent steps sharing a workspace do not clobber each other.
+	TempDir string
+
+	// Storage is nil when Unreachable is set, the error of probing the
+	// servers on a restore, which is a miss failing only when FailOnMiss.
+	Storage     storage.Storage
+	Unreachable error
 }
 
 const (
 	RestoreMode = "restore"
 	RebuildMode = "rebuild"
-	FlushMode = "flush"
+	FlushMode   = "flush"
+
+	FlushDaemonMode = "flush-daemon"
+	JournalMode     = "journal"
+	ReportMode      = "report"
+	ManifestMode    = "manifest"
+	ListMode        = "list"
+	BootstrapMode   = "bootstrap"
+	CheckMode       = "check"
+	BrowseMode      = "browse"
+	LintMode        = "lint"
 )
 
 // Exec runs the plugin
 func (p *Plugin) Exec() error {
+	if p.ErrorFile != "" || p.RestoreHints || p.PhaseMarkers {
+		p.phases = newPhaseTracker()
+		p.phases.markers = p.PhaseMarkers
+	}
+
+	p.calls = newCallCounter(p.MaxCalls)
+
+	started := time.Now()
+
+	var err error
+
+	if p.Unreachable == nil || p.RestoreSpool != "" {
+		err = p.explainTLSError(p.execWithTimeout())
+	} else if p.FailOnMiss {
+		err = fmt.Errorf("%w at %s: %s", errCacheMiss, p.Path+p.Filename, p.Unreachable)
+	} else {
+		// Like any other miss an unreachable storage does not fail a restore
+		// unless it is required
+		log.Warnf("Cache could not be restored %s. Skipping restore", p.Unreachable)
+	}
+
+	if p.calls.total > 0 {
+		log.Infof("Storage calls %s", p.calls)
+	}
+
+	if p.AsyncHelper {
+		p.finishAsyncRebuild(p.Path+p.Filename, started, err)
+	}
+
+	if p.PhaseMarkers {
+		log.Infof("phases %s", p.phases.durations())
+	}
+
+	if err != nil && p.ErrorFile != "" {
+		p.writeErrorDocument(err)
+	}
+
+	// Caching is best effort unless asked otherwise, so an unavailable
+	// storage does not fail the build
+	if err != nil && !p.FailOnError && (p.Mode == RestoreMode || p.Mode == RebuildMode) && isStorageError(err) {
+		log.Warnf("Cache %s failed %s. Continuing as fail_on_error is disabled", p.Mode, err)
+		return nil
+	}
+
+	return err
+}
+
+func (p *Plugin) execWithTimeout() error {
+	// Daemons run until they are stopped
+	if p.Timeout <= 0 || p.Mode == FlushDaemonMode || p.Mode == JournalMode {
+		return p.exec(context.Background())
+	}
+
+	if p.phases == nil {
+		p.phases = newPhaseTracker()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- p.exec(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(p.Timeout):
+		err := fmt.Errorf("%w after %s. Phases: %s", errTimeout, p.Timeout, p.phases)
+
+		// The storage calls fail once cancelled, so the operation stops
+		// before the next step gets to the workspace
+		cancel()
+		log.Infof("Waiting for the %s to stop after %s", p.Mode, p.Timeout)
+
+		// A call stuck in the backend never sees the cancellation, so the
+		// wait is bounded
+		select {
+		case serr := <-done:
+			if serr != nil {
+				log.Debugf("The %s stopped %s", p.Mode, serr)
+			}
+		case <-time.After(stopGrace):
+			log.Warnf("The %s did not stop within %s of the timeout. Giving up on it", p.Mode, stopGrace)
+		}
+
+		// A restore which timed out should not fail the build either
+		if p.Mode == RestoreMode && !p.FailOnMiss {
+			log.Warn(err)
+			return nil
+		}
+
+		return err
+	}
+}
+
+func (p *Plugin) exec(ctx context.Context) error {
+	// Bootstrapping talks to the backend rather than the wrappers below
+	if p.Mode == BootstrapMode {
+		return p.bootstrap()
+	}
+
+	// Linting only resolves the keys
+	if p.Mode == LintMode {
+		return p.lint()
+	}
+
 	var err error
+	var at archive.Archive
+
+	t := tarArchive{
+		packSmallFiles: p.PackSmallFiles,
+		fileMask:       p.FileModeMask,
+		dirMask:        p.DirModeMask,
+		exactMtimes:    p.ExactMtimes,
+		specialBits:    p.AllowSpecialBits,
+		external:       p.ExternalMounts,
+		phases:         p.phases,
+		workers:        p.ExtractWorkers,
+	}
+
+	if p.VerboseFiles > 0 && p.Mode == RebuildMode {
+		t.files = newFileLog("Archived", p.VerboseFiles)
+	} else if p.VerboseFiles > 0 && p.Mode == RestoreMode {
+		t.files = newFileLog("Extracted", p.VerboseFiles)
+	}
 
-	at, err := util.FromFilename(p.Filename)
+	defer t.files.summary()
 
-	if err != nil {
+	c := compressor{level: p.CompressionLevel, threads: p.CompressionThreads}
+
+	if p.CompressorCmd != "" {
+		at = &commandArchive{tar: t, compress: p.CompressorCmd, decompress: p.DecompressorCmd}
+	} else if p.Compression != "" {
+		if at, err = archiveFromCompression(p.Compression, t, c); err != nil {
+			return err
+		}
+	} else if at, err = archiveFromFilename(p.Filename, t, c); err != nil {
 		return err
 	}
 
-	c := cache.New(p.Storage, at)
+	if err = p.wrapStorage(ctx); err != nil {
+		return err
+	}
 
 	path := p.Path + p.Filename
 	fallbackPath := p.FallbackPath + p.Filename
 
 	if p.Mode == RebuildMode {
-		log.Infof("Rebuilding cache at %s", path)
-		err = c.Rebuild(p.Mount, path)
+		if p.ReadOnly {
+			log.Infof("Pull requests do not rebuild the cache at %s. Skipping rebuild", path)
+			return nil
+		}
 
-		if err == nil {
+		if p.BuildFailed {
+			log.Infof("Build failed. Skipping rebuild of the cache at %s", path)
+			return nil
+		}
+
+		if err = p.checkProtected(path); err != nil {
+			return err
+		}
+
+		// The helper only uploads the archive the step packed
+		if p.AsyncHelper {
+			return p.uploadAsyncRebuild(path)
+		}
+
+		// Keys derived from checksums hold the same contents once written,
+		// while the routes and volumes are still rebuilt where missing
+		existing := p.SkipExisting && exists(p.Storage, path)
+
+		if p.AsyncRebuild && !p.helpersOutliveStep() {
+			log.Warnf("async_rebuild only applies to exec pipelines, as the runner of %q pipelines stops the helper along with the step. Rebuilding before the step finishes", p.StageType)
+			p.AsyncRebuild = false
+		} else if p.AsyncRebuild {
+			p.checkAsyncRebuild(path)
+		}
+
+		var release func()
+
+		if release, err = p.acquireTransferSlot(ctx); err != nil {
+			return err
+		}
+
+		defer release()
+
+		var mount []string
+		var delta, skip bool
+
+		if existing {
+			log.Infof("Cache already exists at %s. Skipping rebuild", path)
+			mount, skip = p.Mount, true
+		} else {
+			log.Infof("Rebuilding cache at %s", path)
+			mount, delta, skip = p.journaledMount(path)
+		}
+
+		mount = orderMounts(mount, p.MountPriority)
+
+		// The size of the files approximates the size of the archive
+		size := int64(-1)
+
+		if !skip {
+			summary, serr := p.checkMountLimits(mount)
+
+			if serr != nil {
+				return serr
+			}
+
+			size = summary.Size
+
+			if summary.Files == 0 && p.SkipEmpty {
+				log.Infof("Mounts have no files. Skipping rebuild of the cache at %s", path)
+				return nil
+			} else if summary.Files == 0 {
+				log.Warnf("Mounts have no files. Rebuilding an empty cache at %s", path)
+			}
+
+			// Archives are at most about the size of the files in them
+			if err = p.checkBranchSize(summary.Size); err != nil {
+				return err
+			}
+		}
+
+		var routeOrder []string
+		var routed map[string][]string
+
+		if len(p.MountRoutes) > 0 {
+			mount, routeOrder, routed = routeMounts(mount, p.MountRoutes)
+		}
+
+		// The helper removes the delta and writes the aliases once uploaded
+		background := p.AsyncRebuild && !skip
+		key := path
+
+		if delta {
+			key = path + journalDeltaSuffix
+		}
+
+		switch {
+		case skip:
+			if !existing {
+				log.Info("No changes recorded in the journal. Skipping rebuild")
+			}
+		case background:
+			err = p.startAsyncRebuild(path, key, mount, at)
+		case delta:
+			err = p.rebuildTransfer(mount, key, "", size, at)
+		default:
+			err = p.rebuildTransfer(mount, path, fallbackPath, size, at)
+		}
+
+		uploaded := !skip && !background
+
+		if err == nil && uploaded && !delta && p.JournalFile != "" {
+			p.removeJournalDelta(path)
+		}
+
+		// Older caches are only rotated once the new one is in the bucket
+		if err == nil && uploaded && (p.BranchMaxSize > 0 || p.BranchMaxAge > 0) {
+			err = p.enforceBranchLimits(path, size)
+		}
+
+		if err == nil && (!skip || existing) && len(routeOrder) > 0 {
+			err = p.rebuildRoutes(routeOrder, routed, at)
+		}
+
+		if err == nil && len(p.Volumes) > 0 {
+			err = p.rebuildVolumes(at)
+		}
+
+		if err == nil && !background {
+			err = p.writeAliases(path)
+		}
+
+		if err == nil && uploaded {
 			log.Infof("Cache rebuilt")
 		}
+
+		if err == nil {
+			p.writeRebuildEnv(path, fallbackPath, !skip)
+		}
+	}
+
+	// The helper of a priority restore only extracts the rest of the cache
+	if p.Mode == RestoreMode && p.RestoreSpool != "" {
+		if t := tarOf(at); t != nil {
+			return p.finishSpooledRestore(t)
+		}
+
+		return fmt.Errorf("Cannot extract %s with the archive of %s", p.RestoreSpool, p.Filename)
 	}
 
 	if p.Mode == RestoreMode {
+		if p.ReadOnlyKeys && (p.TrackAccess || p.TrackHits || p.RestoreHints) {
+			log.Warn("The read-only keys may not write to the bucket. Skipping the access markers, hit counts and restore hints")
+		}
+
+		var release func()
+
+		if release, err = p.acquireTransferSlot(ctx); err != nil {
+			return err
+		}
+
+		defer release()
+
+		// A staged restore unpacks into a staging directory which is only
+		// moved into the mounts once the cache is restored
+		var staging string
+		ua := at
+
+		if p.OverlayDir != "" {
+			if staging, err = newOverlayLower(p.OverlayDir); err != nil {
+				return err
+			}
+
+			ua = &rootedArchive{Archive: at, root: staging}
+		} else if p.StagedRestore {
+			if staging, err = newStaging(); err != nil {
+				return err
+			}
+
+			defer os.RemoveAll(staging)
+			ua = &rootedArchive{Archive: at, root: staging}
+		}
+
+		for _, merge := range p.MergePaths {
+			mergePath := merge + p.Filename
+
+			log.Infof("Restoring cache layer at %s", mergePath)
+
+			if _, lerr := restoreCache(mergePath, p.Storage, ua); lerr != nil {
+				log.Warnf("Cache layer could not be restored %s", lerr)
+			}
+		}
+
+		p.restoreRoutes(ua)
+		p.restoreVolumes(at)
+
+		// Entries outside the priority paths are spooled and restored last
+		var sp *spool
+		t := tarOf(at)
+
+		if len(p.RestorePriority) > 0 && t != nil {
+			if sp, err = newSpool(p.TempDir); err != nil {
+				return err
+			}
+
+			t.priority = p.RestorePriority
+			t.deferred = sp
+		}
+
+		la := legacyArchive(at)
+
+		if staging != "" {
+			la = &rootedArchive{Archive: la, root: staging}
+		}
+
+		if p.RestoreHints {
+			applyRestoreHint(p.Storage, path, t)
+		}
+
 		log.Infof("Restoring cache at %s", path)
-		err = c.Restore(path, fallbackPath)
+		started := time.Now()
+		restored, rerr := p.restoreFirst(p.restoreCandidates(path, ua, la))
 
-		if err == nil {
+		// The changes journaled since the cache was rebuilt in full are
+		// restored over it, with those outside the priority paths spooled
+		// after the rest of the cache
+		if rerr == nil && restored != "" && p.JournalFile != "" {
+			rerr = p.restoreJournalDelta(restored, staging, at, ua)
+		}
+
+		// The rest of the cache is extracted in the background where the
+		// helper outlives the step, and the staging directory is not
+		// needed to move it into place
+		if rerr == nil && sp != nil && staging == "" && p.helpersOutliveStep() {
+			rerr = p.backgroundPriorityRestore(t, sp)
+		} else if rerr == nil && sp != nil {
+			rerr = finishPriorityRestore(t, sp)
+		}
+
+		// The caches of the plugin migrated from are restored on a miss,
+		// leaving restored empty as there is no key of this plugin
+		if rerr != nil && p.Compat != "" {
+			log.Warnf("Cache could not be restored %s. Trying the %s cache", rerr, p.Compat)
+			rerr = p.restoreCompat(ua, staging)
+		}
+
+		if rerr == nil && p.OverlayDir != "" {
+			rerr = p.overlayMounts(staging)
+		} else if rerr == nil && staging != "" {
+			rerr = swapMounts(staging, p.Mount)
+		}
+
+		// A failed restore should not fail the build unless asked to
+		if rerr != nil && p.FailOnMiss {
+			err = fmt.Errorf("%w at %s: %s", errCacheMiss, path, rerr)
+		} else if rerr != nil {
+			log.Warnf("Cache could not be restored %s", rerr)
+		} else {
 			log.Info("Cache restored")
 		}
+
+		if rerr == nil && restored != "" {
+			writeRestoreRecord(p.Storage, restored)
+		}
+
+		if rerr == nil && restored != "" && p.TrackAccess && !p.ReadOnlyKeys {
+			markAccess(p.Storage, restored)
+		}
+
+		p.writeRestoreEnv(path, fallbackPath, restored, rerr == nil)
+
+		// A background rebuild which failed or is still running explains
+		// why the cache at path was missed
+		if restored != path {
+			p.checkAsyncRebuild(path)
+		}
+
+		if p.TrackHits && !p.ReadOnlyKeys {
+			p.recordHit(path, restored)
+		}
+
+		if rerr == nil && restored != "" && p.RestoreHints && !p.ReadOnlyKeys {
+			p.recordRestoreHint(restored, time.Since(started))
+		}
 	}
 
 	if p.Mode == FlushMode {
 		log.Infof("Flushing cache items older then %d days at %s", p.FlushAge, path)
-		f := cache.NewFlusher(p.Storage, genIsExpired(p.FlushAge))
-		err = f.Flush(p.FlushPath)
+		var dirty cache.DirtyFunc
+
+		if dirty, err = p.ownedDirty(genIsExpired(p.FlushAge)); err == nil {
+			err = flush(p.Storage, p.FlushPath, dirty, p.FlushDryRun, p.FlushCheckpoint)
+		}
 
 		if err == nil {
 			log.Info("Cache flushed")
 		}
 	}
 
+	if p.Mode == FlushDaemonMode {
+		err = p.flushDaemon()
+	}
+
+	if p.Mode == JournalMode {
+		err = p.watchJournal()
+	}
+
+	if p.Mode == ReportMode {
+		err = p.report()
+	}
+
+	if p.Mode == ListMode {
+		err = p.list()
+	}
+
+	if p.Mode == CheckMode {
+		err = p.check(path)
+	}
+
+	if p.Mode == BrowseMode {
+		err = p.browse(path)
+	}
+
+	if p.Mode == ManifestMode {
+		if err = p.checkProtected(path); err == nil {
+			err = p.publishManifest(path)
+		}
+	}
+
 	return err
 }
 
+// wrapStorage wraps the storage of the plugin, from the calls counted on the
+// backend out to the cancellation of the calls once ctx is done.
+func (p *Plugin) wrapStorage(ctx context.Context) error {
+	var err error
+
+	if ms, ok := p.Storage.(metadataStorage); ok && p.calls != nil {
+		p.Storage = &countedStorage{metadataStorage: ms, calls: p.calls}
+	} else if p.MaxCalls > 0 {
+		log.Warn("Storage does not support counting calls. Ignoring max_calls")
+	}
+
+	// The local cache holds the objects as stored, so they are decrypted
+	// and verified on every restore served from it
+	if p.LocalCache != "" {
+		if ms, ok := p.Storage.(metadataStorage); ok {
+			p.Storage = &tieredStorage{metadataStorage: ms, dir: p.LocalCache}
+		} else {
+			log.Warn("Storage does not support a local cache. Ignoring local_cache")
+		}
+	}
+
+	if p.Passphrase != "" {
+		if len(p.Recipients) != 0 || p.Identity != "" {
+			return errors.New("encryption_passphrase cannot be combined with encryption_recipients or encryption_identity")
+		}
+
+		if p.Storage, err = encryptStorage(p.Storage, p.Passphrase); err != nil {
+			return err
+		}
+	}
+
+	if len(p.Recipients) != 0 || p.Identity != "" {
+		if p.Storage, err = recipientEncryptStorage(p.Storage, p.Recipients, p.Identity, p.TempDir); err != nil {
+			return err
+		}
+	}
+
+	if p.SigningKey != "" || p.VerifyKey != "" {
+		if p.Storage, err = signStorage(p.Storage, p.SigningKey, p.VerifyKey, p.TempDir); err != nil {
+			return err
+		}
+	}
+
+	if ms, ok := p.Storage.(metadataStorage); ok && p.phases != nil {
+		p.Storage = &trackedStorage{metadataStorage: ms, phases: p.phases}
+	}
+
+	if ms, ok := p.Storage.(metadataStorage); ok {
+		p.Storage = &stampedStorage{metadataStorage: ms, metadata: p.producerMetadata()}
+	} else if len(p.Metadata) > 0 {
+		log.Warn("Storage does not support metadata. Ignoring metadata")
+	}
+
+	if ms, ok := p.Storage.(metadataStorage); ok && ctx.Done() != nil {
+		p.Storage = &cancelledStorage{metadataStorage: ms, ctx: ctx}
+	}
+
+	return nil
+}
+
 func genIsExpired(age int) cache.DirtyFunc {
 	return func(file storage.FileEntry) bool {
 		// Check if older then "age" days
-		return file.LastModified.Before(time.Now().AddDate(0, 0, age * -1))
+		return file.LastModified.Before(time.Now().AddDate(0, 0, age*-1))
 	}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// previousKey returns the newest archive named filename under prefix which
+// was last modified before the given time, such as the start of the build.
+func previousKey(s storage.Storage, prefix string, filename string, before time.Time) (string, error) {
+	newest, err := newestArchive(s, prefix, filename, func(file storage.FileEntry) bool {
+		return file.LastModified.Before(before)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if newest == nil {
+		return "", fmt.Errorf("No previous %s found at %s", filename, prefix)
+	}
+
+	log.Infof("Found previous cache %s from %s", newest.Path, newest.LastModified.Format(time.RFC3339))
+
+	return "/" + newest.Path, nil
+}
+
+// prefixKey returns the newest archive named filename whose key starts with
+// prefix, which need not end at a directory.
+func prefixKey(s storage.Storage, prefix string, filename string) (string, error) {
+	newest, err := newestArchive(s, prefix, filename, func(storage.FileEntry) bool { return true })
+
+	if err != nil {
+		return "", err
+	}
+
+	if newest == nil {
+		return "", fmt.Errorf("No %s found matching %s", filename, prefix)
+	}
+
+	log.Infof("Found cache %s matching %s from %s", newest.Path, prefix, newest.LastModified.Format(time.RFC3339))
+
+	return "/" + newest.Path, nil
+}
+
+// isArchiveKey reports whether key is an archive named filename, rather
+// than an object of the plugin next to archives ending in the same name.
+func isArchiveKey(key, filename string) bool {
+	return strings.HasSuffix(key, "/"+filename) && !isPointerRef(key)
+}
+
+// newestArchive returns the newest archive named filename under prefix for
+// which keep returns true, or nil when there is none. Volume archives are
+// never returned as they do not hold the workspace.
+func newestArchive(s storage.Storage, prefix string, filename string, keep func(storage.FileEntry) bool) (*storage.FileEntry, error) {
+	files, err := s.List(prefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var newest *storage.FileEntry
+
+	for i, file := range files {
+		if !isArchiveKey(file.Path, filename) || isVolumeKey(file.Path) || !keep(file) {
+			continue
+		}
+
+		if newest == nil || file.LastModified.After(newest.LastModified) {
+			newest = &files[i]
+		}
+	}
+
+	return newest, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreviousKeySkipsVolumes(t *testing.T) {
+	s := newMemoryStorage()
+
+	s.Put("bucket/repo/main/archive.tar", strings.NewReader("main"))
+	s.Put(volumeKey("bucket/repo/main/", "archive.tar", "data"), strings.NewReader("volume"))
+
+	key, err := previousKey(s, "bucket/repo/", "archive.tar", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "/bucket/repo/main/archive.tar" {
+		t.Errorf("Expected the newer volume archive to be skipped, got %s", key)
+	}
+
+	if key, err := prefixKey(s, "bucket/repo/ma", "archive.tar"); err != nil || key != "/bucket/repo/main/archive.tar" {
+		t.Errorf("Expected the newer volume archive to be skipped, got %s %v", key, err)
+	}
+}
+
+func TestIsVolumeKey(t *testing.T) {
+	for key, expected := range map[string]bool{
+		volumeKey("/bucket/repo/main/", "archive.tar", "data"): true,
+		"/bucket/repo/main/archive.tar":                        false,
+		"/bucket/repo/volumes/archive.tar":                     false,
+	} {
+		if isVolumeKey(key) != expected {
+			t.Errorf("Expected isVolumeKey(%s) to be %t", key, expected)
+		}
+	}
+}
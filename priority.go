@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// restorePriorityMarker is written to the workspace once the priority
+	// paths are restored, and restoreCompleteMarker once everything is.
+	restorePriorityMarker = ".cache-restore-priority"
+	restoreCompleteMarker = ".cache-restore-complete"
+)
+
+// spool holds the entries deferred by a priority restore in a tar file, to
+// be extracted once the priority paths are restored. dst is the directory
+// they were deferred from, which is a staging directory on staged restores.
+type spool struct {
+	mu   sync.Mutex
+	file *os.File
+	tw   *tar.Writer
+	dst  string
+}
+
+func newSpool(dir string) (*spool, error) {
+	f, err := ioutil.TempFile(dir, "spool-")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &spool{file: f, tw: tar.NewWriter(f)}, nil
+}
+
+// add copies an entry unpacked into dst to the spool. Archives may be
+// unpacked concurrently when sharded so entries are written under the lock.
+func (s *spool) add(dst string, header *tar.Header, r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dst = dst
+
+	if err := s.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(s.tw, r)
+	return err
+}
+
+// unpack extracts the spooled entries with a into the directory they were
+// deferred from and removes the spool.
+func (s *spool) unpack(a *tarArchive) error {
+	defer os.Remove(s.file.Name())
+	defer s.file.Close()
+
+	if err := s.tw.Close(); err != nil {
+		return err
+	}
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return a.Unpack(s.dst, s.file)
+}
+
+// detach finishes the spool and moves it to dir, returning its name, so it
+// can be unpacked by another process.
+func (s *spool) detach(dir string) (string, error) {
+	err := s.tw.Close()
+
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+
+	name := filepath.Join(dir, filepath.Base(s.file.Name()))
+
+	if err == nil {
+		err = os.Rename(s.file.Name(), name)
+	}
+
+	if err != nil {
+		os.Remove(s.file.Name())
+		return "", err
+	}
+
+	return name, nil
+}
+
+// isPriority reports whether the entry name is within a priority path.
+func (a *tarArchive) isPriority(name string) bool {
+	for _, p := range a.priority {
+		if withinPath(name, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withinPath reports whether name is dir or within it, comparing them as
+// workspace relative paths.
+func withinPath(name, dir string) bool {
+	name = filepath.ToSlash(filepath.Clean(strings.TrimPrefix(name, "/")))
+	dir = filepath.ToSlash(filepath.Clean(strings.TrimPrefix(dir, "/")))
+
+	return name == dir || dir == "." || strings.HasPrefix(name, dir+"/")
+}
+
+// orderMounts orders the paths within each priority path first, in the
+// order of the priorities, followed by the remaining paths. Archives are
+// extracted in the order they are packed so the priority paths are the
+// first restored.
+func orderMounts(paths, priority []string) []string {
+	ordered := make([]string, 0, len(paths))
+	seen := make(map[int]bool, len(paths))
+
+	for _, p := range priority {
+		for i, path := range paths {
+			if !seen[i] && withinPath(path, p) {
+				ordered = append(ordered, path)
+				seen[i] = true
+			}
+		}
+	}
+
+	for i, path := range paths {
+		if !seen[i] {
+			ordered = append(ordered, path)
+		}
+	}
+
+	return ordered
+}
+
+// deferEntry reports whether the entry is spooled rather than unpacked.
+// Blocks of small files are always unpacked immediately.
+func (a *tarArchive) deferEntry(header *tar.Header) bool {
+	if a.deferred == nil || a.isPriority(header.Name) {
+		return false
+	}
+
+	_, isBlock := header.PAXRecords[packIndexKey]
+	return !isBlock
+}
+
+// finishPriorityRestore extracts the entries deferred while the priority
+// paths were restored, writing a marker after each stage.
+func finishPriorityRestore(t *tarArchive, s *spool) error {
+	t.deferred = nil
+
+	writeMarker(restorePriorityMarker)
+	log.Info("Priority paths restored. Restoring the remaining paths")
+
+	if err := s.unpack(t); err != nil {
+		return err
+	}
+
+	writeMarker(restoreCompleteMarker)
+	return nil
+}
+
+// backgroundPriorityRestore writes the priority marker and hands the entries
+// deferred while the priority paths were restored to a helper, which
+// extracts them in the background and writes the complete marker once done,
+// so the step finishes without waiting for them.
+func (p *Plugin) backgroundPriorityRestore(t *tarArchive, s *spool) error {
+	t.deferred = nil
+
+	// The scratch files of the run are removed once the step finishes
+	name, err := s.detach(os.TempDir())
+
+	if err != nil {
+		return err
+	}
+
+	pid, err := startHelper("PLUGIN_RESTORE_SPOOL=" + name)
+
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	writeMarker(restorePriorityMarker)
+	log.Infof("Priority paths restored. Restoring the remaining paths in the background as process %d, writing %s once done", pid, restoreCompleteMarker)
+
+	return nil
+}
+
+// finishSpooledRestore extracts the spool handed to the helper by a priority
+// restore and writes the complete marker.
+func (p *Plugin) finishSpooledRestore(t *tarArchive) error {
+	defer os.Remove(p.RestoreSpool)
+
+	f, err := os.Open(p.RestoreSpool)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if err = t.Unpack("", f); err != nil {
+		return err
+	}
+
+	writeMarker(restoreCompleteMarker)
+	log.Info("Remaining paths restored")
+
+	return nil
+}
+
+func writeMarker(name string) {
+	if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+		log.Warnf("Failed to write %s %s", name, err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestOrderMounts(t *testing.T) {
+	tests := []struct {
+		paths    []string
+		priority []string
+		expected []string
+	}{
+		{
+			[]string{"a", "b", "c"},
+			nil,
+			[]string{"a", "b", "c"},
+		},
+		{
+			[]string{"a", "b", "c"},
+			[]string{"c", "b"},
+			[]string{"c", "b", "a"},
+		},
+		{
+			[]string{"vendor/x", "node_modules/y", "node_modules/z", "vendor"},
+			[]string{"./node_modules/", "missing"},
+			[]string{"node_modules/y", "node_modules/z", "vendor/x", "vendor"},
+		},
+		{
+			[]string{"ab", "a/b"},
+			[]string{"a"},
+			[]string{"a/b", "ab"},
+		},
+	}
+
+	for _, test := range tests {
+		if got := orderMounts(test.paths, test.priority); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("orderMounts(%q, %q) = %q, expected %q", test.paths, test.priority, got, test.expected)
+		}
+	}
+}
+
+func TestRouteMounts(t *testing.T) {
+	routes := []mountRoute{
+		{Mount: "dist", Path: "/ia/repo/"},
+		{Mount: "./vendor", Path: "/standard/repo/"},
+	}
+
+	rest, order, routed := routeMounts([]string{"vendor/a", "node_modules", "dist", "vendor/b"}, routes)
+
+	if !reflect.DeepEqual(rest, []string{"node_modules"}) {
+		t.Errorf("Expected node_modules to be unrouted, got %q", rest)
+	}
+
+	if !reflect.DeepEqual(order, []string{"/standard/repo/", "/ia/repo/"}) {
+		t.Errorf("Expected routes in the order of their first path, got %q", order)
+	}
+
+	if !reflect.DeepEqual(routed["/standard/repo/"], []string{"vendor/a", "vendor/b"}) {
+		t.Errorf("Expected vendor paths to be routed together, got %q", routed["/standard/repo/"])
+	}
+}
+
+func TestFinishSpooledRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("rest", 0755)
+	os.MkdirAll("first", 0755)
+	ioutil.WriteFile("rest/file", []byte("rest"), 0644)
+	ioutil.WriteFile("first/file", []byte("first"), 0644)
+
+	a := &tarArchive{}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"rest", "first"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("rest")
+	os.RemoveAll("first")
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.priority = []string{"first"}
+	a.deferred = sp
+
+	if err := a.Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The spool is handed to the helper outside the scratch files of the run
+	name, err := sp.detach(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("rest"); err == nil {
+		t.Error("Expected the other paths to be left to the helper")
+	}
+
+	p := &Plugin{RestoreSpool: name}
+
+	if err := p.finishSpooledRestore(&tarArchive{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"rest/file", restoreCompleteMarker} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s to exist once the helper finished", name)
+		}
+	}
+
+	if _, err := os.Stat(name); err == nil {
+		t.Error("Expected the spool to be removed by the helper")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+)
+
+// probeServers checks that at least one of the comma separated servers
+// accepts connections within the timeout.
+func probeServers(servers string, timeout time.Duration, resolver *s3.Resolver) error {
+	var err error
+
+	for _, server := range strings.Split(servers, ",") {
+		endpoint, useSSL, perr := s3Endpoint(strings.TrimSpace(server))
+
+		if perr != nil {
+			return perr
+		}
+
+		if err = probeEndpoint(endpoint, useSSL, timeout, resolver); err == nil {
+			return nil
+		}
+
+		log.Warnf("Endpoint %s is unreachable %s", endpoint, err)
+	}
+
+	return fmt.Errorf("No endpoint reachable within %s %w", timeout, err)
+}
+
+func probeEndpoint(endpoint string, useSSL bool, timeout time.Duration, resolver *s3.Resolver) error {
+	host := endpoint
+
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		if useSSL {
+			host = net.JoinHostPort(endpoint, "443")
+		} else {
+			host = net.JoinHostPort(endpoint, "80")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := resolver.DialContext(ctx, "tcp", host)
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
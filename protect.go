@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkProtected refuses writes to keys under the protected paths unless
+// the build is a push to a protected branch, so a pull request or a
+// misconfigured pipeline cannot poison the cache of those branches.
+func (p *Plugin) checkProtected(key string) error {
+	key = strings.TrimPrefix(key, "/")
+
+	for _, protected := range p.ProtectedPaths {
+		if !strings.HasPrefix(key, strings.TrimPrefix(protected, "/")) {
+			continue
+		}
+
+		if p.Event == "push" && p.isProtectedBranch() {
+			return nil
+		}
+
+		return fmt.Errorf("Refusing to write %s. Protected paths are only written by pushes to %s", key, strings.Join(p.ProtectedBranches, ", "))
+	}
+
+	return nil
+}
+
+func (p *Plugin) isProtectedBranch() bool {
+	for _, branch := range p.ProtectedBranches {
+		if branch == p.Branch {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestCheckProtected(t *testing.T) {
+	tests := []struct {
+		key     string
+		event   string
+		branch  string
+		allowed bool
+	}{
+		{"/bucket/repo/master/archive.tar", "push", "master", true},
+		{"/bucket/repo/master/archive.tar", "pull_request", "master", false},
+		{"/bucket/repo/master/archive.tar", "push", "feature", false},
+		{"/bucket/repo/feature/archive.tar", "pull_request", "feature", true},
+	}
+
+	for _, test := range tests {
+		p := &Plugin{
+			ProtectedPaths:    []string{"bucket/repo/master/"},
+			ProtectedBranches: []string{"master"},
+			Event:             test.event,
+			Branch:            test.branch,
+		}
+
+		if err := p.checkProtected(test.key); (err == nil) != test.allowed {
+			t.Errorf("Expected %s by %s of %s to be allowed %t, got %v", test.key, test.event, test.branch, test.allowed, err)
+		}
+	}
+}
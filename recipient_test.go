@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRecipientCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recipient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	encrypt, decrypt, err := recipientCommands([]string{"age1abc", "age1def"}, "AGE-SECRET-KEY-1XYZ", dir)
+
+	if _, lerr := exec.LookPath("age"); lerr != nil {
+		if err == nil || !strings.Contains(err.Error(), "age command") {
+			t.Errorf("Expected a missing age command to fail, got %v", err)
+		}
+	} else if err != nil {
+		t.Fatal(err)
+	} else {
+		if encrypt != "age -e -r 'age1abc' -r 'age1def'" {
+			t.Errorf("Expected encrypting to both recipients, got %s", encrypt)
+		}
+
+		if !strings.HasPrefix(decrypt, "age -d -i ") {
+			t.Errorf("Expected decrypting with the identity file, got %s", decrypt)
+		}
+	}
+
+	if _, _, err := recipientCommands([]string{"age1abc", pgpPublicKeyBlock}, "", dir); err == nil {
+		t.Error("Expected mixing age and gpg keys to fail")
+	}
+
+	if _, _, err := recipientCommands([]string{pgpPublicKeyBlock}, "AGE-SECRET-KEY-1XYZ", dir); err == nil {
+		t.Error("Expected an age identity for gpg recipients to fail")
+	}
+
+	if _, _, err := recipientCommands([]string{"ssh-rsa AAAA"}, "", dir); err == nil {
+		t.Error("Expected an unknown key to fail")
+	}
+}
+
+func TestRecipientStorage(t *testing.T) {
+	s := &recipientStorage{
+		metadataStorage: newMemoryStorage(),
+		encrypt:         "tr a-z n-za-m",
+		decrypt:         "tr a-z n-za-m",
+	}
+
+	if err := s.Put("/bucket/archive.tar", strings.NewReader("cache")); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored, got bytes.Buffer
+
+	s.metadataStorage.Get("/bucket/archive.tar", &stored)
+
+	if stored.String() != "pnpur" {
+		t.Errorf("Expected the object to be stored encrypted, got %q", stored.String())
+	}
+
+	if err := s.Get("/bucket/archive.tar", &got); err != nil || got.String() != "cache" {
+		t.Errorf("Expected the object to be decrypted, got %q %v", got.String(), err)
+	}
+
+	if err := s.Get("/bucket/missing.tar", &got); err == nil || strings.Contains(err.Error(), "decrypt") {
+		t.Errorf("Expected the error of the storage for a miss, got %v", err)
+	}
+
+	s.encrypt = ""
+
+	if err := s.Put("/bucket/archive.tar", strings.NewReader("cache")); err == nil {
+		t.Error("Expected uploading without recipients to fail")
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// accessMarkerSuffix is appended to the key of an archive for the
+	// marker counting its restores.
+	accessMarkerSuffix = ".access.json"
+
+	// accessMarkerDir held a marker object per restore of an archive
+	// before the restores were counted in a single marker.
+	accessMarkerDir = ".access/"
+)
+
+// accessMarker counts the restores of an archive. Its modification time is
+// the last restore.
+type accessMarker struct {
+	Hits int `json:"hits"`
+}
+
+// reportEntry summarises the caches stored under one repo/branch path.
+type reportEntry struct {
+	Path      string    `json:"path"`
+	Objects   int       `json:"objects"`
+	Size      int64     `json:"size"`
+	Newest    time.Time `json:"newest"`
+	Oldest    time.Time `json:"oldest"`
+	Hits      int       `json:"hits"`
+	LastHit   time.Time `json:"last_hit,omitempty"`
+	Retention int       `json:"recommended_retention_days"`
+
+	// Restores counted by track_hits
+	Restores *hitStats `json:"restores,omitempty"`
+	HitRatio float64   `json:"hit_ratio"`
+
+	// Metadata of the newest object
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Objects the simulated retention policy deletes
+	Simulation *policySimulation `json:"simulation,omitempty"`
+
+	newestPath string
+	files      []storage.FileEntry
+}
+
+// policySimulation is what a retention policy would delete under a path.
+type policySimulation struct {
+	Deleted   []string `json:"deleted"`
+	Reclaimed int64    `json:"reclaimed"`
+	Kept      int      `json:"kept"`
+	KeptSize  int64    `json:"kept_size"`
+}
+
+// simulatePolicy returns what deleting the files older than age days, then
+// the oldest until they fit in size, would delete. Zero disables either.
+func simulatePolicy(files []storage.FileEntry, age int, size int64) *policySimulation {
+	kept := append([]storage.FileEntry(nil), files...)
+
+	var deleted []storage.FileEntry
+
+	if age > 0 {
+		deleted, kept = splitExpired(kept, genIsExpired(age))
+	}
+
+	if size > 0 {
+		var rotated []storage.FileEntry
+		rotated, kept = rotateOldest(kept, size)
+		deleted = append(deleted, rotated...)
+	}
+
+	sim := &policySimulation{Deleted: []string{}, Kept: len(kept)}
+
+	for _, file := range deleted {
+		sim.Deleted = append(sim.Deleted, "/"+strings.TrimPrefix(file.Path, "/"))
+		sim.Reclaimed += file.Size
+	}
+
+	for _, file := range kept {
+		sim.KeptSize += file.Size
+	}
+
+	return sim
+}
+
+// markAccess counts a restore of src in the marker next to it, which is
+// overwritten rather than adding an object per restore. Restores at the
+// same time may count once.
+func markAccess(s storage.Storage, src string) {
+	key := src + accessMarkerSuffix
+	marker := readAccessMarker(s, key)
+	marker.Hits++
+
+	b, _ := json.Marshal(marker)
+
+	if err := s.Put(key, bytes.NewReader(b)); err != nil {
+		log.Warnf("Failed to write access marker %s %s", key, err)
+	}
+}
+
+// readAccessMarker returns the marker at key, counting no restores when
+// there is none.
+func readAccessMarker(s storage.Storage, key string) *accessMarker {
+	var buf bytes.Buffer
+	marker := &accessMarker{}
+
+	if err := s.Get(key, &buf); err == nil {
+		json.Unmarshal(buf.Bytes(), marker)
+	}
+
+	return marker
+}
+
+// reportGroup returns the repo/branch path under the report path that key
+// is reported in, the first two directories below it, so the caches of
+// every checksum or runner of a branch are reported together.
+func reportGroup(reportPath, key string) string {
+	key = strings.TrimPrefix(key, "/")
+	root := strings.Trim(reportPath, "/")
+
+	rel := key
+	if root != "" && strings.HasPrefix(key, root+"/") {
+		rel = strings.TrimPrefix(key, root+"/")
+	} else {
+		root = ""
+	}
+
+	dirs := strings.Split(path.Dir(rel), "/")
+
+	if path.Dir(rel) == "." {
+		dirs = nil
+	}
+
+	if len(dirs) > 2 {
+		dirs = dirs[:2]
+	}
+
+	return path.Join(append([]string{root}, dirs...)...)
+}
+
+// report summarises the caches under the report path per repo/branch.
+func (p *Plugin) report() error {
+	log.Infof("Reporting on caches at %s", p.ReportPath)
+
+	files, err := p.Storage.List(p.ReportPath)
+
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]*reportEntry)
+
+	entry := func(dir string) *reportEntry {
+		if e, ok := entries[dir]; ok {
+			return e
+		}
+
+		e := &reportEntry{Path: "/" + dir}
+		entries[dir] = e
+		return e
+	}
+
+	var stats []string
+
+	for _, file := range files {
+		if path.Base(file.Path) == hitStatsName {
+			stats = append(stats, file.Path)
+			continue
+		}
+
+		// Markers live at <archive>.access.json, or one per restore at
+		// <archive>/.access/<timestamp> before
+		if strings.HasSuffix(file.Path, accessMarkerSuffix) || strings.Contains(file.Path, "/"+accessMarkerDir) {
+			e := entry(reportGroup(p.ReportPath, file.Path))
+
+			if strings.HasSuffix(file.Path, accessMarkerSuffix) {
+				e.Hits += readAccessMarker(p.Storage, "/"+strings.TrimPrefix(file.Path, "/")).Hits
+			} else {
+				e.Hits++
+			}
+
+			if file.LastModified.After(e.LastHit) {
+				e.LastHit = file.LastModified
+			}
+
+			continue
+		}
+
+		e := entry(reportGroup(p.ReportPath, file.Path))
+		e.Objects++
+		e.Size += file.Size
+		e.files = append(e.files, file)
+
+		if file.LastModified.After(e.Newest) {
+			e.Newest = file.LastModified
+			e.newestPath = file.Path
+		}
+
+		if e.Oldest.IsZero() || file.LastModified.Before(e.Oldest) {
+			e.Oldest = file.LastModified
+		}
+	}
+
+	total := &hitStats{}
+
+	for _, statsPath := range stats {
+		h, err := readHitStats(p.Storage, "/"+strings.TrimPrefix(statsPath, "/"))
+
+		if err != nil {
+			log.Warnf("Failed to read %s %s", statsPath, err)
+			continue
+		}
+
+		e := entry(reportGroup(p.ReportPath, statsPath))
+
+		if e.Restores == nil {
+			e.Restores = &hitStats{}
+		}
+
+		e.Restores.add(h)
+		e.HitRatio = e.Restores.ratio()
+		total.add(h)
+	}
+
+	if total.restores() > 0 {
+		log.Infof("Hit ratio %.1f%% over %d restores: %d hits, %d fallback hits, %d misses",
+			100*total.ratio(), total.restores(), total.Hits, total.FallbackHits, total.Misses)
+	}
+
+	ms, hasMetadata := p.Storage.(metadataStorage)
+	simulate := p.SimulateAge > 0 || p.SimulateSize > 0
+
+	var report []*reportEntry
+	var deleted int
+	var reclaimed int64
+
+	for _, e := range entries {
+		e.Retention = recommendedRetention(e)
+
+		if simulate {
+			e.Simulation = simulatePolicy(e.files, p.SimulateAge, p.SimulateSize)
+			deleted += len(e.Simulation.Deleted)
+			reclaimed += e.Simulation.Reclaimed
+		}
+
+		if hasMetadata && e.newestPath != "" {
+			if _, metadata, err := ms.Stat("/" + e.newestPath); err == nil {
+				e.Metadata = metadata
+			}
+		}
+
+		report = append(report, e)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Path < report[j].Path
+	})
+
+	if simulate {
+		for _, e := range report {
+			if len(e.Simulation.Deleted) > 0 {
+				log.Infof("Policy deletes %d of %d objects at %s reclaiming %s", len(e.Simulation.Deleted), e.Objects, e.Path, humanize.Bytes(uint64(e.Simulation.Reclaimed)))
+			}
+		}
+
+		log.Infof("Policy of %d days and %s per path deletes %d objects reclaiming %s",
+			p.SimulateAge, humanize.Bytes(uint64(p.SimulateSize)), deleted, humanize.Bytes(uint64(reclaimed)))
+	}
+
+	out := io.Writer(os.Stdout)
+
+	if p.ReportFile != "" {
+		f, err := os.Create(p.ReportFile)
+
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		out = f
+	}
+
+	if p.ReportFormat == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	return writeReportCSV(out, report, simulate)
+}
+
+// recommendedRetention is twice the age in days of the last cache hit,
+// rounded up to a week, or zero when the cache has never been hit.
+func recommendedRetention(e *reportEntry) int {
+	if e.LastHit.IsZero() {
+		return 0
+	}
+
+	days := 2 * time.Since(e.LastHit).Hours() / 24
+
+	return int(math.Max(1, math.Ceil(days/7))) * 7
+}
+
+func writeReportCSV(out io.Writer, report []*reportEntry, simulate bool) error {
+	w := csv.NewWriter(out)
+
+	header := []string{"path", "objects", "size", "newest", "oldest", "hits", "last_hit", "recommended_retention_days", "metadata", "restore_hits", "restore_fallback_hits", "restore_misses", "hit_ratio"}
+
+	// The deleted objects are only listed in the json report
+	if simulate {
+		header = append(header, "simulated_deleted", "simulated_reclaimed", "simulated_kept", "simulated_kept_size")
+	}
+
+	w.Write(header)
+
+	for _, e := range report {
+		var lastHit string
+		if !e.LastHit.IsZero() {
+			lastHit = e.LastHit.Format(time.RFC3339)
+		}
+
+		restores := e.Restores
+		if restores == nil {
+			restores = &hitStats{}
+		}
+
+		record := []string{
+			e.Path,
+			strconv.Itoa(e.Objects),
+			strconv.FormatInt(e.Size, 10),
+			e.Newest.Format(time.RFC3339),
+			e.Oldest.Format(time.RFC3339),
+			strconv.Itoa(e.Hits),
+			lastHit,
+			strconv.Itoa(e.Retention),
+			formatMetadata(e.Metadata),
+			strconv.Itoa(restores.Hits),
+			strconv.Itoa(restores.FallbackHits),
+			strconv.Itoa(restores.Misses),
+			strconv.FormatFloat(e.HitRatio, 'f', 3, 64),
+		}
+
+		if simulate {
+			record = append(record,
+				strconv.Itoa(len(e.Simulation.Deleted)),
+				strconv.FormatInt(e.Simulation.Reclaimed, 10),
+				strconv.Itoa(e.Simulation.Kept),
+				strconv.FormatInt(e.Simulation.KeptSize, 10),
+			)
+		}
+
+		w.Write(record)
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// formatMetadata formats metadata as sorted key=value pairs.
+func formatMetadata(metadata map[string]string) string {
+	var pairs []string
+	for k, v := range metadata {
+		pairs = append(pairs, k+"="+v)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMarkAccess(t *testing.T) {
+	s := newMemoryStorage()
+	key := "/owner/repo/master/archive.tar"
+
+	markAccess(s, key)
+	markAccess(s, key)
+
+	if len(s.objects) != 1 {
+		t.Errorf("Expected a single marker, got %d objects", len(s.objects))
+	}
+
+	if marker := readAccessMarker(s, key+accessMarkerSuffix); marker.Hits != 2 {
+		t.Errorf("Expected the marker to count 2 restores, got %d", marker.Hits)
+	}
+}
+
+func TestReportGroup(t *testing.T) {
+	tests := []struct {
+		reportPath string
+		key        string
+		group      string
+	}{
+		{"/owner/", "owner/repo/master/archive.tar", "owner/repo/master"},
+		{"/owner/", "owner/repo/master/0123abcd/archive.tar", "owner/repo/master"},
+		{"/owner/", "owner/repo/master/runner/archive.tar.access.json", "owner/repo/master"},
+		{"/owner/", "owner/repo/archive.tar", "owner/repo"},
+		{"/owner/repo/", "owner/repo/master/volumes/db/archive.tar", "owner/repo/master/volumes"},
+	}
+
+	for _, test := range tests {
+		if group := reportGroup(test.reportPath, test.key); group != test.group {
+			t.Errorf("Expected %s under %s to be reported in %s, got %s", test.key, test.reportPath, test.group, group)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newMemoryStorage()
+	s.Put("/owner/repo/master/0123/archive.tar", bytes.NewReader(make([]byte, 10)))
+	s.Put("/owner/repo/master/4567/archive.tar", bytes.NewReader(make([]byte, 20)))
+	s.Put("/owner/repo/feature/archive.tar", bytes.NewReader(make([]byte, 30)))
+
+	markAccess(s, "/owner/repo/master/0123/archive.tar")
+	markAccess(s, "/owner/repo/master/4567/archive.tar")
+	markAccess(s, "/owner/repo/master/4567/archive.tar")
+
+	file := filepath.Join(dir, "report.json")
+	p := &Plugin{Storage: s, ReportPath: "/owner/", ReportFormat: "json", ReportFile: file}
+
+	if err := p.report(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadFile(file)
+
+	var report []*reportEntry
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report) != 2 || report[1].Path != "/owner/repo/master" {
+		t.Fatalf("Expected a line per branch, got %s", b)
+	}
+
+	if master := report[1]; master.Objects != 2 || master.Size != 30 || master.Hits != 3 {
+		t.Errorf("Expected the caches of every checksum of the branch to add up, got %+v", master)
+	}
+}
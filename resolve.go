@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+)
+
+// KeySchemeActions looks caches up like actions/cache: the exact key, then
+// the newest cache starting with each restore key, in the scope of the
+// branch and then of the default branch.
+const KeySchemeActions = "actions"
+
+const (
+	// probeAttempts is the number of times a key is probed when the
+	// endpoint cannot be reached, waiting probeBackoff and then twice as
+	// long as the previous wait between attempts.
+	probeAttempts = 3
+	probeBackoff  = 200 * time.Millisecond
+)
+
+// restoreCandidate is a cache tried on restore, in the order of the
+// fallback chain.
+type restoreCandidate struct {
+	// name describes the cache in logs.
+	name string
+
+	// key of the archive, or find to look it up when it is not known
+	// up front.
+	key  string
+	find func() (string, error)
+
+	archive archive.Archive
+}
+
+// restoreCandidates returns the fallback chain of the restore, starting
+// with the cache at path. The caches are unpacked with a, or la for the
+// legacy cache.
+func (p *Plugin) restoreCandidates(path string, a, la archive.Archive) []restoreCandidate {
+	if p.KeyScheme == KeySchemeActions {
+		return p.actionsCandidates(path, a)
+	}
+
+	candidates := []restoreCandidate{{name: "cache", key: path, archive: a}}
+
+	if p.RestoreNewest {
+		candidates = append(candidates, restoreCandidate{
+			name: "newest cache",
+			find: func() (string, error) {
+				return prefixKey(p.Storage, p.Path, p.Filename)
+			},
+			archive: a,
+		})
+	}
+
+	if p.LegacyFallback && p.Filename != legacyFilename {
+		candidates = append(candidates, restoreCandidate{name: "legacy cache", key: p.Path + legacyFilename, archive: la})
+	}
+
+	if p.PreviousPrefix != "" {
+		candidates = append(candidates, restoreCandidate{
+			name: "previous cache",
+			find: func() (string, error) {
+				return previousKey(p.Storage, p.PreviousPrefix, p.Filename, p.BuildCreated)
+			},
+			archive: a,
+		})
+	}
+
+	// Restore keys take the place of the fallback paths
+	if len(p.RestoreKeys) > 0 {
+		return append(candidates, p.restoreKeyCandidates(path, a)...)
+	}
+
+	fallbacks := p.FallbackPaths
+
+	if len(fallbacks) == 0 {
+		fallbacks = []string{p.FallbackPath}
+	}
+
+	seen := map[string]bool{path: true}
+
+	for _, fallback := range fallbacks {
+		key := fallback + p.Filename
+
+		if fallback == "" || seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		candidates = append(candidates, restoreCandidate{name: "fallback cache", key: key, archive: a})
+	}
+
+	return candidates
+}
+
+// restoreKeyCandidates returns the cache at each restore key followed by
+// the newest cache whose key starts with it.
+func (p *Plugin) restoreKeyCandidates(path string, a archive.Archive) []restoreCandidate {
+	var candidates []restoreCandidate
+
+	for _, key := range p.RestoreKeys {
+		prefix := key
+
+		if exact := strings.TrimSuffix(key, "/") + "/" + p.Filename; exact != path {
+			candidates = append(candidates, restoreCandidate{name: "cache at restore key " + key, key: exact, archive: a})
+		}
+
+		candidates = append(candidates, restoreCandidate{
+			name: "newest cache matching restore key " + key,
+			find: func() (string, error) {
+				return prefixKey(p.Storage, prefix, p.Filename)
+			},
+			archive: a,
+		})
+	}
+
+	return candidates
+}
+
+// actionsCandidates returns the cache at path, the key in the scope of the
+// branch, and then tries each scope in turn like actions/cache, the exact
+// key and then the newest cache starting with each restore key.
+func (p *Plugin) actionsCandidates(path string, a archive.Archive) []restoreCandidate {
+	var candidates []restoreCandidate
+	seen := make(map[string]bool)
+
+	for _, scope := range p.Scopes {
+		if seen[scope] {
+			continue
+		}
+
+		seen[scope] = true
+
+		if key := scope + p.Key + "/" + p.Filename; key == path {
+			candidates = append(candidates, restoreCandidate{name: "cache", key: key, archive: a})
+		} else {
+			candidates = append(candidates, restoreCandidate{name: "cache in scope " + scope, key: key, archive: a})
+		}
+
+		for _, restoreKey := range p.RestoreKeys {
+			prefix := scope + restoreKey
+
+			candidates = append(candidates, restoreCandidate{
+				name: "newest cache matching restore key " + restoreKey + " in scope " + scope,
+				find: func() (string, error) {
+					return prefixKey(p.Storage, prefix, p.Filename)
+				},
+				archive: a,
+			})
+		}
+	}
+
+	return candidates
+}
+
+// restoreFirst restores the first cache of the candidates which can be
+// restored, returning the key of the archive unpacked. When the storage
+// supports metadata the candidates are probed concurrently first, so
+// misses along the chain cost a single round trip instead of one each.
+func (p *Plugin) restoreFirst(candidates []restoreCandidate) (string, error) {
+	keys := make([]string, len(candidates))
+	start := 0
+
+	if ms, ok := p.Storage.(metadataStorage); ok && len(candidates) > 1 && p.FallbackParallelism > 1 {
+		start, keys = probeCandidates(ms, candidates, p.FallbackParallelism)
+
+		if start == len(candidates) {
+			return "", errors.New("No cache found along the fallback chain")
+		}
+	}
+
+	var err error
+
+	for i := start; i < len(candidates); i++ {
+		c := candidates[i]
+		key := keys[i]
+
+		if key == "" {
+			key = c.key
+		}
+
+		if key == "" {
+			var ferr error
+			if key, ferr = c.find(); ferr != nil {
+				log.Warnf("The %s could not be found %s", c.name, ferr)
+				continue
+			}
+		}
+
+		if i > 0 {
+			log.Warnf("Failed to retrieve %s, trying %s at %s", candidates[0].key, c.name, key)
+		}
+
+		var restored string
+		if restored, err = restoreCache(key, p.Storage, c.archive); err == nil {
+			return restored, nil
+		}
+	}
+
+	if err == nil {
+		err = errors.New("No cache found along the fallback chain")
+	}
+
+	return "", err
+}
+
+// probeCandidates checks which candidates exist, at most parallelism at a
+// time. It returns the index of the first which exists, or the number of
+// candidates when none does, along with the keys found up to it.
+func probeCandidates(s metadataStorage, candidates []restoreCandidate, parallelism int) (int, []string) {
+	keys := make([]string, len(candidates))
+	results := make([]chan string, len(candidates))
+	sem := make(chan struct{}, parallelism)
+
+	for i := range candidates {
+		results[i] = make(chan string, 1)
+
+		go func(i int) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] <- probeCandidate(s, candidates[i])
+		}(i)
+	}
+
+	// The chain is in order of preference so later probes only matter when
+	// every earlier one misses
+	for i := range candidates {
+		if keys[i] = <-results[i]; keys[i] != "" {
+			log.Infof("Found %s at %s", candidates[i].name, keys[i])
+			return i, keys
+		}
+	}
+
+	return len(candidates), keys
+}
+
+// probeCandidate returns the key of the candidate when it exists, backing
+// off and trying again while the endpoint cannot be reached.
+func probeCandidate(s metadataStorage, c restoreCandidate) string {
+	backoff := probeBackoff
+
+	for attempt := 1; ; attempt++ {
+		key := c.key
+		var err error
+
+		if key == "" {
+			key, err = c.find()
+		}
+
+		if err == nil {
+			_, _, err = s.Stat(key)
+		}
+
+		if err == nil {
+			return key
+		}
+
+		if !isConnectionError(err) || attempt == probeAttempts {
+			log.Debugf("The %s was not found %s", c.name, err)
+			return ""
+		}
+
+		log.Debugf("Probing the %s failed %s. Trying again in %s", c.name, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeCandidates(t *testing.T) {
+	s := newMemoryStorage()
+	s.objects["/bucket/fallback/archive.tar"] = []byte("fallback")
+	s.objects["/bucket/last/archive.tar"] = []byte("last")
+
+	candidates := []restoreCandidate{
+		{name: "cache", key: "/bucket/branch/archive.tar"},
+		{name: "previous cache", find: func() (string, error) {
+			return "/bucket/previous/archive.tar", nil
+		}},
+		{name: "fallback cache", key: "/bucket/fallback/archive.tar"},
+		{name: "last cache", key: "/bucket/last/archive.tar"},
+	}
+
+	for _, parallelism := range []int{1, 2, 4} {
+		i, keys := probeCandidates(s, candidates, parallelism)
+
+		if i != 2 || keys[2] != "/bucket/fallback/archive.tar" {
+			t.Errorf("Expected the fallback cache with parallelism %d, got %d %v", parallelism, i, keys)
+		}
+	}
+
+	if i, _ := probeCandidates(s, candidates[:2], 4); i != 2 {
+		t.Errorf("Expected no candidate to be found, got %d", i)
+	}
+}
+
+func TestRestoreKeyCandidates(t *testing.T) {
+	s := newMemoryStorage()
+	s.Put("bucket/repo/deps-old/archive.tar", strings.NewReader("old"))
+	s.Put("bucket/repo/deps-new/archive.tar", strings.NewReader("new"))
+	s.Put("bucket/repo/deps-new/archive.tgz", strings.NewReader("other"))
+
+	p := &Plugin{
+		Storage:       s,
+		Filename:      "archive.tar",
+		FallbackPaths: []string{"/bucket/repo/master/"},
+		RestoreKeys:   []string{"/bucket/repo/deps-abc/", "bucket/repo/deps-"},
+	}
+
+	candidates := p.restoreCandidates("/bucket/repo/deps-abc/archive.tar", nil, nil)
+	var keys []string
+
+	for _, c := range candidates {
+		key := c.key
+
+		if key == "" {
+			key, _ = c.find()
+		}
+
+		keys = append(keys, key)
+	}
+
+	// The exact restore key matching path is not tried twice, and the
+	// fallback path is replaced
+	expected := []string{
+		"/bucket/repo/deps-abc/archive.tar",
+		"",
+		"bucket/repo/deps-/archive.tar",
+		"/bucket/repo/deps-new/archive.tar",
+	}
+
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected candidates %v, got %v", expected, keys)
+	}
+}
+
+func TestActionsCandidates(t *testing.T) {
+	s := newMemoryStorage()
+	s.objects["bucket/repo/feature/npm-linux-old/archive.tar"] = []byte("old")
+	s.objects["bucket/repo/master/npm-linux-abc/archive.tar"] = []byte("master")
+	s.objects["bucket/repo/master/npm-darwin-abc/archive.tar"] = []byte("darwin")
+
+	p := &Plugin{
+		Storage:     s,
+		Filename:    "archive.tar",
+		KeyScheme:   KeySchemeActions,
+		Key:         "npm-linux-abc",
+		Scopes:      []string{"bucket/repo/feature/", "bucket/repo/master/"},
+		RestoreKeys: []string{"npm-linux-"},
+	}
+
+	candidates := p.restoreCandidates("bucket/repo/feature/npm-linux-abc/archive.tar", nil, nil)
+	var keys []string
+
+	for _, c := range candidates {
+		key := c.key
+
+		if key == "" {
+			key, _ = c.find()
+		}
+
+		keys = append(keys, key)
+	}
+
+	// The branch is searched before the default branch, and restore keys
+	// match within the scope only
+	expected := []string{
+		"bucket/repo/feature/npm-linux-abc/archive.tar",
+		"/bucket/repo/feature/npm-linux-old/archive.tar",
+		"bucket/repo/master/npm-linux-abc/archive.tar",
+		"/bucket/repo/master/npm-linux-abc/archive.tar",
+	}
+
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected candidates %v, got %v", expected, keys)
+	}
+}
+
+func TestRestoreNewest(t *testing.T) {
+	s := newMemoryStorage()
+	s.objects["bucket/repo/master/nested/archive.tar"] = []byte("nested")
+	s.objects["bucket/repo/master/nested/archive.tgz"] = []byte("other")
+
+	p := &Plugin{Storage: s, Path: "bucket/repo/master/", Filename: "archive.tar", RestoreNewest: true}
+	candidates := p.restoreCandidates("bucket/repo/master/archive.tar", nil, nil)
+
+	if len(candidates) != 2 {
+		t.Fatalf("Expected the newest cache after the cache, got %d candidates", len(candidates))
+	}
+
+	if key, err := candidates[1].find(); err != nil || key != "/bucket/repo/master/nested/archive.tar" {
+		t.Errorf("Expected the archive under the path, got %s %v", key, err)
+	}
+}
+
+func TestPreviousCandidate(t *testing.T) {
+	s := newMemoryStorage()
+	created := memoryEpoch.Add(time.Hour)
+
+	for key, mtime := range map[string]time.Time{
+		"bucket/repo/10/archive.tar":     memoryEpoch,
+		"bucket/repo/12/archive.tar":     created.Add(-time.Minute),
+		"bucket/repo/12/archive.tar.sig": created.Add(-time.Second),
+		"bucket/repo/14/archive.tar":     created.Add(time.Minute),
+	} {
+		s.objects[key] = []byte(key)
+		s.mtimes[key] = mtime
+	}
+
+	p := &Plugin{Storage: s, Path: "bucket/repo/13/", Filename: "archive.tar", PreviousPrefix: "bucket/repo/", BuildCreated: created}
+	candidates := p.restoreCandidates("bucket/repo/13/archive.tar", nil, nil)
+
+	if len(candidates) != 2 || candidates[1].name != "previous cache" {
+		t.Fatalf("Expected the previous cache after the cache, got %d candidates", len(candidates))
+	}
+
+	if key, err := candidates[1].find(); err != nil || key != "/bucket/repo/12/archive.tar" {
+		t.Errorf("Expected the newest archive from before the build, got %s %v", key, err)
+	}
+
+	p.BuildCreated = memoryEpoch
+
+	if key, err := candidates[1].find(); err == nil {
+		t.Errorf("Expected no previous cache before the oldest archive, got %s", key)
+	}
+}
+
+func TestFallbackPathCandidates(t *testing.T) {
+	p := &Plugin{
+		Filename:      "archive.tar",
+		FallbackPaths: []string{"/bucket/repo/feature/", "/bucket/repo/develop/", "/bucket/repo/feature/", "/bucket/repo/master/"},
+	}
+
+	var keys []string
+
+	for _, c := range p.restoreCandidates("/bucket/repo/feature/archive.tar", nil, nil) {
+		keys = append(keys, c.key)
+	}
+
+	expected := "/bucket/repo/feature/archive.tar,/bucket/repo/develop/archive.tar,/bucket/repo/master/archive.tar"
+
+	if strings.Join(keys, ",") != expected {
+		t.Errorf("Expected candidates %s, got %v", expected, keys)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+const (
+	// restoreRecordFile is written to the workspace after a restore.
+	restoreRecordFile = ".cache-restore.json"
+
+	// legacyFilename is the default filename of caches written by earlier
+	// releases.
+	legacyFilename = "archive.tar"
+
+	// buildMetadataKey and commitMetadataKey record the build and commit
+	// which produced an archive.
+	buildMetadataKey  = "build"
+	commitMetadataKey = "commit"
+
+	// producerMetadataKey marks every object uploaded by the plugin with
+	// producerName, so flushes leave objects written by others alone.
+	producerMetadataKey = "producer"
+	producerName        = "drone-s3-cache"
+)
+
+// restoreRecord describes the cache a build restored.
+type restoreRecord struct {
+	Key      string    `json:"key"`
+	ETag     string    `json:"etag,omitempty"`
+	Commit   string    `json:"commit,omitempty"`
+	Build    string    `json:"build,omitempty"`
+	Restored time.Time `json:"restored"`
+}
+
+// readRestoreRecord returns the record of the restore in the workspace.
+func readRestoreRecord() (*restoreRecord, error) {
+	b, err := ioutil.ReadFile(restoreRecordFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := &restoreRecord{}
+	if err := json.Unmarshal(b, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// legacyArchive returns a tar archive configured like a, for restoring
+// caches written under legacyFilename.
+func legacyArchive(a archive.Archive) archive.Archive {
+	if t := tarOf(a); t != nil {
+		legacy := *t
+		return &legacy
+	}
+
+	return &tarArchive{}
+}
+
+// producerMetadata returns the metadata attached to uploads, including the
+// build and commit when rebuilding. The producer marker cannot be
+// overridden by the configured metadata.
+func (p *Plugin) producerMetadata() map[string]string {
+	metadata := make(map[string]string, len(p.Metadata)+3)
+
+	if p.Mode == RebuildMode && p.BuildNumber > 0 {
+		metadata[buildMetadataKey] = strconv.Itoa(p.BuildNumber)
+	}
+
+	if p.Mode == RebuildMode && p.Commit != "" {
+		metadata[commitMetadataKey] = p.Commit
+	}
+
+	for k, v := range p.Metadata {
+		metadata[k] = v
+	}
+
+	metadata[producerMetadataKey] = producerName
+
+	return metadata
+}
+
+// writeRestoreRecord records the archive restored from key in the workspace.
+// The details of the producing build are only known for storage supporting
+// metadata.
+func writeRestoreRecord(s storage.Storage, key string) {
+	record := &restoreRecord{
+		Key:      key,
+		Restored: time.Now().UTC(),
+	}
+
+	if ms, ok := s.(metadataStorage); ok {
+		if _, metadata, err := ms.Stat(key); err == nil {
+			record.Commit = metadata[commitMetadataKey]
+			record.Build = metadata[buildMetadataKey]
+		}
+	}
+
+	if ts, ok := s.(taggedStorage); ok {
+		record.ETag, _ = ts.ETag(key)
+	}
+
+	b, _ := json.MarshalIndent(record, "", "  ")
+
+	if err := ioutil.WriteFile(restoreRecordFile, append(b, '\n'), 0644); err != nil {
+		log.Warnf("Failed to write %s %s", restoreRecordFile, err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProducerMetadata(t *testing.T) {
+	p := &Plugin{
+		Mode:        RebuildMode,
+		BuildNumber: 42,
+		Commit:      "abc123",
+		Metadata:    map[string]string{"team": "platform", producerMetadataKey: "other"},
+	}
+
+	metadata := p.producerMetadata()
+
+	if metadata[buildMetadataKey] != "42" || metadata[commitMetadataKey] != "abc123" || metadata["team"] != "platform" {
+		t.Errorf("Expected the build, commit and configured metadata, got %v", metadata)
+	}
+
+	if metadata[producerMetadataKey] != producerName {
+		t.Errorf("Expected the producer marker not to be overridden, got %s", metadata[producerMetadataKey])
+	}
+
+	p.Mode = FlushMode
+
+	if metadata := p.producerMetadata(); metadata[buildMetadataKey] != "" || metadata[commitMetadataKey] != "" {
+		t.Errorf("Expected the build and commit only when rebuilding, got %v", metadata)
+	}
+}
+
+func TestWriteRestoreRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	s := &labelledStorage{memoryStorage: newMemoryStorage(), metadata: make(map[string]map[string]string)}
+	p := &Plugin{Mode: RebuildMode, BuildNumber: 42, Commit: "abc123"}
+	key := "/bucket/repo/master/archive.tar"
+
+	s.PutWithMetadata(key, strings.NewReader("cached"), p.producerMetadata())
+
+	writeRestoreRecord(s, key)
+
+	record, err := readRestoreRecord()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Key != key || record.Build != "42" || record.Commit != "abc123" || record.Restored.IsZero() {
+		t.Errorf("Expected the key and producing build of the cache, got %+v", record)
+	}
+
+	// Entity tags are recorded when the storage supports them
+	vs := &versionedStorage{memoryStorage: newMemoryStorage(), versions: map[string]int{key: 3}}
+	vs.Put(key, strings.NewReader("cached"))
+
+	writeRestoreRecord(vs, key)
+
+	if record, err := readRestoreRecord(); err != nil || record.ETag != "3" || record.Build != "" {
+		t.Errorf("Expected the entity tag without a build, got %+v %v", record, err)
+	}
+}
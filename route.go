@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+)
+
+// mountRoute stores the archive of a mount under a different path, such
+// as a bucket with another storage class.
+type mountRoute struct {
+	Mount string
+	Path  string
+}
+
+// routeMounts splits the paths to archive by the route of the mount they
+// are within. Paths without a route are returned first, followed by the
+// route paths in the order they are first used and the paths routed to each.
+func routeMounts(paths []string, routes []mountRoute) ([]string, []string, map[string][]string) {
+	var rest, order []string
+	routed := make(map[string][]string)
+
+	for _, path := range paths {
+		matched := false
+
+		for _, route := range routes {
+			if withinPath(path, route.Mount) {
+				if _, ok := routed[route.Path]; !ok {
+					order = append(order, route.Path)
+				}
+
+				routed[route.Path] = append(routed[route.Path], path)
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			rest = append(rest, path)
+		}
+	}
+
+	return rest, order, routed
+}
+
+// routeKey returns the key of the archive routed to route. The path of the
+// cache without its bucket is mirrored under route, so every repository and
+// branch keeps its own routed archive.
+func (p *Plugin) routeKey(route string) string {
+	rel := strings.TrimPrefix(p.Path, "/")
+
+	if i := strings.Index(rel, "/"); i >= 0 {
+		rel = rel[i+1:]
+	} else {
+		rel = ""
+	}
+
+	return strings.TrimSuffix(route, "/") + "/" + rel + p.Filename
+}
+
+// rebuildRoutes archives the routed paths under their route paths.
+func (p *Plugin) rebuildRoutes(order []string, routed map[string][]string, a archive.Archive) error {
+	for _, path := range order {
+		key := p.routeKey(path)
+
+		if err := p.checkProtected(key); err != nil {
+			return err
+		}
+
+		if p.SkipExisting && exists(p.Storage, key) {
+			log.Infof("Routed cache already exists at %s. Skipping rebuild", key)
+			continue
+		}
+
+		if err := rebuildCache(routed[path], key, p.Storage, a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreRoutes restores the archive of every route path. A route which
+// cannot be restored does not fail the build.
+func (p *Plugin) restoreRoutes(a archive.Archive) {
+	restored := make(map[string]bool)
+
+	for _, route := range p.MountRoutes {
+		if restored[route.Path] {
+			continue
+		}
+
+		restored[route.Path] = true
+		key := p.routeKey(route.Path)
+
+		log.Infof("Restoring routed cache at %s", key)
+
+		if _, err := restoreCache(key, p.Storage, a); err != nil {
+			log.Warnf("Routed cache could not be restored %s", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRouteKey(t *testing.T) {
+	tests := []struct {
+		path  string
+		route string
+		key   string
+	}{
+		{"/bucket/owner/repo/master/", "/cold/", "/cold/owner/repo/master/archive.tar"},
+		{"/bucket/owner/repo/feature/", "/cold/routed", "/cold/routed/owner/repo/feature/archive.tar"},
+		{"/bucket/", "/cold/", "/cold/archive.tar"},
+	}
+
+	for _, test := range tests {
+		p := &Plugin{Path: test.path, Filename: "archive.tar"}
+
+		if key := p.routeKey(test.route); key != test.key {
+			t.Errorf("Expected %s routed to %s at %s, got %s", test.path, test.route, test.key, key)
+		}
+	}
+}
+
+func TestRebuildRoutesSkipExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.Mkdir("dist", 0755)
+	ioutil.WriteFile("dist/file", []byte("dist"), 0644)
+
+	s := newMemoryStorage()
+	s.Put("/existing/repo/master/archive.tar", bytes.NewReader([]byte("existing")))
+
+	p := &Plugin{Storage: s, Path: "/bucket/repo/master/", Filename: "archive.tar", SkipExisting: true}
+	order := []string{"/existing/", "/missing/"}
+	routed := map[string][]string{"/existing/": {"dist"}, "/missing/": {"dist"}}
+
+	if err := p.rebuildRoutes(order, routed, &tarArchive{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(s.objects["/existing/repo/master/archive.tar"]) != "existing" {
+		t.Error("Expected the existing routed cache to be kept")
+	}
+
+	if _, ok := s.objects["/missing/repo/master/archive.tar"]; !ok {
+		t.Error("Expected the missing routed cache to be rebuilt")
+	}
+}
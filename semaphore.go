@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// transferSlotInterval is how often the slots are tried again while all of
+// them are taken.
+const transferSlotInterval = time.Second
+
+// acquireTransferSlot waits for one of the MaxTransfers slots the steps of
+// the build share under TransferLocks, returning the function releasing
+// it. Each slot is a file locked for the duration of the transfer, so the
+// directory needs to be on a volume all the steps mount on the same host.
+// Waiting stops when ctx is done.
+func (p *Plugin) acquireTransferSlot(ctx context.Context) (func(), error) {
+	if p.MaxTransfers <= 0 || p.TransferLocks == "" {
+		return func() {}, nil
+	}
+
+	dir := filepath.Join(p.TransferLocks, fmt.Sprintf("%s-%d", sanitizeName(p.Repo), p.BuildNumber))
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create transfer locks %s %w", dir, err)
+	}
+
+	started := time.Now()
+	waiting := false
+
+	for {
+		for i := 0; i < p.MaxTransfers; i++ {
+			release, err := tryLockFile(filepath.Join(dir, fmt.Sprintf("slot-%d", i)))
+
+			if err == errLocked {
+				continue
+			}
+
+			if err != nil {
+				log.Warnf("Failed to take a transfer slot %s. Not limiting transfers", err)
+				return func() {}, nil
+			}
+
+			if waiting {
+				log.Infof("Took transfer slot %d after waiting %s", i, time.Since(started).Round(time.Second))
+			}
+
+			return release, nil
+		}
+
+		if !waiting {
+			log.Infof("All %d transfer slots of the build are taken. Waiting for one", p.MaxTransfers)
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w waiting for a transfer slot", errTimeout)
+		case <-time.After(transferSlotInterval):
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAcquireTransferSlot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "semaphore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &Plugin{MaxTransfers: 2, TransferLocks: dir, Repo: "octocat/hello-world", BuildNumber: 7}
+
+	first, err := p.acquireTransferSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := p.acquireTransferSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan struct{})
+
+	go func() {
+		release, _ := p.acquireTransferSlot(context.Background())
+		close(acquired)
+		release()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Expected a third transfer to wait for a slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first()
+
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the third transfer to take the released slot")
+	}
+
+	second()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	cachearchive "github.com/drone-plugins/drone-s3-cache/pkg/archive"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// partSuffix is appended to the key of a sharded archive, followed by the
+// number of the part, for the key of each part.
+const partSuffix = ".part-"
+
+// rebuildSharded splits the files under the srcs across shards archives
+// which are packed and uploaded concurrently, then uploads a manifest of
+// the parts to dst.
+func rebuildSharded(srcs []string, dst string, shards int, s storage.Storage, a entryPacker) error {
+	log.Infof("Rebuilding cache at %s to %s in %d parts", srcs, dst, shards)
+
+	parts, err := shardEntries(srcs, shards)
+
+	if err != nil {
+		return err
+	}
+
+	manifest := &cachearchive.Manifest{}
+	errs := make([]error, len(parts))
+
+	var wg sync.WaitGroup
+
+	for i, entries := range parts {
+		name := fmt.Sprintf("%s%s%d", dst, partSuffix, i)
+		manifest.Parts = append(manifest.Parts, name)
+
+		wg.Add(1)
+		go func(i int, entries []string) {
+			defer wg.Done()
+
+			errs[i] = uploadArchive(name, s, func(w io.Writer) error {
+				return a.PackEntries(entries, w)
+			})
+		}(i, entries)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err := cachearchive.WriteManifest(&buf, manifest); err != nil {
+		return err
+	}
+
+	if err := s.Put(dst, &buf); err != nil {
+		return err
+	}
+
+	return deleteStaleParts(s, dst, len(manifest.Parts))
+}
+
+// deleteStaleParts deletes the parts of an earlier sharded archive at dst
+// numbered count and up, with their sidecars, once the archive replacing
+// them is uploaded.
+func deleteStaleParts(s storage.Storage, dst string, count int) error {
+	prefix := dst + partSuffix
+	files, err := s.List(prefix)
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		i := strings.Index(file.Path, partSuffix)
+
+		if i < 0 {
+			continue
+		}
+
+		digits := file.Path[i+len(partSuffix):]
+		end := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' })
+
+		if end >= 0 {
+			digits = digits[:end]
+		}
+
+		if n, err := strconv.Atoi(digits); err != nil || n < count {
+			continue
+		}
+
+		log.Infof("Deleting stale part %s", file.Path)
+
+		if err := s.Delete(file.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shardEntries walks the srcs and splits the entries into at most shards
+// lists of similar total size. Directories all go in the first list.
+func shardEntries(srcs []string, shards int) ([][]string, error) {
+	type file struct {
+		path string
+		size int64
+	}
+
+	var dirs []string
+	var files []file
+
+	for _, src := range srcs {
+		err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if fi.IsDir() {
+				dirs = append(dirs, path)
+			} else {
+				files = append(files, file{path, fi.Size()})
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Place the largest files first, each in the smallest shard so far
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].size > files[j].size
+	})
+
+	parts := make([][]string, shards)
+	sizes := make([]int64, shards)
+	parts[0] = dirs
+
+	for _, f := range files {
+		smallest := 0
+		for i := range sizes {
+			if sizes[i] < sizes[smallest] {
+				smallest = i
+			}
+		}
+
+		parts[smallest] = append(parts[smallest], f.path)
+		sizes[smallest] += f.size
+	}
+
+	// Drop empty shards when there are fewer files than shards
+	var nonEmpty [][]string
+	for _, part := range parts {
+		if len(part) > 0 {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+
+	return nonEmpty, nil
+}
+
+// restoreShards downloads and unpacks the parts of a sharded archive
+// concurrently. The first part, holding the directories, is unpacked once
+// the others finish, so the modes and times of the directories are applied
+// after every file is written into them.
+func restoreShards(manifest *cachearchive.Manifest, s storage.Storage, a archive.Archive) error {
+	log.Infof("Restoring cache from %d parts", len(manifest.Parts))
+
+	if len(manifest.Parts) == 0 {
+		return nil
+	}
+
+	errs := make([]error, len(manifest.Parts))
+
+	var wg sync.WaitGroup
+
+	for i, part := range manifest.Parts[1:] {
+		wg.Add(1)
+		go func(i int, part string) {
+			defer wg.Done()
+
+			_, errs[i] = restoreCache(part, s, a)
+		}(i+1, part)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := restoreCache(manifest.Parts[0], s, a)
+	return err
+}
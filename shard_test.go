@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShardedRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	for i := 0; i < 10; i++ {
+		file := filepath.Join("src", fmt.Sprintf("dir%d", i%3), fmt.Sprintf("file%d", i))
+		os.MkdirAll(filepath.Dir(file), 0755)
+		ioutil.WriteFile(file, []byte(file), 0644)
+	}
+
+	s := newMemoryStorage()
+	a := &tgzArchive{}
+
+	if err := rebuildSharded([]string{"src"}, "/bucket/archive.tgz", 4, s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.objects) != 5 {
+		t.Errorf("Expected 4 parts and a manifest, got %d objects", len(s.objects))
+	}
+
+	os.RemoveAll("src")
+
+	if _, err := restoreCache("/bucket/archive.tgz", s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		file := filepath.Join("src", fmt.Sprintf("dir%d", i%3), fmt.Sprintf("file%d", i))
+
+		if b, _ := ioutil.ReadFile(file); string(b) != file {
+			t.Errorf("Expected %s to be restored, got %q", file, b)
+		}
+	}
+}
+
+func TestShardedDirectoryTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("src/dir", 0755)
+
+	for i := 0; i < 8; i++ {
+		ioutil.WriteFile(filepath.Join("src/dir", fmt.Sprintf("file%d", i)), []byte(strings.Repeat("x", i+1)), 0644)
+	}
+
+	mtime := time.Unix(1000000000, 0)
+	os.Chtimes("src/dir", mtime, mtime)
+
+	s := newMemoryStorage()
+	a := &tarArchive{}
+
+	if err := rebuildSharded([]string{"src"}, "/bucket/archive.tar", 4, s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("src")
+
+	if _, err := restoreCache("/bucket/archive.tar", s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat("src/dir"); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected the directory time to be applied after every part, got %v %v", fi, err)
+	}
+}
+
+func TestShardedStaleParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.Mkdir("src", 0755)
+
+	for i := 0; i < 4; i++ {
+		ioutil.WriteFile(filepath.Join("src", fmt.Sprintf("file%d", i)), []byte("cached"), 0644)
+	}
+
+	s := newMemoryStorage()
+	a := &tgzArchive{}
+
+	if err := rebuildSharded([]string{"src"}, "/bucket/archive.tgz", 4, s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Put("/bucket/archive.tgz.part-3.sig", strings.NewReader("signature"))
+
+	if err := rebuildSharded([]string{"src"}, "/bucket/archive.tgz", 2, s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"/bucket/archive.tgz.part-2", "/bucket/archive.tgz.part-3", "/bucket/archive.tgz.part-3.sig"} {
+		if _, ok := s.objects[key]; ok {
+			t.Errorf("Expected the stale part %s to be deleted", key)
+		}
+	}
+
+	for _, key := range []string{"/bucket/archive.tgz.part-0", "/bucket/archive.tgz.part-1"} {
+		if _, ok := s.objects[key]; !ok {
+			t.Errorf("Expected the part %s to be kept", key)
+		}
+	}
+}
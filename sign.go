@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+const (
+	// signatureSuffix is appended to the key of an object for its
+	// signature.
+	signatureSuffix = ".sig"
+
+	signatureHMAC    = "hmac-sha256"
+	signatureEd25519 = "ed25519"
+)
+
+// errUnsigned is returned for archives without a signature, like caches
+// written before signing was enabled.
+var errUnsigned = errors.New("Cache is not signed")
+
+// unsignedSidecars are the suffixes of the sidecars the plugin writes next
+// to archives, which restores write and nothing unpacks.
+var unsignedSidecars = []string{restoreHintSuffix, manifestSuffix, asyncStatusSuffix, accessMarkerSuffix}
+
+// isUnsigned reports whether p is a sidecar of the plugin, its counter of
+// restores or the referrer of a pointer, which are neither signed nor
+// verified.
+func isUnsigned(p string) bool {
+	if path.Base(p) == hitStatsName || isPointerRef(p) {
+		return true
+	}
+
+	for _, suffix := range unsignedSidecars {
+		if strings.HasSuffix(p, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signer signs and verifies the SHA-256 digest of objects along with their
+// key, so a signed archive cannot be replayed at another key, either with
+// a shared HMAC key or an ed25519 key pair. Steps only restoring caches
+// can be given the public key alone.
+type signer struct {
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// newSigner parses the signing_key and verify_key settings. A PEM encoded
+// PKCS #8 private key or PKIX public key is an ed25519 key, anything else
+// signing_key holds is an HMAC key.
+func newSigner(signingKey, verifyKey string) (*signer, error) {
+	s := &signer{}
+
+	if block, _ := pem.Decode([]byte(signingKey)); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid signing_key %s", err)
+		}
+
+		private, ok := key.(ed25519.PrivateKey)
+
+		if !ok {
+			return nil, errors.New("Invalid signing_key. Needs to be an ed25519 key")
+		}
+
+		s.private, s.public = private, private.Public().(ed25519.PublicKey)
+	} else if signingKey != "" {
+		s.secret = []byte(signingKey)
+	}
+
+	if verifyKey != "" {
+		if s.secret != nil {
+			return nil, errors.New("verify_key cannot be combined with an hmac signing_key")
+		}
+
+		block, _ := pem.Decode([]byte(verifyKey))
+
+		if block == nil {
+			return nil, errors.New("Invalid verify_key. Needs to be a PEM encoded ed25519 public key")
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid verify_key %s", err)
+		}
+
+		public, ok := key.(ed25519.PublicKey)
+
+		if !ok {
+			return nil, errors.New("Invalid verify_key. Needs to be an ed25519 key")
+		}
+
+		if s.public != nil && !bytes.Equal(s.public, public) {
+			return nil, errors.New("verify_key does not match signing_key")
+		}
+
+		s.public = public
+	}
+
+	return s, nil
+}
+
+// sign returns the signature of the object at p with digest. It holds the
+// digest, so copies can be signed for their key without reading them.
+func (s *signer) sign(p string, digest []byte) (string, error) {
+	message := signedMessage(p, digest)
+	sum := hex.EncodeToString(digest)
+
+	switch {
+	case s.secret != nil:
+		return signatureHMAC + " " + sum + " " + hex.EncodeToString(s.hmac(message)), nil
+	case s.private != nil:
+		return signatureEd25519 + " " + sum + " " + base64.StdEncoding.EncodeToString(ed25519.Sign(s.private, message)), nil
+	}
+
+	return "", errors.New("Signing caches needs signing_key")
+}
+
+// verify checks signature against the key and the digest of an object,
+// returning the digest signed. A nil digest accepts whichever was signed.
+func (s *signer) verify(p string, digest []byte, signature string) ([]byte, error) {
+	algorithm, sum, value := splitSignature(signature)
+	signed, err := hex.DecodeString(sum)
+
+	if err != nil || (digest != nil && !hmac.Equal(signed, digest)) {
+		return nil, errors.New("Signature does not match. The cache was modified or signed with another key")
+	}
+
+	message := signedMessage(p, signed)
+
+	switch {
+	case algorithm == signatureHMAC && s.secret != nil:
+		mac, err := hex.DecodeString(value)
+
+		if err == nil && hmac.Equal(mac, s.hmac(message)) {
+			return signed, nil
+		}
+	case algorithm == signatureEd25519 && s.public != nil:
+		sig, err := base64.StdEncoding.DecodeString(value)
+
+		if err == nil && ed25519.Verify(s.public, message, sig) {
+			return signed, nil
+		}
+	default:
+		return nil, fmt.Errorf("Cannot verify %s signatures with the keys given", algorithm)
+	}
+
+	return nil, errors.New("Signature does not match. The cache was modified, moved from another key or signed with another key")
+}
+
+func (s *signer) hmac(message []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// signedMessage returns what is signed for the object at p with digest.
+func signedMessage(p string, digest []byte) []byte {
+	return []byte(strings.TrimPrefix(p, "/") + "\n" + hex.EncodeToString(digest))
+}
+
+func splitSignature(signature string) (algorithm, digest, value string) {
+	fields := strings.Fields(signature)
+
+	if len(fields) != 3 {
+		return "", "", ""
+	}
+
+	return fields[0], fields[1], fields[2]
+}
+
+// signedStorage signs the objects uploaded, writing the signature next to
+// them, and verifies objects before handing them out so tampered caches
+// are never unpacked. Objects are spooled to dir until verified.
+type signedStorage struct {
+	metadataStorage
+
+	signer *signer
+	dir    string
+}
+
+func (s *signedStorage) Get(p string, dst io.Writer) error {
+	if isUnsigned(p) {
+		return s.metadataStorage.Get(p, dst)
+	}
+
+	f, err := ioutil.TempFile(s.dir, "signed-")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+
+	if err = s.metadataStorage.Get(p, io.MultiWriter(f, h)); err != nil {
+		return err
+	}
+
+	var sig bytes.Buffer
+
+	if err = s.metadataStorage.Get(p+signatureSuffix, &sig); err != nil {
+		return fmt.Errorf("%w. Refusing to restore %s", errUnsigned, p)
+	}
+
+	if _, err = s.signer.verify(p, h.Sum(nil), sig.String()); err != nil {
+		return fmt.Errorf("Refusing to restore %s %w", p, err)
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+func (s *signedStorage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+func (s *signedStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	if isUnsigned(p) {
+		return s.metadataStorage.PutWithMetadata(p, src, metadata)
+	}
+
+	h := sha256.New()
+
+	if err := s.metadataStorage.PutWithMetadata(p, io.TeeReader(src, h), metadata); err != nil {
+		return err
+	}
+
+	return s.putSignature(p, h.Sum(nil), metadata)
+}
+
+// putSignature writes the signature of the object at p with the metadata
+// of the object, so flushes treat the two alike.
+func (s *signedStorage) putSignature(p string, digest []byte, metadata map[string]string) error {
+	sig, err := s.signer.sign(p, digest)
+
+	if err != nil {
+		return err
+	}
+
+	if err = s.metadataStorage.PutWithMetadata(p+signatureSuffix, strings.NewReader(sig), metadata); err != nil {
+		return fmt.Errorf("Failed to write signature of %s %w", p, err)
+	}
+
+	return nil
+}
+
+func (s *signedStorage) ETag(p string) (string, error) {
+	if ts, ok := s.metadataStorage.(taggedStorage); ok {
+		return ts.ETag(p)
+	}
+
+	return "", errors.New("Storage does not support entity tags")
+}
+
+// Copy copies the object and signs the copy for its key, once the
+// signature of the original checks out.
+func (s *signedStorage) Copy(src, dst string) error {
+	cs, ok := s.metadataStorage.(copyingStorage)
+
+	if !ok {
+		return errNoCopy
+	}
+
+	if isUnsigned(src) {
+		return cs.Copy(src, dst)
+	}
+
+	var sig bytes.Buffer
+
+	if err := s.metadataStorage.Get(src+signatureSuffix, &sig); err != nil {
+		return fmt.Errorf("%w. Refusing to copy %s", errUnsigned, src)
+	}
+
+	digest, err := s.signer.verify(src, nil, sig.String())
+
+	if err != nil {
+		return fmt.Errorf("Refusing to copy %s %w", src, err)
+	}
+
+	if err = cs.Copy(src, dst); err != nil {
+		return err
+	}
+
+	_, metadata, err := s.metadataStorage.Stat(dst)
+
+	if err != nil {
+		return err
+	}
+
+	return s.putSignature(dst, digest, metadata)
+}
+
+func (s *signedStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	cs, ok := s.metadataStorage.(conditionalStorage)
+
+	if !ok {
+		return false, errors.New("Storage does not support conditional writes")
+	}
+
+	if isUnsigned(p) {
+		return cs.PutIfMatch(p, src, etag, metadata)
+	}
+
+	h := sha256.New()
+	written, err := cs.PutIfMatch(p, io.TeeReader(src, h), etag, metadata)
+
+	if err != nil || !written {
+		return written, err
+	}
+
+	return true, s.putSignature(p, h.Sum(nil), metadata)
+}
+
+// signStorage wraps s to sign and verify its objects, spooling downloads
+// to dir.
+func signStorage(s storage.Storage, signingKey, verifyKey, dir string) (storage.Storage, error) {
+	ms, ok := s.(metadataStorage)
+
+	if !ok {
+		return nil, errors.New("Storage does not support signing")
+	}
+
+	sg, err := newSigner(signingKey, verifyKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &signedStorage{metadataStorage: ms, signer: sg, dir: dir}, nil
+}
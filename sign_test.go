@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public, private, _ := ed25519.GenerateKey(nil)
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(private)
+	publicDER, _ := x509.MarshalPKIXPublicKey(public)
+
+	privatePEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}))
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+
+	tests := []struct {
+		name           string
+		signing        string
+		restoreSigning string
+		restoreVerify  string
+	}{
+		{name: "hmac", signing: "secret", restoreSigning: "secret"},
+		{name: "ed25519", signing: privatePEM, restoreVerify: publicPEM},
+	}
+
+	for _, test := range tests {
+		ms := newMemoryStorage()
+
+		s, err := signStorage(ms, test.signing, "", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Put("/bucket/archive.tar", strings.NewReader("cache")); err != nil {
+			t.Fatal(err)
+		}
+
+		restore, err := signStorage(ms, test.restoreSigning, test.restoreVerify, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got bytes.Buffer
+
+		if err := restore.Get("/bucket/archive.tar", &got); err != nil || got.String() != "cache" {
+			t.Errorf("%s: Expected the signed cache to be restored, got %q %v", test.name, got.String(), err)
+		}
+
+		if err := restore.Put("/bucket/archive.tar.restore-hint.json", strings.NewReader("{}")); err != nil {
+			t.Errorf("%s: Expected sidecars to be written unsigned, got %v", test.name, err)
+		}
+
+		ms.Put("/bucket/archive.tar", strings.NewReader("poisoned"))
+		got.Reset()
+
+		if err := restore.Get("/bucket/archive.tar", &got); err == nil || got.Len() != 0 {
+			t.Errorf("%s: Expected the tampered cache to be refused, got %q %v", test.name, got.String(), err)
+		}
+
+		ms.Put("/bucket/archive.tar", strings.NewReader("cache"))
+		ms.Put("/bucket/replayed.tar", strings.NewReader("cache"))
+		ms.objects["/bucket/replayed.tar.sig"] = ms.objects["/bucket/archive.tar.sig"]
+		got.Reset()
+
+		if err := restore.Get("/bucket/replayed.tar", &got); err == nil || got.Len() != 0 {
+			t.Errorf("%s: Expected a cache replayed at another key to be refused, got %q %v", test.name, got.String(), err)
+		}
+
+		ms.Put("/bucket/unsigned.tar", strings.NewReader("cache"))
+		ms.Put("/bucket/unsigned.json", strings.NewReader("cache"))
+
+		if err := restore.Get("/bucket/unsigned.tar", &got); !errors.Is(err, errUnsigned) {
+			t.Errorf("%s: Expected an unsigned cache to be refused, got %v", test.name, err)
+		}
+
+		if err := restore.Get("/bucket/unsigned.json", &got); !errors.Is(err, errUnsigned) {
+			t.Errorf("%s: Expected an unsigned cache ending in .json to be refused, got %v", test.name, err)
+		}
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	if _, err := newSigner("secret", "not a key"); err == nil {
+		t.Error("Expected a verify_key along with an hmac key to fail")
+	}
+
+	if _, err := newSigner("", "not a key"); err == nil {
+		t.Error("Expected an invalid verify_key to fail")
+	}
+
+	s, err := newSigner("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.sign("/bucket/archive.tar", []byte("digest")); err == nil {
+		t.Error("Expected signing without a signing_key to fail")
+	}
+}
+
+func TestSignedStorageCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ms := &labelledStorage{memoryStorage: newMemoryStorage(), metadata: make(map[string]map[string]string)}
+
+	s, err := signStorage(ms, "secret", "", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stamped := &stampedStorage{metadataStorage: s.(metadataStorage), metadata: map[string]string{producerMetadataKey: producerName}}
+
+	if err := stamped.Put("/bucket/archive.tar", strings.NewReader("cache")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, metadata, _ := ms.Stat("/bucket/archive.tar.sig"); metadata[producerMetadataKey] != producerName {
+		t.Errorf("Expected the signature to carry the producer marker, got %v", metadata)
+	}
+
+	if err := stamped.Copy("/bucket/archive.tar", "/bucket/alias.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+
+	if err := s.Get("/bucket/alias.tar", &got); err != nil || got.String() != "cache" {
+		t.Errorf("Expected the copy to be signed for its key, got %q %v", got.String(), err)
+	}
+
+	if _, metadata, _ := ms.Stat("/bucket/alias.tar.sig"); metadata[producerMetadataKey] != producerName {
+		t.Errorf("Expected the signature of the copy to carry the producer marker, got %v", metadata)
+	}
+}
+
+func TestSignedLocalCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &Plugin{Storage: newMemoryStorage(), LocalCache: filepath.Join(dir, "local"), SigningKey: "secret", TempDir: dir}
+
+	if err := p.wrapStorage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Storage.Put("/bucket/archive.tar", strings.NewReader("cache")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy poisoned in the shared directory still matches the remote
+	// object, but not its signature
+	local := filepath.Join(p.LocalCache, "bucket", "archive.tar")
+	fi, err := os.Stat(local)
+	if err != nil {
+		t.Fatalf("Expected a local copy, got %v", err)
+	}
+
+	ioutil.WriteFile(local, []byte("evil!"), 0644)
+	os.Chtimes(local, fi.ModTime(), fi.ModTime())
+
+	var got bytes.Buffer
+
+	if err := p.Storage.Get("/bucket/archive.tar", &got); err == nil || got.Len() != 0 {
+		t.Errorf("Expected the poisoned local copy to be refused, got %q %v", got.String(), err)
+	}
+}
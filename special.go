@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// capabilityXattr is the extended attribute holding file capabilities.
+	capabilityXattr = "security.capability"
+
+	// capabilityPAXKey is the PAX record of the capabilities of an entry,
+	// as written by GNU tar with --xattrs.
+	capabilityPAXKey = "SCHILY.xattr." + capabilityXattr
+
+	// specialModes are the setuid, setgid and sticky bits.
+	specialModes = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+	// specialHeaderModes are the setuid, setgid and sticky bits of tar
+	// header modes.
+	specialHeaderModes = 07000
+)
+
+// hasSpecialBits reports whether path has special mode bits or file
+// capabilities.
+func hasSpecialBits(path string, fi os.FileInfo) bool {
+	if fi.Mode()&specialModes != 0 {
+		return true
+	}
+
+	capability, _ := getCapability(path)
+
+	return len(capability) > 0
+}
+
+// packSpecialBits adds the capabilities of path to the header when special
+// bits are allowed, and strips the special mode bits and capabilities with
+// a warning otherwise.
+func packSpecialBits(header *tar.Header, path string, fi os.FileInfo, allow bool) error {
+	if !fi.Mode().IsRegular() && !fi.IsDir() {
+		return nil
+	}
+
+	var capability []byte
+
+	if fi.Mode().IsRegular() {
+		var err error
+		if capability, err = getCapability(path); err != nil {
+			return err
+		}
+	}
+
+	if !allow {
+		if header.Mode&specialHeaderModes != 0 || len(capability) > 0 {
+			log.Warnf("Stripping the special permissions of %s. Set allow_special_bits to keep them", path)
+			header.Mode &^= specialHeaderModes
+		}
+
+		return nil
+	}
+
+	if len(capability) > 0 {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+
+		header.Format = tar.FormatPAX
+		header.PAXRecords[capabilityPAXKey] = string(capability)
+	}
+
+	return nil
+}
+
+// unpackSpecialBits restores the special mode bits and capabilities of the
+// entry at target when they are allowed, warning they are stripped
+// otherwise. The permissions are applied without mask.
+func unpackSpecialBits(target string, header *tar.Header, mask os.FileMode, allow bool) error {
+	special := header.FileInfo().Mode() & specialModes
+	capability, hasCapability := header.PAXRecords[capabilityPAXKey]
+
+	if special == 0 && !hasCapability {
+		return nil
+	}
+
+	if !allow {
+		log.Warnf("Stripping the special permissions of %s. Set allow_special_bits to restore them", target)
+		return nil
+	}
+
+	if special != 0 {
+		if err := os.Chmod(target, header.FileInfo().Mode().Perm()&^mask|special); err != nil {
+			return err
+		}
+	}
+
+	if hasCapability {
+		return setCapability(target, []byte(capability))
+	}
+
+	return nil
+}
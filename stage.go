@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// stagingPrefix names the directory a staged restore unpacks into. It
+	// is created in the workspace so the mounts can be renamed into place.
+	stagingPrefix = ".cache-staging-"
+
+	// stagingBackupSuffix is appended to the staged path a replaced mount
+	// is moved to, removed along with the staging directory.
+	stagingBackupSuffix = ".cache-replaced"
+)
+
+func newStaging() (string, error) {
+	return ioutil.TempDir(".", stagingPrefix)
+}
+
+// swapMounts moves the mounts unpacked into the staging directory into the
+// workspace. Each mount is renamed as a whole so it is either restored
+// completely or left untouched. Mounts missing from the cache are kept.
+func swapMounts(staging string, mounts []string) error {
+	names := make([]string, 0, len(mounts))
+
+	for _, mount := range mounts {
+		names = append(names, filepath.Clean(strings.TrimPrefix(mount, "/")))
+	}
+
+	// Parents sort before the mounts nested in them, which are moved along
+	// with the parent
+	sort.Strings(names)
+
+	for _, name := range names {
+		staged := filepath.Join(staging, name)
+
+		if _, err := os.Lstat(staged); err != nil {
+			log.Debugf("Mount %s not in the cache. Keeping it", name)
+			continue
+		}
+
+		if err := swapPath(staged, name); err != nil {
+			return fmt.Errorf("Failed to move %s into place %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// swapPath replaces target with staged, putting target back when the
+// staged path cannot be moved.
+func swapPath(staged, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	backup := staged + stagingBackupSuffix
+	_, err := os.Lstat(target)
+	replaced := err == nil
+
+	if replaced {
+		if err := os.Rename(target, backup); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(staged, target); err != nil {
+		if replaced {
+			os.Rename(backup, target)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// unstaged returns the workspace path of a file unpacked into staging.
+func unstaged(staging, name string) string {
+	if rel, err := filepath.Rel(staging, name); err == nil {
+		return rel
+	}
+
+	return name
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStagedRestoreSwapsMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("cache/nested", 0755)
+	ioutil.WriteFile("cache/nested/file", []byte("cached"), 0644)
+
+	a := &tarArchive{}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"cache"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The workspace holds stale files and a mount missing from the cache
+	os.RemoveAll("cache")
+	os.MkdirAll("cache", 0755)
+	ioutil.WriteFile("cache/stale", []byte("stale"), 0644)
+	os.MkdirAll("other", 0755)
+	ioutil.WriteFile("other/file", []byte("kept"), 0644)
+
+	staging, err := newStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ra := &rootedArchive{Archive: a, root: staging}
+	if err := ra.Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is moved until the swap
+	if _, err := os.Stat("cache/nested/file"); err == nil {
+		t.Error("Expected the mount to be untouched before the swap")
+	}
+
+	if err := swapMounts(staging, []string{"cache/nested", "/cache", "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile("cache/nested/file"); string(b) != "cached" {
+		t.Errorf("Expected the restored file, got %q", b)
+	}
+	if _, err := os.Stat("cache/stale"); err == nil {
+		t.Error("Expected the stale file to be replaced")
+	}
+	if b, _ := ioutil.ReadFile("other/file"); string(b) != "kept" {
+		t.Errorf("Expected the mount missing from the cache to be kept, got %q", b)
+	}
+
+	if got := unstaged(staging, filepath.Join(staging, "cache/file")); got != filepath.Join("cache", "file") {
+		t.Errorf("Expected the workspace path, got %q", got)
+	}
+}
+
+func TestOverlayMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("cache", 0755)
+	ioutil.WriteFile("cache/file", []byte("cached"), 0644)
+
+	a := &tarArchive{}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"cache"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lower, err := newOverlayLower("overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Unpack(lower, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Plugin{Mount: []string{"cache", "missing"}, OverlayDir: "overlay"}
+
+	if err := p.overlayMounts(lower); err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := ioutil.ReadFile(filepath.Join("overlay", overlayScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	abs, _ := filepath.Abs("cache")
+	options := "lowerdir=" + filepath.Join(lower, "cache") + ":" + abs
+
+	if !bytes.Contains(script, []byte(options)) || bytes.Contains(script, []byte("missing")) {
+		t.Errorf("Expected only the cache mount to be overlaid above its contents, got %s", script)
+	}
+
+	if _, err := os.Stat(filepath.Join("overlay", "upper", "cache")); err != nil {
+		t.Errorf("Expected the upper directory to be created, got %v", err)
+	}
+}
+
+func TestStagedRestoreWithPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	os.MkdirAll("rest", 0755)
+	os.MkdirAll("first", 0755)
+	ioutil.WriteFile("rest/file", []byte("rest"), 0644)
+	ioutil.WriteFile("first/file", []byte("first"), 0644)
+
+	a := &tarArchive{}
+
+	var buf bytes.Buffer
+	if err := a.Pack([]string{"rest", "first"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("rest")
+	os.RemoveAll("first")
+
+	staging, err := newStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.priority = []string{"first"}
+	a.deferred = sp
+
+	ra := &rootedArchive{Archive: a, root: staging}
+	if err := ra.Unpack("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := finishPriorityRestore(a, sp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deferred paths are restored into staging rather than the mounts
+	if _, err := os.Stat("rest"); err == nil {
+		t.Error("Expected the deferred paths to be unpacked into staging")
+	}
+
+	if err := swapMounts(staging, []string{"rest", "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"rest/file": "rest", "first/file": "first"} {
+		if b, _ := ioutil.ReadFile(name); string(b) != expected {
+			t.Errorf("Expected %s to be restored, got %q", name, b)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// metadataStorage is implemented by backends that can attach metadata to
+// objects and retrieve it without downloading the object.
+type metadataStorage interface {
+	storage.Storage
+
+	PutWithMetadata(p string, src io.Reader, metadata map[string]string) error
+	Stat(p string) (storage.FileEntry, map[string]string, error)
+}
+
+// stampedStorage attaches metadata to every object uploaded.
+type stampedStorage struct {
+	metadataStorage
+
+	metadata map[string]string
+}
+
+func (s *stampedStorage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+func (s *stampedStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	return s.metadataStorage.PutWithMetadata(p, src, s.merge(metadata))
+}
+
+func (s *stampedStorage) ETag(p string) (string, error) {
+	if ts, ok := s.metadataStorage.(taggedStorage); ok {
+		return ts.ETag(p)
+	}
+
+	return "", errors.New("Storage does not support entity tags")
+}
+
+func (s *stampedStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	if cs, ok := s.metadataStorage.(conditionalStorage); ok {
+		return cs.PutIfMatch(p, src, etag, s.merge(metadata))
+	}
+
+	return false, errors.New("Storage does not support conditional writes")
+}
+
+// merge returns the stamped metadata overlaid with metadata.
+func (s *stampedStorage) merge(metadata map[string]string) map[string]string {
+	merged := make(map[string]string, len(s.metadata)+len(metadata))
+
+	for k, v := range s.metadata {
+		merged[k] = v
+	}
+
+	for k, v := range metadata {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// copyingStorage is implemented by backends which can copy an object on
+// the server, keeping its metadata, without downloading it. Wrappers
+// return errNoCopy when the backend they wrap cannot.
+type copyingStorage interface {
+	Copy(src, dst string) error
+}
+
+var errNoCopy = errors.New("Storage does not support copies")
+
+func (s *stampedStorage) Copy(src, dst string) error {
+	if cs, ok := s.metadataStorage.(copyingStorage); ok {
+		return cs.Copy(src, dst)
+	}
+
+	return errNoCopy
+}
+
+// taggedStorage is implemented by backends exposing the entity tag of
+// objects.
+type taggedStorage interface {
+	ETag(p string) (string, error)
+}
+
+// conditionalStorage is implemented by backends which can write an object
+// only when it is unchanged since it was read, reporting false otherwise.
+// An empty etag writes the object only when it does not exist.
+type conditionalStorage interface {
+	taggedStorage
+
+	PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error)
+}
@@ -0,0 +1,133 @@
+// Package process implements a storage backend delegating to an external
+// command, so backends can be added without changing the plugin.
+//
+// The command is run with sh once per operation. The first line of its
+// stdin is a JSON request with the op, get, put, list or delete, and the
+// path. The object follows the request on stdin for put, and is written to
+// stdout for get. List writes one JSON entry per line with the path, size
+// and last_modified of every object under the path. A non-zero exit fails
+// the operation with stderr as the message.
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// Request is the JSON request line of an operation.
+type Request struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+}
+
+// Entry is the JSON line written for every object listed.
+type Entry struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type processStorage struct {
+	command string
+}
+
+// New returns a Storage running command for every operation.
+func New(command string) storage.Storage {
+	return &processStorage{command: command}
+}
+
+func (s *processStorage) Get(p string, dst io.Writer) error {
+	log.Infof("Retrieving %s with %s", p, s.command)
+
+	return s.run(Request{Op: "get", Path: p}, nil, dst)
+}
+
+func (s *processStorage) Put(p string, src io.Reader) error {
+	log.Infof("Uploading %s with %s", p, s.command)
+
+	return s.run(Request{Op: "put", Path: p}, src, nil)
+}
+
+func (s *processStorage) List(p string) ([]storage.FileEntry, error) {
+	log.Infof("Retrieving objects at %s with %s", p, s.command)
+
+	var out bytes.Buffer
+
+	if err := s.run(Request{Op: "list", Path: p}, nil, &out); err != nil {
+		return nil, err
+	}
+
+	var objects []storage.FileEntry
+	scanner := bufio.NewScanner(&out)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("Invalid entry %s from %s %s", line, s.command, err)
+		}
+
+		objects = append(objects, storage.FileEntry{
+			Path:         entry.Path,
+			Size:         entry.Size,
+			LastModified: entry.LastModified,
+		})
+	}
+
+	log.Infof("Found %d objects at %s", len(objects), p)
+
+	return objects, scanner.Err()
+}
+
+func (s *processStorage) Delete(p string) error {
+	log.Infof("Deleting %s with %s", p, s.command)
+
+	return s.run(Request{Op: "delete", Path: p}, nil, nil)
+}
+
+// run sends the request followed by body to the command, copying its
+// output to dst.
+func (s *processStorage) run(req Request, body io.Reader, dst io.Writer) error {
+	line, err := json.Marshal(&req)
+
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("sh", "-c", s.command)
+	cmd.Stderr = &stderr
+	cmd.Stdout = dst
+
+	stdin := io.Reader(bytes.NewReader(append(line, '\n')))
+	if body != nil {
+		stdin = io.MultiReader(stdin, body)
+	}
+
+	cmd.Stdin = stdin
+
+	if err = cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s %s failed: %s", req.Op, req.Path, msg)
+		}
+
+		return fmt.Errorf("%s %s failed: %s", req.Op, req.Path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHelperBackend is the backend run by the tests, storing objects as
+// files in the directory of BACKEND_DIR.
+func TestHelperBackend(t *testing.T) {
+	dir := os.Getenv("BACKEND_DIR")
+
+	if dir == "" {
+		return
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	line, _ := r.ReadBytes('\n')
+
+	var req Request
+	if err := json.Unmarshal(line, &req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(req.Path))
+
+	var err error
+
+	switch req.Op {
+	case "get":
+		var f *os.File
+		if f, err = os.Open(path); err == nil {
+			io.Copy(os.Stdout, f)
+			f.Close()
+		}
+	case "put":
+		os.MkdirAll(filepath.Dir(path), 0755)
+
+		var b []byte
+		if b, err = ioutil.ReadAll(r); err == nil {
+			err = ioutil.WriteFile(path, b, 0644)
+		}
+	case "list":
+		err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			rel, _ := filepath.Rel(dir, p)
+			rel = filepath.ToSlash(rel)
+
+			if err != nil || fi.IsDir() || !strings.HasPrefix(rel, req.Path) {
+				return err
+			}
+
+			return json.NewEncoder(os.Stdout).Encode(&Entry{Path: rel, Size: fi.Size(), LastModified: fi.ModTime()})
+		})
+	case "delete":
+		err = os.Remove(path)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+func TestCommandStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backend")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s := New(fmt.Sprintf("BACKEND_DIR=%s %s -test.run=TestHelperBackend", dir, os.Args[0]))
+
+	if err = s.Put("bucket/cache/archive.tar", strings.NewReader("contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = s.Get("bucket/cache/archive.tar", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "contents" {
+		t.Errorf("Expected contents, got %q", buf.String())
+	}
+
+	files, err := s.List("bucket/cache")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].Path != "bucket/cache/archive.tar" || files[0].Size != 8 {
+		t.Errorf("Expected the archive listed, got %v", files)
+	}
+
+	if err = s.Delete("bucket/cache/archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Get("bucket/cache/archive.tar", &buf)
+
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("Expected the get of a deleted object to fail with the stderr of the command, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Bootstrap creates the bucket unless it exists and, with the minio
+// provider, adds document as the canned policy name through the admin
+// API, which needs admin credentials. It reports whether the policy was
+// added, as other providers manage policies in their own IAM.
+func (s *s3Storage) Bootstrap(bucket, name string, document []byte) (bool, error) {
+	if isDirectoryBucket(bucket) {
+		return false, fmt.Errorf("Directory bucket %s has to be created up front", bucket)
+	}
+
+	if err := s.ensureBucket(bucket); err != nil {
+		return false, err
+	}
+
+	if !strings.EqualFold(s.opts.Provider, "minio") {
+		return false, nil
+	}
+
+	if err := s.addCannedPolicy(name, document); err != nil {
+		return false, err
+	}
+
+	log.Infof("Policy %s added", name)
+	return true, nil
+}
+
+// addCannedPolicy adds or replaces the MinIO policy name. The vendored
+// client has no admin API so the request is made directly.
+func (s *s3Storage) addCannedPolicy(name string, document []byte) error {
+	scheme := "http"
+	if s.opts.UseSSL {
+		scheme = "https"
+	}
+
+	region := s.opts.Region
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+
+	u := fmt.Sprintf("%s://%s/minio/admin/v3/add-canned-policy?name=%s", scheme, s.opts.Endpoint, url.QueryEscape(name))
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(document))
+
+	if err != nil {
+		return err
+	}
+
+	creds, err := s.creds.get()
+
+	if err != nil {
+		return err
+	}
+
+	signV4(req, creds, region, "s3", hexSum256(document), time.Now())
+
+	resp, err := s.http.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Adding policy %s failed: %s %s", name, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
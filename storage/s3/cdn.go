@@ -0,0 +1,156 @@
+package s3
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/s3utils"
+)
+
+// cdnURLLifetime is how long the signed URLs of downloads are valid.
+const cdnURLLifetime = time.Hour
+
+// cdnSignature replaces the characters of base64 which are not valid in the
+// query strings of CloudFront signed URLs.
+var cdnSignature = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+// cdnClient downloads objects through a CDN or caching proxy in front of the
+// buckets, signing the URLs with a CloudFront key pair when one is given.
+type cdnClient struct {
+	base      string
+	keyPairID string
+	key       *rsa.PrivateKey
+	client    *http.Client
+}
+
+func newCDNClient(opts *Options) (*cdnClient, error) {
+	c := &cdnClient{
+		base:      strings.TrimSuffix(opts.DownloadBaseURL, "/"),
+		keyPairID: opts.DownloadKeyPairID,
+		client:    http.DefaultClient,
+	}
+
+	if _, err := url.Parse(c.base); err != nil {
+		return nil, fmt.Errorf("Invalid download base URL %s", err)
+	}
+
+	if (len(opts.DownloadKeyPairID) == 0) != (len(opts.DownloadPrivateKey) == 0) {
+		return nil, errors.New("Signed download URLs need both a key pair ID and a private key")
+	}
+
+	if len(opts.DownloadPrivateKey) == 0 {
+		return c, nil
+	}
+
+	key, err := parsePrivateKey([]byte(opts.DownloadPrivateKey))
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid download private key %s", err)
+	}
+
+	c.key = key
+
+	return c, nil
+}
+
+// url returns the URL of the object in bucket at key, with {bucket} in the
+// base URL replaced by the bucket.
+func (c *cdnClient) url(bucket, key string) (string, error) {
+	u := strings.Replace(c.base, "{bucket}", bucket, -1) + "/" + s3utils.EncodePath(key)
+
+	if c.key == nil {
+		return u, nil
+	}
+
+	expires := time.Now().Add(cdnURLLifetime).Unix()
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, u, expires)
+
+	sum := sha1.Sum([]byte(policy))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA1, sum[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s?Expires=%d&Signature=%s&Key-Pair-Id=%s", u, expires,
+		cdnSignature.Replace(base64.StdEncoding.EncodeToString(signature)), url.QueryEscape(c.keyPairID)), nil
+}
+
+// Get downloads the object in bucket at key to dst, reporting whether any
+// of it was written. Missing objects are reported as NoSuchKey.
+func (c *cdnClient) Get(bucket, key string, dst io.Writer) (bool, error) {
+	u, err := c.url(bucket, key)
+
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.client.Get(u)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, minio.ErrorResponse{Code: "NoSuchKey", Message: resp.Status, BucketName: bucket, Key: key}
+	default:
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("Download of %s/%s failed: %s %s", bucket, key, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	numBytes, err := io.Copy(dst, resp.Body)
+
+	if err != nil {
+		return numBytes > 0, err
+	}
+
+	log.Infof("Downloaded %s through %s", humanize.Bytes(uint64(numBytes)), resp.Request.URL.Host)
+
+	return true, nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, errors.New("No PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, errors.New("Only RSA keys are supported")
+	}
+
+	return key, nil
+}
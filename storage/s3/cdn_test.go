@@ -0,0 +1,57 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCDNClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		if q.Get("Key-Pair-Id") != "K2JCJMDEHXQW5F" || q.Get("Signature") == "" || q.Get("Expires") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path != "/cache/repo/archive.tar" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		io.WriteString(w, "archive")
+	}))
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newCDNClient(&Options{
+		DownloadBaseURL:    server.URL + "/{bucket}/",
+		DownloadKeyPairID:  "K2JCJMDEHXQW5F",
+		DownloadPrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if _, err = c.Get("cache", "repo/archive.tar", &buf); err != nil || buf.String() != "archive" {
+		t.Errorf("Expected the archive through the CDN, got %q %v", buf.String(), err)
+	}
+
+	if _, err = c.Get("cache", "repo/missing.tar", &buf); ErrorCode(err) != "NoSuchKey" {
+		t.Errorf("Expected a missing object, got %v", err)
+	}
+}
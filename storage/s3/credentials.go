@@ -0,0 +1,578 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// credentialRefreshWindow is how long before they expire temporary
+	// credentials are refreshed.
+	credentialRefreshWindow = 5 * time.Minute
+
+	// instanceTokenTTL is the lifetime requested for IMDSv2 tokens.
+	instanceTokenTTL = "21600"
+
+	// assumeRoleDuration is the lifetime in seconds requested for the
+	// credentials of assumed roles.
+	assumeRoleDuration = "3600"
+
+	// DefaultRoleSessionName names the sessions of assumed roles unless
+	// configured otherwise.
+	DefaultRoleSessionName = "drone-s3-cache"
+)
+
+var (
+	// instanceMetadataEndpoint and containerMetadataEndpoint serve the
+	// credentials of EC2 instance profiles and ECS task roles.
+	instanceMetadataEndpoint  = "http://169.254.169.254"
+	containerMetadataEndpoint = "http://169.254.170.2"
+
+	// stsEndpoint is the global endpoint of STS roles are assumed through.
+	stsEndpoint = "https://sts.amazonaws.com"
+	stsClient   = &http.Client{Timeout: 30 * time.Second}
+
+	// metadataClient gives up quickly outside of EC2 and ECS, where the
+	// metadata endpoints cannot be reached.
+	metadataClient = &http.Client{Timeout: 2 * time.Second}
+)
+
+// credentialProvider retrieves credentials, along with when they expire or
+// the zero time when they do not.
+type credentialProvider interface {
+	retrieve() (credentials, time.Time, error)
+}
+
+// staticCredentials are the access and secret keys configured.
+type staticCredentials credentials
+
+func (c staticCredentials) retrieve() (credentials, time.Time, error) {
+	return credentials(c), time.Time{}, nil
+}
+
+// envCredentials reads the keys from the standard AWS environment
+// variables.
+type envCredentials struct{}
+
+func (envCredentials) retrieve() (credentials, time.Time, error) {
+	creds := credentials{
+		Access: firstEnv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY"),
+		Secret: firstEnv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"),
+		Token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if len(creds.Access) == 0 || len(creds.Secret) == 0 {
+		return credentials{}, time.Time{}, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY not set")
+	}
+
+	return creds, time.Time{}, nil
+}
+
+// sharedCredentials reads the keys of the profile, or of the AWS_PROFILE or
+// default profile, from the shared credentials and config files. A file
+// given replaces the shared credentials files otherwise read.
+type sharedCredentials struct {
+	profile string
+	file    string
+}
+
+func (c sharedCredentials) retrieve() (credentials, time.Time, error) {
+	profile := c.profile
+
+	if len(profile) == 0 {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+
+	if len(profile) == 0 {
+		profile = "default"
+	}
+
+	home, _ := os.UserHomeDir()
+
+	files := []struct {
+		path, section string
+	}{
+		{firstEnv("AWS_SHARED_CREDENTIALS_FILE"), profile},
+		{filepath.Join(home, ".aws", "credentials"), profile},
+		{firstEnv("AWS_CONFIG_FILE"), "profile " + profile},
+		{filepath.Join(home, ".aws", "config"), "profile " + profile},
+	}
+
+	if len(c.file) > 0 {
+		if _, err := os.Stat(c.file); err != nil {
+			return credentials{}, time.Time{}, fmt.Errorf("Failed to read credentials file %s", err)
+		}
+
+		files[0].path, files[1].path = c.file, ""
+	}
+
+	for _, file := range files {
+		if len(file.path) == 0 {
+			continue
+		}
+
+		section := file.section
+		if profile == "default" {
+			section = "default"
+		}
+
+		values, err := readProfile(file.path, section)
+
+		if err != nil {
+			continue
+		}
+
+		creds := credentials{
+			Access: values["aws_access_key_id"],
+			Secret: values["aws_secret_access_key"],
+			Token:  values["aws_session_token"],
+		}
+
+		if len(creds.Access) > 0 && len(creds.Secret) > 0 {
+			return creds, time.Time{}, nil
+		}
+	}
+
+	return credentials{}, time.Time{}, fmt.Errorf("No keys for profile %s in the shared credentials or config file", profile)
+}
+
+// readProfile returns the keys of the section of the INI file at path.
+func readProfile(path, section string) (map[string]string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	values := make(map[string]string)
+	current := ""
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case len(line) == 0 || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[' && line[len(line)-1] == ']':
+			current = strings.TrimSpace(line[1 : len(line)-1])
+		case current == section:
+			if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+				values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+
+	return values, scanner.Err()
+}
+
+// containerCredentials requests the credentials of the ECS task role.
+type containerCredentials struct{}
+
+func (containerCredentials) retrieve() (credentials, time.Time, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); len(relative) > 0 {
+		endpoint = containerMetadataEndpoint + relative
+	}
+
+	if len(endpoint) == 0 {
+		return credentials{}, time.Time{}, errors.New("Not running in an ECS task")
+	}
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+
+	if err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); len(token) > 0 {
+		req.Header.Set("Authorization", token)
+	}
+
+	return requestRoleCredentials(req)
+}
+
+// instanceCredentials requests the credentials of the EC2 instance profile
+// through IMDSv2, or IMDSv1 when no token can be obtained.
+type instanceCredentials struct{}
+
+func (instanceCredentials) retrieve() (credentials, time.Time, error) {
+	var token string
+
+	req, err := http.NewRequest("PUT", instanceMetadataEndpoint+"/latest/api/token", nil)
+
+	if err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", instanceTokenTTL)
+
+	if b, err := metadataRequest(req); err == nil {
+		token = string(b)
+	}
+
+	path := instanceMetadataEndpoint + "/latest/meta-data/iam/security-credentials/"
+
+	if req, err = http.NewRequest("GET", path, nil); err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	if len(token) > 0 {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	}
+
+	b, err := metadataRequest(req)
+
+	if err != nil {
+		return credentials{}, time.Time{}, fmt.Errorf("No instance profile %s", err)
+	}
+
+	role := strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0])
+
+	if req, err = http.NewRequest("GET", path+role, nil); err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	if len(token) > 0 {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	}
+
+	return requestRoleCredentials(req)
+}
+
+// requestRoleCredentials decodes the role credentials returned by the
+// metadata endpoints of EC2 and ECS.
+func requestRoleCredentials(req *http.Request) (credentials, time.Time, error) {
+	b, err := metadataRequest(req)
+
+	if err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	var result struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+
+	if err = json.Unmarshal(b, &result); err != nil {
+		return credentials{}, time.Time{}, fmt.Errorf("Invalid role credentials %s", err)
+	}
+
+	creds := credentials{Access: result.AccessKeyID, Secret: result.SecretAccessKey, Token: result.Token}
+
+	return creds, result.Expiration, nil
+}
+
+func metadataRequest(req *http.Request) ([]byte, error) {
+	resp, err := metadataClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request to %s failed: %s", req.URL, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// chainCredentials retrieves the credentials of the first provider which
+// has any.
+type chainCredentials []credentialProvider
+
+// defaultChain is the standard AWS credential chain: the environment, the
+// shared credentials and config files, the web identity of the environment,
+// the ECS task role and the EC2 instance profile.
+func defaultChain() chainCredentials {
+	return chainCredentials{envCredentials{}, sharedCredentials{}, envWebIdentity(), containerCredentials{}, instanceCredentials{}}
+}
+
+func (c chainCredentials) retrieve() (credentials, time.Time, error) {
+	var errs []string
+
+	for _, provider := range c {
+		creds, expires, err := provider.retrieve()
+
+		if err == nil {
+			return creds, expires, nil
+		}
+
+		errs = append(errs, err.Error())
+	}
+
+	return credentials{}, time.Time{}, fmt.Errorf("No access credentials found: %s", strings.Join(errs, ". "))
+}
+
+// cachedCredentials holds the credentials of the provider, refreshing them
+// shortly before they expire.
+type cachedCredentials struct {
+	provider credentialProvider
+
+	mu      sync.Mutex
+	creds   credentials
+	expires time.Time
+	valid   bool
+}
+
+func newCachedCredentials(provider credentialProvider) *cachedCredentials {
+	return &cachedCredentials{provider: provider}
+}
+
+func (c *cachedCredentials) get() (credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.valid && (c.expires.IsZero() || time.Now().Add(credentialRefreshWindow).Before(c.expires)) {
+		return c.creds, nil
+	}
+
+	creds, expires, err := c.provider.retrieve()
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	if !expires.IsZero() {
+		log.Debugf("Retrieved credentials expiring %s", expires.Format(time.RFC3339))
+	}
+
+	c.creds, c.expires, c.valid = creds, expires, true
+
+	return creds, nil
+}
+
+// signingTransport signs the requests of the vendored client again with
+// the current credentials, which it cannot refresh, adding the session
+// token it does not know about.
+type signingTransport struct {
+	base  http.RoundTripper
+	creds *cachedCredentials
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth := req.Header.Get("Authorization")
+
+	if !strings.HasPrefix(auth, signV4Algorithm) {
+		return t.base.RoundTrip(req)
+	}
+
+	creds, err := t.creds.get()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The region is the third element of the credential scope
+	// <key>/<date>/<region>/s3/aws4_request
+	scope := strings.Split(strings.SplitN(strings.TrimPrefix(auth, signV4Algorithm+" Credential="), ",", 2)[0], "/")
+
+	if len(scope) < 5 {
+		return nil, fmt.Errorf("Invalid authorization %s", auth)
+	}
+
+	signed := new(http.Request)
+	*signed = *req
+	signed.Header = make(http.Header, len(req.Header))
+
+	for k, v := range req.Header {
+		signed.Header[k] = v
+	}
+
+	signed.Header.Del("Authorization")
+	signV4(signed, creds, scope[2], "s3", req.Header.Get("X-Amz-Content-Sha256"), time.Now())
+
+	return t.base.RoundTrip(signed)
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); len(v) > 0 {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// assumeRoleCredentials assumes a role through STS with the credentials of
+// base, for access scoped to the role.
+type assumeRoleCredentials struct {
+	base        *cachedCredentials
+	roleARN     string
+	sessionName string
+	externalID  string
+}
+
+func (c *assumeRoleCredentials) retrieve() (credentials, time.Time, error) {
+	creds, err := c.base.get()
+
+	if err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {c.roleARN},
+		"RoleSessionName": {c.sessionName},
+		"DurationSeconds": {assumeRoleDuration},
+	}
+
+	if len(c.externalID) > 0 {
+		form.Set("ExternalId", c.externalID)
+	}
+
+	var result struct {
+		Credentials stsCredentials `xml:"AssumeRoleResult>Credentials"`
+	}
+
+	if err = postSTS(form, &creds, c.roleARN, &result); err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	log.Infof("Assumed role %s", c.roleARN)
+
+	return result.Credentials.retrieve()
+}
+
+// webIdentityCredentials assumes a role through STS with the OIDC token in
+// tokenFile, like the service account tokens EKS projects into pods for
+// IAM roles for service accounts. The token is read again on every refresh
+// as it is rotated.
+type webIdentityCredentials struct {
+	tokenFile   string
+	roleARN     string
+	sessionName string
+}
+
+// envWebIdentity returns the web identity of AWS_WEB_IDENTITY_TOKEN_FILE
+// and AWS_ROLE_ARN, or nil when they are not set.
+func envWebIdentity() *webIdentityCredentials {
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+
+	if len(tokenFile) == 0 || len(roleARN) == 0 {
+		return nil
+	}
+
+	return &webIdentityCredentials{
+		tokenFile:   tokenFile,
+		roleARN:     roleARN,
+		sessionName: os.Getenv("AWS_ROLE_SESSION_NAME"),
+	}
+}
+
+func (c *webIdentityCredentials) retrieve() (credentials, time.Time, error) {
+	if c == nil {
+		return credentials{}, time.Time{}, errors.New("AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN not set")
+	}
+
+	token, err := ioutil.ReadFile(c.tokenFile)
+
+	if err != nil {
+		return credentials{}, time.Time{}, fmt.Errorf("Failed to read web identity token %s", err)
+	}
+
+	name := c.sessionName
+
+	if len(name) == 0 {
+		name = DefaultRoleSessionName
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {c.roleARN},
+		"RoleSessionName":  {name},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+		"DurationSeconds":  {assumeRoleDuration},
+	}
+
+	var result struct {
+		Credentials stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+
+	// The token authenticates the request, which is not signed
+	if err = postSTS(form, nil, c.roleARN, &result); err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	log.Infof("Assumed role %s with web identity", c.roleARN)
+
+	return result.Credentials.retrieve()
+}
+
+// stsCredentials are the temporary credentials of an assumed role.
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+func (c stsCredentials) retrieve() (credentials, time.Time, error) {
+	creds := credentials{
+		Access: c.AccessKeyID,
+		Secret: c.SecretAccessKey,
+		Token:  c.SessionToken,
+	}
+
+	return creds, c.Expiration, nil
+}
+
+// postSTS posts form to STS, signed with creds unless they are nil, and
+// decodes the response into result.
+func postSTS(form url.Values, creds *credentials, roleARN string, result interface{}) error {
+	body := []byte(form.Encode())
+	req, err := http.NewRequest("POST", stsEndpoint+"/", bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if creds != nil {
+		signV4(req, *creds, "us-east-1", "sts", hexSum256(body), time.Now())
+	}
+
+	resp, err := stsClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Failed to assume role %s: %s %s", roleARN, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	if err = xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("Invalid credentials of role %s: %s", roleARN, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,428 @@
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+	"github.com/minio/minio-go/pkg/s3utils"
+)
+
+// directoryBucketSuffix ends the name of every S3 Express One Zone
+// directory bucket, e.g. cache--usw2-az1--x-s3.
+const directoryBucketSuffix = "--x-s3"
+
+// expressRegions maps the region code of an availability zone ID to the
+// region it is in.
+var expressRegions = map[string]string{
+	"use1":  "us-east-1",
+	"use2":  "us-east-2",
+	"usw1":  "us-west-1",
+	"usw2":  "us-west-2",
+	"euw1":  "eu-west-1",
+	"euw2":  "eu-west-2",
+	"euw3":  "eu-west-3",
+	"euc1":  "eu-central-1",
+	"eun1":  "eu-north-1",
+	"aps1":  "ap-south-1",
+	"apne1": "ap-northeast-1",
+	"apne2": "ap-northeast-2",
+	"apse1": "ap-southeast-1",
+	"apse2": "ap-southeast-2",
+	"cac1":  "ca-central-1",
+	"sae1":  "sa-east-1",
+}
+
+// isDirectoryBucket reports whether bucket is an S3 Express One Zone
+// directory bucket.
+func isDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, directoryBucketSuffix)
+}
+
+// expressSession holds the temporary credentials from CreateSession.
+type expressSession struct {
+	credentials
+	Token   string
+	Expires time.Time
+}
+
+// expressClient talks to S3 Express One Zone directory buckets, which use
+// zonal endpoints and session based authentication.
+type expressClient struct {
+	creds   *cachedCredentials
+	region  string
+	tempDir string
+	client  *http.Client
+
+	mu       sync.Mutex
+	sessions map[string]*expressSession
+}
+
+func newExpressClient(opts *Options, creds *cachedCredentials) *expressClient {
+	return &expressClient{
+		creds:    creds,
+		region:   opts.Region,
+		tempDir:  opts.TempDir,
+		client:   http.DefaultClient,
+		sessions: make(map[string]*expressSession),
+	}
+}
+
+// endpoint returns the zonal endpoint and region of a directory bucket.
+func (c *expressClient) endpoint(bucket string) (string, string, error) {
+	// Names are <base>--<az id>--x-s3, with AZ IDs such as usw2-az1
+	parts := strings.Split(strings.TrimSuffix(bucket, directoryBucketSuffix), "--")
+
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("Invalid directory bucket %s. Needs to be <name>--<az id>--x-s3", bucket)
+	}
+
+	zone := parts[len(parts)-1]
+	region := c.region
+
+	if len(region) == 0 {
+		code := strings.SplitN(zone, "-", 2)[0]
+
+		if region = expressRegions[code]; len(region) == 0 {
+			return "", "", fmt.Errorf("Unknown region for availability zone %s. Set the region", zone)
+		}
+	}
+
+	return fmt.Sprintf("https://%s.s3express-%s.%s.amazonaws.com", bucket, zone, region), region, nil
+}
+
+// session returns valid session credentials for the bucket, creating a
+// session when there is none or it is about to expire.
+func (c *expressClient) session(bucket string) (*expressSession, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, ok := c.sessions[bucket]; ok && time.Now().Add(time.Minute).Before(s.Expires) {
+		return s, nil
+	}
+
+	endpoint, region, err := c.endpoint(bucket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", endpoint+"/?session", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := c.creds.get()
+
+	if err != nil {
+		return nil, err
+	}
+
+	signV4(req, creds, region, "s3express", hexSum256(nil), time.Now())
+
+	resp, err := c.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, expressError(resp, bucket)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"Credentials"`
+	}
+
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Invalid session for %s: %s", bucket, err)
+	}
+
+	s := &expressSession{
+		credentials: credentials{
+			Access: result.Credentials.AccessKeyID,
+			Secret: result.Credentials.SecretAccessKey,
+		},
+		Token:   result.Credentials.SessionToken,
+		Expires: result.Credentials.Expiration,
+	}
+
+	log.Debugf("Created session for %s expiring %s", bucket, s.Expires)
+
+	c.sessions[bucket] = s
+
+	return s, nil
+}
+
+// do sends a request for key in bucket signed with the bucket session.
+func (c *expressClient) do(method, bucket, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	s, err := c.session(bucket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, region, err := c.endpoint(bucket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(endpoint + "/" + s3utils.EncodePath(key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.RawQuery = s3utils.QueryEncode(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	req.Header.Set("X-Amz-S3session-Token", s.Token)
+	signV4(req, s.credentials, region, "s3express", unsignedPayload, time.Now())
+
+	return c.client.Do(req)
+}
+
+func (c *expressClient) Get(bucket, key string, dst io.Writer) error {
+	resp, err := c.do("GET", bucket, key, nil, nil, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return expressError(resp, bucket+"/"+key)
+	}
+
+	numBytes, err := io.Copy(dst, resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Downloaded %s from server", humanize.Bytes(uint64(numBytes)))
+
+	return nil
+}
+
+// Put uploads src to the bucket. Directory buckets need the size of the
+// object up front so the stream is spooled to a temporary file first.
+func (c *expressClient) Put(bucket, key string, src io.Reader, headers map[string][]string) error {
+	tmp, err := ioutil.TempFile(c.tempDir, "upload")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, src)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	s, err := c.session(bucket)
+
+	if err != nil {
+		return err
+	}
+
+	endpoint, region, err := c.endpoint(bucket)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", endpoint+"/"+s3utils.EncodePath(key), tmp)
+
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("X-Amz-S3session-Token", s.Token)
+	signV4(req, s.credentials, region, "s3express", unsignedPayload, time.Now())
+
+	resp, err := c.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return expressError(resp, bucket+"/"+key)
+	}
+
+	log.Infof("Uploaded %s to server", humanize.Bytes(uint64(size)))
+
+	return nil
+}
+
+func (c *expressClient) List(bucket, prefix string) ([]storage.FileEntry, error) {
+	var objects []storage.FileEntry
+	var token string
+
+	for {
+		query := url.Values{"list-type": {"2"}}
+
+		if len(prefix) > 0 {
+			query.Set("prefix", prefix)
+		}
+
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do("GET", bucket, "", query, nil, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = expressError(resp, bucket+"/"+prefix)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			objects = append(objects, storage.FileEntry{
+				Path:         bucket + "/" + object.Key,
+				Size:         object.Size,
+				LastModified: object.LastModified,
+			})
+		}
+
+		if token = result.NextContinuationToken; len(token) == 0 {
+			return objects, nil
+		}
+	}
+}
+
+func (c *expressClient) Delete(bucket, key string) error {
+	resp, err := c.do("DELETE", bucket, key, nil, nil, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return expressError(resp, bucket+"/"+key)
+	}
+
+	return nil
+}
+
+func expressError(resp *http.Response, resource string) error {
+	var result struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || len(result.Code) == 0 {
+		return fmt.Errorf("Request for %s failed: %s", resource, resp.Status)
+	}
+
+	return fmt.Errorf("Request for %s failed: %s %s", resource, result.Code, result.Message)
+}
+
+func hexSum256(data []byte) string {
+	return fmt.Sprintf("%x", sum256(data))
+}
+
+func (c *expressClient) Stat(bucket, key string) (storage.FileEntry, map[string]string, error) {
+	resp, err := c.do("HEAD", bucket, key, nil, nil, 0)
+
+	if err != nil {
+		return storage.FileEntry{}, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return storage.FileEntry{}, nil, fmt.Errorf("Request for %s/%s failed: %s", bucket, key, resp.Status)
+	}
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return storage.FileEntry{
+		Path:         bucket + "/" + key,
+		Size:         resp.ContentLength,
+		LastModified: lastModified,
+	}, userMetadata(resp.Header), nil
+}
+
+func (c *expressClient) ETag(bucket, key string) (string, error) {
+	resp, err := c.do("HEAD", bucket, key, nil, nil, 0)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Request for %s/%s failed: %s", bucket, key, resp.Status)
+	}
+
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
@@ -0,0 +1,196 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/minio/minio-go"
+)
+
+// bucketPolicy is the subset of a bucket policy needed to explain denials.
+type bucketPolicy struct {
+	Statement []struct {
+		Effect    string                            `json:"Effect"`
+		Action    interface{}                       `json:"Action"`
+		Condition map[string]map[string]interface{} `json:"Condition"`
+	} `json:"Statement"`
+}
+
+// uploadError adds guidance to an upload denied by a bucket policy, since
+// S3 only reports a bare AccessDenied.
+func (s *s3Storage) uploadError(bucket string, err error) error {
+	if minio.ToErrorResponse(err).Code != "AccessDenied" {
+		return err
+	}
+
+	policy, perr := s.bucketPolicy(bucket)
+
+	if perr != nil {
+		log.Debugf("Could not retrieve bucket policy of %s %s", bucket, perr)
+		return err
+	}
+
+	guidance := policyGuidance(policy, s.opts)
+
+	if len(guidance) == 0 {
+		return err
+	}
+
+	for _, g := range guidance {
+		log.Error(g)
+	}
+
+	return fmt.Errorf("%s. %s", err, strings.Join(guidance, ". "))
+}
+
+// bucketPolicy retrieves the policy of the bucket. The vendored client does
+// not expose policy conditions so the policy is requested directly.
+func (s *s3Storage) bucketPolicy(bucket string) (*bucketPolicy, error) {
+	region, err := s.client.GetBucketLocation(bucket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	if s.opts.UseSSL {
+		scheme = "https"
+	}
+
+	host := s.opts.Endpoint
+	if host == "s3.amazonaws.com" && region != "us-east-1" {
+		host = "s3." + region + ".amazonaws.com"
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/%s?policy", scheme, host, bucket), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := s.creds.get()
+
+	if err != nil {
+		return nil, err
+	}
+
+	signV4(req, creds, region, "s3", hexSum256(nil), time.Now())
+
+	resp, err := s.http.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request for policy of %s failed: %s", bucket, resp.Status)
+	}
+
+	policy := &bucketPolicy{}
+	if err = json.NewDecoder(resp.Body).Decode(policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// policyGuidance explains the conditions under which the policy denies
+// uploads, naming the settings to change from those in opts.
+func policyGuidance(policy *bucketPolicy, opts *Options) []string {
+	var guidance []string
+
+	for _, statement := range policy.Statement {
+		if statement.Effect != "Deny" || !deniesPut(statement.Action) {
+			continue
+		}
+
+		for operator, conditions := range statement.Condition {
+			for key, value := range conditions {
+				switch strings.ToLower(key) {
+				case "aws:securetransport":
+					guidance = append(guidance, "Bucket policy requires TLS. Set server to an https:// URL")
+
+				case "s3:x-amz-server-side-encryption":
+					if operator == "Null" {
+						guidance = append(guidance, "Bucket policy requires server side encryption of uploads. Set encryption: aes256 or encryption: aws:kms")
+					} else {
+						guidance = append(guidance, fmt.Sprintf("Bucket policy requires server side encryption of uploads with %s. Set %s%s", conditionValue(value), encryptionSettings(value), currentSetting("encryption", opts.Encryption)))
+					}
+
+				case "s3:x-amz-server-side-encryption-aws-kms-key-id":
+					guidance = append(guidance, fmt.Sprintf("Bucket policy requires uploads encrypted with a KMS key. Set encryption: aws:kms and kms_key_id: %s%s", conditionValue(value), currentSetting("kms_key_id", opts.KMSKeyID)))
+				}
+			}
+		}
+	}
+
+	return guidance
+}
+
+func deniesPut(action interface{}) bool {
+	var actions []interface{}
+
+	switch a := action.(type) {
+	case string:
+		actions = []interface{}{a}
+	case []interface{}:
+		actions = a
+	}
+
+	for _, a := range actions {
+		switch strings.ToLower(fmt.Sprint(a)) {
+		case "s3:putobject", "s3:*", "*":
+			return true
+		}
+	}
+
+	return false
+}
+
+// encryptionSettings returns the encryption setting matching each server
+// side encryption allowed by a condition.
+func encryptionSettings(value interface{}) string {
+	var settings []string
+
+	for _, v := range strings.Split(conditionValue(value), " or ") {
+		switch {
+		case strings.EqualFold(v, EncryptionAES256):
+			settings = append(settings, "encryption: aes256")
+		case strings.EqualFold(v, EncryptionKMS):
+			settings = append(settings, "encryption: aws:kms")
+		default:
+			settings = append(settings, "encryption: "+v)
+		}
+	}
+
+	return strings.Join(settings, " or ")
+}
+
+// currentSetting describes the value of a setting replaced by the guidance,
+// or nothing when it is unset.
+func currentSetting(name, value string) string {
+	if len(value) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" instead of %s: %s", name, value)
+}
+
+func conditionValue(value interface{}) string {
+	if values, ok := value.([]interface{}); ok {
+		var s []string
+		for _, v := range values {
+			s = append(s, fmt.Sprint(v))
+		}
+
+		return strings.Join(s, " or ")
+	}
+
+	return fmt.Sprint(value)
+}
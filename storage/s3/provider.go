@@ -0,0 +1,89 @@
+package s3
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// quirks adjust the client for the incompatibilities of S3 compatible
+// providers, so unsupported operations are avoided instead of failing
+// mid-operation.
+type quirks struct {
+	// createBuckets creates missing buckets on upload.
+	createBuckets bool
+
+	// bucketRegion overrides the region buckets are created in.
+	bucketRegion string
+
+	// listV1 lists objects with the original ListObjects API.
+	listV1 bool
+
+	// encryption supports server side encryption headers.
+	encryption bool
+
+	// md5ETags computes ETags from the MD5 of the contents, or of the parts
+	// for multipart uploads, so uploads can be verified.
+	md5ETags bool
+
+	// singlePutLimit uploads objects of at most this many bytes in a single
+	// PUT as multipart uploads are not implemented. Zero uploads in parts.
+	singlePutLimit int64
+}
+
+var providers = map[string]quirks{
+	"aws": {
+		createBuckets: true,
+		encryption:    true,
+		md5ETags:      true,
+	},
+	"minio": {
+		createBuckets: true,
+		encryption:    true,
+		md5ETags:      true,
+	},
+	"ceph": {
+		createBuckets: true,
+		encryption:    true,
+		md5ETags:      true,
+	},
+	// R2 buckets live in the auto region and have no server side
+	// encryption options since objects are always encrypted
+	"r2": {
+		createBuckets: true,
+		bucketRegion:  "auto",
+	},
+	// Creating buckets through the interoperability API needs a project,
+	// and neither ListObjectsV2 nor multipart uploads are implemented
+	"gcs-interop": {
+		listV1:         true,
+		singlePutLimit: 5 * 1024 * 1024 * 1024,
+	},
+}
+
+// providerQuirks returns the quirks of the named provider, defaulting to aws.
+func providerQuirks(provider string) (quirks, error) {
+	if len(provider) == 0 {
+		provider = "aws"
+	}
+
+	q, ok := providers[strings.ToLower(provider)]
+
+	if !ok {
+		return quirks{}, fmt.Errorf("Unknown provider %s. Needs to be one of %s", provider, strings.Join(Providers(), ", "))
+	}
+
+	return q, nil
+}
+
+// Providers returns the names of the supported providers.
+func Providers() []string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
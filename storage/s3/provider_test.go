@@ -0,0 +1,65 @@
+package s3
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProviderQuirks(t *testing.T) {
+	if q, err := providerQuirks(""); err != nil || !q.md5ETags || q.singlePutLimit != 0 {
+		t.Errorf("Expected the quirks of aws by default, got %+v %v", q, err)
+	}
+
+	if q, err := providerQuirks("R2"); err != nil || q.bucketRegion != "auto" || q.encryption {
+		t.Errorf("Expected the quirks of r2, got %+v %v", q, err)
+	}
+
+	if q, err := providerQuirks("gcs-interop"); err != nil || !q.listV1 || q.singlePutLimit == 0 {
+		t.Errorf("Expected the quirks of gcs-interop, got %+v %v", q, err)
+	}
+
+	if _, err := providerQuirks("azure"); err == nil || !strings.Contains(err.Error(), "gcs-interop, minio, r2") {
+		t.Errorf("Expected an unknown provider to list the providers, got %v", err)
+	}
+}
+
+func TestPutSingle(t *testing.T) {
+	var puts []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD" && r.URL.Path == "/bucket/":
+		case r.Method == "PUT" && r.URL.RawQuery == "":
+			b, _ := ioutil.ReadAll(r.Body)
+			puts = append(puts, r.URL.Path+" "+string(b))
+
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	st, err := New(&Options{Endpoint: strings.TrimPrefix(server.URL, "http://"), Access: "access", Secret: "secret", Region: "us-east-1", Provider: "gcs-interop"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := st.(*s3Storage)
+	s.quirks.singlePutLimit = 10
+
+	if err := s.Put("bucket/archive.tar", strings.NewReader("cached")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put("bucket/large.tar", strings.NewReader("over the limit")); err == nil || !strings.Contains(err.Error(), "limited to 10 B") {
+		t.Errorf("Expected an upload over the limit to be refused, got %v", err)
+	}
+
+	if len(puts) != 1 || puts[0] != "/bucket/archive.tar cached" {
+		t.Errorf("Expected a single PUT of the cache, got %v", puts)
+	}
+}
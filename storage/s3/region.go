@@ -0,0 +1,148 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// regionTransport answers the bucket location requests of the vendored
+// client, which otherwise assumes us-east-1 whenever it may not read the
+// location and gets redirected for buckets in any other region.
+//
+// With a region configured the requests are answered with it. Otherwise
+// they go through, and when they fail the region is found from the
+// x-amz-bucket-region header of a HeadBucket, which S3 returns even to
+// requests it denies.
+type regionTransport struct {
+	base   http.RoundTripper
+	region string
+
+	mu      sync.Mutex
+	regions map[string]string
+}
+
+func (t *regionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bucket, ok := locationRequest(req)
+
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	if len(t.region) > 0 {
+		return locationResponse(req, t.region), nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+
+	if err != nil || resp.StatusCode == http.StatusOK {
+		return resp, err
+	}
+
+	region := t.bucketRegion(req, bucket)
+
+	if len(region) == 0 {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	return locationResponse(req, region), nil
+}
+
+// bucketRegion returns the region of bucket from the headers of a
+// HeadBucket, or an empty string when there are none.
+func (t *regionTransport) bucketRegion(req *http.Request, bucket string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if region, ok := t.regions[bucket]; ok {
+		return region
+	}
+
+	u := *req.URL
+	u.RawQuery = ""
+
+	head, err := http.NewRequest(http.MethodHead, u.String(), nil)
+
+	if err != nil {
+		return ""
+	}
+
+	resp, err := t.base.RoundTrip(head)
+
+	if err != nil {
+		log.Debugf("Failed to find the region of bucket %s %s", bucket, err)
+		return ""
+	}
+
+	resp.Body.Close()
+
+	region := resp.Header.Get("X-Amz-Bucket-Region")
+
+	if len(region) > 0 {
+		log.Infof("Bucket %s is in region %s", bucket, region)
+	}
+
+	if t.regions == nil {
+		t.regions = make(map[string]string)
+	}
+
+	t.regions[bucket] = region
+
+	return region
+}
+
+// locationRequest reports whether req is a GetBucketLocation, which the
+// client sends in path style, and the bucket it is for.
+func locationRequest(req *http.Request) (string, bool) {
+	if req.Method != http.MethodGet {
+		return "", false
+	}
+
+	if _, ok := req.URL.Query()["location"]; !ok {
+		return "", false
+	}
+
+	bucket := strings.Trim(req.URL.Path, "/")
+
+	if len(bucket) == 0 || strings.Contains(bucket, "/") {
+		return "", false
+	}
+
+	return bucket, true
+}
+
+// locationResponse returns the GetBucketLocation response of region, where
+// us-east-1 is an empty location constraint.
+func locationResponse(req *http.Request, region string) *http.Response {
+	constraint := struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+		Location string   `xml:",chardata"`
+	}{}
+
+	if region != "us-east-1" {
+		constraint.Location = region
+	}
+
+	body, _ := xml.Marshal(&constraint)
+	body = append([]byte(xml.Header), body...)
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/xml"}, "Content-Length": {strconv.Itoa(len(body))}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
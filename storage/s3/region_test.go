@@ -0,0 +1,46 @@
+package s3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go"
+)
+
+func TestRegionTransport(t *testing.T) {
+	heads := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads++
+			w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Denied</Message></Error>`))
+	}))
+	defer server.Close()
+
+	for _, region := range []string{"", "eu-west-1"} {
+		client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), "access", "secret", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client.SetCustomTransport(&regionTransport{base: http.DefaultTransport, region: region})
+
+		location, err := client.GetBucketLocation("bucket")
+
+		if err != nil || location != "eu-west-1" {
+			t.Errorf("Expected the region of the bucket with region %q, got %s %v", region, location, err)
+		}
+	}
+
+	if heads != 1 {
+		t.Errorf("Expected the region to be found with a single HeadBucket, got %d", heads)
+	}
+}
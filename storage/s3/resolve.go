@@ -0,0 +1,69 @@
+package s3
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Resolver overrides how the host names of endpoints are resolved, for
+// networks where the default DNS cannot resolve them.
+type Resolver struct {
+	// Hosts maps host names to the IP addresses connected to instead.
+	Hosts map[string]string
+
+	// DNSServer is the address of the DNS server resolving the other host
+	// names, with port 53 by default.
+	DNSServer string
+}
+
+// DialContext connects to addr resolving its host with the resolver. A nil
+// resolver uses the system resolver.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if r == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip, ok := r.Hosts[host]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+	}
+
+	if r.DNSServer != "" {
+		server := r.DNSServer
+
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// transport returns the HTTP transport connecting through the resolver,
+// otherwise configured like the default transport.
+func (r *Resolver) transport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           r.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -1,8 +1,12 @@
 package s3
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,11 +17,34 @@ import (
 
 // Options contains configuration for the S3 connection.
 type Options struct {
-	Endpoint   string
-	Key        string
-	Secret     string
+	Endpoint string
+	Key      string
+	Secret   string
+	Access   string
+
+	// DownloadBaseURL serves the objects of the buckets through a CDN or
+	// caching proxy, downloading from it rather than from the endpoint.
+	// {bucket} in it is replaced by the bucket. The URLs are signed for
+	// CloudFront with DownloadKeyPairID and DownloadPrivateKey when given.
+	DownloadBaseURL    string
+	DownloadKeyPairID  string
+	DownloadPrivateKey string
+
+	// Encryption is the server side encryption requested for uploads,
+	// EncryptionAES256 for keys managed by S3 or EncryptionKMS for keys
+	// managed by KMS, the KMSKeyID given or else the default key of S3.
 	Encryption string
-	Access     string
+	KMSKeyID   string
+
+	// Token is the session token of temporary credentials given as Access
+	// and Secret.
+	Token string
+
+	// Profile and CredentialsFile read the keys of the profile from the
+	// shared credentials file, when no keys are given, in place of the
+	// credential chain.
+	Profile         string
+	CredentialsFile string
 
 	// us-east-1
 	// us-west-1
@@ -34,26 +61,183 @@ type Options struct {
 	// Should be true for minio and false for AWS.
 	PathStyle bool
 
+	// TempDir holds scratch files. Defaults to the system temp directory.
+	TempDir string
+
+	// Provider of the S3 compatible API: aws, r2, minio, ceph or
+	// gcs-interop. Defaults to aws.
+	Provider string
+
+	// Resolver overrides the resolution of the endpoint host names.
+	Resolver *Resolver
+
+	// CACert holds PEM encoded certificates trusted along with the system
+	// roots, for endpoints signed by a private CA.
+	CACert string
+
+	// SkipVerify does not verify the certificates of the endpoint, e.g.
+	// self-signed in lab environments.
+	SkipVerify bool
+
+	// ClientCert and ClientKey are the PEM encoded certificate and key
+	// presented to endpoints behind proxies requiring mutual TLS.
+	ClientCert string
+	ClientKey  string
+
+	// RoleARN is assumed through STS with the credentials configured, or
+	// from the credential chain, naming the session RoleSessionName and
+	// passing ExternalID when set. Without keys configured and with
+	// AWS_WEB_IDENTITY_TOKEN_FILE set it is assumed with the web identity
+	// token instead.
+	RoleARN         string
+	RoleSessionName string
+	ExternalID      string
+
+	// VerifyUploads compares the ETag of uploaded objects with the one
+	// computed locally, retrying the upload on a mismatch.
+	VerifyUploads bool
+
 	UseSSL bool
 }
 
+// metaPrefix is the header prefix S3 uses for user defined metadata.
+const metaPrefix = "X-Amz-Meta-"
+
+const (
+	// EncryptionAES256 encrypts uploads on the server with keys managed by
+	// S3.
+	EncryptionAES256 = "AES256"
+
+	// EncryptionKMS encrypts uploads on the server with keys managed by KMS.
+	EncryptionKMS = "aws:kms"
+)
+
 type s3Storage struct {
-	client *minio.Client
-	opts   *Options
+	client  *minio.Client
+	express *expressClient
+	http    *http.Client
+	quirks  quirks
+	opts    *Options
+	creds   *cachedCredentials
+	cdn     *cdnClient
 }
 
 // NewS3Storage creates an implementation of Storage with S3 as the backend.
 func New(opts *Options) (storage.Storage, error) {
-	client, err := minio.New(opts.Endpoint, opts.Access, opts.Secret, opts.UseSSL)
+	q, err := providerQuirks(opts.Provider)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validEncryption(opts, q); err != nil {
+		return nil, err
+	}
+
+	// Without keys configured the standard AWS credential chain is used
+	var provider credentialProvider = staticCredentials{Access: opts.Access, Secret: opts.Secret, Token: opts.Token}
+
+	// The client does not send session tokens, which the signing transport
+	// adds
+	static := len(opts.Token) == 0
+
+	if len(opts.Access) == 0 && len(opts.Secret) == 0 {
+		provider, static = defaultChain(), false
+
+		if len(opts.Profile) > 0 || len(opts.CredentialsFile) > 0 {
+			provider = sharedCredentials{profile: opts.Profile, file: opts.CredentialsFile}
+		}
+	}
+
+	if len(opts.RoleARN) > 0 && len(opts.Access) == 0 && len(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")) > 0 {
+		// The role is assumed directly with the web identity token
+		provider = &webIdentityCredentials{
+			tokenFile:   os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+			roleARN:     opts.RoleARN,
+			sessionName: opts.RoleSessionName,
+		}
+	} else if len(opts.RoleARN) > 0 {
+		name := opts.RoleSessionName
+
+		if len(name) == 0 {
+			name = DefaultRoleSessionName
+		}
+
+		provider = &assumeRoleCredentials{
+			base:        newCachedCredentials(provider),
+			roleARN:     opts.RoleARN,
+			sessionName: name,
+			externalID:  opts.ExternalID,
+		}
+		static = false
+	}
+
+	creds := newCachedCredentials(provider)
+	initial, err := creds.get()
+
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := minio.New(opts.Endpoint, initial.Access, initial.Secret, opts.UseSSL)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &s3Storage{
-		client: client,
-		opts:   opts,
-	}, nil
+	s := &s3Storage{
+		client:  client,
+		express: newExpressClient(opts, creds),
+		http:    http.DefaultClient,
+		quirks:  q,
+		opts:    opts,
+		creds:   creds,
+	}
+
+	// Restores download through the CDN while uploads go to the endpoint
+	if len(opts.DownloadBaseURL) > 0 {
+		if s.cdn, err = newCDNClient(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+
+	// Requests made directly rather than through the client share its
+	// transport
+	if opts.Resolver != nil {
+		transport = opts.Resolver.transport()
+	}
+
+	if opts.SkipVerify {
+		log.Warnf("TLS CERTIFICATES OF %s ARE NOT VERIFIED as skip_verify is set. Anyone on the network can read and tamper with the caches. Only use it in lab environments", opts.Endpoint)
+	}
+
+	if len(opts.CACert) > 0 || opts.SkipVerify || len(opts.ClientCert) > 0 || len(opts.ClientKey) > 0 {
+		if transport, err = tlsTransport(transport, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if transport != http.DefaultTransport {
+		s.http = &http.Client{Transport: transport}
+		s.express.client = s.http
+	}
+
+	// The client looks up the region of buckets, which is answered with
+	// the region configured or found from the bucket
+	var clientTransport http.RoundTripper = &regionTransport{base: transport, region: opts.Region}
+
+	// Credentials from the chain may be temporary, so requests of the
+	// client are signed with the current ones and their session token.
+	// Requests with a session token configured are signed again to add it
+	if !static {
+		clientTransport = &signingTransport{base: clientTransport, creds: creds}
+	}
+
+	client.SetCustomTransport(clientTransport)
+
+	return s, nil
 }
 
 func (s *s3Storage) Get(p string, dst io.Writer) error {
@@ -65,10 +249,29 @@ func (s *s3Storage) Get(p string, dst io.Writer) error {
 
 	log.Infof("Retrieving file in %s at %s", bucket, key)
 
+	if isDirectoryBucket(bucket) {
+		return s.express.Get(bucket, key, dst)
+	}
+
+	if s.cdn != nil {
+		transferred, err := s.cdn.Get(bucket, key, dst)
+
+		// The bucket is only tried when the CDN failed before writing
+		// anything, and not for missing objects
+		if err == nil || transferred || ErrorCode(err) == "NoSuchKey" {
+			return err
+		}
+
+		log.Warnf("Download through %s failed %s. Downloading from the bucket", s.opts.DownloadBaseURL, err)
+	}
+
 	exists, err := s.client.BucketExists(bucket)
 
+	if err != nil {
+		return fmt.Errorf("%s does not exist: %s", p, err)
+	}
 	if !exists {
-		return err
+		return fmt.Errorf("%s does not exist", p)
 	}
 
 	object, err := s.client.GetObject(bucket, key)
@@ -90,6 +293,11 @@ func (s *s3Storage) Get(p string, dst io.Writer) error {
 }
 
 func (s *s3Storage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+// PutWithMetadata uploads src to p attaching the metadata to the object.
+func (s *s3Storage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
 	bucket, key := splitBucket(p)
 
 	log.Infof("Uploading to bucket %s at %s", bucket, key)
@@ -98,23 +306,43 @@ func (s *s3Storage) Put(p string, src io.Reader) error {
 		return fmt.Errorf("Invalid path %s", p)
 	}
 
-	exists, err := s.client.BucketExists(bucket)
+	headers := map[string][]string{
+		"Content-Type": {"application/tar"},
+	}
 
-	if !exists || err != nil {
-		if err = s.client.MakeBucket(bucket, s.opts.Region); err != nil {
-			return err
-		}
-		log.Infof("Bucket %s created", bucket)
-	} else {
-		log.Infof("Bucket %s already exists", bucket)
+	for k, v := range metadata {
+		headers[metaPrefix+k] = []string{v}
+	}
+
+	s.encrypt(headers)
+
+	// Directory buckets have to be created up front in an availability zone
+	if isDirectoryBucket(bucket) {
+		return s.express.Put(bucket, key, src, headers)
+	}
+
+	if err := s.ensureBucket(bucket); err != nil {
+		return err
 	}
 
 	log.Infof("Putting file in %s at %s", bucket, key)
 
-	numBytes, err := s.client.PutObject(bucket, key, src, "application/tar")
+	if s.quirks.singlePutLimit > 0 {
+		return s.putSingle(bucket, key, src, headers)
+	}
+
+	if s.opts.VerifyUploads {
+		if s.quirks.md5ETags {
+			return s.putVerified(bucket, key, src, headers)
+		}
+
+		log.Warnf("Uploads cannot be verified with provider %s", s.opts.Provider)
+	}
+
+	numBytes, err := s.client.PutObjectWithMetadata(bucket, key, src, headers, nil)
 
 	if err != nil {
-		return err
+		return s.uploadError(bucket, err)
 	}
 
 	log.Infof("Uploaded %s to server", humanize.Bytes(uint64(numBytes)))
@@ -122,15 +350,187 @@ func (s *s3Storage) Put(p string, src io.Reader) error {
 	return nil
 }
 
-func (s *s3Storage) List(p string) ([]storage.FileEntry, error) {
+// putSingle uploads src in a single PUT for providers without multipart
+// uploads. It is spooled to a temporary file first for its size, so an
+// object over the limit of the provider is refused before it is sent.
+func (s *s3Storage) putSingle(bucket, key string, src io.Reader, headers map[string][]string) error {
+	tmp, err := ioutil.TempFile(s.opts.TempDir, "upload")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, io.LimitReader(src, s.quirks.singlePutLimit+1))
+
+	if err != nil {
+		return err
+	}
+
+	if size > s.quirks.singlePutLimit {
+		return fmt.Errorf("Uploads to provider %s are limited to %s without multipart uploads", s.opts.Provider, humanize.IBytes(uint64(s.quirks.singlePutLimit)))
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	resp, err := s.request(http.MethodPut, bucket, key, nil, tmp, size, "UNSIGNED-PAYLOAD", headers)
+
+	if err != nil {
+		return s.uploadError(bucket, err)
+	}
+
+	resp.Body.Close()
+
+	log.Infof("Uploaded %s to server", humanize.Bytes(uint64(size)))
+
+	return nil
+}
+
+// Stat retrieves the details and metadata of the object at p without
+// downloading it.
+func (s *s3Storage) Stat(p string) (storage.FileEntry, map[string]string, error) {
 	bucket, key := splitBucket(p)
 
-	log.Infof("Retrieving objects in bucket %s at %s", bucket, key)
+	if len(bucket) == 0 || len(key) == 0 {
+		return storage.FileEntry{}, nil, fmt.Errorf("Invalid path %s", p)
+	}
+
+	log.Debugf("Retrieving object details in %s at %s", bucket, key)
+
+	if isDirectoryBucket(bucket) {
+		return s.express.Stat(bucket, key)
+	}
+
+	info, err := s.client.StatObject(bucket, key)
+
+	if err != nil {
+		return storage.FileEntry{}, nil, err
+	}
+
+	return storage.FileEntry{
+		Path:         bucket + "/" + info.Key,
+		Size:         info.Size,
+		LastModified: info.LastModified,
+	}, userMetadata(info.Metadata), nil
+}
+
+// ETag returns the entity tag of the object at p.
+func (s *s3Storage) ETag(p string) (string, error) {
+	bucket, key := splitBucket(p)
+
+	if len(bucket) == 0 || len(key) == 0 {
+		return "", fmt.Errorf("Invalid path %s", p)
+	}
+
+	if isDirectoryBucket(bucket) {
+		return s.express.ETag(bucket, key)
+	}
+
+	info, err := s.client.StatObject(bucket, key)
+
+	if err != nil {
+		return "", err
+	}
+
+	return info.ETag, nil
+}
+
+// ensureBucket creates the bucket unless it exists.
+func (s *s3Storage) ensureBucket(bucket string) error {
+	exists, err := s.client.BucketExists(bucket)
+
+	if exists && err == nil {
+		log.Infof("Bucket %s already exists", bucket)
+		return nil
+	}
+
+	if !s.quirks.createBuckets {
+		return fmt.Errorf("Bucket %s does not exist and cannot be created with provider %s", bucket, s.opts.Provider)
+	}
+
+	region := s.opts.Region
+	if len(s.quirks.bucketRegion) > 0 {
+		region = s.quirks.bucketRegion
+	}
+
+	if err = s.client.MakeBucket(bucket, region); err != nil {
+		return err
+	}
+
+	log.Infof("Bucket %s created", bucket)
+	return nil
+}
+
+// PutIfMatch uploads src to p only when the entity tag of the object is
+// still etag, or when the object does not exist for an empty etag, with
+// the metadata attached. It reports false when the object changed since it was read.
+func (s *s3Storage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	bucket, key := splitBucket(p)
 
 	if len(bucket) == 0 || len(key) == 0 {
+		return false, fmt.Errorf("Invalid path %s", p)
+	}
+
+	if isDirectoryBucket(bucket) {
+		return false, fmt.Errorf("Conditional writes to directory bucket %s are not supported", bucket)
+	}
+
+	headers := map[string][]string{
+		"Content-Type": {"application/json"},
+	}
+
+	if len(etag) == 0 {
+		headers["If-None-Match"] = []string{"*"}
+	} else {
+		headers["If-Match"] = []string{`"` + strings.Trim(etag, `"`) + `"`}
+	}
+
+	for k, v := range metadata {
+		headers[metaPrefix+k] = []string{v}
+	}
+
+	s.encrypt(headers)
+
+	_, err := s.client.PutObjectWithMetadata(bucket, key, src, headers, nil)
+
+	// A conflict means a concurrent conditional write is in progress
+	if code := ErrorCode(err); code == "PreconditionFailed" || code == "ConditionalRequestConflict" {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// userMetadata extracts the user defined metadata from object headers.
+func userMetadata(headers http.Header) map[string]string {
+	metadata := make(map[string]string)
+
+	for k, v := range headers {
+		if strings.HasPrefix(k, metaPrefix) && len(v) > 0 {
+			metadata[strings.ToLower(strings.TrimPrefix(k, metaPrefix))] = v[0]
+		}
+	}
+
+	return metadata
+}
+
+func (s *s3Storage) List(p string) ([]storage.FileEntry, error) {
+	bucket, key := splitPrefix(p)
+
+	log.Infof("Retrieving objects in bucket %s at %s", bucket, key)
+
+	if len(bucket) == 0 {
 		return nil, fmt.Errorf("Invalid path %s", p)
 	}
 
+	if isDirectoryBucket(bucket) {
+		return s.express.List(bucket, key)
+	}
+
 	exists, err := s.client.BucketExists(bucket)
 
 	if err != nil {
@@ -148,7 +548,14 @@ func (s *s3Storage) List(p string) ([]storage.FileEntry, error) {
 
 	var objects []storage.FileEntry
 	isRecursive := true
-	objectCh := s.client.ListObjectsV2(bucket, key, isRecursive, doneCh)
+
+	var objectCh <-chan minio.ObjectInfo
+	if s.quirks.listV1 {
+		objectCh = s.client.ListObjects(bucket, key, isRecursive, doneCh)
+	} else {
+		objectCh = s.client.ListObjectsV2(bucket, key, isRecursive, doneCh)
+	}
+
 	for object := range objectCh {
 		if object.Err != nil {
 			return nil, fmt.Errorf("Failed to retreive object %s: %s", object.Key, object.Err)
@@ -156,18 +563,43 @@ func (s *s3Storage) List(p string) ([]storage.FileEntry, error) {
 
 		path := bucket + "/" + object.Key
 		objects = append(objects, storage.FileEntry{
-			Path: path,
-			Size: object.Size,
+			Path:         path,
+			Size:         object.Size,
 			LastModified: object.LastModified,
 		})
-		log.Debugf("Found object %s: Path=%s Size=%s LastModified=%s", object.Key, path, object.Size, object.LastModified)
+		log.Debugf("Found object %s: Path=%s Size=%d LastModified=%s", object.Key, path, object.Size, object.LastModified)
 	}
 
-	log.Infof("Found %s objects in bucket %s at %s", len(objects), bucket, key)
+	log.Infof("Found %d objects in bucket %s at %s", len(objects), bucket, key)
 
 	return objects, nil
 }
 
+// Copy copies the object at src to dst on the server, keeping its
+// metadata. Objects larger than 5GB cannot be copied in one request.
+func (s *s3Storage) Copy(src, dst string) error {
+	srcBucket, srcKey := splitBucket(src)
+	dstBucket, dstKey := splitBucket(dst)
+
+	if len(srcBucket) == 0 || len(srcKey) == 0 {
+		return fmt.Errorf("Invalid path %s", src)
+	}
+
+	if len(dstBucket) == 0 || len(dstKey) == 0 {
+		return fmt.Errorf("Invalid path %s", dst)
+	}
+
+	log.Infof("Copying object in bucket %s at %s to bucket %s at %s", srcBucket, srcKey, dstBucket, dstKey)
+
+	// The client cannot send the encryption header along with a copy, so
+	// the object is downloaded and uploaded again instead
+	if len(s.opts.Encryption) > 0 {
+		return s.copyThrough(src, dst)
+	}
+
+	return s.client.CopyObject(dstBucket, dstKey, srcBucket+"/"+srcKey, minio.NewCopyConditions())
+}
+
 func (s *s3Storage) Delete(p string) error {
 	bucket, key := splitBucket(p)
 
@@ -177,6 +609,10 @@ func (s *s3Storage) Delete(p string) error {
 		return fmt.Errorf("Invalid path %s", p)
 	}
 
+	if isDirectoryBucket(bucket) {
+		return s.express.Delete(bucket, key)
+	}
+
 	exists, err := s.client.BucketExists(bucket)
 
 	if err != nil {
@@ -204,3 +640,118 @@ func splitBucket(p string) (string, string) {
 
 	return "", ""
 }
+
+// splitPrefix is splitBucket allowing an empty key to list a whole bucket.
+func splitPrefix(p string) (string, string) {
+	if bucket, key := splitBucket(p); len(bucket) > 0 {
+		return bucket, key
+	}
+
+	bucket := strings.Trim(p, "/")
+
+	if len(bucket) == 0 || strings.Contains(bucket, "/") {
+		return "", ""
+	}
+
+	return strings.ToLower(bucket), ""
+}
+
+// ErrorCode returns the S3 error code of err, such as NoSuchKey, or an
+// empty string when err is not an S3 error response.
+func ErrorCode(err error) string {
+	var resp minio.ErrorResponse
+
+	if errors.As(err, &resp) {
+		return resp.Code
+	}
+
+	return ""
+}
+
+// IsObjectLocked reports whether err is the refusal to delete an object
+// under a legal hold or governance or compliance retention. S3 reports an
+// AccessDenied and MinIO an InvalidRequest, told apart from other denials
+// by their message.
+func IsObjectLocked(err error) bool {
+	var resp minio.ErrorResponse
+
+	if !errors.As(err, &resp) {
+		return false
+	}
+
+	if resp.Code == "ObjectLocked" {
+		return true
+	}
+
+	msg := strings.ToLower(resp.Message)
+
+	for _, s := range []string{"object lock", "worm protected", "legal hold", "retention"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyThrough copies the object at src to dst by downloading it while it
+// is uploaded, keeping its metadata.
+func (s *s3Storage) copyThrough(src, dst string) error {
+	_, metadata, err := s.Stat(src)
+
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(s.Get(src, pw))
+	}()
+
+	err = s.PutWithMetadata(dst, pr, metadata)
+	pr.CloseWithError(err)
+
+	return err
+}
+
+// encrypt adds the server side encryption of uploads to headers.
+func (s *s3Storage) encrypt(headers map[string][]string) {
+	if len(s.opts.Encryption) > 0 {
+		headers["X-Amz-Server-Side-Encryption"] = []string{s.opts.Encryption}
+	}
+
+	if len(s.opts.KMSKeyID) > 0 {
+		headers["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = []string{s.opts.KMSKeyID}
+	}
+}
+
+// validEncryption normalizes the encryption of opts, checking the provider
+// supports it.
+func validEncryption(opts *Options, q quirks) error {
+	if len(opts.KMSKeyID) > 0 && !strings.EqualFold(opts.Encryption, EncryptionKMS) {
+		return errors.New("A KMS key ID needs the aws:kms encryption")
+	}
+
+	switch strings.ToUpper(opts.Encryption) {
+	case "":
+		return nil
+	case EncryptionAES256:
+		opts.Encryption = EncryptionAES256
+	case strings.ToUpper(EncryptionKMS):
+		// The ETags of objects encrypted with KMS are not their MD5
+		if opts.VerifyUploads {
+			return errors.New("Uploads encrypted with aws:kms cannot be verified")
+		}
+
+		opts.Encryption = EncryptionKMS
+	default:
+		return fmt.Errorf("Invalid encryption %s. Needs to be aes256 or aws:kms", opts.Encryption)
+	}
+
+	if !q.encryption {
+		return fmt.Errorf("Provider %s does not support server side encryption", opts.Provider)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/pkg/s3utils"
+)
+
+const (
+	signV4Algorithm = "AWS4-HMAC-SHA256"
+	iso8601Format   = "20060102T150405Z"
+	yyyymmdd        = "20060102"
+
+	// unsignedPayload is used for bodies streamed over TLS.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// credentials used to sign requests. Temporary credentials come with a
+// session token.
+type credentials struct {
+	Access string
+	Secret string
+	Token  string
+}
+
+// signV4 signs the request for the service in region. The vendored signer
+// only signs for the s3 service, which S3 Express does not accept.
+func signV4(req *http.Request, creds credentials, region, service, payloadHash string, t time.Time) {
+	t = t.UTC()
+
+	req.Header.Set("X-Amz-Date", t.Format(iso8601Format))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	if len(creds.Token) > 0 {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	var names []string
+	headers := map[string]string{"host": req.URL.Host}
+
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		headers[name] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3utils.EncodePath(req.URL.Path),
+		s3utils.QueryEncode(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{t.Format(yyyymmdd), region, service, "aws4_request"}, "/")
+
+	stringToSign := strings.Join([]string{
+		signV4Algorithm,
+		t.Format(iso8601Format),
+		scope,
+		hex.EncodeToString(sum256([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := sumHMAC([]byte("AWS4"+creds.Secret), []byte(t.Format(yyyymmdd)))
+	key = sumHMAC(key, []byte(region))
+	key = sumHMAC(key, []byte(service))
+	key = sumHMAC(key, []byte("aws4_request"))
+
+	signature := hex.EncodeToString(sumHMAC(key, []byte(stringToSign)))
+
+	req.Header.Set("Authorization", signV4Algorithm+
+		" Credential="+creds.Access+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+func sum256(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+func sumHMAC(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,53 @@
+package s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// tlsTransport returns a copy of base with the TLS settings of opts: the
+// certificates of CACert trusted along with the system roots, for
+// endpoints signed by a private CA, or no verification at all with
+// SkipVerify, and the client certificate presented to proxies requiring
+// mutual TLS.
+func tlsTransport(base http.RoundTripper, opts *Options) (http.RoundTripper, error) {
+	t, ok := base.(*http.Transport)
+
+	if !ok {
+		return nil, errors.New("Transport does not support TLS settings")
+	}
+
+	t = t.Clone()
+	config := &tls.Config{InsecureSkipVerify: opts.SkipVerify}
+
+	if len(opts.CACert) > 0 && !opts.SkipVerify {
+		pool, err := x509.SystemCertPool()
+
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM([]byte(opts.CACert)) {
+			return nil, errors.New("No PEM encoded certificates found in ca_cert")
+		}
+
+		config.RootCAs = pool
+	}
+
+	if len(opts.ClientCert) > 0 || len(opts.ClientKey) > 0 {
+		cert, err := tls.X509KeyPair([]byte(opts.ClientCert), []byte(opts.ClientKey))
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tls_client_cert or tls_client_key %s", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	t.TLSClientConfig = config
+
+	return t, nil
+}
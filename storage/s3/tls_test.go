@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTLSTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	if _, err := http.Get(server.URL); err == nil {
+		t.Fatal("Expected the certificate of the test server not to be trusted")
+	}
+
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	transport, err := tlsTransport(http.DefaultTransport, &Options{CACert: caCert})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+
+	if err != nil {
+		t.Fatalf("Expected the ca_cert to be trusted, got %s", err)
+	}
+
+	resp.Body.Close()
+
+	if _, err := tlsTransport(http.DefaultTransport, &Options{CACert: "not a certificate"}); err == nil {
+		t.Error("Expected a ca_cert without certificates to fail")
+	}
+
+	if transport, err = tlsTransport(http.DefaultTransport, &Options{SkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err = (&http.Client{Transport: transport}).Get(server.URL); err != nil {
+		t.Fatalf("Expected the certificate not to be verified with skip_verify, got %s", err)
+	}
+
+	resp.Body.Close()
+}
+
+func TestTLSTransportClientCert(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	clientCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	clientKey := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	transport, err := tlsTransport(http.DefaultTransport, &Options{SkipVerify: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Fatal("Expected the server to require a client certificate")
+	}
+
+	transport, err = tlsTransport(http.DefaultTransport, &Options{SkipVerify: true, ClientCert: clientCert, ClientKey: clientKey})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+
+	if err != nil {
+		t.Fatalf("Expected the client certificate to be accepted, got %s", err)
+	}
+
+	resp.Body.Close()
+
+	if _, err := tlsTransport(http.DefaultTransport, &Options{ClientCert: clientCert}); err == nil {
+		t.Error("Expected a client certificate without its key to fail")
+	}
+}
@@ -0,0 +1,370 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/minio/minio-go/pkg/s3utils"
+)
+
+const (
+	// minPartSize and maxPartsCount mirror the constants minio-go splits
+	// multipart uploads with.
+	minPartSize   = 64 * 1024 * 1024
+	maxPartsCount = 10000
+
+	// verifyAttempts is the number of times a verified upload is tried.
+	verifyAttempts = 3
+)
+
+// partSize returns the size of the parts minio-go uploads an object of
+// size in, or 0 when it is uploaded in a single request.
+func partSize(size int64) int64 {
+	if size < minPartSize {
+		return 0
+	}
+
+	// Parts are a multiple of minPartSize large enough for the object to
+	// fit in maxPartsCount parts
+	part := math.Ceil(float64(size/maxPartsCount)) / minPartSize
+
+	return int64(math.Ceil(part)) * minPartSize
+}
+
+// expectedETag computes the ETag of r once uploaded. Single part uploads
+// have the MD5 of the contents, multipart uploads the MD5 of the part MD5s
+// followed by the number of parts.
+func expectedETag(r io.Reader, size int64) (string, error) {
+	part := partSize(size)
+
+	if part == 0 {
+		h := md5.New()
+
+		if _, err := io.Copy(h, r); err != nil {
+			return "", err
+		}
+
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	composite := md5.New()
+	parts := 0
+
+	for remaining := size; remaining > 0; remaining -= part {
+		h := md5.New()
+
+		if _, err := io.CopyN(h, r, part); err != nil && err != io.EOF {
+			return "", err
+		}
+
+		composite.Write(h.Sum(nil))
+		parts++
+	}
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(composite.Sum(nil)), parts), nil
+}
+
+// putVerified spools src to a temporary file, uploads it and compares the
+// ETag of the object with the one computed locally. A mismatch means the
+// object was corrupted, so a single part upload is retried from the spool.
+// Larger objects are uploaded in parts, retrying only the parts which
+// mismatch.
+func (s *s3Storage) putVerified(bucket, key string, src io.Reader, headers map[string][]string) error {
+	tmp, err := ioutil.TempFile(s.opts.TempDir, "upload")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, src)
+
+	if err != nil {
+		return err
+	}
+
+	if part := partSize(size); part > 0 {
+		return s.putPartsVerified(bucket, key, tmp, size, part, headers)
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	expected, err := expectedETag(tmp, size)
+
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err = s.client.PutObjectWithMetadata(bucket, key, tmp, headers, nil); err != nil {
+			return s.uploadError(bucket, err)
+		}
+
+		info, err := s.client.StatObject(bucket, key)
+
+		if err != nil {
+			return err
+		}
+
+		etag := strings.Trim(info.ETag, `"`)
+
+		if etag == expected {
+			log.Infof("Uploaded %s to server and verified ETag %s", humanize.Bytes(uint64(size)), etag)
+			return nil
+		}
+
+		if attempt == verifyAttempts {
+			return fmt.Errorf("Uploaded %s/%s has ETag %s rather than %s after %d attempts", bucket, key, etag, expected, attempt)
+		}
+
+		log.Warnf("Uploaded %s/%s has ETag %s rather than %s. Retrying upload", bucket, key, etag, expected)
+	}
+}
+
+// completedPart is a part listed in a CompleteMultipartUpload request.
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putPartsVerified uploads the size bytes of f to key in parts of part
+// bytes. The vendored client hides the parts of its multipart uploads, so
+// the requests are made directly. A part whose ETag is not the MD5 of its
+// contents is uploaded again, and the upload is aborted when a part keeps
+// mismatching or the assembled object does not have the composite ETag.
+func (s *s3Storage) putPartsVerified(bucket, key string, f io.ReaderAt, size, part int64, headers map[string][]string) error {
+	uploadID, err := s.initiateMultipart(bucket, key, headers)
+
+	if err != nil {
+		return s.uploadError(bucket, err)
+	}
+
+	var parts []completedPart
+	composite := md5.New()
+
+	for offset := int64(0); offset < size; offset += part {
+		length := part
+		if size-offset < length {
+			length = size - offset
+		}
+
+		h := md5.New()
+
+		if _, err = io.Copy(h, io.NewSectionReader(f, offset, length)); err != nil {
+			s.abortMultipart(bucket, key, uploadID)
+			return err
+		}
+
+		number := len(parts) + 1
+		sum := h.Sum(nil)
+
+		if err = s.uploadPartVerified(bucket, key, uploadID, number, f, offset, length, hex.EncodeToString(sum)); err != nil {
+			s.abortMultipart(bucket, key, uploadID)
+			return err
+		}
+
+		parts = append(parts, completedPart{PartNumber: number, ETag: hex.EncodeToString(sum)})
+		composite.Write(sum)
+	}
+
+	expected := fmt.Sprintf("%s-%d", hex.EncodeToString(composite.Sum(nil)), len(parts))
+	etag, err := s.completeMultipart(bucket, key, uploadID, parts)
+
+	if err != nil {
+		s.abortMultipart(bucket, key, uploadID)
+		return err
+	}
+
+	if etag != expected {
+		return fmt.Errorf("Uploaded %s/%s has ETag %s rather than %s with every part verified", bucket, key, etag, expected)
+	}
+
+	log.Infof("Uploaded %s to server in %d parts and verified ETag %s", humanize.Bytes(uint64(size)), len(parts), etag)
+
+	return nil
+}
+
+// uploadPartVerified uploads the part number of an upload, the length
+// bytes of f from offset, until its ETag is expected.
+func (s *s3Storage) uploadPartVerified(bucket, key, uploadID string, number int, f io.ReaderAt, offset, length int64, expected string) error {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := s.request("PUT", bucket, key, query, io.NewSectionReader(f, offset, length), length, unsignedPayload, nil)
+
+		if err != nil {
+			return err
+		}
+
+		resp.Body.Close()
+		etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+
+		if etag == expected {
+			return nil
+		}
+
+		if attempt == verifyAttempts {
+			return fmt.Errorf("Part %d of %s/%s has ETag %s rather than %s after %d attempts", number, bucket, key, etag, expected, attempt)
+		}
+
+		log.Warnf("Part %d of %s/%s has ETag %s rather than %s. Retrying the part", number, bucket, key, etag, expected)
+	}
+}
+
+// initiateMultipart starts a multipart upload to key with the headers of
+// the object and returns its ID.
+func (s *s3Storage) initiateMultipart(bucket, key string, headers map[string][]string) (string, error) {
+	resp, err := s.request("POST", bucket, key, url.Values{"uploads": {""}}, nil, 0, hexSum256(nil), headers)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil || len(result.UploadID) == 0 {
+		return "", fmt.Errorf("Invalid multipart upload of %s/%s", bucket, key)
+	}
+
+	return result.UploadID, nil
+}
+
+// completeMultipart assembles the parts of an upload into the object and
+// returns its ETag.
+func (s *s3Storage) completeMultipart(bucket, key, uploadID string, parts []completedPart) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.request("POST", bucket, key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), int64(len(body)), hexSum256(body), nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	// Errors may be reported in the body of a 200 response
+	var result struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("Invalid response completing the upload of %s/%s %s", bucket, key, err)
+	}
+
+	if result.XMLName.Local == "Error" {
+		return "", fmt.Errorf("Request for %s/%s failed: %s %s", bucket, key, result.Code, result.Message)
+	}
+
+	return strings.Trim(result.ETag, `"`), nil
+}
+
+// abortMultipart discards the parts of an upload which failed.
+func (s *s3Storage) abortMultipart(bucket, key, uploadID string) {
+	resp, err := s.request("DELETE", bucket, key, url.Values{"uploadId": {uploadID}}, nil, 0, hexSum256(nil), nil)
+
+	if err != nil {
+		log.Warnf("Failed to abort the upload of %s/%s %s", bucket, key, err)
+		return
+	}
+
+	resp.Body.Close()
+}
+
+// request sends a request for key in bucket to the endpoint in path style,
+// signed with the current credentials, failing on any status but 200.
+func (s *s3Storage) request(method, bucket, key string, query url.Values, body io.Reader, size int64, payloadHash string, headers map[string][]string) (*http.Response, error) {
+	region, err := s.client.GetBucketLocation(bucket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	if s.opts.UseSSL {
+		scheme = "https"
+	}
+
+	host := s.opts.Endpoint
+	if host == "s3.amazonaws.com" && region != "us-east-1" {
+		host = "s3." + region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(fmt.Sprintf("%s://%s/%s/%s", scheme, host, bucket, s3utils.EncodePath(key)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.RawQuery = s3utils.QueryEncode(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	creds, err := s.creds.get()
+
+	if err != nil {
+		return nil, err
+	}
+
+	signV4(req, creds, region, "s3", payloadHash, time.Now())
+
+	resp, err := s.http.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, expressError(resp, bucket+"/"+key)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// memoryEpoch is the modification time of objects set directly.
+var memoryEpoch = time.Unix(1, 0)
+
+// memoryStorage is an in memory Storage for tests. Objects written are
+// modified a second apart in the order they were written, so listings are
+// the same on every run.
+type memoryStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	mtimes  map[string]time.Time
+	writes  int
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string][]byte), mtimes: make(map[string]time.Time)}
+}
+
+// modified returns the modification time of the object at p. The lock
+// needs to be held.
+func (s *memoryStorage) modified(p string) time.Time {
+	if mtime, ok := s.mtimes[p]; ok {
+		return mtime
+	}
+
+	return memoryEpoch
+}
+
+func (s *memoryStorage) Get(p string, dst io.Writer) error {
+	s.mu.Lock()
+	b, ok := s.objects[p]
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%s does not exist", p)
+	}
+
+	_, err := dst.Write(b)
+	return err
+}
+
+func (s *memoryStorage) Put(p string, src io.Reader) error {
+	var buf bytes.Buffer
+
+	if _, err := io.Copy(&buf, src); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.writes++
+	s.objects[p] = buf.Bytes()
+	s.mtimes[p] = memoryEpoch.Add(time.Duration(s.writes) * time.Second)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *memoryStorage) List(p string) ([]storage.FileEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []storage.FileEntry
+	for k, b := range s.objects {
+		if strings.HasPrefix(k, p) {
+			entries = append(entries, storage.FileEntry{
+				Path:         k,
+				Size:         int64(len(b)),
+				LastModified: s.modified(k),
+			})
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *memoryStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	return s.Put(p, src)
+}
+
+func (s *memoryStorage) Stat(p string) (storage.FileEntry, map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.objects[p]
+
+	if !ok {
+		return storage.FileEntry{}, nil, fmt.Errorf("%s %w", p, os.ErrNotExist)
+	}
+
+	return storage.FileEntry{Path: p, Size: int64(len(b)), LastModified: s.modified(p)}, nil, nil
+}
+
+func (s *memoryStorage) Delete(p string) error {
+	s.mu.Lock()
+	delete(s.objects, p)
+	delete(s.mtimes, p)
+	s.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+)
+
+// summaryTop is the number of largest files and directories logged.
+const summaryTop = 10
+
+// pathSize is the size of a file or the files within a directory.
+type pathSize struct {
+	Path string
+	Size int64
+}
+
+// mountSummary describes the files about to be archived.
+type mountSummary struct {
+	Files int
+	Size  int64
+
+	Dirs    []pathSize
+	Largest []pathSize
+}
+
+// summarizeMounts walks the paths, counting the files and their size per
+// top level directory within each path.
+func summarizeMounts(paths []string) (*mountSummary, error) {
+	summary := &mountSummary{}
+	dirs := make(map[string]int64)
+
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+
+			summary.Files++
+			summary.Size += fi.Size()
+			summary.Largest = append(summary.Largest, pathSize{path, fi.Size()})
+
+			dirs[topDir(root, path)] += fi.Size()
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for dir, size := range dirs {
+		summary.Dirs = append(summary.Dirs, pathSize{dir, size})
+	}
+
+	summary.Dirs = largest(summary.Dirs)
+	summary.Largest = largest(summary.Largest)
+
+	return summary, nil
+}
+
+// topDir returns the directory directly below root containing path.
+func topDir(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+
+	if err != nil || rel == "." {
+		return filepath.Dir(path)
+	}
+
+	if i := strings.Index(rel, string(filepath.Separator)); i != -1 {
+		return filepath.Join(root, rel[:i])
+	}
+
+	return root
+}
+
+func largest(sizes []pathSize) []pathSize {
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i].Size > sizes[j].Size
+	})
+
+	if len(sizes) > summaryTop {
+		sizes = sizes[:summaryTop]
+	}
+
+	return sizes
+}
+
+func (s *mountSummary) log() {
+	log.Infof("Archiving %d files totalling %s", s.Files, humanize.Bytes(uint64(s.Size)))
+
+	log.Info("Largest directories:")
+	for _, dir := range s.Dirs {
+		log.Infof("  %10s %s", humanize.Bytes(uint64(dir.Size)), dir.Path)
+	}
+
+	log.Info("Largest files:")
+	for _, file := range s.Largest {
+		log.Infof("  %10s %s", humanize.Bytes(uint64(file.Size)), file.Path)
+	}
+}
+
+// checkMountLimits logs the summary of the mounts and fails when they
+// exceed the file count or size limits.
+func (p *Plugin) checkMountLimits(mount []string) (*mountSummary, error) {
+	summary, err := summarizeMounts(mount)
+
+	if err != nil {
+		return nil, err
+	}
+
+	summary.log()
+
+	if p.MaxFiles > 0 && summary.Files > p.MaxFiles {
+		return nil, fmt.Errorf("Cache has %d files, more than max_files %d", summary.Files, p.MaxFiles)
+	}
+
+	if p.MaxSize > 0 && summary.Size > p.MaxSize {
+		return nil, fmt.Errorf("Cache is %s, more than max_size %s", humanize.Bytes(uint64(summary.Size)), humanize.Bytes(uint64(p.MaxSize)))
+	}
+
+	return summary, nil
+}
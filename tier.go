@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tieredStorage keeps a copy of the objects transferred in a local
+// directory shared by the builds on a host, and serves restores from it
+// while it matches the remote object. Every key is guarded by a flock and
+// copies are written to a temporary file renamed into place, so concurrent
+// pipelines never see a partial copy.
+type tieredStorage struct {
+	metadataStorage
+
+	dir string
+}
+
+// local returns the path of the local copy of key.
+func (s *tieredStorage) local(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(strings.TrimPrefix(key, "/")))
+}
+
+// lock takes the lock of key, creating the directory of its local copy.
+func (s *tieredStorage) lock(key string) (func(), error) {
+	local := s.local(key)
+
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return nil, err
+	}
+
+	return lockFile(local + ".lock")
+}
+
+func (s *tieredStorage) Get(p string, dst io.Writer) error {
+	unlock, err := s.lock(p)
+
+	if err != nil {
+		log.Warnf("Failed to lock local cache %s. Bypassing it", err)
+		return s.metadataStorage.Get(p, dst)
+	}
+
+	defer unlock()
+
+	local := s.local(p)
+
+	if s.fresh(p, local) {
+		log.Infof("Restoring %s from the local cache", p)
+
+		f, err := os.Open(local)
+
+		if err == nil {
+			defer f.Close()
+
+			_, err = io.Copy(dst, f)
+			return err
+		}
+	}
+
+	return s.store(p, local, func(w io.Writer) error {
+		return s.metadataStorage.Get(p, io.MultiWriter(dst, w))
+	})
+}
+
+// fresh reports whether the local copy matches the remote object. When the
+// remote cannot be checked the local copy is used, but a copy of an object
+// which no longer exists, such as a flushed cache, is evicted.
+func (s *tieredStorage) fresh(key, local string) bool {
+	fi, err := os.Stat(local)
+
+	if err != nil {
+		return false
+	}
+
+	entry, _, err := s.Stat(key)
+
+	if isNotFound(err) {
+		log.Infof("Evicting %s from the local cache as it no longer exists", key)
+		os.Remove(local)
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	return fi.Size() == entry.Size && fi.ModTime().Equal(entry.LastModified)
+}
+
+func (s *tieredStorage) Put(p string, src io.Reader) error {
+	return s.PutWithMetadata(p, src, nil)
+}
+
+func (s *tieredStorage) PutWithMetadata(p string, src io.Reader, metadata map[string]string) error {
+	unlock, err := s.lock(p)
+
+	if err != nil {
+		log.Warnf("Failed to lock local cache %s. Bypassing it", err)
+		return s.metadataStorage.PutWithMetadata(p, src, metadata)
+	}
+
+	defer unlock()
+
+	return s.store(p, s.local(p), func(w io.Writer) error {
+		return s.metadataStorage.PutWithMetadata(p, &sizedReader{Reader: io.TeeReader(src, w), size: readerSize(src)}, metadata)
+	})
+}
+
+// store runs transfer, which copies the object to the writer given, and on
+// success renames the copy into place with the modification time of the
+// remote object.
+func (s *tieredStorage) store(key, local string, transfer func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(local), ".tmp-")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	err = transfer(tmp)
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if entry, _, serr := s.Stat(key); serr == nil {
+		os.Chtimes(tmp.Name(), entry.LastModified, entry.LastModified)
+	}
+
+	if rerr := os.Rename(tmp.Name(), local); rerr != nil {
+		log.Warnf("Failed to update local cache %s", rerr)
+	}
+
+	return nil
+}
+
+func (s *tieredStorage) Delete(p string) error {
+	if unlock, err := s.lock(p); err == nil {
+		os.Remove(s.local(p))
+		unlock()
+	}
+
+	return s.metadataStorage.Delete(p)
+}
+
+func (s *tieredStorage) ETag(p string) (string, error) {
+	if ts, ok := s.metadataStorage.(taggedStorage); ok {
+		return ts.ETag(p)
+	}
+
+	return "", errors.New("Storage does not support entity tags")
+}
+
+func (s *tieredStorage) Copy(src, dst string) error {
+	if cs, ok := s.metadataStorage.(copyingStorage); ok {
+		return cs.Copy(src, dst)
+	}
+
+	return errNoCopy
+}
+
+func (s *tieredStorage) PutIfMatch(p string, src io.Reader, etag string, metadata map[string]string) (bool, error) {
+	if cs, ok := s.metadataStorage.(conditionalStorage); ok {
+		return cs.PutIfMatch(p, src, etag, metadata)
+	}
+
+	return false, errors.New("Storage does not support conditional writes")
+}
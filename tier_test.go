@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTieredStorageServesLocalCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := newMemoryStorage()
+	s := &tieredStorage{metadataStorage: remote, dir: dir}
+
+	if err := s.Put("/bucket/archive.tar", strings.NewReader("contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy matching the size and time of the remote object is served
+	// locally
+	remote.objects["/bucket/archive.tar"] = []byte("CONTENTS")
+
+	var buf bytes.Buffer
+	if err := s.Get("/bucket/archive.tar", &buf); err != nil || buf.String() != "contents" {
+		t.Fatalf("Expected the local copy, got %q %v", buf.String(), err)
+	}
+
+	// A changed remote object replaces the local copy
+	remote.objects["/bucket/archive.tar"] = []byte("rebuilt contents")
+
+	buf.Reset()
+	if err := s.Get("/bucket/archive.tar", &buf); err != nil || buf.String() != "rebuilt contents" {
+		t.Fatalf("Expected the remote object, got %q %v", buf.String(), err)
+	}
+
+	if b, _ := ioutil.ReadFile(s.local("/bucket/archive.tar")); string(b) != "rebuilt contents" {
+		t.Errorf("Expected the local copy to be updated, got %q", b)
+	}
+}
+
+func TestTieredStorageEvictsMissingObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := newMemoryStorage()
+	s := &tieredStorage{metadataStorage: remote, dir: dir}
+
+	if err := s.Put("/bucket/archive.tar", strings.NewReader("contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flushed cache is not served from the local copy
+	delete(remote.objects, "/bucket/archive.tar")
+
+	var buf bytes.Buffer
+	if err := s.Get("/bucket/archive.tar", &buf); err == nil {
+		t.Fatalf("Expected a miss once the remote object is deleted, got %q", buf.String())
+	}
+
+	if _, err := os.Stat(s.local("/bucket/archive.tar")); !os.IsNotExist(err) {
+		t.Errorf("Expected the local copy to be evicted, got %v", err)
+	}
+}
+
+func TestTieredStorageKeepsCiphertext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &Plugin{Storage: newMemoryStorage(), LocalCache: dir, Passphrase: "secret", calls: newCallCounter(0)}
+
+	if err := p.wrapStorage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Storage.Put("/bucket/archive.tar", strings.NewReader("contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "bucket", "archive.tar")); err != nil || bytes.Contains(b, []byte("contents")) {
+		t.Errorf("Expected the local copy to be encrypted, got %q %v", b, err)
+	}
+
+	// The ciphertext matches the size of the remote object, so the restore
+	// is served locally
+	var buf bytes.Buffer
+	if err := p.Storage.Get("/bucket/archive.tar", &buf); err != nil || buf.String() != "contents" {
+		t.Fatalf("Expected the decrypted cache, got %q %v", buf.String(), err)
+	}
+
+	if p.calls.counts["get"] != 0 {
+		t.Errorf("Expected the restore to be served from the local cache, got %s", p.calls)
+	}
+}
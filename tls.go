@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// schemeProbeTimeout bounds the request probing whether a server failing
+// TLS negotiation speaks plain HTTP.
+const schemeProbeTimeout = 5 * time.Second
+
+// tlsEndpointError is a failed TLS negotiation with a configured server,
+// suggesting the likely fix.
+type tlsEndpointError struct {
+	err      error
+	endpoint string
+}
+
+func (e *tlsEndpointError) Error() string {
+	return fmt.Sprintf("%s. TLS negotiation with %s failed, it may only speak plain HTTP or the port may belong to another service. "+
+		"Try setting server to http://%s, or to the port serving HTTPS", e.err, e.endpoint, e.endpoint)
+}
+
+func (e *tlsEndpointError) Unwrap() error {
+	return e.err
+}
+
+// explainTLSError returns err with a suggestion of the scheme or port to
+// use when it is a failed TLS negotiation with an explicitly configured
+// HTTPS server. With debug output the server is probed over plain HTTP.
+func (p *Plugin) explainTLSError(err error) error {
+	if err == nil || len(p.Endpoint) == 0 || !isTLSMismatch(err) {
+		return err
+	}
+
+	for _, server := range strings.Split(p.Endpoint, ",") {
+		endpoint, useSSL, perr := s3Endpoint(strings.TrimSpace(server))
+
+		if perr != nil || !useSSL {
+			continue
+		}
+
+		if log.GetLevel() >= log.DebugLevel {
+			probeScheme(endpoint)
+		}
+
+		return &tlsEndpointError{err: err, endpoint: endpoint}
+	}
+
+	return err
+}
+
+// isTLSMismatch reports whether err is a TLS negotiation with a server not
+// speaking TLS on the port.
+func isTLSMismatch(err error) bool {
+	var rerr tls.RecordHeaderError
+	if errors.As(err, &rerr) {
+		return true
+	}
+
+	msg := err.Error()
+
+	return strings.Contains(msg, "first record does not look like a TLS handshake") ||
+		strings.Contains(msg, "server gave HTTP response to HTTPS client") ||
+		strings.Contains(msg, "tls: handshake failure")
+}
+
+// probeScheme logs whether endpoint answers over plain HTTP.
+func probeScheme(endpoint string) {
+	client := &http.Client{Timeout: schemeProbeTimeout}
+	resp, err := client.Head("http://" + endpoint + "/")
+
+	if err != nil {
+		log.Debugf("Endpoint %s does not answer over plain HTTP either %s", endpoint, err)
+		return
+	}
+
+	resp.Body.Close()
+
+	log.Debugf("Endpoint %s answers over plain HTTP with %s. Setting server to http://%s should fix it", endpoint, resp.Status, endpoint)
+}
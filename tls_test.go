@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExplainTLSError(t *testing.T) {
+	handshake := fmt.Errorf("Get https://minio:9000/bucket: %w", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"})
+
+	p := &Plugin{Endpoint: "https://minio:9000"}
+	err := p.explainTLSError(handshake)
+
+	if !strings.Contains(err.Error(), "http://minio:9000") {
+		t.Errorf("Expected the error to suggest plain HTTP, got %s", err)
+	}
+
+	if !errors.Is(err, handshake) {
+		t.Errorf("Expected the handshake error to be wrapped, got %s", err)
+	}
+
+	for _, endpoint := range []string{"", "http://minio:9000"} {
+		p := &Plugin{Endpoint: endpoint}
+
+		if err := p.explainTLSError(handshake); err != handshake {
+			t.Errorf("Expected the error for server %q to be unchanged, got %s", endpoint, err)
+		}
+	}
+
+	if err := errors.New("Access Denied"); p.explainTLSError(err) != err {
+		t.Error("Expected other errors to be unchanged")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// TransferAuto picks the upload strategy from the size of the mounts.
+	TransferAuto = "auto"
+
+	// Upload strategies. Single spools the archive so it is uploaded in one
+	// request, stream uploads it in parts as it is packed, sharded splits it
+	// into archives uploaded concurrently and dedup hashes it first to
+	// upload a pointer when unchanged.
+	transferSingle  = "single"
+	transferStream  = "stream"
+	transferSharded = "sharded"
+	transferDedup   = "dedup"
+
+	// maxAutoShards caps the shards of automatically sharded archives.
+	maxAutoShards = 16
+)
+
+// transferStrategy returns the upload strategy of an archive of about size
+// bytes, with the number of shards of sharded uploads. Without the auto
+// strategy, or when the size is unknown, it follows shards and dedup.
+func (p *Plugin) transferStrategy(size int64, at archive.Archive) (string, int) {
+	_, packsEntries := at.(entryPacker)
+	_, hasMetadata := p.Storage.(metadataStorage)
+
+	if p.TransferStrategy != TransferAuto || size < 0 {
+		switch {
+		case packsEntries && p.Shards > 1:
+			return transferSharded, p.Shards
+		case hasMetadata && p.Dedup:
+			return transferDedup, 0
+		}
+
+		return transferStream, 0
+	}
+
+	switch {
+	case size <= p.TransferSingleMax:
+		return transferSingle, 0
+	case packsEntries && p.TransferShardMin > 0 && size >= p.TransferShardMin:
+		shards := p.Shards
+
+		if shards < 2 {
+			shards = runtime.NumCPU()
+		}
+
+		if shards < 2 {
+			shards = 2
+		} else if shards > maxAutoShards {
+			shards = maxAutoShards
+		}
+
+		return transferSharded, shards
+	case hasMetadata && p.Dedup:
+		return transferDedup, 0
+	}
+
+	return transferStream, 0
+}
+
+// rebuildTransfer packs the mounts to path with the strategy chosen for
+// their size, or -1 when unknown.
+func (p *Plugin) rebuildTransfer(mount []string, path, fallbackPath string, size int64, at archive.Archive) error {
+	strategy, shards := p.transferStrategy(size, at)
+
+	if size >= 0 {
+		log.Infof("Uploading mounts of %s with the %s strategy", humanize.Bytes(uint64(size)), strategy)
+	} else {
+		log.Infof("Uploading with the %s strategy", strategy)
+	}
+
+	// Pointers to path would follow it to the new archive
+	if err := p.resolveDedupPointers(path); err != nil {
+		return err
+	}
+
+	var err error
+
+	switch strategy {
+	case transferSingle:
+		err = rebuildSpooled(mount, path, p.TempDir, p.Storage, at)
+	case transferSharded:
+		return rebuildSharded(mount, path, shards, p.Storage, at.(entryPacker))
+	case transferDedup:
+		err = rebuildDeduplicated(mount, path, fallbackPath, p.TempDir, p.Storage.(metadataStorage), at)
+	default:
+		err = rebuildCache(mount, path, p.Storage, at)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The parts of an archive sharded before are no longer read
+	return deleteStaleParts(p.Storage, path, 0)
+}
+
+// rebuildSpooled packs the srcs to a temporary file and uploads it with its
+// size, which small archives need to be uploaded in a single request.
+func rebuildSpooled(srcs []string, dst string, tempDir string, s storage.Storage, a archive.Archive) error {
+	log.Infof("Rebuilding cache at %s to %s", srcs, dst)
+
+	tmp, err := ioutil.TempFile(tempDir, "archive")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err = a.Pack(srcs, tmp); err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return s.Put(dst, &sizedReader{Reader: tmp, size: size})
+}
+
+// sizer is implemented by readers which know their size. minio-go finds it
+// by reflection and uploads small objects in a single request.
+type sizer interface {
+	Size() int64
+}
+
+// readerSize returns the size of r, or -1 when it is not known.
+func readerSize(r io.Reader) int64 {
+	if s, ok := r.(sizer); ok {
+		return s.Size()
+	}
+
+	return -1
+}
+
+// sizedReader is a reader of a known size.
+type sizedReader struct {
+	io.Reader
+
+	size int64
+}
+
+func (r *sizedReader) Size() int64 {
+	return r.size
+}
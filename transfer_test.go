@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTransferStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		shards   int
+		dedup    bool
+		size     int64
+		expected string
+	}{
+		{"", 0, false, 10, transferStream},
+		{"", 4, false, 10, transferSharded},
+		{"", 0, true, 1 << 40, transferDedup},
+		{TransferAuto, 0, false, 10, transferSingle},
+		{TransferAuto, 0, false, 100 << 20, transferStream},
+		{TransferAuto, 0, true, 100 << 20, transferDedup},
+		{TransferAuto, 4, true, 100 << 20, transferDedup},
+		{TransferAuto, 0, false, 8 << 30, transferSharded},
+		{TransferAuto, 0, false, -1, transferStream},
+	}
+
+	for _, test := range tests {
+		p := &Plugin{
+			Storage:           newMemoryStorage(),
+			TransferStrategy:  test.strategy,
+			TransferSingleMax: 32 << 20,
+			TransferShardMin:  4 << 30,
+			Shards:            test.shards,
+			Dedup:             test.dedup,
+		}
+
+		strategy, shards := p.transferStrategy(test.size, &tarArchive{})
+
+		if strategy != test.expected {
+			t.Errorf("Expected %s for %d bytes with %q, got %s", test.expected, test.size, test.strategy, strategy)
+		}
+
+		if strategy == transferSharded && (shards < 2 || shards > maxAutoShards) {
+			t.Errorf("Expected between 2 and %d shards, got %d", maxAutoShards, shards)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fileLogDepth is the depth of the directories files are counted in.
+const fileLogDepth = 2
+
+// fileLog logs every Nth file archived or extracted and counts the files
+// per directory, which keeps the log of large caches readable.
+type fileLog struct {
+	mu    sync.Mutex
+	verb  string
+	every int
+	files int
+	dirs  map[string]int
+}
+
+func newFileLog(verb string, every int) *fileLog {
+	return &fileLog{
+		verb:  verb,
+		every: every,
+		dirs:  make(map[string]int),
+	}
+}
+
+func (l *fileLog) record(name string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.files++
+	l.dirs[countedDir(name)]++
+
+	if (l.files-1)%l.every == 0 {
+		log.Infof("%s %s (file %d)", l.verb, name, l.files)
+	}
+}
+
+// summary logs the number of files per directory.
+func (l *fileLog) summary() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dirs := make([]string, 0, len(l.dirs))
+	for dir := range l.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	log.Infof("%s %d files", l.verb, l.files)
+
+	for _, dir := range dirs {
+		log.Infof("  %8d %s", l.dirs[dir], dir)
+	}
+}
+
+// countedDir truncates the directory of name to fileLogDepth.
+func countedDir(name string) string {
+	parts := strings.Split(filepath.ToSlash(filepath.Dir(name)), "/")
+
+	if len(parts) > fileLogDepth {
+		parts = parts[:fileLogDepth]
+	}
+
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/archive"
+)
+
+// rootedArchive unpacks an archive relative to root rather than the
+// workspace. Volume archives hold absolute paths so they unpack at /.
+type rootedArchive struct {
+	archive.Archive
+
+	root string
+}
+
+func (a *rootedArchive) Unpack(dst string, r io.Reader) error {
+	return a.Archive.Unpack(filepath.Join(a.root, dst), r)
+}
+
+// volumeKey returns the key of the archive of the named volume stored next
+// to the cache at path.
+func volumeKey(path, filename, name string) string {
+	return path + "volumes/" + name + "/" + filename
+}
+
+// isVolumeKey reports whether key is the archive of a named volume rather
+// than a cache of the workspace.
+func isVolumeKey(key string) bool {
+	return path.Base(path.Dir(path.Dir(key))) == "volumes"
+}
+
+// volumeDir returns the directory holding the contents of a named volume.
+func (p *Plugin) volumeDir(name string) string {
+	return filepath.Join(p.VolumesRoot, name, "_data")
+}
+
+// rebuildVolumes archives every named volume separately from the mounts.
+func (p *Plugin) rebuildVolumes(a archive.Archive) error {
+	for _, name := range p.Volumes {
+		dir := p.volumeDir(name)
+
+		if _, err := os.Stat(dir); err != nil {
+			log.Warnf("Volume %s not found at %s. Is %s mounted?", name, dir, p.VolumesRoot)
+			continue
+		}
+
+		key := volumeKey(p.Path, p.Filename, name)
+
+		if p.SkipExisting && exists(p.Storage, key) {
+			log.Infof("Volume %s already exists at %s. Skipping rebuild", name, key)
+			continue
+		}
+
+		if err := rebuildCache([]string{dir}, key, p.Storage, a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreVolumes restores every named volume. A volume which cannot be
+// restored does not fail the build.
+func (p *Plugin) restoreVolumes(a archive.Archive) {
+	ra := &rootedArchive{Archive: a, root: "/"}
+
+	for _, name := range p.Volumes {
+		key := volumeKey(p.Path, p.Filename, name)
+
+		log.Infof("Restoring volume %s from %s", name, key)
+
+		if _, err := restoreCache(key, p.Storage, ra); err != nil {
+			log.Warnf("Volume %s could not be restored %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newMemoryStorage()
+	p := &Plugin{
+		Storage:     s,
+		Path:        "/bucket/repo/main/",
+		Filename:    "archive.tar",
+		Volumes:     []string{"data", "missing"},
+		VolumesRoot: filepath.Join(dir, "volumes"),
+	}
+
+	os.MkdirAll(p.volumeDir("data"), 0755)
+	ioutil.WriteFile(filepath.Join(p.volumeDir("data"), "file"), []byte("cached"), 0644)
+
+	if err := p.rebuildVolumes(&tarArchive{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.objects) != 1 {
+		t.Errorf("Expected only the existing volume to be archived, got %d objects", len(s.objects))
+	}
+
+	root := filepath.Join(dir, "root")
+	a := &rootedArchive{Archive: &tarArchive{}, root: root}
+
+	if _, err := restoreCache(volumeKey(p.Path, p.Filename, "data"), s, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(filepath.Join(root, p.volumeDir("data"), "file")); string(b) != "cached" {
+		t.Errorf("Expected the volume to be restored under the root, got %q", b)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "syscall"
+
+// getCapability returns the file capabilities of path, or nil when it has
+// none.
+func getCapability(path string) ([]byte, error) {
+	buf := make([]byte, 64)
+
+	for {
+		n, err := syscall.Getxattr(path, capabilityXattr, buf)
+
+		switch {
+		case err == syscall.ENODATA || err == syscall.ENOTSUP:
+			return nil, nil
+		case err == syscall.ERANGE:
+			buf = make([]byte, 2*len(buf))
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+}
+
+// setCapability sets the file capabilities of path, which needs
+// CAP_SETFCAP.
+func setCapability(path string, value []byte) error {
+	return syscall.Setxattr(path, capabilityXattr, value, 0)
+}
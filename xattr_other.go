@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func getCapability(path string) ([]byte, error) {
+	return nil, nil
+}
+
+func setCapability(path string, value []byte) error {
+	return errors.New("File capabilities are only supported on linux")
+}
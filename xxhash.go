@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxHash64 is the 64 bit xxHash with a zero seed, as computed by xxhsum.
+type xxHash64 struct {
+	v1, v2, v3, v4 uint64
+
+	total uint64
+	mem   [32]byte
+	n     int
+}
+
+func newXXHash64() hash.Hash64 {
+	x := &xxHash64{}
+	x.Reset()
+	return x
+}
+
+func (x *xxHash64) Reset() {
+	// The seed arithmetic wraps, which constant expressions cannot
+	p1, p2 := xxPrime1, xxPrime2
+
+	x.v1 = p1 + p2
+	x.v2 = p2
+	x.v3 = 0
+	x.v4 = -p1
+	x.total = 0
+	x.n = 0
+}
+
+func (x *xxHash64) Size() int      { return 8 }
+func (x *xxHash64) BlockSize() int { return 32 }
+
+func (x *xxHash64) Write(b []byte) (int, error) {
+	n := len(b)
+	x.total += uint64(n)
+
+	if x.n+len(b) < 32 {
+		x.n += copy(x.mem[x.n:], b)
+		return n, nil
+	}
+
+	if x.n > 0 {
+		c := copy(x.mem[x.n:], b)
+		x.stripe(x.mem[:])
+		b = b[c:]
+		x.n = 0
+	}
+
+	for ; len(b) >= 32; b = b[32:] {
+		x.stripe(b)
+	}
+
+	x.n = copy(x.mem[:], b)
+	return n, nil
+}
+
+func (x *xxHash64) stripe(b []byte) {
+	x.v1 = xxRound(x.v1, binary.LittleEndian.Uint64(b[0:8]))
+	x.v2 = xxRound(x.v2, binary.LittleEndian.Uint64(b[8:16]))
+	x.v3 = xxRound(x.v3, binary.LittleEndian.Uint64(b[16:24]))
+	x.v4 = xxRound(x.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+func (x *xxHash64) Sum64() uint64 {
+	var h uint64
+
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v1, 1) + bits.RotateLeft64(x.v2, 7) +
+			bits.RotateLeft64(x.v3, 12) + bits.RotateLeft64(x.v4, 18)
+		h = xxMergeRound(h, x.v1)
+		h = xxMergeRound(h, x.v2)
+		h = xxMergeRound(h, x.v3)
+		h = xxMergeRound(h, x.v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += x.total
+
+	b := x.mem[:x.n]
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+func (x *xxHash64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], x.Sum64())
+	return append(b, sum[:]...)
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}